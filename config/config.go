@@ -5,30 +5,120 @@ import (
 )
 
 type HTTPAPIConfigure struct {
-	Endpoint   string `endpoint,omitempty`
-	ActiveTime uint   `active-time,omitempty`
+	Endpoint   string `yaml:"endpoint,omitempty"`
+	ActiveTime uint   `yaml:"active-time,omitempty"`
+	AckTimeout uint   `yaml:"ack-timeout,omitempty"`
+}
+
+type TCPAPIConfigure struct {
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+type MQTTAPIConfigure struct {
+	Endpoint string `yaml:"endpoint,omitempty"`
 }
 
 type HTTPManagementAPIConfigure struct {
-	Endpoint string `endpoint,omitempty`
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Token required by management API.
+	Token string `yaml:"token,omitempty"`
 }
 
 type ServiceConnectionConfigure struct {
-	Endpoints       map[string]string `endpoints,omitempty`
-	KeepalivePeriod uint              `keepalive-period,omitempty`
+	Endpoints       map[string]string `yaml:"endpoints,omitempty"`
+	KeepalivePeriod uint              `yaml:"keepalive-period,omitempty"`
+
+	// Virtual points of each service node on hash ring.
+	HashReplicas uint `yaml:"hash-replicas,omitempty"`
+	// Percent over average key share a service node may own. 0 disables bounded load.
+	HashLoadBound uint `yaml:"hash-load-bound,omitempty"`
+
+	// Load balancing strategies. "round-robin", "weighted", "least-outstanding" or "ewma".
+	LBStrategy  string `yaml:"lb-strategy,omitempty"`
+	LBConnect   string `yaml:"lb-connect,omitempty"`
+	LBSubscribe string `yaml:"lb-subscribe,omitempty"`
+	LBEntity    string `yaml:"lb-entity,omitempty"`
 }
 
 type GatewayConfigure struct {
-	LogLevel uint `log-level,omitempty,flow`
+	LogLevel uint `yaml:"log-level,omitempty,flow"`
+
+	MessageBulkTime uint `yaml:"message-bulk,omitempty"`
+
+	RedisEndpoint string `yaml:"redis-endpoint,omitempty"`
+	RedisPrefix   string `yaml:"redis-prefix,omitempty"`
+
+	// Discover node changes by redis notifications instead of polling only.
+	DigNotify bool `yaml:"dig-notify,omitempty"`
+	// Seconds between full discovery synchronization when notified.
+	DigResync uint `yaml:"dig-resync,omitempty"`
+
+	Debug bool `yaml:"debug,omitempty"`
 
-	MessageBulkTime uint `message-bulk,omitempty`
+	PresenceIdle uint `yaml:"presence-idle,omitempty"`
 
-	RedisEndpoint string `redis-endpoint,omitempty`
-	RedisPrefix   string `redis-prefix,omitempty`
+	// File to export trace spans to, or "stdout".
+	TraceExport string `yaml:"trace-export,omitempty"`
 
-	Debug bool `debug,omitempty`
+	// Codec of RPC between gates and services.
+	RPCCodec string `yaml:"rpc-codec,omitempty"`
+
+	SVCConfig  ServiceConnectionConfigure `yaml:"service,omitempty"`
+	HTTPConfig HTTPAPIConfigure           `yaml:"http,omitempty"`
+	TCPConfig  TCPAPIConfigure            `yaml:"tcp,omitempty"`
+	MQTTConfig MQTTAPIConfigure           `yaml:"mqtt,omitempty"`
+	Manage     HTTPManagementAPIConfigure `yaml:"manage,omitempty"`
+}
+
+// Verification key of JWT in a namespace.
+type JWTKeyConfigure struct {
+	// HS256 or RS256.
+	Algorithm string `yaml:"alg"`
+	// Shared secret for HS256.
+	Secret string `yaml:"secret,omitempty"`
+	// Path to PEM encoded public key for RS256.
+	PublicKey string `yaml:"public-key,omitempty"`
+	Issuer    string `yaml:"issuer,omitempty"`
+	Audience  string `yaml:"audience,omitempty"`
+}
+
+type JWTConfigure struct {
+	// Claim holding granted scopes. Defaults to "scope". "-" disables scope checking.
+	ScopeClaim string `yaml:"scope-claim,omitempty"`
+	// Claims copied to session besides "sub", "exp" and scopes, e.g. for ACL session attributes.
+	Claims []string `yaml:"claims,omitempty"`
+	// Seconds of clock skew tolerated when checking "exp" and "nbf".
+	Leeway     uint                       `yaml:"leeway,omitempty"`
+	Namespaces map[string]JWTKeyConfigure `yaml:"namespaces"`
+}
+
+type WebhookConfigure struct {
+	// Webhook URL of each namespace.
+	Namespaces map[string]string `yaml:"namespaces,omitempty"`
+	// Webhook URL of namespaces not listed.
+	Default string `yaml:"default,omitempty"`
+	// Request timeout in milliseconds.
+	Timeout uint `yaml:"timeout,omitempty"`
+	// Seconds to cache operation decisions. 0 disables caching.
+	CacheTTL uint `yaml:"cache-ttl,omitempty"`
+}
+
+type ACLRuleConfigure struct {
+	Name string `yaml:"name,omitempty"`
+	// "allow" or "deny".
+	Effect string `yaml:"effect"`
+	// Glob patterns. Empty matches all.
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// Operation names. Empty matches all.
+	Ops []string `yaml:"ops,omitempty"`
+	// Glob patterns of group. Empty matches all.
+	Groups []string `yaml:"groups,omitempty"`
+	// Glob patterns of session attributes. All should match.
+	Session map[string]string `yaml:"session,omitempty"`
+}
 
-	SVCConfig  ServiceConnectionConfigure `service,omitempty`
-	HTTPConfig HTTPAPIConfigure           `http,omitempty`
-	Manage     HTTPManagementAPIConfigure `manage,omitempty`
+type ACLConfigure struct {
+	// Effect when no rule matches. "allow" or "deny".
+	Default string             `yaml:"default,omitempty"`
+	Rules   []ACLRuleConfigure `yaml:"rules,omitempty"`
 }
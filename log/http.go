@@ -1,8 +1,11 @@
 package log
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -36,6 +39,21 @@ func (w *ProxyResponseWriter) WriteHeader(statusCode int) {
 	w.Origin.WriteHeader(statusCode)
 }
 
+func (w *ProxyResponseWriter) Flush() {
+	if flusher, ok := w.Origin.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets protocol upgrades (e.g. WebSocket) take over the connection.
+func (w *ProxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.Origin.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported by origin ResponseWriter.")
+	}
+	return hijacker.Hijack()
+}
+
 // LoggedHandler automaticalliy log http response/request.
 type LoggedHandler struct {
 	Tags       map[string]interface{}
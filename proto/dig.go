@@ -3,4 +3,19 @@ package proto
 const (
 	DIG_GATE_SERVICE_NAME = "linker-gateway"
 	DIG_SERVICE_NAME      = "linker-svc"
+
+	// Codec of RPC over plain TCP. Gob over HTTP is used if absent.
+	DIG_META_RPC_CODEC = "linker-rpc-codec"
+
+	// Load balancing weight of node. 1 if absent.
+	DIG_META_WEIGHT = "linker-weight"
 )
+
+// IsRPCMetadata reports whether metadata key affects RPC endpoint of node.
+func IsRPCMetadata(key string) bool {
+	switch key {
+	case "linker-nodeid", "linker-rpc", "linker-role", DIG_META_RPC_CODEC:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Binary frame:
+//
+//	| length (4) | op (2) | id (4) | code (4) | payload (length) |
+//
+// All integers are big-endian. Strings in payload are length-prefixed with 4 bytes.
+//
+// Payloads:
+//
+//	OP_CONNECT    request:  type (1) namespace credential/session
+//	              reply:    session
+//	OP_KEEPALIVE  empty.
+//	OP_INFO       reply:    node-id window (4)
+//	OP_SUB/UNSUB  request:  group
+//	OP_PUSH       request:  count (4) [group raw]...
+//	              reply:    count (4) [timestamp (8) sequence (4) msg]...
+//	OP_PULL       delivery: count (4) [timestamp (8) sequence (4) user group raw]...
+//
+// Direct messages are in group "@<user>".
+// Replies with non-zero code carry an error message string as payload.
+const FRAME_HEADER_SIZE = 14
+
+var ErrFrameTooLarge = errors.New("Frame too large.")
+var ErrFrameTruncated = errors.New("Frame truncated.")
+
+type FrameHeader struct {
+	Length uint32
+	Op     uint16
+	ID     uint32
+	Code   uint32
+}
+
+func ReadFrame(r io.Reader, maxLength uint32) (*FrameHeader, []byte, error) {
+	raw := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+	hdr := &FrameHeader{
+		Length: binary.BigEndian.Uint32(raw[0:4]),
+		Op:     binary.BigEndian.Uint16(raw[4:6]),
+		ID:     binary.BigEndian.Uint32(raw[6:10]),
+		Code:   binary.BigEndian.Uint32(raw[10:14]),
+	}
+	if maxLength > 0 && hdr.Length > maxLength {
+		return hdr, nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, payload, nil
+}
+
+func WriteFrame(w io.Writer, op uint16, id, code uint32, payload []byte) error {
+	raw := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(raw[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint16(raw[4:6], op)
+	binary.BigEndian.PutUint32(raw[6:10], id)
+	binary.BigEndian.PutUint32(raw[10:14], code)
+	_, err := w.Write(append(raw, payload...))
+	return err
+}
+
+// FrameEncoder builds frame payload.
+type FrameEncoder struct {
+	Buf []byte
+}
+
+func (e *FrameEncoder) PutUint8(v uint8) {
+	e.Buf = append(e.Buf, v)
+}
+
+func (e *FrameEncoder) PutUint32(v uint32) {
+	var raw [4]byte
+	binary.BigEndian.PutUint32(raw[:], v)
+	e.Buf = append(e.Buf, raw[:]...)
+}
+
+func (e *FrameEncoder) PutUint64(v uint64) {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], v)
+	e.Buf = append(e.Buf, raw[:]...)
+}
+
+func (e *FrameEncoder) PutString(v string) {
+	e.PutUint32(uint32(len(v)))
+	e.Buf = append(e.Buf, v...)
+}
+
+// FrameDecoder reads frame payload.
+// The first failure is kept and returned by Err().
+type FrameDecoder struct {
+	buf []byte
+	err error
+}
+
+func NewFrameDecoder(payload []byte) *FrameDecoder {
+	return &FrameDecoder{buf: payload}
+}
+
+func (d *FrameDecoder) take(n uint32) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint32(len(d.buf)) < n {
+		d.err = ErrFrameTruncated
+		return nil
+	}
+	raw := d.buf[:n]
+	d.buf = d.buf[n:]
+	return raw
+}
+
+func (d *FrameDecoder) Uint8() uint8 {
+	if raw := d.take(1); raw != nil {
+		return raw[0]
+	}
+	return 0
+}
+
+func (d *FrameDecoder) Uint32() uint32 {
+	if raw := d.take(4); raw != nil {
+		return binary.BigEndian.Uint32(raw)
+	}
+	return 0
+}
+
+func (d *FrameDecoder) Uint64() uint64 {
+	if raw := d.take(8); raw != nil {
+		return binary.BigEndian.Uint64(raw)
+	}
+	return 0
+}
+
+func (d *FrameDecoder) String() string {
+	length := d.Uint32()
+	if raw := d.take(length); raw != nil {
+		return string(raw)
+	}
+	return ""
+}
+
+func (d *FrameDecoder) Err() error {
+	return d.err
+}
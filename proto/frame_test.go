@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	enc := FrameEncoder{}
+	enc.PutUint8(CONN_BASIC)
+	enc.PutUint32(0xdeadbeef)
+	enc.PutUint64(1 << 40)
+	enc.PutString("ns")
+	enc.PutString("")
+
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, OP_CONNECT, 7, SUCCEED, enc.Buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != FRAME_HEADER_SIZE+len(enc.Buf) {
+		t.Fatalf("expected %v bytes, got %v", FRAME_HEADER_SIZE+len(enc.Buf), buf.Len())
+	}
+	hdr, payload, err := ReadFrame(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *hdr != (FrameHeader{Length: uint32(len(enc.Buf)), Op: OP_CONNECT, ID: 7, Code: SUCCEED}) {
+		t.Fatalf("unexpected header %+v", hdr)
+	}
+	dec := NewFrameDecoder(payload)
+	if v := dec.Uint8(); v != CONN_BASIC {
+		t.Fatalf("expected %v, got %v", CONN_BASIC, v)
+	}
+	if v := dec.Uint32(); v != 0xdeadbeef {
+		t.Fatalf("expected 0xdeadbeef, got %x", v)
+	}
+	if v := dec.Uint64(); v != 1<<40 {
+		t.Fatalf("expected %v, got %v", uint64(1<<40), v)
+	}
+	if v := dec.String(); v != "ns" {
+		t.Fatalf("expected \"ns\", got %q", v)
+	}
+	if v := dec.String(); v != "" || dec.Err() != nil {
+		t.Fatalf("expected empty string, got %q with %v", v, dec.Err())
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, OP_PUSH, 1, SUCCEED, make([]byte, 16))
+	raw := buf.Bytes()
+
+	if _, _, err := ReadFrame(bytes.NewReader(raw), 15); err != ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader(raw), 16); err != nil {
+		t.Fatalf("frame of max length: %v", err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader(raw[:FRAME_HEADER_SIZE-1]), 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated header, got %v", err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader(raw[:len(raw)-1]), 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated payload, got %v", err)
+	}
+}
+
+// The first failure is kept, and values read after are zero.
+func TestFrameDecoderTruncated(t *testing.T) {
+	enc := FrameEncoder{}
+	enc.PutUint32(100) // String longer than payload.
+	enc.PutString("abc")
+	dec := NewFrameDecoder(enc.Buf)
+	if v := dec.String(); v != "" || dec.Err() != ErrFrameTruncated {
+		t.Fatalf("expected ErrFrameTruncated, got %q with %v", v, dec.Err())
+	}
+	if v := dec.Uint32(); v != 0 || dec.Err() != ErrFrameTruncated {
+		t.Fatalf("expected zero after failure, got %v with %v", v, dec.Err())
+	}
+}
@@ -1,16 +1,60 @@
 package proto
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidMessageIdentifier = errors.New("Invalid message identifier.")
+
 type MessageIdentifier struct {
 	Timestamp uint64 `json:"t,omitempty"`
 	Sequence  uint32 `json:"s,omitempty"`
 }
 
+// ParseMessageIdentifier parses identifier in form "<timestamp>-<sequence>".
+func ParseMessageIdentifier(raw string) (MessageIdentifier, error) {
+	id := MessageIdentifier{}
+	parts := strings.SplitN(raw, "-", 2)
+	if len(parts) != 2 {
+		return id, ErrInvalidMessageIdentifier
+	}
+	stamp, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return id, ErrInvalidMessageIdentifier
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return id, ErrInvalidMessageIdentifier
+	}
+	id.Timestamp, id.Sequence = stamp, uint32(seq)
+	return id, nil
+}
+
+func (id MessageIdentifier) Text() string {
+	return strconv.FormatUint(id.Timestamp, 10) + "-" + strconv.FormatUint(uint64(id.Sequence), 10)
+}
+
+// Less reports whether id is ordered before another.
+func (id MessageIdentifier) Less(another MessageIdentifier) bool {
+	if id.Timestamp != another.Timestamp {
+		return id.Timestamp < another.Timestamp
+	}
+	return id.Sequence < another.Sequence
+}
+
+// MessageBody is sent to subscribers of Group, or to user To directly if To is not empty.
 type MessageBody struct {
 	User  string `json:"u"`
 	Group string `json:"g"`
+	To    string `json:"to,omitempty"`
 	Raw   string `json:"d"`
 }
 
+// Binary transports (TCP, MQTT) address direct messages by group DIRECT_GROUP_PREFIX + user.
+const DIRECT_GROUP_PREFIX = "@"
+
 type Message struct {
 	MessageIdentifier
 	*MessageBody
@@ -24,12 +24,16 @@ const (
 	OP_PUSH      = uint16(5)
 	OP_PULL      = uint16(6)
 	OP_INFO      = uint16(7)
+	OP_HISTORY   = uint16(8)
+	OP_PRESENCE  = uint16(9)
+	OP_ENTITY    = uint16(10)
 )
 
 type ConnectV1 struct {
-	Credential string `json:"cre"`
-	Namespace  string `json:"-"`
-	Type       uint8  `json:"-"`
+	Credential string       `json:"cre"`
+	Namespace  string       `json:"-"`
+	Type       uint8        `json:"-"`
+	Trace      TraceContext `json:"-"`
 }
 
 type ConnectResultV1 struct {
@@ -46,9 +50,17 @@ type MessagePushV1 struct {
 	Msgs []MessageBody `json:"msg"`
 }
 
+// Pulled messages in at-least-once mode.
+// Messages will be redelivered until cursor acknowledged.
+type MessagePullV1 struct {
+	Cursor uint64    `json:"cursor"`
+	Msgs   []Message `json:"msgs"`
+}
+
 type Subscription struct {
-	Namespace string `json:"-"`
-	Session   string `json:"s"`
-	Group     string `json:"g"`
-	Op        uint8  `json:"-"`
+	Namespace string       `json:"-"`
+	Session   string       `json:"s"`
+	Group     string       `json:"g"`
+	Op        uint8        `json:"-"`
+	Trace     TraceContext `json:"-"`
 }
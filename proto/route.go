@@ -0,0 +1,28 @@
+package proto
+
+// ClientRoute locates a client device.
+// Routes are stored in hash "{clientinfo-<key>}" with device identifiers as fields.
+type ClientRoute struct {
+	Proto  uint   `json:"p"`
+	Remote string `json:"r"`
+	Gate   string `json:"g"`
+	Expire int64  `json:"e"` // Unix time in seconds.
+	Active int64  `json:"a"` // Unix time in seconds of last client activity.
+	Idle   bool   `json:"i,omitempty"`
+}
+
+const (
+	PRESENCE_OFFLINE = "offline"
+	PRESENCE_ONLINE  = "online"
+	PRESENCE_IDLE    = "idle"
+)
+
+// Presence changes of user are published to group PRESENCE_GROUP_PREFIX + user.
+// Subscribe the group to opt in.
+const PRESENCE_GROUP_PREFIX = "$presence."
+
+type Presence struct {
+	User   string `json:"u"`
+	State  string `json:"st"`
+	Active int64  `json:"a,omitempty"` // Unix time in seconds of last client activity.
+}
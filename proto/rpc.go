@@ -3,14 +3,23 @@ package proto
 const RPC_PATH = "/__rpc_linker_svc"
 const RPC_DEBUG_PATH = "/__rpc_linker_svc_debug"
 
+// TraceContext identifies span of caller.
+// Empty TraceID means request is not traced.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+}
+
 // push message group.
 type MessageGroup struct {
-	Msgs []*Message
-	Keys []string
+	Msgs  []*Message
+	Keys  []string
+	Trace TraceContext
 }
 
 type MessagePushArguments struct {
-	Gups []MessageGroup
+	Gups  []MessageGroup
+	Trace TraceContext
 }
 
 // push raw message.
@@ -18,6 +27,7 @@ type RawMessagePushArguments struct {
 	Msgs      []*MessageBody
 	Session   string
 	Namespace string
+	Trace     TraceContext
 }
 
 type PushResult struct {
@@ -31,19 +41,119 @@ type MessagePushResult struct {
 	Msg         string
 }
 
+// RPC arguments and replies are kept apart from HTTP structures,
+// so that fields hidden from clients survive codecs honoring JSON tags.
+type ConnectArguments struct {
+	Credential string
+	Namespace  string
+	Type       uint8
+	Trace      TraceContext
+}
+
+type ConnectReply struct {
+	AuthError string
+	Session   string
+	Key       string
+}
+
+type SubscribeArguments struct {
+	Namespace string
+	Session   string
+	Group     string
+	Op        uint8
+	Trace     TraceContext
+}
+
+// Namespace entities are altered with session of Namespace.
 type EntityAlterArguments struct {
 	Namespace string
+	Session   string
 	Entities  []string
 	Operation uint8
 	Type      uint8
+	Trace     TraceContext
 }
 
+// Namespace entities are listed with session of Namespace.
 type EntityListArguments struct {
 	Namespace string
+	Session   string
 	Type      uint8
+	Trace     TraceContext
 }
 
 type EntityListReply struct {
-	Entities []string
-	Msg      string
+	Entities    []string
+	IsAuthError bool
+	Msg         string
+}
+
+// query message history between [Begin, End).
+// Zero End means no upper bound.
+// History of user is queried when Group is empty.
+type HistoryQuery struct {
+	Namespace string
+	Session   string
+	Group     string
+	Begin     MessageIdentifier
+	End       MessageIdentifier
+	Limit     int
+	Trace     TraceContext
+}
+
+type HistoryReply struct {
+	Msgs        []Message `json:"msgs"`
+	Next        string    `json:"next,omitempty"`
+	IsAuthError bool      `json:"-"`
+	Msg         string    `json:"-"`
+}
+
+type HistoryRangeReply struct {
+	Msgs        []Message
+	Next        string
+	IsAuthError bool
+	Msg         string
+}
+
+type HistoryCheckReply struct {
+	Check       MessageCheck
+	IsAuthError bool
+	Msg         string
+}
+
+type PresenceQuery struct {
+	Namespace string
+	Session   string
+	Users     []string
+	Trace     TraceContext
+}
+
+type PresenceReply struct {
+	Presences   []Presence
+	IsAuthError bool
+	Msg         string
+}
+
+type PresenceNotifyArguments struct {
+	Keys  []string
+	Trace TraceContext
+}
+
+// session of client.
+type SessionArguments struct {
+	Namespace string
+	Session   string
+	// Operation authorized along with key resolution. Zero authorizes nothing.
+	Op    uint16
+	Trace TraceContext
+}
+
+type SessionReply struct {
+	IsAuthError bool
+	Msg         string
+}
+
+type SessionKeyReply struct {
+	SessionReply
+	Key string
 }
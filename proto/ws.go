@@ -0,0 +1,20 @@
+package proto
+
+// Frame sent by WebSocket clients.
+// Op is one of OP_PUSH, OP_SUB, OP_UNSUB and OP_KEEPALIVE.
+type WebSocketRequestV1 struct {
+	Op    uint16        `json:"op"`
+	ID    uint32        `json:"id,omitempty"`
+	Group string        `json:"g,omitempty"`
+	Msgs  []MessageBody `json:"msg,omitempty"`
+}
+
+// Frame sent to WebSocket clients.
+// Replies carry the ID of request. Messages are delivered with Op = OP_PULL.
+type WebSocketResponseV1 struct {
+	Op   uint16      `json:"op"`
+	ID   uint32      `json:"id,omitempty"`
+	Data interface{} `json:"data"`
+	Code uint32      `json:"code"`
+	Msg  string      `json:"msg"`
+}
@@ -8,60 +8,122 @@ type Authorizer interface {
 	Identifier(namespace string, session map[string]string) (string, error)
 }
 
+// ResourceAuthorizer grants/denies operation on specific resource, such as group.
+type ResourceAuthorizer interface {
+	AuthResource(namespace string, op uint16, resource string, session map[string]string) error
+}
+
+// AuthResource authorizes operation on resource.
+// Falls back to Auth for authorizers not aware of resources.
+func AuthResource(authorizer Authorizer, namespace string, op uint16, resource string, session map[string]string) error {
+	if resAuther, ok := authorizer.(ResourceAuthorizer); ok {
+		return resAuther.AuthResource(namespace, op, resource, session)
+	}
+	return authorizer.Auth(namespace, op, session)
+}
+
 // And Combinator
-//type AndAuthorizer struct {
-//	Authorizers []Authorizer
-//}
-//
-//func AuthAnd(authorizers ...Authorizer) Authorizer {
-//	return &AndAuthorizer{
-//		Authorizers: append(make([]Authorizer, 0, len(authorizers)), authorizers...),
-//	}
-//}
-//
-//func (comb *AndAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
-//	for _, authorizer := range comb.Authorizers {
-//		if err := authorizer.Auth(op, namespace, session); err != nil {
-//			return err
-//		}
-//	}
-//	return nil
-//}
-//
-//func authorizerConnect(authorizers []Authorizer, namespace, credential string, session map[string]string) error {
-//	for _, authorizer := range authorizers {
-//		if err := authorizer.Connect(namespace, credential, session); err != nil {
-//			return err
-//		}
-//	}
-//	return nil
-//}
-//
-//func (comb *AndAuthorizer) Connect(namespace, credential string, session map[string]string) error {
-//	return authorizerConnect(comb.Authorizers, namespace, credential, session)
-//}
-//
-//// Or Combinator
-//type OrAuthorizer struct {
-//	Authorizers []Authorizer
-//}
-//
-//func OrAuth(authorizers ...Authorizer) Authorizer {
-//	return &OrAuthorizer{
-//		Authorizers: append(make([]Authorizer, 0, len(authorizers)), authorizers...),
-//	}
-//}
-//
-//func (comb *OrAuthorizer) Connect(namespace, credential string, session map[string]string) error {
-//	return authorizerConnect(comb.Authorizers, namespace, credential, session)
-//}
-//
-//func (comb *OrAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
-//	var err error
-//	for _, authorizer := range comb.Authorizers {
-//		if err = authorizer.Auth(namespace, op, session); err == nil {
-//			return nil
-//		}
-//	}
-//	return err
-//}
+// Identifier is resolved by the first authorizer.
+type AndAuthorizer struct {
+	Authorizers []Authorizer
+}
+
+func AuthAnd(authorizers ...Authorizer) Authorizer {
+	return &AndAuthorizer{
+		Authorizers: append(make([]Authorizer, 0, len(authorizers)), authorizers...),
+	}
+}
+
+func (comb *AndAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
+	for _, authorizer := range comb.Authorizers {
+		if err := authorizer.Auth(namespace, op, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (comb *AndAuthorizer) AuthResource(namespace string, op uint16, resource string, session map[string]string) error {
+	for _, authorizer := range comb.Authorizers {
+		if err := AuthResource(authorizer, namespace, op, resource, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (comb *AndAuthorizer) Connect(namespace, credential string, session map[string]string) error {
+	for _, authorizer := range comb.Authorizers {
+		if err := authorizer.Connect(namespace, credential, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (comb *AndAuthorizer) Identifier(namespace string, session map[string]string) (string, error) {
+	if len(comb.Authorizers) < 1 {
+		return "", nil
+	}
+	return comb.Authorizers[0].Identifier(namespace, session)
+}
+
+// Or Combinator
+// Session is populated by the first authorizer accepting connection.
+type OrAuthorizer struct {
+	Authorizers []Authorizer
+}
+
+func OrAuth(authorizers ...Authorizer) Authorizer {
+	return &OrAuthorizer{
+		Authorizers: append(make([]Authorizer, 0, len(authorizers)), authorizers...),
+	}
+}
+
+func (comb *OrAuthorizer) Connect(namespace, credential string, session map[string]string) error {
+	var err error
+	for _, authorizer := range comb.Authorizers {
+		attempt := make(map[string]string, len(session))
+		for k, v := range session {
+			attempt[k] = v
+		}
+		if err = authorizer.Connect(namespace, credential, attempt); err == nil {
+			for k, v := range attempt {
+				session[k] = v
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+func (comb *OrAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
+	var err error
+	for _, authorizer := range comb.Authorizers {
+		if err = authorizer.Auth(namespace, op, session); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (comb *OrAuthorizer) AuthResource(namespace string, op uint16, resource string, session map[string]string) error {
+	var err error
+	for _, authorizer := range comb.Authorizers {
+		if err = AuthResource(authorizer, namespace, op, resource, session); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (comb *OrAuthorizer) Identifier(namespace string, session map[string]string) (string, error) {
+	var err error
+	var ident string
+	for _, authorizer := range comb.Authorizers {
+		if ident, err = authorizer.Identifier(namespace, session); err == nil && ident != "" {
+			return ident, nil
+		}
+	}
+	return ident, err
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Breaker states.
+const (
+	BREAKER_CLOSED    = uint8(0)
+	BREAKER_OPEN      = uint8(1)
+	BREAKER_HALF_OPEN = uint8(2)
+)
+
+var BreakerStateNames = map[uint8]string{
+	BREAKER_CLOSED:    "closed",
+	BREAKER_OPEN:      "open",
+	BREAKER_HALF_OPEN: "half-open",
+}
+
+const (
+	// Outcomes of recent calls kept to compute failure ratio.
+	BREAKER_WINDOW = 20
+	// Breaker never opens before so many calls in window.
+	BREAKER_MIN_CALLS = 10
+	// Breaker opens when ratio of failures in window reaches this.
+	BREAKER_FAILURE_RATIO = 0.5
+	// Successes in half-open state to close breaker.
+	BREAKER_HALF_OPEN_SUCCESSES = 5
+
+	// Open period doubles every consecutive ejection, from BREAKER_OPEN_MIN up to BREAKER_OPEN_MAX.
+	BREAKER_OPEN_MIN = time.Second
+	BREAKER_OPEN_MAX = time.Minute
+)
+
+// Breaker ejects node when its calls keep failing.
+// Node is re-admitted in half-open state after open period,
+// and ejected again for doubled period on any failure before closed.
+type Breaker struct {
+	lock sync.Mutex
+
+	state     uint8
+	outcomes  [BREAKER_WINDOW]bool // true for failure.
+	next      int
+	calls     int
+	failures  int
+	successes int // Successes in half-open state.
+
+	ejections int
+	period    time.Duration
+	closedAt  time.Time
+	timer     *time.Timer
+	stopped   bool
+
+	// Called without lock held when state changes.
+	onChange func(from, to uint8)
+}
+
+func NewBreaker(onChange func(from, to uint8)) *Breaker {
+	return &Breaker{
+		state:    BREAKER_CLOSED,
+		onChange: onChange,
+	}
+}
+
+// IsBreakerFailure reports whether err indicates unhealthy node.
+// Transport errors, errors returned by node, and deadlines expired after request written count.
+// Rejected authentication, invalid requests, and deadlines or cancellation of callers
+// before request written are not failures.
+func IsBreakerFailure(err error) bool {
+	switch err {
+	case nil, context.Canceled, context.DeadlineExceeded:
+		return false
+	case rpc.ErrShutdown, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	switch e := err.(type) {
+	case rpc.ServerError:
+		return !strings.HasPrefix(string(e), REQUEST_ERROR_PREFIX)
+	case ReplyTimeoutError, net.Error:
+		return true
+	}
+	return false
+}
+
+func (b *Breaker) State() uint8 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Record outcome of call.
+func (b *Breaker) Record(err error) {
+	failed := IsBreakerFailure(err)
+	b.lock.Lock()
+	from := b.state
+	to := b.record(failed)
+	b.lock.Unlock()
+	b.notify(from, to)
+}
+
+func (b *Breaker) record(failed bool) uint8 {
+	if b.stopped {
+		return b.state
+	}
+	switch b.state {
+	case BREAKER_CLOSED:
+		if b.calls == BREAKER_WINDOW {
+			if b.outcomes[b.next] {
+				b.failures--
+			}
+		} else {
+			b.calls++
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % BREAKER_WINDOW
+		if failed {
+			b.failures++
+		}
+		if b.calls >= BREAKER_MIN_CALLS && float64(b.failures) >= BREAKER_FAILURE_RATIO*float64(b.calls) {
+			b.trip()
+		}
+
+	case BREAKER_HALF_OPEN:
+		if failed {
+			b.trip()
+		} else if b.successes++; b.successes >= BREAKER_HALF_OPEN_SUCCESSES {
+			b.reset(BREAKER_CLOSED)
+			b.closedAt = time.Now()
+		}
+	}
+	// Calls finished while open are outcomes before ejection. Ignored.
+	return b.state
+}
+
+func (b *Breaker) trip() {
+	// Node stayed closed long enough. Start over.
+	if !b.closedAt.IsZero() && time.Since(b.closedAt) > BREAKER_OPEN_MAX {
+		b.ejections = 0
+	}
+	period := BREAKER_OPEN_MIN << uint(b.ejections)
+	if period > BREAKER_OPEN_MAX || period <= 0 {
+		period = BREAKER_OPEN_MAX
+	} else {
+		b.ejections++
+	}
+	b.reset(BREAKER_OPEN)
+	b.period = period
+	b.timer = time.AfterFunc(period, b.halfOpen)
+}
+
+func (b *Breaker) halfOpen() {
+	b.lock.Lock()
+	from := b.state
+	if from == BREAKER_OPEN && !b.stopped {
+		b.reset(BREAKER_HALF_OPEN)
+	}
+	to := b.state
+	b.lock.Unlock()
+	b.notify(from, to)
+}
+
+func (b *Breaker) reset(state uint8) {
+	b.state = state
+	b.calls, b.failures, b.next, b.successes = 0, 0, 0, 0
+}
+
+func (b *Breaker) notify(from, to uint8) {
+	if from != to && b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+// OpenPeriod returns period of the latest ejection.
+func (b *Breaker) OpenPeriod() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.period
+}
+
+// Stop breaker. State is no longer changed.
+func (b *Breaker) Stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestIsBreakerFailure(t *testing.T) {
+	_, pipe := net.Pipe()
+	pipe.SetReadDeadline(time.Now())
+	_, timeout := pipe.Read(make([]byte, 1))
+	pipe.Close()
+
+	for err, expected := range map[error]bool{
+		nil:                      false,
+		context.Canceled:         false,
+		context.DeadlineExceeded: false,
+		rpc.ServerError(REQUEST_ERROR_PREFIX + "Invalid namespace."): false,
+		RequestError{Origin: errors.New("Invalid namespace.")}:       false,
+		NewAuthError(errors.New("Forbidden.")):                       false,
+		errors.New("Invalid namespace."):                             false,
+		rpc.ServerError("Redis failure."):                            true,
+		ReplyTimeoutError{Origin: context.DeadlineExceeded}:          true,
+		rpc.ErrShutdown:     true,
+		io.EOF:              true,
+		io.ErrUnexpectedEOF: true,
+		timeout:             true,
+		&net.OpError{Op: "dial", Err: errors.New("Connection refused.")}: true,
+	} {
+		if failed := IsBreakerFailure(err); failed != expected {
+			t.Errorf("%#v: expected failure %v, got %v", err, expected, failed)
+		}
+	}
+}
+
+// Breaker opens on failures of node only.
+func TestBreakerRecord(t *testing.T) {
+	b := NewBreaker(nil)
+	defer b.Stop()
+	for idx := 0; idx < BREAKER_WINDOW; idx++ {
+		b.Record(context.DeadlineExceeded)
+		b.Record(RequestError{Origin: errors.New("Invalid namespace.")})
+	}
+	if state := b.State(); state != BREAKER_CLOSED {
+		t.Fatalf("expected breaker closed, got %v", BreakerStateNames[state])
+	}
+	for idx := 0; idx < BREAKER_WINDOW; idx++ {
+		b.Record(rpc.ErrShutdown)
+	}
+	if state := b.State(); state != BREAKER_OPEN {
+		t.Fatalf("expected breaker open, got %v", BreakerStateNames[state])
+	}
+}
@@ -1,19 +1,30 @@
 package server
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"sort"
 	"strings"
 )
 
 // Constants
-const DEFAULT_HASHRING_CAPACITY = 4
+const (
+	DEFAULT_HASHRING_CAPACITY = 4
+
+	// Hash points of each bucket on ring.
+	DEFAULT_HASHRING_REPLICAS = 128
+
+	// Key space is divided into slots with bounded load.
+	// Slots are assigned to buckets instead of single keys.
+	HASHRING_BOUNDED_SLOTS = 4096
+	hashRingSlotShift      = 20 // 2^32 / HASHRING_BOUNDED_SLOTS = 2^20
+)
 
 // Consistent Hashing.
 type Bucket interface {
 	Hash() uint32
-	ResetHash()
-	Rehash()
 	OrderLess(Bucket) bool
 }
 
@@ -35,172 +46,282 @@ type Hashable interface {
 	Hash() uint32
 }
 
+// BucketShare is share of key space owned by bucket.
+type BucketShare struct {
+	Bucket Bucket
+	Share  float64
+}
+
+type hashPoint struct {
+	hash   uint32
+	bucket int // Index of bucket.
+}
+
+// HashRing places each bucket on ring with several virtual points.
+// Ring is rebuilt from buckets on change, so that rings of the same buckets are identical
+// no matter in which order buckets are added.
 type HashRing struct {
-	ring []Bucket // (Ascending order)
+	buckets []Bucket
+	points  []hashPoint // (Ascending order)
+
+	replicas int
+
+	// Load is bounded if bound is not negative.
+	// No bucket owns more than (1 + bound) times of average slots.
+	bound float64
+	slots []int
 }
 
 func NewEmptyHashRing() *HashRing {
 	instance := &HashRing{
-		ring: make([]Bucket, 0, DEFAULT_HASHRING_CAPACITY),
+		buckets:  make([]Bucket, 0, DEFAULT_HASHRING_CAPACITY),
+		replicas: DEFAULT_HASHRING_REPLICAS,
+		bound:    -1,
 	}
 	return instance
 }
 
 func NewHashRing(buckets []Bucket) *HashRing {
-	instance := &HashRing{
-		ring: make([]Bucket, 0, len(buckets)),
-	}
+	instance := NewEmptyHashRing()
 	instance.Substitute(buckets)
 	return instance
 }
 
-func (r *HashRing) Len() int {
-	return len(r.ring)
+// SetReplicas sets number of hash points of each bucket.
+func (r *HashRing) SetReplicas(replicas int) {
+	if replicas < 1 {
+		replicas = 1
+	}
+	r.replicas = replicas
+	r.rebuild()
 }
 
-func (r *HashRing) Less(i, j int) bool {
-	return r.ring[i].Hash() > r.ring[j].Hash()
+// SetLoadBound bounds share of each bucket to (1 + epsilon) times of average.
+// Bounded load is disabled if epsilon is negative.
+func (r *HashRing) SetLoadBound(epsilon float64) {
+	r.bound = epsilon
+	r.rebuild()
 }
 
-func (r *HashRing) Swap(i, j int) {
-	r.ring[i], r.ring[j] = r.ring[j], r.ring[i]
+// Len returns number of buckets.
+func (r *HashRing) Len() int {
+	return len(r.buckets)
 }
 
 func (r *HashRing) At(index int) Bucket {
-	if index >= len(r.ring) {
+	if index < 0 || index >= len(r.buckets) {
 		return nil
 	}
-	return r.ring[index]
+	return r.buckets[index]
 }
 
 func (r *HashRing) String() string {
-	hashValueString := make([]string, 0, len(r.ring))
-	for _, bucket := range r.ring {
-		hashValueString = append(hashValueString, fmt.Sprintf("%v", bucket.Hash()))
+	hashValueString := make([]string, 0, len(r.points))
+	for _, point := range r.points {
+		hashValueString = append(hashValueString, fmt.Sprintf("%v", point.hash))
 	}
 	return "{" + strings.Join(hashValueString, ", ") + "}"
 }
 
-func (r *HashRing) Append(bucket Bucket) (int, Bucket) {
-	// avoid collision.
-	hash := bucket.Hash()
-	for {
-		idx, _ := r.FromHash(hash)
-		if idx != -1 {
-			if bucket.OrderLess(r.ring[idx]) {
-				bucket, r.ring[idx] = r.ring[idx], bucket
-			}
-			bucket.Rehash()
-			hash = bucket.Hash()
-			continue
-		}
-		break
-	}
+func (r *HashRing) Append(bucket Bucket) {
+	r.buckets = append(r.buckets, bucket)
+	r.rebuild()
+}
 
-	oriLen := len(r.ring)
-	idx := oriLen
-	r.ring = append(r.ring, nil)
-	for ; idx > 0 && bucket.Hash() < r.ring[idx-1].Hash(); idx-- {
-		r.ring[idx] = r.ring[idx-1]
-	}
-	r.ring[idx] = bucket
+func (r *HashRing) Substitute(buckets []Bucket) {
+	r.buckets = append(r.buckets[0:0], buckets...)
+	r.rebuild()
+}
 
-	// Find the following bucket
-	if idx == oriLen {
-		idx = 0
-	} else {
-		idx += 1
+// Remove bucket at index. Returns removed bucket.
+func (r *HashRing) Remove(index int) Bucket {
+	if index < 0 || index >= len(r.buckets) {
+		return nil
 	}
-	return idx, r.ring[idx]
+	removed := r.buckets[index]
+	r.buckets = append(r.buckets[:index], r.buckets[index+1:]...)
+	r.rebuild()
+	return removed
 }
 
-// Search bucket according to hash value.
-func (r *HashRing) Search(hash uint32) int {
-	return sort.Search(len(r.ring), func(idx int) bool {
-		return hash <= r.ring[idx].Hash()
-	})
+// Has reports whether bucket is on ring.
+func (r *HashRing) Has(bucket Bucket) bool {
+	for _, b := range r.buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
 }
 
-// Hit bucket.
-func (r *HashRing) HashHit(hash uint32) (int, Bucket) {
-	if len(r.ring) == 0 {
-		return -1, nil
+// RemoveHash removes bucket whose hash is equal to the given.
+func (r *HashRing) RemoveHash(hash uint32) Bucket {
+	for idx, bucket := range r.buckets {
+		if bucket.Hash() == hash {
+			return r.Remove(idx)
+		}
 	}
+	return nil
+}
 
-	idx := r.Search(hash)
-
-	if idx == len(r.ring) {
-		idx = 0
+func replicaHash(hash uint32, replica int) uint32 {
+	if replica == 0 {
+		return hash
 	}
-	return idx, r.ring[idx]
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf, hash)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(replica))
+	fnvHash := fnv.New32a()
+	fnvHash.Write(buf)
+	// FNV spreads trailing bytes poorly. Points of bucket cluster without finalization.
+	h := fnvHash.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
 }
 
-func (r *HashRing) Hit(instance Hashable) (int, Bucket) {
-	return r.HashHit(instance.Hash())
+func (r *HashRing) pointLess(a, b hashPoint) bool {
+	if a.hash != b.hash {
+		return a.hash < b.hash
+	}
+	return r.buckets[a.bucket].OrderLess(r.buckets[b.bucket])
 }
 
-// Find bucket whose hash is equal to the given.
-func (r *HashRing) FromHash(hash uint32) (int, Bucket) {
-	idx, bucket := r.HashHit(hash)
-	if bucket == nil || bucket.Hash() != hash {
-		return -1, nil
+func (r *HashRing) rebuild() {
+	r.points = r.points[0:0]
+	for idx, bucket := range r.buckets {
+		for replica := 0; replica < r.replicas; replica++ {
+			r.points = append(r.points, hashPoint{
+				hash:   replicaHash(bucket.Hash(), replica),
+				bucket: idx,
+			})
+		}
 	}
-	return idx, bucket
+	r.uniquify()
+	r.assignSlots()
 }
 
-// Ensure hashes not collided and ring sorted.
-func (r *HashRing) uniquify(buckets []Bucket) bool {
-	sortTimes := 0
-	for duplicated, ringLen := true, len(r.ring); duplicated; sortTimes++ {
+// Ensure hashes not collided and points sorted.
+// Point of lesser bucket keeps its hash when collided.
+func (r *HashRing) uniquify() {
+	for duplicated := true; duplicated; {
 		duplicated = false
-		sort.Stable(r)
-		for sb := 1; sb < ringLen; sb++ {
-			se, hash := sb, r.ring[sb-1].Hash()
-			for ; se < ringLen && r.ring[se].Hash() == hash; se++ {
-			}
-			if se > sb { // hash values duplicated. se - (sb - 1) > 1
+		sort.Slice(r.points, func(i, j int) bool { return r.pointLess(r.points[i], r.points[j]) })
+		for idx := 1; idx < len(r.points); idx++ {
+			if r.points[idx].hash == r.points[idx-1].hash {
 				duplicated = true
-				sort.Stable(BucketSlice(r.ring[sb-1 : se]))
 				// Re-hash to avoid collision.
-				for sb < se {
-					r.ring[sb].Rehash()
-				}
+				r.points[idx].hash = replicaHash(r.points[idx].hash, 1)
 			}
 		}
 	}
-	return sortTimes > 1
 }
 
-func (r *HashRing) Substitute(buckets []Bucket) {
-	r.ring = r.ring[0:0] // Clear
-	// Copy
-	r.ring = append(r.ring, buckets...)
-	for _, bucket := range r.ring {
-		bucket.ResetHash()
+// Assign slots to buckets in order of slot. Slot goes to the first bucket clockwise with free capacity.
+func (r *HashRing) assignSlots() {
+	if r.bound < 0 || len(r.buckets) == 0 {
+		r.slots = nil
+		return
+	}
+	capacity := int(math.Ceil((1 + r.bound) * HASHRING_BOUNDED_SLOTS / float64(len(r.buckets))))
+	load := make([]int, len(r.buckets))
+	if cap(r.slots) < HASHRING_BOUNDED_SLOTS {
+		r.slots = make([]int, HASHRING_BOUNDED_SLOTS)
 	}
-	r.uniquify(r.ring)
+	r.slots = r.slots[:HASHRING_BOUNDED_SLOTS]
+	for slot := range r.slots {
+		idx := r.search(uint32(slot) << hashRingSlotShift)
+		for load[r.points[idx].bucket] >= capacity {
+			if idx++; idx >= len(r.points) {
+				idx = 0
+			}
+		}
+		r.slots[slot] = r.points[idx].bucket
+		load[r.points[idx].bucket]++
+	}
+}
+
+// Search index of the first point clockwise from hash.
+func (r *HashRing) search(hash uint32) int {
+	idx := sort.Search(len(r.points), func(idx int) bool {
+		return hash <= r.points[idx].hash
+	})
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return idx
 }
 
-func (r *HashRing) Remove(index int) (Bucket, Bucket) {
-	if index >= len(r.ring) || index < 0 {
-		return nil, nil
+// Hit bucket. Returns index of bucket.
+func (r *HashRing) HashHit(hash uint32) (int, Bucket) {
+	if len(r.points) == 0 {
+		return -1, nil
 	}
-	removed := r.ring[index]
-	for i := index + 1; i < len(r.ring); i++ {
-		r.ring[i-1] = r.ring[i]
+	var idx int
+	if r.slots != nil {
+		idx = r.slots[hash>>hashRingSlotShift]
+	} else {
+		idx = r.points[r.search(hash)].bucket
 	}
-	// shrink.
-	r.ring = r.ring[:len(r.ring)-1]
-	if len(r.ring) == 0 {
-		return removed, nil
+	return idx, r.buckets[idx]
+}
+
+// HashHitAccepted hits bucket accepted by accept. Keys of rejected bucket fail over to
+// the next accepted bucket clockwise, so that keys of accepted buckets never move.
+// Returns -1 and nil if no bucket is accepted.
+func (r *HashRing) HashHitAccepted(hash uint32, accept func(Bucket) bool) (int, Bucket) {
+	idx, bucket := r.HashHit(hash)
+	if bucket == nil || accept(bucket) {
+		return idx, bucket
 	}
-	if index >= len(r.ring) {
-		index = 0
+	rejected := make(map[int]bool, len(r.buckets))
+	rejected[idx] = true
+	for start, offset := r.search(hash), 0; offset < len(r.points); offset++ {
+		candidate := r.points[(start+offset)%len(r.points)].bucket
+		if _, decided := rejected[candidate]; !decided {
+			rejected[candidate] = !accept(r.buckets[candidate])
+		}
+		if !rejected[candidate] {
+			return candidate, r.buckets[candidate]
+		}
+		if len(rejected) == len(r.buckets) {
+			break
+		}
 	}
-	return removed, r.ring[index]
+	return -1, nil
 }
 
-func (r *HashRing) RemoveHash(hash uint32) (Bucket, Bucket) {
-	idx, _ := r.FromHash(hash)
-	return r.Remove(idx)
+func (r *HashRing) Hit(instance Hashable) (int, Bucket) {
+	return r.HashHit(instance.Hash())
+}
+
+// Shares returns share of key space owned by each bucket.
+func (r *HashRing) Shares() []BucketShare {
+	shares := make([]BucketShare, len(r.buckets))
+	for idx, bucket := range r.buckets {
+		shares[idx].Bucket = bucket
+	}
+	if len(r.points) == 0 {
+		return shares
+	}
+	if r.slots != nil {
+		for _, idx := range r.slots {
+			shares[idx].Share += 1.0 / HASHRING_BOUNDED_SLOTS
+		}
+		return shares
+	}
+	if len(r.points) == 1 {
+		shares[r.points[0].bucket].Share = 1
+		return shares
+	}
+	// Point owns keys between previous point and itself.
+	prev := r.points[len(r.points)-1].hash
+	for _, point := range r.points {
+		shares[point.bucket].Share += float64(point.hash-prev) / (1 << 32)
+		prev = point.hash
+	}
+	return shares
 }
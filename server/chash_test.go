@@ -0,0 +1,204 @@
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"testing"
+)
+
+type testBucket struct {
+	name string
+}
+
+func (b *testBucket) Hash() uint32 {
+	fnvHash := fnv.New32a()
+	fnvHash.Write([]byte(b.name))
+	return fnvHash.Sum32()
+}
+
+func (b *testBucket) OrderLess(other Bucket) bool {
+	return b.name < other.(*testBucket).name
+}
+
+func testBuckets(n int) []Bucket {
+	buckets := make([]Bucket, n)
+	for idx := range buckets {
+		buckets[idx] = &testBucket{name: "node-" + strconv.Itoa(idx)}
+	}
+	return buckets
+}
+
+// testKeys returns hashes of sample keys.
+func testKeys(n int) []uint32 {
+	keys := make([]uint32, n)
+	for idx := range keys {
+		fnvHash := fnv.New32a()
+		fnvHash.Write([]byte("key-" + strconv.Itoa(idx)))
+		keys[idx] = replicaHash(fnvHash.Sum32(), 1)
+	}
+	return keys
+}
+
+// testAssign maps keys to names of buckets.
+func testAssign(ring *HashRing, keys []uint32) []string {
+	names := make([]string, len(keys))
+	for idx, key := range keys {
+		if _, bucket := ring.HashHit(key); bucket != nil {
+			names[idx] = bucket.(*testBucket).name
+		}
+	}
+	return names
+}
+
+func testRing(buckets []Bucket, epsilon float64) *HashRing {
+	ring := NewEmptyHashRing()
+	ring.SetLoadBound(epsilon)
+	ring.Substitute(buckets)
+	return ring
+}
+
+func TestHashRingDeterministic(t *testing.T) {
+	keys := testKeys(10000)
+	for _, epsilon := range []float64{-1, 0.25} {
+		// Distinct instances of the same buckets, added in reversed order.
+		buckets, reversed := testBuckets(7), testBuckets(7)
+		for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+			reversed[i], reversed[j] = reversed[j], reversed[i]
+		}
+		appended := NewEmptyHashRing()
+		appended.SetLoadBound(epsilon)
+		for _, bucket := range testBuckets(7) {
+			appended.Append(bucket)
+		}
+		expected := testAssign(testRing(buckets, epsilon), keys)
+		for _, ring := range []*HashRing{testRing(reversed, epsilon), appended} {
+			for idx, name := range testAssign(ring, keys) {
+				if name != expected[idx] {
+					t.Fatalf("epsilon %v: key %v hits %v, expected %v", epsilon, keys[idx], name, expected[idx])
+				}
+			}
+		}
+	}
+}
+
+func TestHashRingLoadBound(t *testing.T) {
+	for _, n := range []int{1, 3, 7, 10} {
+		for _, epsilon := range []float64{0, 0.1, 0.25, 1} {
+			ring := testRing(testBuckets(n), epsilon)
+			capacity := int(math.Ceil((1 + epsilon) * HASHRING_BOUNDED_SLOTS / float64(n)))
+			load := make(map[string]int, n)
+			for slot := 0; slot < HASHRING_BOUNDED_SLOTS; slot++ {
+				// Every key in slot hits the same bucket.
+				_, first := ring.HashHit(uint32(slot) << hashRingSlotShift)
+				_, last := ring.HashHit(uint32(slot)<<hashRingSlotShift | (1<<hashRingSlotShift - 1))
+				if first != last {
+					t.Fatalf("%v buckets, epsilon %v: slot %v split", n, epsilon, slot)
+				}
+				load[first.(*testBucket).name]++
+			}
+			total := 0.0
+			for _, share := range ring.Shares() {
+				name := share.Bucket.(*testBucket).name
+				if load[name] > capacity {
+					t.Fatalf("%v buckets, epsilon %v: %v owns %v slots over capacity %v", n, epsilon, name, load[name], capacity)
+				}
+				if expected := float64(load[name]) / HASHRING_BOUNDED_SLOTS; math.Abs(share.Share-expected) > 1e-9 {
+					t.Fatalf("%v buckets, epsilon %v: share of %v is %v, expected %v", n, epsilon, name, share.Share, expected)
+				}
+				total += share.Share
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Fatalf("%v buckets, epsilon %v: shares sum to %v", n, epsilon, total)
+			}
+		}
+	}
+}
+
+// testMoved counts keys assigned differently.
+func testMoved(before, after []string) int {
+	moved := 0
+	for idx := range before {
+		if before[idx] != after[idx] {
+			moved++
+		}
+	}
+	return moved
+}
+
+func TestHashRingMinimalMovement(t *testing.T) {
+	const n = 8
+	keys := testKeys(20000)
+
+	// Without load bound, only keys of the added or removed bucket move.
+	ring := testRing(testBuckets(n), -1)
+	before := testAssign(ring, keys)
+	added := &testBucket{name: "node-new"}
+	ring.Append(added)
+	after := testAssign(ring, keys)
+	for idx := range keys {
+		if before[idx] != after[idx] && after[idx] != added.name {
+			t.Fatalf("key %v moved from %v to %v on adding bucket", keys[idx], before[idx], after[idx])
+		}
+	}
+	ring.Remove(ring.Len() - 1)
+	if moved := testMoved(before, testAssign(ring, keys)); moved != 0 {
+		t.Fatalf("%v keys not restored after removing added bucket", moved)
+	}
+	removed := ring.Remove(3).(*testBucket)
+	after = testAssign(ring, keys)
+	for idx := range keys {
+		if before[idx] != after[idx] && before[idx] != removed.name {
+			t.Fatalf("key %v moved from %v to %v on removing bucket", keys[idx], before[idx], after[idx])
+		}
+	}
+
+	// With load bound, slots pushed over capacity cascade, but movement stays near the share of one bucket.
+	for _, epsilon := range []float64{0.1, 0.25} {
+		ring = testRing(testBuckets(n), epsilon)
+		before = testAssign(ring, keys)
+		ring.Append(&testBucket{name: "node-new"})
+		after = testAssign(ring, keys)
+		if moved := testMoved(before, after); moved > 5*len(keys)/(4*(n+1)) {
+			t.Fatalf("epsilon %v: %v of %v keys moved on adding bucket", epsilon, moved, len(keys))
+		}
+		ring.Remove(ring.Len() - 1)
+		if moved := testMoved(before, testAssign(ring, keys)); moved != 0 {
+			t.Fatalf("epsilon %v: %v keys not restored after removing added bucket", epsilon, moved)
+		}
+		ring.Remove(3)
+		if moved := testMoved(before, testAssign(ring, keys)); moved > 5*len(keys)/(4*n) {
+			t.Fatalf("epsilon %v: %v of %v keys moved on removing bucket", epsilon, moved, len(keys))
+		}
+	}
+}
+
+func TestHashRingHitAccepted(t *testing.T) {
+	keys := testKeys(20000)
+	for _, epsilon := range []float64{-1, 0.25} {
+		ring := testRing(testBuckets(8), epsilon)
+		before := testAssign(ring, keys)
+		// Keys of rejected bucket fail over, while keys of others stay.
+		rejected := ring.At(3).(*testBucket).name
+		spread := make(map[string]int)
+		for idx, key := range keys {
+			_, bucket := ring.HashHitAccepted(key, func(b Bucket) bool { return b.(*testBucket).name != rejected })
+			name := bucket.(*testBucket).name
+			switch {
+			case name == rejected:
+				t.Fatalf("epsilon %v: key %v hits rejected bucket", epsilon, key)
+			case before[idx] != rejected && name != before[idx]:
+				t.Fatalf("epsilon %v: key %v moved from %v to %v", epsilon, key, before[idx], name)
+			case before[idx] == rejected:
+				spread[name]++
+			}
+		}
+		// Failover spreads over remaining buckets.
+		if len(spread) < 4 {
+			t.Fatalf("epsilon %v: keys of rejected bucket fail over to %v buckets only", epsilon, len(spread))
+		}
+		if idx, bucket := ring.HashHitAccepted(keys[0], func(Bucket) bool { return false }); idx != -1 || bucket != nil {
+			t.Fatalf("epsilon %v: expected no bucket hit", epsilon)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+	"sync"
+)
+
+const (
+	RPC_CODEC_GOB  = "gob"
+	RPC_CODEC_JSON = "json"
+)
+
+// RPCCodec creates net/rpc codecs on plain connections.
+type RPCCodec struct {
+	Name           string
+	NewClientCodec func(conn io.ReadWriteCloser) rpc.ClientCodec
+	NewServerCodec func(conn io.ReadWriteCloser) rpc.ServerCodec
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[string]*RPCCodec{
+		RPC_CODEC_GOB: &RPCCodec{
+			Name:           RPC_CODEC_GOB,
+			NewClientCodec: newGobClientCodec,
+			NewServerCodec: newGobServerCodec,
+		},
+		RPC_CODEC_JSON: &RPCCodec{
+			Name:           RPC_CODEC_JSON,
+			NewClientCodec: jsonrpc.NewClientCodec,
+			NewServerCodec: jsonrpc.NewServerCodec,
+		},
+	}
+)
+
+// RegisterRPCCodec adds codec, or replaces codec with the same name.
+func RegisterRPCCodec(codec *RPCCodec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[codec.Name] = codec
+}
+
+func GetRPCCodec(name string) *RPCCodec {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return codecs[name]
+}
+
+// RPCCodecNames returns names of registered codecs.
+func RPCCodecNames() []string {
+	codecLock.RLock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	codecLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Gob codec. Same wire format as default codec of net/rpc.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &gobClientCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		// Stream is broken.
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
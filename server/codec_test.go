@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+func TestRPCCodecNames(t *testing.T) {
+	if names := RPCCodecNames(); !reflect.DeepEqual(names, []string{RPC_CODEC_GOB, RPC_CODEC_JSON}) {
+		t.Fatalf("unexpected codecs: %v", names)
+	}
+	if GetRPCCodec("unknown") != nil {
+		t.Fatal("unknown codec found")
+	}
+}
+
+// Gob codec should interoperate with default codec of net/rpc.
+func TestGobCodecCompatible(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(TestEcho{}); err != nil {
+		t.Fatal(err)
+	}
+	codec := GetRPCCodec(RPC_CODEC_GOB)
+
+	// Default server with gob client codec.
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClientWithCodec(codec.NewClientCodec(clientConn))
+	testEcho(t, client)
+	client.Close()
+
+	// Gob server codec with default client.
+	clientConn, serverConn = net.Pipe()
+	go server.ServeCodec(codec.NewServerCodec(serverConn))
+	client = rpc.NewClient(clientConn)
+	testEcho(t, client)
+	client.Close()
+}
@@ -0,0 +1,38 @@
+// Package digtest provides utilities for testing watchers of dig notifications.
+package digtest
+
+import (
+	"context"
+	"github.com/Sunmxt/linker-im/server/dig"
+	"testing"
+	"time"
+)
+
+// WatchFunc consumes notifications until channel is closed or ctx is done.
+type WatchFunc func(ctx context.Context, events <-chan *dig.Notification)
+
+// Notify passes notifications to watch, which returns after channel is closed.
+func Notify(watch WatchFunc, notifications ...*dig.Notification) {
+	events := make(chan *dig.Notification, len(notifications))
+	for _, notify := range notifications {
+		events <- notify
+	}
+	close(events)
+	watch(context.Background(), events)
+}
+
+// Canceled fails test if watch does not return after ctx is canceled.
+func Canceled(t *testing.T, watch WatchFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan struct{})
+	go func() {
+		watch(ctx, make(chan *dig.Notification))
+		close(returned)
+	}()
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not returned after canceled")
+	}
+}
@@ -10,3 +10,5 @@ var ErrInvalidConnector = errors.New("Invalid connector.")
 var ErrInvalidArguments = errors.New("Invalid arguments.")
 var ErrServiceNotFound = errors.New("Service not found.")
 var ErrClosed = errors.New("Closed.")
+var ErrNotPublished = errors.New("Node not published.")
+var ErrUnexpectedReply = errors.New("Unexpected reply.")
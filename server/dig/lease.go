@@ -0,0 +1,261 @@
+package dig
+
+import (
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// Leases are renewed REDIS_LEASE_RENEWALS times in TTL.
+const REDIS_LEASE_RENEWALS = 3
+
+// redisLease keeps node registered. Keys of node expire in TTL (Node.Timeout) unless renewed by registry.
+// Node never expires if TTL is 0.
+type redisLease struct {
+	node      *Node
+	services  map[string]struct{}
+	announced bool // Peers notified of metadata.
+}
+
+func (l *redisLease) ttl() time.Duration {
+	return time.Duration(l.node.Timeout) * time.Second
+}
+
+// Publish node with lease. Lease is renewed by registry until unpublished or registry closed.
+// Publish again to notify peers after metadata changes.
+// Lease is kept if registering fails, and registering is retried by renewal.
+func (r *RedisRegistry) Publish(node *Node) error {
+	return r.publish("", node)
+}
+
+// Unpublish node and revoke its lease. Node is deregistered from all services immediately.
+func (r *RedisRegistry) Unpublish(name string) error {
+	return r.unpublish("", name)
+}
+
+func (r *RedisRegistry) publish(service string, node *Node) error {
+	if node == nil {
+		return ErrInvalidArguments
+	}
+	r.leaseLock.Lock()
+	defer r.leaseLock.Unlock()
+	select {
+	case <-r.closed:
+		return ErrClosed
+	default:
+	}
+	lease, ok := r.leases[node.Name]
+	if !ok {
+		lease = &redisLease{services: make(map[string]struct{})}
+		r.leases[node.Name] = lease
+	}
+	lease.node, lease.announced = node, false
+	if service != "" {
+		lease.services[service] = struct{}{}
+	}
+
+	r.keepalive.Do(func() {
+		go r.renewLeases()
+	})
+	select {
+	case r.renew <- struct{}{}:
+	default:
+	}
+
+	return r.refresh([]*redisLease{lease})
+}
+
+// unpublish node from service. Lease of node is revoked if service is empty.
+func (r *RedisRegistry) unpublish(service, name string) error {
+	r.leaseLock.Lock()
+	defer r.leaseLock.Unlock()
+	lease, ok := r.leases[name]
+	if !ok {
+		return ErrNotPublished
+	}
+	if service == "" {
+		delete(r.leases, name)
+		return r.revoke(lease, lease.services, true)
+	}
+	if _, ok = lease.services[service]; !ok {
+		return ErrNotPublished
+	}
+	delete(lease.services, service)
+	return r.revoke(lease, map[string]struct{}{service: struct{}{}}, false)
+}
+
+// renewLeases renews leases periodically until registry closed.
+func (r *RedisRegistry) renewLeases() {
+	for {
+		if !r.waitRenewal() {
+			return
+		}
+
+		r.leaseLock.Lock()
+		leases := make([]*redisLease, 0, len(r.leases))
+		for _, lease := range r.leases {
+			leases = append(leases, lease)
+		}
+		err := r.refresh(leases)
+		r.leaseLock.Unlock()
+		if err != nil {
+			log.Warn("Dig lease renewal failure: " + err.Error())
+		}
+	}
+}
+
+// waitRenewal blocks until leases should be renewed. Returns false if registry closed.
+func (r *RedisRegistry) waitRenewal() bool {
+	for {
+		var tick <-chan time.Time
+		timer := time.NewTimer(0)
+		timer.Stop()
+		if period := r.renewPeriod(); period > 0 {
+			timer.Reset(period)
+			tick = timer.C
+		}
+		select {
+		case <-r.closed:
+			timer.Stop()
+			return false
+		case <-tick:
+			return true
+		case <-r.renew: // Leases changed. Period may change.
+			timer.Stop()
+		}
+	}
+}
+
+// renewPeriod returns period to renew the shortest lease. 0 if no lease expires.
+func (r *RedisRegistry) renewPeriod() time.Duration {
+	r.leaseLock.Lock()
+	defer r.leaseLock.Unlock()
+	var period time.Duration
+	for _, lease := range r.leases {
+		if ttl := lease.ttl() / REDIS_LEASE_RENEWALS; ttl > 0 && (period == 0 || ttl < period) {
+			period = ttl
+		}
+	}
+	return period
+}
+
+// refresh writes metadata and presence of nodes, and extends expiration. Should be called with leaseLock held.
+// Peers are notified if node joins service or metadata is not announced.
+func (r *RedisRegistry) refresh(leases []*redisLease) error {
+	conn, err := r.redisConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	joined := make(map[string]struct{})
+	for _, lease := range leases {
+		name, ttl := lease.node.Name, lease.node.Timeout
+		nodeKey := r.prefix + "{dig-node-" + name + "}"
+		// Each node is written in transaction. Metadata is written before presence, so that peers notified find
+		// metadata of node. Metadata not announced is replaced, so that keys removed by publishing or left by
+		// previous registration are deleted, and peers never find it partially written.
+		conn.Send("MULTI")
+		if !lease.announced {
+			conn.Send("DEL", nodeKey)
+		}
+		for k, v := range lease.node.Metadata {
+			conn.Send("HSET", nodeKey, k, v)
+		}
+		if ttl > 0 {
+			conn.Send("EXPIRE", nodeKey, ttl)
+		}
+		services := make([]string, 0, len(lease.services))
+		for svc := range lease.services {
+			present := r.prefix + "{dig-service-" + svc + "-node-" + name + "-present}"
+			if ttl > 0 {
+				conn.Send("SET", present, 1, "ex", ttl)
+			} else {
+				conn.Send("SET", present, 1)
+			}
+			conn.Send("SADD", r.prefix+"{dig-service-"+svc+"-node}", name)
+			services = append(services, svc)
+		}
+		replies, err := redis.Values(conn.Do("EXEC"))
+		if err != nil {
+			return err
+		}
+		// Replies of SET and SADD of services come last.
+		offset := len(replies) - 2*len(services)
+		if offset < 0 {
+			return ErrUnexpectedReply
+		}
+		for idx, svc := range services {
+			if added, _ := redis.Int(replies[offset+2*idx+1], nil); added > 0 {
+				joined[svc] = struct{}{}
+			}
+		}
+	}
+
+	for svc := range joined { // Node joins service.
+		if _, err = conn.Do("PUBLISH", r.eventChannel(), redisEventService+svc); err != nil {
+			return err
+		}
+	}
+	for _, lease := range leases {
+		if lease.announced {
+			continue
+		}
+		if _, err = conn.Do("PUBLISH", r.eventChannel(), redisEventNode+lease.node.Name); err != nil {
+			return err
+		}
+		lease.announced = true
+	}
+	return nil
+}
+
+// revoke removes node from services, and deletes metadata of node if all is true.
+// Peers are notified. Should be called with leaseLock held.
+func (r *RedisRegistry) revoke(lease *redisLease, services map[string]struct{}, all bool) error {
+	conn, err := r.redisConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	name := lease.node.Name
+	conn.Send("MULTI")
+	for svc := range services {
+		conn.Send("SREM", r.prefix+"{dig-service-"+svc+"-node}", name)
+		conn.Send("DEL", r.prefix+"{dig-service-"+svc+"-node-"+name+"-present}")
+		conn.Send("PUBLISH", r.eventChannel(), redisEventService+svc)
+	}
+	if all {
+		conn.Send("DEL", r.prefix+"{dig-node-"+name+"}")
+		conn.Send("PUBLISH", r.eventChannel(), redisEventNode+name)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Close revokes leases of all nodes published, so that they are deregistered immediately.
+// Leases are no longer renewed and notifications no longer listened.
+func (r *RedisRegistry) Close() error {
+	r.leaseLock.Lock()
+	select {
+	case <-r.closed:
+		r.leaseLock.Unlock()
+		return ErrClosed
+	default:
+	}
+	var err error
+	for name, lease := range r.leases {
+		if revokeErr := r.revoke(lease, lease.services, true); revokeErr != nil && err == nil {
+			err = revokeErr
+		}
+		delete(r.leases, name)
+	}
+	// Leases are revoked before closed, since redis is not connected after closed.
+	close(r.closed)
+	r.leaseLock.Unlock()
+
+	r.lock.Lock()
+	r.listening = false
+	r.lock.Unlock()
+	return err
+}
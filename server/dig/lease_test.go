@@ -0,0 +1,193 @@
+package dig
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testConn records commands, and replies to commands queued in transaction as redis does.
+type testConn struct {
+	lock     sync.Mutex
+	commands []string
+	pending  []interface{} // Replies not received.
+	queued   []interface{} // Replies of commands in transaction.
+	multi    bool
+	abort    bool // EXEC fails.
+	reply    func(cmd string, args []interface{}) interface{}
+}
+
+func (c *testConn) Close() error { return nil }
+func (c *testConn) Err() error   { return nil }
+func (c *testConn) Flush() error { return nil }
+
+func (c *testConn) Send(cmd string, args ...interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	command := cmd
+	for _, arg := range args {
+		command += " " + fmt.Sprint(arg)
+	}
+	c.commands = append(c.commands, command)
+	var reply interface{} = "OK"
+	switch {
+	case cmd == "MULTI":
+		c.multi, c.queued = true, nil
+	case cmd == "EXEC" && c.abort:
+		reply, c.multi, c.queued = redis.Error("EXECABORT Transaction discarded."), false, nil
+	case cmd == "EXEC":
+		reply, c.multi, c.queued = c.queued, false, nil
+	case cmd == "DISCARD":
+		c.multi, c.queued = false, nil
+	case c.reply != nil:
+		reply = c.reply(cmd, args)
+	}
+	if c.multi && cmd != "MULTI" {
+		c.queued = append(c.queued, reply)
+		reply = "QUEUED"
+	}
+	c.pending = append(c.pending, reply)
+	return nil
+}
+
+func (c *testConn) Receive() (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.pending) < 1 {
+		return nil, redis.ErrNil
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *testConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+	for {
+		c.lock.Lock()
+		left := len(c.pending)
+		c.lock.Unlock()
+		if left < 1 {
+			return reply, err
+		}
+		reply, err = c.Receive()
+	}
+}
+
+// testCommands returns commands recorded since last call.
+func (c *testConn) testCommands() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	commands := c.commands
+	c.commands = nil
+	return commands
+}
+
+func testConnRegistry(conn *testConn) *RedisRegistry {
+	r, _ := NewRedisPoolRegistry(&redis.Pool{
+		Dial: func() (redis.Conn, error) { return conn, nil },
+	}, "p:")
+	return r.(*RedisRegistry)
+}
+
+func testExpectCommands(t *testing.T, commands []string, expected ...string) {
+	if len(commands) != len(expected) {
+		t.Fatalf("expected commands %q, got %q", expected, commands)
+	}
+	for idx := range expected {
+		if commands[idx] != expected[idx] {
+			t.Fatalf("expected commands %q, got %q", expected, commands)
+		}
+	}
+}
+
+func TestLeaseRefresh(t *testing.T) {
+	joined := map[string]bool{"a": true}
+	conn := &testConn{reply: func(cmd string, args []interface{}) interface{} {
+		if cmd == "SADD" {
+			if joined[strings.TrimSuffix(strings.TrimPrefix(args[0].(string), "p:{dig-service-"), "-node}")] {
+				return int64(1)
+			}
+			return int64(0)
+		}
+		return "OK"
+	}}
+	r := testConnRegistry(conn)
+	lease := &redisLease{
+		node:     &Node{Name: "n1", Metadata: map[string]string{"k": "v"}, Timeout: 3},
+		services: map[string]struct{}{"a": struct{}{}},
+	}
+	other := &redisLease{
+		node:      &Node{Name: "n2"},
+		services:  map[string]struct{}{"b": struct{}{}},
+		announced: true,
+	}
+
+	// Metadata not announced is replaced. Peers are notified of service joined and metadata.
+	if err := r.refresh([]*redisLease{lease, other}); err != nil {
+		t.Fatal(err)
+	}
+	if !lease.announced {
+		t.Fatal("lease not announced")
+	}
+	testExpectCommands(t, conn.testCommands(),
+		"MULTI", "DEL p:{dig-node-n1}", "HSET p:{dig-node-n1} k v", "EXPIRE p:{dig-node-n1} 3",
+		"SET p:{dig-service-a-node-n1-present} 1 ex 3", "SADD p:{dig-service-a-node} n1", "EXEC",
+		"MULTI", "SET p:{dig-service-b-node-n2-present} 1", "SADD p:{dig-service-b-node} n2", "EXEC",
+		"PUBLISH p:{dig-events} service:a",
+		"PUBLISH p:{dig-events} node:n1",
+	)
+
+	// Renewal of member notifies nobody.
+	joined["a"] = false
+	if err := r.refresh([]*redisLease{lease}); err != nil {
+		t.Fatal(err)
+	}
+	testExpectCommands(t, conn.testCommands(),
+		"MULTI", "HSET p:{dig-node-n1} k v", "EXPIRE p:{dig-node-n1} 3",
+		"SET p:{dig-service-a-node-n1-present} 1 ex 3", "SADD p:{dig-service-a-node} n1", "EXEC",
+	)
+
+	// Failed transaction keeps lease unannounced, and notifies nobody.
+	lease.announced, conn.abort = false, true
+	if err := r.refresh([]*redisLease{lease}); err == nil {
+		t.Fatal("expected error of aborted transaction")
+	}
+	if lease.announced {
+		t.Fatal("lease announced after transaction failed")
+	}
+	for _, command := range conn.testCommands() {
+		if strings.HasPrefix(command, "PUBLISH") {
+			t.Fatalf("unexpected %q after transaction failed", command)
+		}
+	}
+}
+
+func TestLeaseRevoke(t *testing.T) {
+	conn := &testConn{}
+	r := testConnRegistry(conn)
+	lease := &redisLease{
+		node:     &Node{Name: "n1"},
+		services: map[string]struct{}{"a": struct{}{}},
+	}
+	if err := r.revoke(lease, lease.services, false); err != nil {
+		t.Fatal(err)
+	}
+	testExpectCommands(t, conn.testCommands(),
+		"MULTI", "SREM p:{dig-service-a-node} n1", "DEL p:{dig-service-a-node-n1-present}",
+		"PUBLISH p:{dig-events} service:a", "EXEC",
+	)
+	if err := r.revoke(lease, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	testExpectCommands(t, conn.testCommands(),
+		"MULTI", "DEL p:{dig-node-n1}", "PUBLISH p:{dig-events} node:n1", "EXEC",
+	)
+}
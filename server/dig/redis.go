@@ -1,10 +1,32 @@
 package dig
 
 import (
+	"context"
+	"github.com/Sunmxt/linker-im/log"
 	"github.com/gomodule/redigo/redis"
+	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	// Full synchronization period when listening for notifications.
+	DEFAULT_RESYNC_PERIOD = 30 * time.Second
+
+	REDIS_SUBSCRIBE_PING_INTERVAL = 5 * time.Second
+	REDIS_SUBSCRIBE_TIMEOUT       = 15 * time.Second
+	REDIS_RESUBSCRIBE_DELAY       = time.Second
+)
+
+// Notifications published to "{dig-events}" channel.
+const (
+	redisEventNode    = "node:"
+	redisEventService = "service:"
+)
+
+// Keyspace events of expired and deleted keys. Delivered only if enabled on redis server.
+var redisKeyEvents = []interface{}{"__keyevent@*__:expired", "__keyevent@*__:del"}
+
 type RedisConnector struct{}
 
 func (c *RedisConnector) Connect(args ...interface{}) (Registry, error) {
@@ -17,14 +39,37 @@ type RedisRegistry struct {
 
 	service sync.Map
 	nodes   sync.Map
-	publish map[string]*Node
+
+	// Leases of nodes published, keyed by name of node.
+	leaseLock sync.Mutex
+	leases    map[string]*redisLease
+	keepalive sync.Once
+	renew     chan struct{}
+	closed    chan struct{}
+
+	// Changes notified since last Poll.
+	lock          sync.Mutex
+	listening     bool
+	resync        time.Duration
+	lastSync      time.Time
+	desync        bool // Notifications may be missed.
+	dirtyServices map[string]struct{}
+	dirtyNodes    map[string]struct{}
+	pending       chan struct{}
+
+	watchers watchHub
 }
 
 func NewRedisPoolRegistry(pool *redis.Pool, prefix string) (Registry, error) {
 	return &RedisRegistry{
-		redis:   pool,
-		prefix:  prefix,
-		publish: make(map[string]*Node),
+		redis:         pool,
+		prefix:        prefix,
+		leases:        make(map[string]*redisLease),
+		renew:         make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		dirtyServices: make(map[string]struct{}),
+		dirtyNodes:    make(map[string]struct{}),
+		pending:       make(chan struct{}, 1),
 	}, nil
 }
 
@@ -114,11 +159,15 @@ func (r *RedisRegistry) GetService(name string, focus bool) (*RedisServiceEntry,
 }
 
 func (r *RedisRegistry) redisConnect() (redis.Conn, error) {
-	pool := r.redis
-	if pool == nil {
+	select {
+	case <-r.closed:
 		return nil, ErrClosed
+	default:
 	}
-	return pool.Get(), nil
+	if r.redis == nil {
+		return nil, ErrClosed
+	}
+	return r.redis.Get(), nil
 }
 
 func (r *RedisRegistry) Poll(notify func(*Notification)) (bool, error) {
@@ -127,14 +176,31 @@ func (r *RedisRegistry) Poll(notify func(*Notification)) (bool, error) {
 		return false, err
 	}
 	defer conn.Close()
+	notify = r.notifier(notify)
+
+	services, nodes, full := r.takeChanges()
+	var changed bool
+	if full {
+		changed, err = r.sync(notify, conn)
+	} else {
+		changed, err = r.syncChanges(notify, conn, services, nodes)
+	}
+	if err != nil {
+		r.setDesync()
+	}
+	return changed, err
+}
+
+// sync synchronizes all services and nodes focused on.
+func (r *RedisRegistry) sync(notify func(*Notification), conn redis.Conn) (bool, error) {
 	changed, svcSet := false, make(map[string]struct{})
 
-	var svcs []string
-	svcs, err = redis.Strings(conn.Do("SMEMBERS", r.prefix+"{dig-services}"))
+	svcs, err := redis.Strings(conn.Do("SMEMBERS", r.prefix+"{dig-services}"))
 	if err != nil {
 		if err != redis.ErrNil {
 			return false, err
 		}
+		err = nil
 	} else {
 		for idx := range svcs {
 			_, created := r.GetService(svcs[idx], false)
@@ -169,13 +235,272 @@ func (r *RedisRegistry) Poll(notify func(*Notification)) (bool, error) {
 		return true
 	})
 
-	if err = r.resolveNodes(notify, conn); err != nil {
+	if err != nil {
 		return changed, err
 	}
 
-	err = r.publishNodes(conn)
+	return changed, r.resolveNodes(notify, conn, nil)
+}
 
-	return changed, err
+// syncChanges synchronizes services and nodes notified only.
+func (r *RedisRegistry) syncChanges(notify func(*Notification), conn redis.Conn, services, nodes map[string]struct{}) (bool, error) {
+	changed := false
+	for name := range services {
+		raw, _ := r.service.Load(name)
+		entry, ok := raw.(*RedisServiceEntry)
+		if !ok { // Not focused on.
+			continue
+		}
+		updated, err := entry.poll(notify, conn)
+		if err != nil {
+			return changed, err
+		}
+		if updated {
+			changed = true
+		}
+		// Metadata of new nodes is required.
+		entry.VisitNodes(func(node string) bool {
+			nodes[node] = struct{}{}
+			return true
+		})
+	}
+	if len(nodes) < 1 {
+		return changed, nil
+	}
+	return changed, r.resolveNodes(notify, conn, nodes)
+}
+
+// takeChanges returns services and nodes notified since last call.
+// full is true if all should be synchronized.
+func (r *RedisRegistry) takeChanges() (services, nodes map[string]struct{}, full bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.listening || r.desync || time.Since(r.lastSync) >= r.resync {
+		r.desync, r.lastSync, full = false, time.Now(), true
+	}
+	services, nodes = r.dirtyServices, r.dirtyNodes
+	r.dirtyServices, r.dirtyNodes = make(map[string]struct{}), make(map[string]struct{})
+	return
+}
+
+func (r *RedisRegistry) setDesync() {
+	r.lock.Lock()
+	r.desync = true
+	r.lock.Unlock()
+}
+
+func (r *RedisRegistry) eventChannel() string {
+	return r.prefix + "{dig-events}"
+}
+
+// Listen for changes notified by peers. Changes are synchronized by the next Poll.
+// All services and nodes are still synchronized once per resync period in case of missed notifications.
+// Expiration of nodes is notified only if keyspace events are enabled on redis server,
+// e.g. "notify-keyspace-events Egx". Otherwise it is found by full synchronization.
+func (r *RedisRegistry) Listen(resync time.Duration) error {
+	pool := r.redis
+	if pool == nil {
+		return ErrClosed
+	}
+	if resync <= 0 {
+		resync = DEFAULT_RESYNC_PERIOD
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resync = resync
+	if r.listening {
+		return nil
+	}
+	select {
+	case <-r.closed:
+		return ErrClosed
+	default:
+	}
+	r.listening, r.desync = true, true
+	go r.listen(pool, r.closed)
+	return nil
+}
+
+// Wait blocks until changes are notified or timeout. Returns error of ctx if ctx is done.
+func (r *RedisRegistry) Wait(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-r.pending:
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Watch returns channel of notifications matched by filter, which are sent by Poll.
+// Channel is closed when ctx is done.
+// Notifications not received yet are queued without blocking polling.
+func (r *RedisRegistry) Watch(ctx context.Context, filter WatchFilter) <-chan *Notification {
+	return r.watchers.watch(ctx, filter)
+}
+
+// notifier returns function that passes notification to both notify and watchers.
+func (r *RedisRegistry) notifier(notify func(*Notification)) func(*Notification) {
+	if r.watchers.empty() {
+		return notify
+	}
+	return func(n *Notification) {
+		if notify != nil {
+			notify(n)
+		}
+		if !r.watchers.dispatch(n, r.match) {
+			// Watcher falls behind. Synchronize all since notifications are missed.
+			r.setDesync()
+		}
+	}
+}
+
+func (r *RedisRegistry) match(filter *WatchFilter, n *Notification) bool {
+	if !filter.matchEvent(n.Event) {
+		return false
+	}
+	if filter.Service == "" {
+		return true
+	}
+	if n.Service != nil {
+		return n.Service.Name() == filter.Service
+	}
+	switch n.Event {
+	case EVENT_SERVICE_FOUND, EVENT_SERVICE_LOST:
+		return n.Name == filter.Service
+	}
+	node := n.Name
+	if n.Node != nil && n.Node.Name != "" {
+		node = n.Node.Name
+	}
+	raw, _ := r.service.Load(filter.Service)
+	entry, ok := raw.(*RedisServiceEntry)
+	if !ok {
+		return false
+	}
+	if _, ok = entry.nodes.Load(node); !ok && n.Event == EVENT_NODE_LOST {
+		// Expired node is removed from service before lost.
+		_, ok = entry.lost.Load(node)
+	}
+	return ok
+}
+
+func (r *RedisRegistry) signal() {
+	select {
+	case r.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (r *RedisRegistry) listen(pool *redis.Pool, stop chan struct{}) {
+	for {
+		if err := r.subscribe(pool, stop); err != nil {
+			log.Warn("Dig subscription failure: " + err.Error())
+		}
+		// Notifications are missed until subscribed again.
+		r.setDesync()
+		select {
+		case <-stop:
+			return
+		case <-time.After(REDIS_RESUBSCRIBE_DELAY):
+		}
+	}
+}
+
+func (r *RedisRegistry) subscribe(pool *redis.Pool, stop chan struct{}) error {
+	psc := redis.PubSubConn{Conn: pool.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(r.eventChannel()); err != nil {
+		return err
+	}
+	if err := psc.PSubscribe(redisKeyEvents...); err != nil {
+		return err
+	}
+
+	// Connection is written by one goroutine only.
+	done, writer := make(chan struct{}), sync.WaitGroup{}
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		ticker := time.NewTicker(REDIS_SUBSCRIBE_PING_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				psc.Unsubscribe()
+				psc.PUnsubscribe()
+				return
+			case <-ticker.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			}
+		}
+	}()
+	defer writer.Wait()
+	defer close(done)
+
+	for {
+		switch v := psc.ReceiveWithTimeout(REDIS_SUBSCRIBE_TIMEOUT).(type) {
+		case redis.Message:
+			r.handleEvent(v)
+		case redis.Subscription:
+			if v.Count == 0 { // Unsubscribed when closing.
+				return nil
+			}
+			if v.Kind == "subscribe" {
+				// Changes before subscribed may be missed.
+				r.setDesync()
+				r.signal()
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (r *RedisRegistry) handleEvent(msg redis.Message) {
+	data := string(msg.Data)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if msg.Pattern == "" {
+		switch {
+		case strings.HasPrefix(data, redisEventNode):
+			r.dirtyNodes[data[len(redisEventNode):]] = struct{}{}
+		case strings.HasPrefix(data, redisEventService):
+			r.dirtyServices[data[len(redisEventService):]] = struct{}{}
+		default:
+			return
+		}
+		r.signal()
+		return
+	}
+
+	// Keyspace event. Data is key.
+	nodePrefix, svcPrefix := r.prefix+"{dig-node-", r.prefix+"{dig-service-"
+	switch {
+	case strings.HasPrefix(data, nodePrefix) && strings.HasSuffix(data, "}"):
+		r.dirtyNodes[data[len(nodePrefix):len(data)-1]] = struct{}{}
+	case strings.HasPrefix(data, svcPrefix):
+		matched := false
+		r.service.Range(func(k, v interface{}) bool {
+			if name, ok := k.(string); ok && strings.HasPrefix(data, svcPrefix+name+"-node") {
+				r.dirtyServices[name] = struct{}{}
+				matched = true
+			}
+			return true
+		})
+		if !matched {
+			return
+		}
+	default:
+		return
+	}
+	r.signal()
 }
 
 func (r *RedisRegistry) Node(name string) (*Node, error) {
@@ -206,14 +531,6 @@ func (r *RedisRegistry) getNode(notify func(*Notification), name string) *Node {
 	return node
 }
 
-func (r *RedisRegistry) Publish(node *Node) error {
-	if node == nil {
-		return ErrInvalidArguments
-	}
-	r.publish[node.Name] = node
-	return nil
-}
-
 // Visit all nodes focused on.
 func (r *RedisRegistry) VisitNodes(fn func(name string, node *Node) bool) {
 	var (
@@ -304,7 +621,8 @@ func updateMetadata(notify func(*Notification), node *Node, meta map[string]stri
 	}
 }
 
-func (r *RedisRegistry) resolveNodes(notify func(*Notification), conn redis.Conn) error {
+// resolveNodes loads metadata of nodes focused on. Only nodes in names are loaded if names is not nil.
+func (r *RedisRegistry) resolveNodes(notify func(*Notification), conn redis.Conn, names map[string]struct{}) error {
 	var (
 		err  error
 		meta map[string]string
@@ -317,10 +635,21 @@ func (r *RedisRegistry) resolveNodes(notify func(*Notification), conn redis.Conn
 				Event: EVENT_NODE_LOST,
 			})
 		}
+		r.VisitServices(func(_ string, svc Service) bool {
+			if entry, ok := svc.(*RedisServiceEntry); ok {
+				entry.lost.Delete(name)
+			}
+			return true
+		})
 	}
 	focusNames := make([]string, 0) // TODO: optimize.
 	focusNodes := make([]*Node, 0)
 	r.VisitNodes(func(name string, node *Node) bool {
+		if names != nil {
+			if _, ok := names[name]; !ok {
+				return true
+			}
+		}
 		keyName := r.prefix + "{dig-node-" + name + "}"
 		if err = conn.Send("EXISTS", keyName); err != nil {
 			return false
@@ -366,52 +695,19 @@ func (r *RedisRegistry) resolveNodes(notify func(*Notification), conn redis.Conn
 	return nil
 }
 
-func (r *RedisRegistry) publishNodes(conn redis.Conn) error {
-	var count uint = 0
-	var err error
-	for name, node := range r.publish {
-		if node != nil && node.Metadata != nil {
-			for k, v := range node.Metadata {
-				if err = conn.Send("HSET", r.prefix+"{dig-node-"+name+"}", k, v); err != nil {
-					return err
-				}
-				count++
-			}
-		}
-	}
-	if err = conn.Flush(); err != nil {
-		return err
-	}
-	for count > 0 {
-		if _, err = conn.Receive(); err != nil {
-			return err
-		}
-		count--
-	}
-	return nil
-}
-
-func (r *RedisRegistry) Close() {
-	r.redis = nil
-}
-
 type RedisServiceEntry struct {
-	name     string
-	nodes    sync.Map
-	publish  map[string]uint
+	name  string
+	nodes sync.Map
+	// Nodes removed for expiration, until EVENT_NODE_LOST is notified.
+	lost     sync.Map
 	registry *RedisRegistry
-
-	lock sync.Mutex
-	sig  *sync.Cond
 }
 
 func NewRedisServiceEntry(name string, registry *RedisRegistry) *RedisServiceEntry {
 	entry := &RedisServiceEntry{
 		name:     name,
-		publish:  make(map[string]uint),
 		registry: registry,
 	}
-	entry.sig = sync.NewCond(&entry.lock)
 	return entry
 }
 
@@ -427,8 +723,11 @@ func (s *RedisServiceEntry) VisitNodes(fn func(node string) bool) {
 
 func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (bool, error) {
 	count, updated := 0, false
-	removeNode := func(name string) {
+	removeNode := func(name string, expired bool) {
 		s.nodes.Delete(name)
+		if expired {
+			s.lost.Store(name, struct{}{})
+		}
 		if notify != nil {
 			notify(&Notification{
 				Event:   EVENT_SVC_NODE_LOST,
@@ -452,6 +751,7 @@ func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (b
 			if !ok {
 				updated = true
 				s.nodes.LoadOrStore(nodes[idx], struct{}{})
+				s.lost.Delete(nodes[idx])
 				if notify != nil {
 					notify(&Notification{
 						Event:   EVENT_SVC_NODE_FOUND,
@@ -485,7 +785,7 @@ func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (b
 			return updated, err
 		}
 		if !exists {
-			removeNode(focusNodes[idx])
+			removeNode(focusNodes[idx], true)
 			conn.Receive()
 			continue
 		}
@@ -493,7 +793,7 @@ func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (b
 		_, err = redis.Int64(conn.Receive())
 		if err != nil {
 			if err == redis.ErrNil {
-				removeNode(focusNodes[idx])
+				removeNode(focusNodes[idx], false)
 			} else {
 				return updated, err
 			}
@@ -509,27 +809,8 @@ func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (b
 			}
 			count--
 		}
-	}
-
-	// Publish
-	focusNodes = focusNodes[0:0]
-	for name, timeout := range s.publish {
-		focusNodes = append(focusNodes, name)
-		if timeout > 0 {
-			conn.Send("SET", s.registry.prefix+"{dig-service-"+s.name+"-node-"+name+"-present}", 1, "ex", timeout)
-		} else {
-			conn.Send("SET", s.registry.prefix+"{dig-service-"+s.name+"-node-"+name+"-present}", 1)
-		}
-		conn.Send("SADD", s.registry.prefix+"{dig-service-"+s.name+"-node}", name)
-	}
-	if err = conn.Flush(); err != nil {
-		return updated, err
-	}
-	for range focusNodes {
-		if _, err = conn.Receive(); err != nil {
-			return updated, err
-		}
-		if _, err = conn.Receive(); err != nil {
+		// Node leaves service.
+		if _, err = conn.Do("PUBLISH", s.registry.eventChannel(), redisEventService+s.name); err != nil {
 			return updated, err
 		}
 	}
@@ -540,9 +821,6 @@ func (s *RedisServiceEntry) poll(notify func(*Notification), conn redis.Conn) (b
 		return true
 	})
 
-	if updated {
-		s.sig.Broadcast()
-	}
 	return updated, nil
 }
 
@@ -559,17 +837,20 @@ func (s *RedisServiceEntry) Name() string {
 	return s.name
 }
 
-func (s *RedisServiceEntry) Watch() error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.sig.Wait()
-	return nil
+// Watch returns channel of notifications of service. All events are watched if events is empty.
+func (s *RedisServiceEntry) Watch(ctx context.Context, events ...uint) <-chan *Notification {
+	return s.registry.Watch(ctx, WatchFilter{
+		Service: s.name,
+		Events:  events,
+	})
 }
 
+// Publish node to service. See RedisRegistry.Publish.
 func (s *RedisServiceEntry) Publish(node *Node) error {
-	if node == nil {
-		return ErrInvalidArguments
-	}
-	s.publish[node.Name] = node.Timeout
-	return s.registry.Publish(node)
+	return s.registry.publish(s.name, node)
+}
+
+// Unpublish node from service. Node is still published to registry.
+func (s *RedisServiceEntry) Unpublish(name string) error {
+	return s.registry.unpublish(s.name, name)
 }
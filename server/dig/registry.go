@@ -1,9 +1,24 @@
 package dig
 
+import (
+	"context"
+	"time"
+)
+
 type Registry interface {
 	Service(name string) (Service, error)
 	Node(name string) (*Node, error)
 	Poll(func(*Notification)) (bool, error)
-	Close()
 	Publish(*Node) error
+	// Unpublish node and revoke its lease.
+	Unpublish(name string) error
+	// Close deregisters all nodes published.
+	Close() error
+
+	// Listen for changes notified by peers, with full synchronization once per resync period.
+	Listen(resync time.Duration) error
+	// Wait blocks until changes are notified, timeout or ctx is done.
+	Wait(ctx context.Context, timeout time.Duration) error
+	// Watch returns channel of notifications sent by Poll until ctx is done.
+	Watch(ctx context.Context, filter WatchFilter) <-chan *Notification
 }
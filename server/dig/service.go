@@ -1,8 +1,14 @@
 package dig
 
+import (
+	"context"
+)
+
 type Service interface {
 	Name() string
 	Nodes() []string
-	Watch() error
+	// Watch returns channel of notifications of service until ctx is done.
+	Watch(ctx context.Context, events ...uint) <-chan *Notification
 	Publish(node *Node) error
+	Unpublish(name string) error
 }
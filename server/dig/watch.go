@@ -0,0 +1,188 @@
+package dig
+
+import (
+	"context"
+	"github.com/Sunmxt/linker-im/log"
+	"sync"
+	"time"
+)
+
+// Notifications buffered in channel of each watcher. More are queued until received.
+const DEFAULT_WATCH_BUFFER = 64
+
+// Notifications queued for each watcher at most. More are dropped and registry is desynchronized.
+const DEFAULT_WATCH_QUEUE = 4096
+
+// WatchFilter selects notifications to watch. Zero value matches all.
+type WatchFilter struct {
+	// Only notifications of the service if not empty.
+	// Node events match if node is a member of service when notified.
+	// EVENT_NODE_LOST also matches services the node expired from.
+	Service string
+
+	// Only these events if not empty.
+	Events []uint
+}
+
+func (f *WatchFilter) matchEvent(event uint) bool {
+	if len(f.Events) < 1 {
+		return true
+	}
+	for _, e := range f.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type watcher struct {
+	ctx    context.Context
+	filter WatchFilter
+	ch     chan *Notification
+
+	// Notifications not yet received, so that dispatching never blocks.
+	lock  sync.Mutex
+	queue []*Notification
+	wake  chan struct{}
+}
+
+// send queues notification without blocking. False if queue is full and notification is dropped.
+func (w *watcher) send(notify *Notification) bool {
+	w.lock.Lock()
+	if len(w.queue) >= DEFAULT_WATCH_QUEUE {
+		w.lock.Unlock()
+		return false
+	}
+	w.queue = append(w.queue, notify)
+	w.lock.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next pops the earliest notification queued. nil if none.
+func (w *watcher) next() *Notification {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.queue) < 1 {
+		return nil
+	}
+	notify := w.queue[0]
+	w.queue[0] = nil
+	if w.queue = w.queue[1:]; len(w.queue) < 1 {
+		w.queue = nil
+	}
+	return notify
+}
+
+// run passes queued notifications to channel in order until ctx is done. Channel is closed then.
+func (w *watcher) run(h *watchHub) {
+	defer func() {
+		h.lock.Lock()
+		delete(h.watchers, w)
+		h.lock.Unlock()
+		close(w.ch)
+	}()
+	for {
+		notify := w.next()
+		if notify == nil {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		select {
+		case w.ch <- notify:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// watchHub dispatches notifications to watchers.
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+// watch returns channel of notifications matched by filter. Channel is closed when ctx is done.
+func (h *watchHub) watch(ctx context.Context, filter WatchFilter) <-chan *Notification {
+	w := &watcher{
+		ctx:    ctx,
+		filter: filter,
+		ch:     make(chan *Notification, DEFAULT_WATCH_BUFFER),
+		wake:   make(chan struct{}, 1),
+	}
+	h.lock.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	h.lock.Unlock()
+
+	go w.run(h)
+	return w.ch
+}
+
+func (h *watchHub) empty() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.watchers) < 1
+}
+
+// dispatch notification to watchers whose filter matches. Notifications are queued for watchers not ready.
+// False if dropped by any watcher with queue full.
+func (h *watchHub) dispatch(notify *Notification, match func(*WatchFilter, *Notification) bool) bool {
+	h.lock.Lock()
+	targets := make([]*watcher, 0, len(h.watchers))
+	for w := range h.watchers {
+		if match(&w.filter, notify) {
+			targets = append(targets, w)
+		}
+	}
+	h.lock.Unlock()
+	if len(targets) < 1 {
+		return true
+	}
+	snapshot, sent := notify.snapshot(), true
+	for _, w := range targets {
+		if !w.send(snapshot) {
+			sent = false
+		}
+	}
+	return sent
+}
+
+// snapshot copies notification, so that watchers read metadata of node without racing with polling.
+func (n *Notification) snapshot() *Notification {
+	copied := *n
+	if n.Node != nil {
+		node := *n.Node
+		if n.Node.Metadata != nil {
+			node.Metadata = make(map[string]string, len(n.Node.Metadata))
+			for k, v := range n.Node.Metadata {
+				node.Metadata[k] = v
+			}
+		}
+		copied.Node = &node
+	}
+	return &copied
+}
+
+// Sync polls registry until ctx is done, so that watchers are notified.
+// Registry is polled at least once per period.
+func Sync(ctx context.Context, reg Registry, period time.Duration) error {
+	for {
+		if _, err := reg.Poll(nil); err != nil && ctx.Err() == nil {
+			log.Error("Dig polling failure: " + err.Error())
+		}
+		if err := reg.Wait(ctx, period); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package dig
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testReceive(t *testing.T, ch <-chan *Notification) *Notification {
+	select {
+	case notify := <-ch:
+		return notify
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+	return nil
+}
+
+func testClosed(t *testing.T, ch <-chan *Notification) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+// Dispatching never blocks on watchers not ready. Notifications are received in order.
+func TestWatchSlowWatcher(t *testing.T) {
+	var h watchHub
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := h.watch(ctx, WatchFilter{})
+
+	count := DEFAULT_WATCH_BUFFER * 4
+	dispatched := make(chan struct{})
+	go func() {
+		for idx := 0; idx < count; idx++ {
+			h.dispatch(&Notification{Event: EVENT_NODE_FOCUS, Node: &Node{Timeout: uint(idx)}}, func(*WatchFilter, *Notification) bool {
+				return true
+			})
+		}
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatching blocked by watcher not ready")
+	}
+	for idx := 0; idx < count; idx++ {
+		if notify := testReceive(t, ch); notify.Node.Timeout != uint(idx) {
+			t.Fatalf("expected notification %v, got %v", idx, notify.Node.Timeout)
+		}
+	}
+}
+
+func TestWatchCanceled(t *testing.T) {
+	var h watchHub
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := h.watch(ctx, WatchFilter{})
+	h.dispatch(&Notification{Event: EVENT_NODE_FOCUS}, func(*WatchFilter, *Notification) bool { return true })
+	cancel()
+	testClosed(t, ch)
+	if !h.empty() {
+		t.Fatal("watcher not removed after canceled")
+	}
+	// Dispatching to nobody.
+	h.dispatch(&Notification{Event: EVENT_NODE_FOCUS}, func(*WatchFilter, *Notification) bool { return true })
+}
+
+// Watchers receive copies of metadata.
+func TestWatchSnapshot(t *testing.T) {
+	var h watchHub
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := h.watch(ctx, WatchFilter{})
+	node := &Node{Name: "n1", Metadata: map[string]string{"k": "v1"}}
+	h.dispatch(&Notification{Event: EVENT_NODE_METADATA_KEY_ADD, Name: "k", Node: node}, func(*WatchFilter, *Notification) bool {
+		return true
+	})
+	node.Metadata["k"] = "v2"
+	if notify := testReceive(t, ch); notify.Node == node || notify.Node.Metadata["k"] != "v1" {
+		t.Fatalf("expected snapshot of metadata, got %v", notify.Node.Metadata)
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	r := &RedisRegistry{}
+	entry := NewRedisServiceEntry("svc", r)
+	entry.nodes.Store("n1", struct{}{})
+	r.service.Store("svc", entry)
+	other := NewRedisServiceEntry("other", r)
+	r.service.Store("other", other)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := r.Watch(ctx, WatchFilter{})
+	svc := entry.Watch(ctx)
+	lost := r.Watch(ctx, WatchFilter{Events: []uint{EVENT_NODE_LOST, EVENT_SVC_NODE_LOST}})
+
+	notifications := []*Notification{
+		{Event: EVENT_SVC_NODE_FOUND, Name: "n1", Service: entry},
+		{Event: EVENT_SVC_NODE_LOST, Name: "n2", Service: other},
+		{Event: EVENT_SERVICE_FOUND, Name: "svc"},
+		{Event: EVENT_NODE_METADATA_KEY_ADD, Name: "k", Node: &Node{Name: "n1"}},
+		{Event: EVENT_NODE_METADATA_KEY_ADD, Name: "k", Node: &Node{Name: "n2"}},
+		{Event: EVENT_NODE_LOST, Name: "n1"},
+	}
+	notify := r.notifier(nil)
+	for _, n := range notifications {
+		notify(n)
+	}
+
+	for name, c := range map[string]struct {
+		ch       <-chan *Notification
+		expected []int
+	}{
+		"all":     {all, []int{0, 1, 2, 3, 4, 5}},
+		"service": {svc, []int{0, 2, 3, 5}},
+		"events":  {lost, []int{1, 5}},
+	} {
+		for _, idx := range c.expected {
+			if n, expected := testReceive(t, c.ch), notifications[idx]; n.Event != expected.Event || n.Name != expected.Name {
+				t.Fatalf("%v: expected %+v, got %+v", name, expected, n)
+			}
+		}
+		select {
+		case n := <-c.ch:
+			t.Fatalf("%v: unexpected %+v", name, n)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	cancel()
+	testClosed(t, all)
+}
+
+func TestWatchMatchService(t *testing.T) {
+	r := &RedisRegistry{}
+	entry := NewRedisServiceEntry("svc", r)
+	entry.nodes.Store("n1", struct{}{})
+	entry.lost.Store("n2", struct{}{})
+	r.service.Store("svc", entry)
+	other := NewRedisServiceEntry("other", r)
+	other.nodes.Store("n3", struct{}{})
+	r.service.Store("other", other)
+
+	cases := []struct {
+		name     string
+		filter   WatchFilter
+		notify   *Notification
+		expected bool
+	}{
+		{"service event", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_SVC_NODE_FOUND, Name: "n1", Service: entry}, true},
+		{"other service event", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_SVC_NODE_LOST, Name: "n3", Service: other}, false},
+		{"service found", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_SERVICE_FOUND, Name: "svc"}, true},
+		{"other service lost", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_SERVICE_LOST, Name: "other"}, false},
+		{"member metadata", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_METADATA_KEY_ADD, Name: "k", Node: &Node{Name: "n1"}}, true},
+		{"other metadata", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_METADATA_KEY_ADD, Name: "k", Node: &Node{Name: "n3"}}, false},
+		{"member lost", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_LOST, Name: "n1"}, true},
+		{"expired member lost", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_LOST, Name: "n2"}, true},
+		{"expired member metadata", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_METADATA_KEY_DEL, Name: "k", Node: &Node{Name: "n2"}}, false},
+		{"other lost", WatchFilter{Service: "svc"}, &Notification{Event: EVENT_NODE_LOST, Name: "n3"}, false},
+		{"lost of other event", WatchFilter{Service: "svc", Events: []uint{EVENT_SVC_NODE_LOST}}, &Notification{Event: EVENT_NODE_LOST, Name: "n1"}, false},
+		{"unknown service", WatchFilter{Service: "none"}, &Notification{Event: EVENT_NODE_LOST, Name: "n1"}, false},
+	}
+	for _, c := range cases {
+		if matched := r.match(&c.filter, c.notify); matched != c.expected {
+			t.Errorf("%v: expected match %v, got %v", c.name, c.expected, matched)
+		}
+	}
+}
+
+// Expired node stays matched by its services until lost is notified.
+func TestWatchNodeLostOfService(t *testing.T) {
+	r := &RedisRegistry{}
+	entry := NewRedisServiceEntry("svc", r)
+	r.service.Store("svc", entry)
+	r.nodes.Store("n1", NewEmptyNode("n1"))
+	entry.lost.Store("n1", struct{}{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := entry.Watch(ctx, EVENT_NODE_LOST)
+	notify := r.notifier(nil)
+	notify(&Notification{Event: EVENT_NODE_LOST, Name: "n1"})
+	if n := testReceive(t, ch); n.Name != "n1" {
+		t.Fatalf("expected lost of n1, got %+v", n)
+	}
+}
+
+// Notifications over queue limit are dropped, and registry synchronizes all on next poll.
+func TestWatchQueueOverflow(t *testing.T) {
+	r := &RedisRegistry{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := r.Watch(ctx, WatchFilter{})
+	notify := r.notifier(nil)
+
+	// Held by channel buffer, queue and watcher passing one to channel.
+	limit := DEFAULT_WATCH_BUFFER + DEFAULT_WATCH_QUEUE + 1
+	for idx := 0; idx <= limit; idx++ {
+		notify(&Notification{Event: EVENT_NODE_FOCUS, Node: &Node{Timeout: uint(idx)}})
+	}
+	r.lock.Lock()
+	desync := r.desync
+	r.lock.Unlock()
+	if !desync {
+		t.Fatal("registry not desynchronized after watcher overflowed")
+	}
+	received := 0
+	for {
+		select {
+		case n := <-ch:
+			if n.Node.Timeout != uint(received) {
+				t.Fatalf("expected notification %v, got %v", received, n.Node.Timeout)
+			}
+			received++
+			continue
+		case <-time.After(20 * time.Millisecond):
+		}
+		break
+	}
+	if received < DEFAULT_WATCH_QUEUE || received > limit {
+		t.Fatalf("%v notifications received, expected %v to %v", received, DEFAULT_WATCH_QUEUE, limit)
+	}
+}
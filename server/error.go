@@ -1,5 +1,17 @@
 package server
 
+import (
+	"context"
+	"errors"
+	"github.com/Sunmxt/linker-im/utils/pool"
+	"net"
+	"net/rpc"
+	"strings"
+)
+
+// Prefix of errors replied for invalid requests, so that callers tell them from failures of node.
+const REQUEST_ERROR_PREFIX = "(request) "
+
 type AuthError struct {
 	Origin error
 }
@@ -16,3 +28,55 @@ func IsAuthError(err error) bool {
 	_, ok := err.(AuthError)
 	return ok
 }
+
+// RequestError is error caused by invalid request rather than failure of node.
+type RequestError struct {
+	Origin error
+}
+
+// ReplyRequestError marks err replied by RPC method as RequestError to callers.
+func ReplyRequestError(err error) error {
+	return errors.New(REQUEST_ERROR_PREFIX + err.Error())
+}
+
+func (err RequestError) Error() string {
+	return err.Origin.Error()
+}
+
+func IsRequestError(err error) bool {
+	_, ok := err.(RequestError)
+	return ok
+}
+
+// ReplyTimeoutError is returned when deadline of caller expires after request is written to node.
+type ReplyTimeoutError struct {
+	Origin error
+}
+
+func (err ReplyTimeoutError) Error() string {
+	return err.Origin.Error()
+}
+
+func (err ReplyTimeoutError) Timeout() bool {
+	return true
+}
+
+// replyError converts errors marked by ReplyRequestError.
+func replyError(err error) error {
+	if serverErr, ok := err.(rpc.ServerError); ok && strings.HasPrefix(string(serverErr), REQUEST_ERROR_PREFIX) {
+		return RequestError{Origin: errors.New(strings.TrimPrefix(string(serverErr), REQUEST_ERROR_PREFIX))}
+	}
+	return err
+}
+
+// IsTimeoutError reports whether err is caused by elapsed deadline.
+func IsTimeoutError(err error) bool {
+	if err == context.DeadlineExceeded || err == pool.ErrWaitTimeout {
+		return true
+	}
+	if _, ok := err.(ReplyTimeoutError); ok {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -2,6 +2,7 @@ package gate
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
@@ -10,6 +11,7 @@ import (
 	gmux "github.com/gorilla/mux"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // API
@@ -24,27 +26,27 @@ func EntityList(w http.ResponseWriter, req *http.Request) {
 	entity, ok := vars["entity"]
 	if !ok {
 		ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "Variable \"entity\" not found.")
+		return
+	}
+	_, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return
 	}
 	defer func() {
 		if err != nil {
-			if authErr, isAuthErr := err.(server.AuthError); !isAuthErr {
-				log.Error("RPC Error: " + err.Error())
-				ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "(rpc failure) "+err.Error())
-			} else {
-				ctx.ResponseError(proto.ACCESS_DEINED, authErr.Error())
-			}
+			ctx.ResponseRPCError(err)
 		}
 	}()
-	if client, err = ctx.BeginRPC(); err != nil {
+	if client, err = ctx.BeginRPC(LB_OP_ENTITY); err != nil {
 		return
 	}
 	switch entity {
 	case "namespace":
-		ctx.Data, err = client.ListNamespace()
+		ctx.Data, err = client.ListNamespace(ctx.Context(), ctx.Namespace, session)
 	case "user":
-		ctx.Data, err = client.ListUser(ctx.Namespace)
+		ctx.Data, err = client.ListUser(ctx.Context(), ctx.Namespace, session)
 	case "group":
-		ctx.Data, err = client.ListGroup(ctx.Namespace)
+		ctx.Data, err = client.ListGroup(ctx.Context(), ctx.Namespace, session)
 	}
 	ctx.EndRPC(err)
 	if err != nil {
@@ -66,37 +68,36 @@ func EntityAlter(w http.ResponseWriter, req *http.Request) {
 		ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "Variable \"entity\" not found.")
 		return
 	}
+	_, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return
+	}
 	defer func() {
 		if err != nil {
-			if authErr, isAuthErr := err.(server.AuthError); !isAuthErr {
-				log.Error("RPC Error: " + err.Error())
-				ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "(rpc failure) "+err.Error())
-			} else {
-				ctx.ResponseError(proto.ACCESS_DEINED, authErr.Error())
-			}
+			ctx.ResponseRPCError(err)
 		}
 	}()
-	if client, err = ctx.BeginRPC(); err != nil {
+	if client, err = ctx.BeginRPC(LB_OP_ENTITY); err != nil {
 		return
 	}
 	switch entity {
 	case "namespace":
 		if req.Method == "POST" {
-			err = client.AddNamespace(ireq.Entities)
+			err = client.AddNamespace(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		} else {
-			err = client.DeleteNamespace(ireq.Entities)
+			err = client.DeleteNamespace(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		}
 	case "user":
 		if req.Method == "POST" {
-			err = client.AddUser(ctx.Namespace, ireq.Entities)
+			err = client.AddUser(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		} else {
-			err = client.DeleteUser(ctx.Namespace, ireq.Entities)
+			err = client.DeleteUser(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		}
 	case "group":
 		if req.Method == "POST" {
-			err = client.AddGroup(ctx.Namespace, ireq.Entities)
+			err = client.AddGroup(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		} else {
-			err = client.DeleteGroup(ctx.Namespace, ireq.Entities)
+			err = client.DeleteGroup(ctx.Context(), ctx.Namespace, session, ireq.Entities)
 		}
 	}
 	ctx.EndRPC(err)
@@ -130,13 +131,8 @@ func PushMessage(w http.ResponseWriter, req *http.Request) {
 				ireq.Msgs[idx].Raw = string(bin)
 			}
 		}
-		if ctx.Data, err = gate.push(ctx.Namespace, session, ireq.Msgs); err != nil {
-			if authErr, isAuthErr := err.(server.AuthError); !isAuthErr {
-				log.Error("RPC Error: " + err.Error())
-				ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "(rpc failure) "+err.Error())
-			} else {
-				ctx.ResponseError(proto.ACCESS_DEINED, authErr.Error())
-			}
+		if ctx.Data, err = gate.push(ctx.Context(), ctx.TraceContext(), ctx.Namespace, session, ireq.Msgs); err != nil {
+			ctx.ResponseRPCError(err)
 			return
 		}
 	}
@@ -150,6 +146,7 @@ func PullMessage(w http.ResponseWriter, req *http.Request) {
 		conn     *Connection
 		msg      []proto.Message
 	)
+	start := time.Now()
 
 	ctx, err := NewRequestContext(w, req, nil)
 	if err != nil {
@@ -172,6 +169,10 @@ func PullMessage(w http.ResponseWriter, req *http.Request) {
 	if enc, usr, err = ctx.ParseAndGetMessagingClientTuple(); err != nil {
 		return
 	}
+	ackMode, ack, err := ctx.ParseAck(false)
+	if err != nil {
+		return
+	}
 
 	if ctx.EnableTimeout {
 		timeout = int(ctx.Timeout)
@@ -179,7 +180,7 @@ func PullMessage(w http.ResponseWriter, req *http.Request) {
 		timeout = -1
 	}
 
-	if conn, err = gate.hubConnect(ctx.Namespace+"."+usr, ConnectMetadata{
+	if conn, err = gate.hubConnect(ctx.Context(), ctx.Namespace, usr, ConnectMetadata{
 		Proto:   PROTO_HTTP,
 		Remote:  req.RemoteAddr,
 		Timeout: timeout,
@@ -192,19 +193,34 @@ func PullMessage(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
+	if err = gate.refreshSession(ctx.Context(), conn, ctx.Namespace, usr); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
 	if bulk > 0 {
 		msg = make([]proto.Message, 0, bulk)
 	} else {
 		msg = make([]proto.Message, 0, 1)
 	}
 
-	msg = conn.Receive(msg, bulk, bulk, timeout)
-	resp := make([]interface{}, 0, len(msg))
-	if enc == "b64" {
-		for idx := range msg {
-			msg[idx].MessageBody.Raw = base64.StdEncoding.EncodeToString([]byte(msg[idx].MessageBody.Raw))
+	if ackMode {
+		var cursor uint64
+		conn.Ack(ack)
+		msg, cursor = conn.ReceiveAcked(msg, bulk, bulk, timeout, gate.Hub.AckTimeout)
+		metricPullSeconds.With("true").ObserveSince(start)
+		ctx.Data = &proto.MessagePullV1{
+			Cursor: cursor,
+			Msgs:   encodeMessages(enc, msg),
 		}
+		ctx.ResponseError(proto.SUCCEED, "")
+		return
 	}
+
+	msg = conn.Receive(msg, bulk, bulk, timeout)
+	metricPullSeconds.With("false").ObserveSince(start)
+	resp := make([]interface{}, 0, len(msg))
+	msg = encodeMessages(enc, msg)
 	for idx := range msg {
 		resp = append(resp, msg[idx])
 	}
@@ -212,6 +228,73 @@ func PullMessage(w http.ResponseWriter, req *http.Request) {
 	ctx.ResponseError(proto.SUCCEED, "")
 }
 
+// ParseAck parses cursor to acknowledge.
+// At-least-once delivery is enabled when "ack" is present. Empty "ack" acknowledges nothing.
+func (ctx *APIRequestContext) ParseAck(required bool) (bool, uint64, error) {
+	raw, ok := ctx.Req.Form["ack"]
+	if !ok || len(raw) < 1 {
+		if required {
+			msg := "Cursor missing."
+			ctx.ResponseError(proto.INVALID_ARGUMENT, msg)
+			return false, 0, errors.New(msg)
+		}
+		return false, 0, nil
+	}
+	if raw[0] == "" {
+		return true, 0, nil
+	}
+	cursor, err := strconv.ParseUint(raw[0], 10, 64)
+	if err != nil {
+		ctx.ResponseError(proto.INVALID_ARGUMENT, "Invalid cursor \""+raw[0]+"\".")
+		return false, 0, err
+	}
+	return true, cursor, nil
+}
+
+func AckMessage(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	_, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return
+	}
+	_, ack, err := ctx.ParseAck(true)
+	if err != nil {
+		return
+	}
+	conn, err := gate.hubConnect(ctx.Context(), ctx.Namespace, session, ConnectMetadata{
+		Proto:   PROTO_HTTP,
+		Remote:  req.RemoteAddr,
+		Timeout: -1,
+	})
+	if err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	conn.Ack(ack)
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+// Encode messages for client. msgs is not modified, so that messages can be requeued if not delivered.
+func encodeMessages(enc string, msgs []proto.Message) []proto.Message {
+	if enc != "b64" {
+		return msgs
+	}
+	encoded := make([]proto.Message, len(msgs))
+	for idx := range msgs {
+		// Message bodies are shared by connections. Encode copies.
+		body := *msgs[idx].MessageBody
+		body.Raw = base64.StdEncoding.EncodeToString([]byte(body.Raw))
+		encoded[idx] = msgs[idx]
+		encoded[idx].MessageBody = &body
+	}
+	return encoded
+}
+
 func Subscribe(w http.ResponseWriter, req *http.Request) {
 	var sub proto.Subscription
 	ctx, err := NewRequestContext(w, req, &sub)
@@ -225,13 +308,10 @@ func Subscribe(w http.ResponseWriter, req *http.Request) {
 		sub.Op = proto.OP_SUB_CANCEL
 	}
 	sub.Namespace = ctx.Namespace
-	if err = gate.subscribe(sub); err != nil {
-		if !server.IsAuthError(err) {
-			log.Error("RPC Error: " + err.Error())
-			ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "(rpc failure) "+err.Error())
-		} else {
-			ctx.ResponseError(proto.ACCESS_DEINED, err.Error())
-		}
+	sub.Trace = ctx.TraceContext()
+	if err = gate.subscribe(ctx.Context(), sub); err != nil {
+		ctx.ResponseRPCError(err)
+		return
 	}
 	ctx.ResponseError(proto.SUCCEED, "")
 }
@@ -244,18 +324,34 @@ func Connect(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	conn.Namespace = ctx.Namespace
-	if result, err = gate.connect(&conn); err != nil {
-		if !server.IsAuthError(err) {
-			log.Error("RPC Error: " + err.Error())
-			ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "(rpc failure) "+err.Error())
-		} else {
-			ctx.ResponseError(proto.ACCESS_DEINED, err.Error())
-		}
+	conn.Trace = ctx.TraceContext()
+	if result, err = gate.connect(ctx.Context(), &conn); err != nil {
+		ctx.ResponseRPCError(err)
+		return
 	}
 	ctx.Data = result
 	ctx.ResponseError(proto.SUCCEED, "")
 }
 
+// Disconnect revokes session.
+func Disconnect(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	_, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return
+	}
+	if err = gate.disconnect(ctx.Context(), ctx.Namespace, session); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
 func (g *Gate) InitHTTP() error {
 	g.Router = gmux.NewRouter()
 
@@ -267,17 +363,34 @@ func (g *Gate) InitHTTP() error {
 	g.Router.HandleFunc("/v1/msg", PullMessage).Methods("GET")
 	g.Router.HandleFunc("/v1/msg", PushMessage).Methods("POST")
 
+	log.Info0("Register HTTP endpoint \"/v1/msg/ack\"")
+	g.Router.HandleFunc("/v1/msg/ack", AckMessage).Methods("POST")
+
+	log.Info0("Register Server-Sent Events endpoint \"/v1/msg/stream\"")
+	g.Router.HandleFunc("/v1/msg/stream", StreamMessage).Methods("GET")
+
+	log.Info0("Register HTTP endpoint \"/v1/history\", \"/v1/history/check\"")
+	g.Router.HandleFunc("/v1/history", History).Methods("GET")
+	g.Router.HandleFunc("/v1/history/check", HistoryCheck).Methods("GET")
+
+	log.Info0("Register HTTP endpoint \"/v1/presence\"")
+	g.Router.HandleFunc("/v1/presence", Presence).Methods("GET")
+
 	log.Info0("Register HTTP endpoint \"/v1/sub\"")
 	g.Router.HandleFunc("/v1/sub", Subscribe).Methods("POST", "DELETE")
 
 	log.Info0("Register HTTP endpoint \"/v1/connect\"")
 	g.Router.HandleFunc("/v1/connect", Connect).Methods("POST")
+	g.Router.HandleFunc("/v1/connect", Disconnect).Methods("DELETE")
+
+	log.Info0("Register WebSocket endpoint \"/v1/ws\"")
+	g.Router.HandleFunc("/v1/ws", WebSocket).Methods("GET")
 
 	return nil
 }
 
 func (g *Gate) ServeHTTP() {
-	log.Infof0("Create HTTP Server. Endpoint is \"" + g.config.APIEndpoint.String() + "\"")
+	log.Info0("Create HTTP Server. Endpoint is \"" + g.config.APIEndpoint.String() + "\"")
 	g.HTTP = &http.Server{
 		Addr: g.config.APIEndpoint.String(),
 		Handler: log.TagLogHandler(g.Router, map[string]interface{}{
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	config "github.com/Sunmxt/linker-im/config"
 	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/utils/cmdline"
 	yaml "gopkg.in/yaml.v2"
 	"io/ioutil"
+	"strings"
 )
 
 type GatewayOptions struct {
@@ -17,15 +19,30 @@ type GatewayOptions struct {
 
 	ManageEndpoint *cmdline.NetEndpointValue
 
+	// Token required by management API.
+	// Management API is disabled when empty.
+	AdminToken *cmdline.StringValue
+
 	// Endpoint to bind and serve HTTP API.
 	APIEndpoint *cmdline.NetEndpointValue
 
+	// Endpoint to bind and serve binary TCP protocol.
+	// Binary protocol is disabled when empty.
+	TCPEndpoint *cmdline.NetEndpointValue
+
+	// Endpoint to bind and serve MQTT 3.1.1.
+	// MQTT is disabled when empty.
+	MQTTEndpoint *cmdline.NetEndpointValue
+
 	// RPC Bind endpoint.
 	RPCEndpoint *cmdline.NetEndpointValue
 
 	// RPC Publish endpoint.
 	RPCPublishEndpoint *cmdline.NetEndpointValue
 
+	// Codec of RPC served by gate. Advertised to services.
+	RPCCodec *cmdline.StringValue
+
 	// Redis endpoint.
 	RedisEndpoint *cmdline.NetEndpointValue
 
@@ -35,6 +52,12 @@ type GatewayOptions struct {
 	// Redis pool maximum idle connections.
 	RedisPoolIdleMax *cmdline.UintValue
 
+	// Discover node changes by redis notifications instead of polling.
+	DigNotify *cmdline.BoolValue
+
+	// Seconds between full synchronization of discovery when notified.
+	DigResync *cmdline.UintValue
+
 	// Redis pool maximum active connections.
 	RedisPoolActiveMax *cmdline.UintValue
 
@@ -47,6 +70,22 @@ type GatewayOptions struct {
 	// List of service endpoints.
 	//ServiceEndpoints *cmdline.NetEndpointSetValue
 
+	// Virtual points of each service node on hash ring.
+	HashReplicas *cmdline.UintValue
+
+	// Percent over average key share a service node may own.
+	// Load is not bounded when 0.
+	HashLoadBound *cmdline.UintValue
+
+	// Load balancing strategy of service calls.
+	LBStrategy *cmdline.StringValue
+
+	// Strategies of connecting, subscribing and entity administration.
+	// LBStrategy is used when empty.
+	LBConnect   *cmdline.StringValue
+	LBSubscribe *cmdline.StringValue
+	LBEntity    *cmdline.StringValue
+
 	// Period to check state of service endpoint.
 	// Unhealthy endpoints will be disable automatically.
 	KeepalivePeriod *cmdline.UintValue
@@ -59,9 +98,19 @@ type GatewayOptions struct {
 	// Active time.
 	ActiveTimeout *cmdline.UintValue
 
+	// Milliseconds to wait for acknowledgement before redelivering messages.
+	AckTimeout *cmdline.UintValue
+
+	// Seconds without client activity before presence becomes idle.
+	PresenceIdle *cmdline.UintValue
+
 	// Debug mode
 	// More information will be reported to clients when debug mode is on.
 	DebugMode *cmdline.BoolValue
+
+	// File to export trace spans to, or "stdout".
+	// Tracing is disabled when empty.
+	TraceExport *cmdline.StringValue
 }
 
 func (options *GatewayOptions) SetDefaultFromConfigure(cfg *config.GatewayConfigure) error {
@@ -74,6 +123,10 @@ func (options *GatewayOptions) SetDefaultFromConfigure(cfg *config.GatewayConfig
 		}
 	}
 
+	if options.AdminToken.IsDefault && cfg.Manage.Token != "" {
+		options.AdminToken.Value = cfg.Manage.Token
+	}
+
 	if options.APIEndpoint.IsDefault && cfg.HTTPConfig.Endpoint != "" {
 		if err := options.APIEndpoint.Set(cfg.HTTPConfig.Endpoint); err != nil {
 			return err
@@ -89,18 +142,64 @@ func (options *GatewayOptions) SetDefaultFromConfigure(cfg *config.GatewayConfig
 	//		options.ServiceEndpoints.Endpoints[k] = ep
 	//	}
 	//}
+	if options.TCPEndpoint.IsDefault && cfg.TCPConfig.Endpoint != "" {
+		if err := options.TCPEndpoint.Set(cfg.TCPConfig.Endpoint); err != nil {
+			return err
+		}
+	}
+	if options.MQTTEndpoint.IsDefault && cfg.MQTTConfig.Endpoint != "" {
+		if err := options.MQTTEndpoint.Set(cfg.MQTTConfig.Endpoint); err != nil {
+			return err
+		}
+	}
 	if options.KeepalivePeriod.IsDefault {
 		options.KeepalivePeriod.Value = cfg.SVCConfig.KeepalivePeriod
 	}
+	if options.HashReplicas.IsDefault && cfg.SVCConfig.HashReplicas > 0 {
+		options.HashReplicas.Value = cfg.SVCConfig.HashReplicas
+	}
+	if options.HashLoadBound.IsDefault {
+		options.HashLoadBound.Value = cfg.SVCConfig.HashLoadBound
+	}
+	if options.LBStrategy.IsDefault && cfg.SVCConfig.LBStrategy != "" {
+		options.LBStrategy.Value = cfg.SVCConfig.LBStrategy
+	}
+	if options.LBConnect.IsDefault && cfg.SVCConfig.LBConnect != "" {
+		options.LBConnect.Value = cfg.SVCConfig.LBConnect
+	}
+	if options.LBSubscribe.IsDefault && cfg.SVCConfig.LBSubscribe != "" {
+		options.LBSubscribe.Value = cfg.SVCConfig.LBSubscribe
+	}
+	if options.LBEntity.IsDefault && cfg.SVCConfig.LBEntity != "" {
+		options.LBEntity.Value = cfg.SVCConfig.LBEntity
+	}
 	if options.DebugMode.IsDefault {
 		options.DebugMode.Value = cfg.Debug
 	}
+	if options.RPCCodec.IsDefault && cfg.RPCCodec != "" {
+		options.RPCCodec.Value = cfg.RPCCodec
+	}
+	if options.TraceExport.IsDefault && cfg.TraceExport != "" {
+		options.TraceExport.Value = cfg.TraceExport
+	}
 	if options.RedisPrefix.IsDefault {
 		options.RedisPrefix.Value = cfg.RedisPrefix
 	}
+	if options.DigNotify.IsDefault {
+		options.DigNotify.Value = cfg.DigNotify
+	}
+	if options.DigResync.IsDefault && cfg.DigResync > 0 {
+		options.DigResync.Value = cfg.DigResync
+	}
 	if options.ActiveTimeout.IsDefault {
 		options.ActiveTimeout.Value = cfg.HTTPConfig.ActiveTime
 	}
+	if options.AckTimeout.IsDefault && cfg.HTTPConfig.AckTimeout > 0 {
+		options.AckTimeout.Value = cfg.HTTPConfig.AckTimeout
+	}
+	if options.PresenceIdle.IsDefault && cfg.PresenceIdle > 0 {
+		options.PresenceIdle.Value = cfg.PresenceIdle
+	}
 	return nil
 }
 
@@ -126,12 +225,33 @@ func (options *GatewayOptions) SetDefault() error {
 	if options.KeepalivePeriod.Value == 0 {
 		return fmt.Errorf("Keepalive period should not be %v. (See \"-keepalive-period\")", options.RedisEndpoint.Port)
 	}
+	if options.HashReplicas.Value == 0 {
+		return errors.New("Hash replicas should not be 0. (See \"-hash-replicas\")")
+	}
+	strategies := []*cmdline.StringValue{options.LBStrategy, options.LBConnect, options.LBSubscribe, options.LBEntity}
+	for idx, flagName := range []string{"lb-strategy", "lb-connect", "lb-subscribe", "lb-entity"} {
+		if strategies[idx].Value == "" {
+			strategies[idx].Value = options.LBStrategy.Value
+		}
+		if !IsLBStrategy(strategies[idx].Value) {
+			return fmt.Errorf("Unknown load balancing strategy \"%v\". Supported strategies: %v. (See \"-%v\")", strategies[idx].Value, strings.Join(LBStrategies, ", "), flagName)
+		}
+	}
 	if options.RedisEndpoint.Scheme == "" {
 		options.RedisEndpoint.Scheme = "tcp"
 	}
 	if options.RPCEndpoint.Scheme == "" {
 		options.RPCEndpoint.Scheme = "tcp"
 	}
+	if server.GetRPCCodec(options.RPCCodec.Value) == nil {
+		return fmt.Errorf("Unknown RPC codec \"%v\". Supported codecs: %v. (See \"-rpc-codec\")", options.RPCCodec.Value, strings.Join(server.RPCCodecNames(), ", "))
+	}
+	if options.TCPEndpoint.String() != "" && options.TCPEndpoint.Scheme == "" {
+		options.TCPEndpoint.Scheme = "tcp"
+	}
+	if options.MQTTEndpoint.String() != "" && options.MQTTEndpoint.Scheme == "" {
+		options.MQTTEndpoint.Scheme = "tcp"
+	}
 	if options.RPCPublishEndpoint.Host == "localhost" || options.RPCPublishEndpoint.Host == "127.0.0.1" {
 		log.Warn("RPC publish a local address: " + options.RPCPublishEndpoint.String())
 	}
@@ -140,7 +260,7 @@ func (options *GatewayOptions) SetDefault() error {
 
 func configureParse() (*GatewayOptions, error) {
 	var err error = nil
-	var api_endpoint, manage_endpoint, redis_endpoint, rpcBind, rpcPub *cmdline.NetEndpointValue
+	var api_endpoint, manage_endpoint, redis_endpoint, rpcBind, rpcPub, tcpEndpoint, mqttEndpoint *cmdline.NetEndpointValue
 	//var serviceEndpoints *cmdline.NetEndpointSetValue
 
 	if manage_endpoint, err = cmdline.NewNetEndpointValueDefault([]string{"tcp", "http", "https"}, "127.0.0.1:12361"); err != nil {
@@ -151,6 +271,14 @@ func configureParse() (*GatewayOptions, error) {
 		log.Panicf("Flag value creating failure: %v", err.Error())
 		return nil, err
 	}
+	if tcpEndpoint, err = cmdline.NewNetEndpointValueDefault([]string{"tcp"}, ""); err != nil {
+		log.Panicf("Flag value creating failure: %v", err.Error())
+		return nil, err
+	}
+	if mqttEndpoint, err = cmdline.NewNetEndpointValueDefault([]string{"tcp"}, ""); err != nil {
+		log.Panicf("Flag value creating failure: %v", err.Error())
+		return nil, err
+	}
 	if redis_endpoint, err = cmdline.NewNetEndpointValueDefault([]string{"tcp"}, ""); err != nil {
 		log.Panicf("Flag value creating failure: %v", err.Error())
 		return nil, err
@@ -172,19 +300,34 @@ func configureParse() (*GatewayOptions, error) {
 		ExternalConfig:  cmdline.NewStringValue(),
 		LogLevel:        cmdline.NewUintValueDefault(0),
 		KeepalivePeriod: cmdline.NewUintValueDefault(10),
+		HashReplicas:    cmdline.NewUintValueDefault(server.DEFAULT_HASHRING_REPLICAS),
+		HashLoadBound:   cmdline.NewUintValueDefault(0),
+		LBStrategy:      cmdline.NewStringValueDefault(LB_ROUND_ROBIN),
+		LBConnect:       cmdline.NewStringValue(),
+		LBSubscribe:     cmdline.NewStringValue(),
+		LBEntity:        cmdline.NewStringValue(),
 		ManageEndpoint:  manage_endpoint,
+		AdminToken:      cmdline.NewStringValue(),
 		APIEndpoint:     api_endpoint,
+		TCPEndpoint:     tcpEndpoint,
+		MQTTEndpoint:    mqttEndpoint,
 		RedisEndpoint:   redis_endpoint,
 		RedisPrefix:     cmdline.NewStringValueDefault("linker"),
+		DigNotify:       cmdline.NewBoolValueDefault(false),
+		DigResync:       cmdline.NewUintValueDefault(30),
 		//ServiceEndpoints:   serviceEndpoints,
 		RouteTimeout:         cmdline.NewUintValueDefault(10),
 		MessageBulkTime:      cmdline.NewUintValueDefault(50),
 		RedisPoolIdleMax:     cmdline.NewUintValueDefault(100),
 		RedisPoolActiveMax:   cmdline.NewUintValueDefault(100),
 		ActiveTimeout:        cmdline.NewUintValueDefault(5000),
+		AckTimeout:           cmdline.NewUintValueDefault(30000),
+		PresenceIdle:         cmdline.NewUintValueDefault(300),
 		ConnectionBufferSize: cmdline.NewUintValueDefault(1024),
 		DebugMode:            cmdline.NewBoolValueDefault(false),
+		TraceExport:          cmdline.NewStringValue(),
 		RPCPublishEndpoint:   rpcPub,
+		RPCCodec:             cmdline.NewStringValueDefault(server.RPC_CODEC_GOB),
 		RPCEndpoint:          rpcBind,
 	}
 
@@ -192,16 +335,31 @@ func configureParse() (*GatewayOptions, error) {
 	flag.Var(options.LogLevel, "log-level", "Log level.")
 	flag.Var(options.APIEndpoint, "endpoint", "Public API binding Endpoint.")
 	flag.Var(options.ManageEndpoint, "manage-endpoint", "Manage API Endpoint.")
+	flag.Var(options.AdminToken, "admin-token", "Token required by manage API. Manage API is disabled if empty.")
+	flag.Var(options.TCPEndpoint, "tcp-endpoint", "Binary TCP protocol binding endpoint. Disabled if empty.")
+	flag.Var(options.MQTTEndpoint, "mqtt-endpoint", "MQTT binding endpoint. Disabled if empty.")
 	flag.Var(options.RedisEndpoint, "redis-endpoint", "Redis cache endpoint.")
 	flag.Var(options.RedisPrefix, "redis-prefix", "Redis cache key prefix.")
+	flag.Var(options.DigNotify, "dig-notify", "Discover node changes by redis pub/sub notifications instead of polling only.")
+	flag.Var(options.DigResync, "dig-resync", "Seconds between full discovery synchronization when \"-dig-notify\" is enabled.")
 	//flag.Var(options.ServiceEndpoints, "service-endpoints", "Service node endpoints.")
 	flag.Var(options.KeepalivePeriod, "keepalive-period", "Keepalive period. Can not be 0.")
+	flag.Var(options.HashReplicas, "hash-replicas", "Virtual points of each service node on hash ring.")
+	flag.Var(options.LBStrategy, "lb-strategy", "Load balancing strategy of service calls. \"round-robin\", \"weighted\", \"least-outstanding\" or \"ewma\".")
+	flag.Var(options.LBConnect, "lb-connect", "Load balancing strategy of connecting. Same as \"-lb-strategy\" if empty.")
+	flag.Var(options.LBSubscribe, "lb-subscribe", "Load balancing strategy of subscribing. Same as \"-lb-strategy\" if empty.")
+	flag.Var(options.LBEntity, "lb-entity", "Load balancing strategy of entity administration. Same as \"-lb-strategy\" if empty.")
+	flag.Var(options.HashLoadBound, "hash-load-bound", "Percent over average key share a service node may own. 0 disables bounded load.")
 	flag.Var(options.ActiveTimeout, "active-timeout", "")
+	flag.Var(options.AckTimeout, "ack-timeout", "Milliseconds to wait for acknowledgement before redelivering messages.")
+	flag.Var(options.PresenceIdle, "presence-idle", "Seconds without client activity before presence becomes idle. 0 disables idle state.")
 	flag.Var(options.RedisPoolIdleMax, "redis-max-idle", "Maximum idle redis connections.")
 	flag.Var(options.RedisPoolActiveMax, "redis-max-active", "Maximum active redis connections.")
 	flag.Var(options.DebugMode, "debug", "Enable debug mode.")
+	flag.Var(options.TraceExport, "trace-export", "File to export trace spans to as JSON lines, or \"stdout\". Tracing is disabled if empty.")
 	flag.Var(options.RPCEndpoint, "rpc", "RPC endpoint.")
 	flag.Var(options.RPCPublishEndpoint, "rpc-publish", "RPC publish endpoint.")
+	flag.Var(options.RPCCodec, "rpc-codec", "Codec of RPC served over plain TCP. \"gob\" or \"json\".")
 	flag.Var(options.RouteTimeout, "route-timeout", "route timeout.")
 	flag.Var(options.ConnectionBufferSize, "connection-bufsize", "Max number of buffered message for a connection.")
 
@@ -226,7 +384,7 @@ func configureParse() (*GatewayOptions, error) {
 			},
 		}
 
-		log.Info0("External configure: %v", options.ExternalConfig.Value)
+		log.Infof0("External configure: %v", options.ExternalConfig.Value)
 
 		if config_content, err = ioutil.ReadFile(options.ExternalConfig.Value); err != nil {
 			return nil, fmt.Errorf("Failed to load configure file: %v", err.Error())
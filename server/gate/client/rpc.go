@@ -1,20 +1,26 @@
 package client
 
 import (
+	"context"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
 )
 
 type GateClient server.RPCClient
 
-func (c *GateClient) Echo(echo string) (string, error) {
+// call returns ctx.Err() if ctx is done before reply arrives.
+func (c *GateClient) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return (*server.RPCClient)(c).CallContext(ctx, method, args, reply)
+}
+
+func (c *GateClient) Echo(ctx context.Context, echo string) (string, error) {
 	var reply string
-	err := c.Client.Call("GateRPC.Echo", echo, &reply)
+	err := c.call(ctx, "GateRPC.Echo", echo, &reply)
 	return reply, err
 }
 
-func (c *GateClient) Push(msgs []proto.MessageGroup) error {
-	if err := c.Client.Call("GateRPC.Push", &proto.MessagePushArguments{
+func (c *GateClient) Push(ctx context.Context, msgs []proto.MessageGroup) error {
+	if err := c.call(ctx, "GateRPC.Push", &proto.MessagePushArguments{
 		Gups: msgs,
 	}, &struct{}{}); err != nil {
 		return err
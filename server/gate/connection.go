@@ -4,6 +4,7 @@ import (
 	ilog "github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +12,8 @@ const (
 	PROTO_HTTP = iota
 	PROTO_TCP
 	PROTO_WEBSOCKET
+	PROTO_SSE
+	PROTO_MQTT
 )
 
 type ConnectMetadata struct {
@@ -20,9 +23,10 @@ type ConnectMetadata struct {
 }
 
 type ActiveMetadata struct {
-	Proto  uint
-	Remote string
-	Key    string
+	Proto  uint   `json:"proto"`
+	Remote string `json:"remote"`
+	Key    string `json:"key"`
+	Device string `json:"device"`
 }
 
 const (
@@ -31,12 +35,32 @@ const (
 	CONN_CLOSE
 )
 
+// Messages delivered but not acknowledged.
+type delivery struct {
+	Cursor   uint64
+	Msgs     []proto.Message
+	Deadline time.Time
+}
+
+// Connection is message buffer of a client device.
+// A user key may have connections of many devices.
 type Connection struct {
-	key string
+	key    string
+	device string
+
+	State uint8
+	Meta  ConnectMetadata
+
+	expire  int64 // Unix nanoseconds.
+	readers int32
 
-	State  uint8
-	Expire time.Time
-	Meta   ConnectMetadata
+	// Presence.
+	active       int64 // Unix nanoseconds of last client request.
+	routed       bool
+	reportedIdle bool
+
+	refreshed int64 // Unix nanoseconds of last session refreshing.
+	kicked    uint32
 
 	Buf  *Ring
 	bulk int
@@ -44,6 +68,71 @@ type Connection struct {
 	signal    *sync.Cond
 	WriteLock sync.Mutex
 	ReadLock  sync.Mutex
+
+	// At-least-once delivery.
+	AckLock      sync.Mutex
+	cursor       uint64
+	pending      []*delivery
+	pendingCount uint64
+}
+
+// Idle connections expire after 3 active windows.
+const CONN_IDLE_WINDOWS = 3
+
+func (c *Connection) Key() string {
+	return c.key
+}
+
+func (c *Connection) Device() string {
+	return c.device
+}
+
+// touch postpones expiration.
+func (c *Connection) touch() {
+	window := c.Meta.Timeout
+	if window <= 0 {
+		window = STREAM_DEFAULT_WINDOW
+	}
+	atomic.StoreInt64(&c.expire, time.Now().Add(time.Duration(window*CONN_IDLE_WINDOWS)*time.Millisecond).UnixNano())
+}
+
+// Expired reports whether connection is idle since notAfter.
+// Connections being read never expire.
+func (c *Connection) Expired(notAfter time.Time) bool {
+	return atomic.LoadInt32(&c.readers) < 1 && atomic.LoadInt64(&c.expire) < notAfter.UnixNano()
+}
+
+// Kick closes streams of connection and lets it expire.
+func (c *Connection) Kick() {
+	atomic.StoreUint32(&c.kicked, 1)
+	atomic.StoreInt64(&c.expire, 0)
+}
+
+func (c *Connection) Kicked() bool {
+	return atomic.LoadUint32(&c.kicked) != 0
+}
+
+// dueRefresh reports whether session should be refreshed, and records refreshing if so.
+func (c *Connection) dueRefresh(now time.Time, interval time.Duration) bool {
+	last := atomic.LoadInt64(&c.refreshed)
+	if now.UnixNano()-last < int64(interval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&c.refreshed, last, now.UnixNano())
+}
+
+// Activate records client activity.
+func (c *Connection) Activate() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+func (c *Connection) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.active))
+}
+
+// Idle reports whether client has no activity within period.
+func (c *Connection) Idle(now time.Time, period time.Duration) bool {
+	return period > 0 && c.LastActive().Add(period).Before(now)
 }
 
 func (c *Connection) wait(wake chan struct{}) {
@@ -57,24 +146,27 @@ func (c *Connection) Push(msgs []*proto.Message) (uint, uint) {
 		return 0, 0
 	}
 
-	var overc, readLocked uint
-	var idx int
+	var pushed, overc, readLocked uint
 	c.WriteLock.Lock()
 	defer c.WriteLock.Unlock()
 
-	for idx := range msgs {
+	for idx := 0; idx < len(msgs); {
 		override, err := c.Buf.Write(msgs[idx], readLocked > 0)
 		if override {
 			ilog.Warnf("Drop message for full ring buffer.")
+			metricRingDrops.Inc()
 		}
 		if err == ErrRingFull {
+			// Lock out readers and write again with overriding.
+			metricRingOverflows.Inc()
 			c.ReadLock.Lock()
 			readLocked = 1
 			continue
 		}
-		if readLocked > 0 {
+		if override {
 			overc++
 		}
+		pushed++
 		idx++
 	}
 	if readLocked > 0 {
@@ -84,7 +176,29 @@ func (c *Connection) Push(msgs []*proto.Message) (uint, uint) {
 		c.signal.Broadcast()
 	}
 
-	return uint(idx), overc
+	return pushed, overc
+}
+
+// PutBack requeues messages received but not delivered ahead of messages in ring,
+// so that they are received first again. Returns count of messages requeued.
+// The earliest messages are dropped if ring becomes full.
+func (c *Connection) PutBack(msgs []proto.Message) int {
+	if len(msgs) < 1 {
+		return 0
+	}
+	c.WriteLock.Lock()
+	defer c.WriteLock.Unlock()
+	c.ReadLock.Lock()
+	count := c.Buf.Unread(msgs)
+	c.ReadLock.Unlock()
+	if dropped := len(msgs) - count; dropped > 0 {
+		ilog.Warnf("Drop %v messages requeued for full ring buffer.", dropped)
+		metricRingDrops.Add(float64(dropped))
+	}
+	if count > 0 && (c.bulk < 0 || c.Buf.Count() >= uint64(c.bulk)) {
+		c.signal.Broadcast()
+	}
+	return count
 }
 
 func (c *Connection) consume(buf []proto.Message, max int) ([]proto.Message, int) {
@@ -109,6 +223,12 @@ func (c *Connection) Receive(buf []proto.Message, max int, bulk int, timeout int
 		bulk = max
 	}
 
+	atomic.AddInt32(&c.readers, 1)
+	defer func() {
+		c.touch()
+		atomic.AddInt32(&c.readers, -1)
+	}()
+
 	var cnt int = 0
 	notAfter, writeLocked, wake := time.Now(), false, make(chan struct{}, 1)
 	buf = buf[0:0]
@@ -154,3 +274,76 @@ func (c *Connection) Receive(buf []proto.Message, max int, bulk int, timeout int
 
 	return buf
 }
+
+// Ack drops deliveries not after cursor.
+func (c *Connection) Ack(cursor uint64) {
+	c.AckLock.Lock()
+	defer c.AckLock.Unlock()
+	idx := 0
+	for ; idx < len(c.pending) && c.pending[idx].Cursor <= cursor; idx++ {
+		c.pendingCount -= uint64(len(c.pending[idx].Msgs))
+		c.pending[idx] = nil
+	}
+	c.pending = c.pending[idx:]
+}
+
+// Take deliveries not acknowledged before deadline.
+func (c *Connection) expiredDeliveries(buf []proto.Message, now time.Time) []proto.Message {
+	c.AckLock.Lock()
+	defer c.AckLock.Unlock()
+	kept := c.pending[0:0]
+	for _, d := range c.pending {
+		if d.Deadline.After(now) {
+			kept = append(kept, d)
+			continue
+		}
+		buf = append(buf, d.Msgs...)
+		c.pendingCount -= uint64(len(d.Msgs))
+	}
+	for idx := len(kept); idx < len(c.pending); idx++ {
+		c.pending[idx] = nil
+	}
+	c.pending = kept
+	return buf
+}
+
+// ReceiveAcked receives messages in at-least-once mode.
+// Messages are kept until cursor returned is acknowledged, and will be redelivered after ackTimeout.
+// Messages not acknowledged are redelivered in prior to new messages.
+func (c *Connection) ReceiveAcked(buf []proto.Message, max int, bulk int, timeout int, ackTimeout time.Duration) ([]proto.Message, uint64) {
+	buf = c.expiredDeliveries(buf[0:0], time.Now())
+
+	c.AckLock.Lock()
+	full := c.pendingCount >= c.Buf.Size()
+	c.AckLock.Unlock()
+	if !full && (max < 1 || len(buf) < max) {
+		var fresh []proto.Message
+		if len(buf) > 0 {
+			// Never wait when redelivering.
+			rest := max
+			if rest > 0 {
+				rest -= len(buf)
+			}
+			fresh = c.Receive(make([]proto.Message, 0, 1), rest, 1, 0)
+		} else {
+			fresh = c.Receive(make([]proto.Message, 0, 1), max, bulk, timeout)
+		}
+		buf = append(buf, fresh...)
+	}
+
+	c.AckLock.Lock()
+	defer c.AckLock.Unlock()
+	if len(buf) < 1 {
+		return buf, c.cursor
+	}
+	c.cursor++
+	msgs := make([]proto.Message, len(buf))
+	copy(msgs, buf)
+	c.pending = append(c.pending, &delivery{
+		Cursor:   c.cursor,
+		Msgs:     msgs,
+		Deadline: time.Now().Add(ackTimeout),
+	})
+	c.pendingCount += uint64(len(msgs))
+	return buf, c.cursor
+}
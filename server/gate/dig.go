@@ -1,11 +1,13 @@
 package gate
 
 import (
+	"context"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/server/dig"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,6 +32,8 @@ func (g *Gate) openDigService(name string) dig.Service {
 	return svc
 }
 
+// addServiceNode adds node to load balancer, or reopens node if its RPC metadata changes.
+// Node is removed if RPC metadata becomes incomplete.
 func (g *Gate) addServiceNode(notify *dig.Notification) {
 	var (
 		ID  server.NodeID
@@ -38,31 +42,65 @@ func (g *Gate) addServiceNode(notify *dig.Notification) {
 	rawID, ok := notify.Node.Metadata["linker-nodeid"]
 	if !ok {
 		log.Info2("ID of node \"" + notify.Node.Name + "\" is missing. Skip.")
+		g.LB.RemoveNode(notify.Node.Name)
 		return
 	}
 	rpc, ok = notify.Node.Metadata["linker-rpc"]
 	if !ok {
 		log.Info2("RPC endpoint of node \"" + notify.Node.Name + "\" is missing. Skip.")
+		g.LB.RemoveNode(notify.Node.Name)
 		return
 	}
 	if err := ID.FromString(rawID); err != nil {
 		log.Warn("Invalid ID of node \"" + notify.Node.Name + "\". skip.")
+		g.LB.RemoveNode(notify.Node.Name)
 		return
 	}
-	if g.LB.Node(notify.Node.Name) == nil {
-		log.Info0("Add node \"" + notify.Node.Name + "\" with ID \"" + rawID + "\" to load balancer. Endpoint is \"" + rpc + "\".")
-		g.LB.AddNode(notify.Node.Name, OpenServiceNode(ID, notify.Node.Name, rpc, proto.RPC_PATH, runtime.NumCPU(), runtime.NumCPU()))
+	codec := notify.Node.Metadata[proto.DIG_META_RPC_CODEC]
+	if node := g.LB.Node(notify.Node.Name); node != nil {
+		if ifce, _ := node.Interface().(*ServiceDripInterface); ifce != nil && ifce.ID == ID && ifce.Addr == rpc && ifce.Codec == codec {
+			return
+		}
+		log.Info0("RPC metadata of node \"" + notify.Node.Name + "\" changed. Reopen.")
+		g.LB.RemoveNode(notify.Node.Name)
 	}
+	log.Info0("Add node \"" + notify.Node.Name + "\" with ID \"" + rawID + "\" to load balancer. Endpoint is \"" + rpc + "\". Codec is \"" + codec + "\".")
+	node := OpenServiceNode(ID, notify.Node.Name, rpc, codec, proto.RPC_PATH, runtime.NumCPU(), runtime.NumCPU())
+	node.SetWeight(nodeWeight(notify.Node))
+	g.LB.AddNode(notify.Node.Name, node)
 }
 
-func (g *Gate) Discover() {
-	var svc, svcSvc dig.Service
+// nodeWeight returns load balancing weight published by node. 1 if absent or invalid.
+func nodeWeight(node *dig.Node) uint32 {
+	raw, ok := node.Metadata[proto.DIG_META_WEIGHT]
+	if !ok {
+		return 1
+	}
+	weight, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil || weight < 1 {
+		log.Warn("Invalid weight \"" + raw + "\" of node \"" + node.Name + "\". Use 1.")
+		return 1
+	}
+	return uint32(weight)
+}
 
+func (g *Gate) updateServiceWeight(notify *dig.Notification) {
+	node := g.LB.Node(notify.Node.Name)
+	if node == nil {
+		return
+	}
+	weight := nodeWeight(notify.Node)
+	log.Infof0("Weight of node \"%v\" is %v.", notify.Node.Name, weight)
+	node.SetWeight(weight)
+}
+
+func (g *Gate) Discover() {
 	log.Info0("Start node discovery.")
 
-	svc = g.openDigService(proto.DIG_GATE_SERVICE_NAME)
+	svc := g.openDigService(proto.DIG_GATE_SERVICE_NAME)
 	log.Info0("Service \"" + proto.DIG_GATE_SERVICE_NAME + "\" opened. Start node discovery.")
-	svcSvc = g.openDigService(proto.DIG_SERVICE_NAME)
+	// Focus on service nodes.
+	g.openDigService(proto.DIG_SERVICE_NAME)
 	log.Info0("Service \"" + proto.DIG_SERVICE_NAME + "\" opened. Start node discovery.")
 
 	g.Node = &dig.Node{
@@ -71,55 +109,76 @@ func (g *Gate) Discover() {
 			"linker-rpc":    g.config.RPCPublishEndpoint.String(),
 			"linker-nodeid": g.ID.String(),
 			"linker-role":   "gate",
+
+			proto.DIG_META_RPC_CODEC: g.config.RPCCodec.Value,
 		},
 		Timeout: 3,
 	}
-	svc.Publish(g.Node)
+	if err := svc.Publish(g.Node); err != nil {
+		log.Warn("Cannot publish gateway node \"" + g.Node.Name + "\": " + err.Error() + ". Retry later.")
+	}
 	log.Info0("Publish gateway node \"" + g.Node.Name + "\" of service \"" + proto.DIG_GATE_SERVICE_NAME + "\".")
 
+	ctx := context.Background()
+	events := g.Dig.Watch(ctx, dig.WatchFilter{})
+	go dig.Sync(ctx, g.Dig, time.Second)
+	g.watchDig(ctx, events)
+}
+
+// watchDig handles dig notifications until ctx is done or events is closed.
+func (g *Gate) watchDig(ctx context.Context, events <-chan *dig.Notification) {
 	for {
-		changed, err := g.Dig.Poll(func(notify *dig.Notification) {
-			switch notify.Event {
-			case dig.EVENT_NODE_FOCUS:
-				log.Info2("Watch node \"" + notify.Name + "\"")
-
-			case dig.EVENT_SVC_NODE_FOUND:
-				log.Info0("Discover node \"" + notify.Name + "\" of service \"" + notify.Service.Name() + "\".")
-
-			case dig.EVENT_NODE_LOST:
-				log.Info0("Node \"" + notify.Name + "\" lost.")
-				g.LB.RemoveNode(notify.Name)
-
-			case dig.EVENT_NODE_METADATA_KEY_ADD:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "svc" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					g.addServiceNode(notify)
-				}
-
-			case dig.EVENT_NODE_METADATA_KEY_CHANGED:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "svc" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					g.LB.RemoveNode(notify.Node.Name)
-					g.addServiceNode(notify)
-				}
-
-			case dig.EVENT_NODE_METADATA_KEY_DEL:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "svc" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					log.Info0("Remove node \"" + notify.Node.Name + "for absent \"" + notify.Name + "\"")
-				}
+		select {
+		case <-ctx.Done():
+			return
+		case notify, ok := <-events:
+			if !ok {
+				return
 			}
-		})
-		if err != nil {
-			log.Error("Dig polling failure: " + err.Error())
-		}
-		if changed {
-			log.Info2("Dig state changed.")
-			log.Info0("Nodes of service \"" + proto.DIG_GATE_SERVICE_NAME + "\": " + strings.Join(svc.Nodes(), ",") + ".")
-			log.Info0("Nodes of service \"" + proto.DIG_SERVICE_NAME + "\": " + strings.Join(svcSvc.Nodes(), ",") + ".")
+			g.digNotified(notify)
 		}
-		time.Sleep(time.Second)
 	}
+}
+
+func (g *Gate) digNotified(notify *dig.Notification) {
+	switch notify.Event {
+	case dig.EVENT_NODE_FOCUS:
+		log.Info2("Watch node \"" + notify.Name + "\"")
+
+	case dig.EVENT_SVC_NODE_FOUND:
+		log.Info0("Discover node \"" + notify.Name + "\" of service \"" + notify.Service.Name() + "\".")
+		log.Info0("Nodes of service \"" + notify.Service.Name() + "\": " + strings.Join(notify.Service.Nodes(), ",") + ".")
+
+	case dig.EVENT_SVC_NODE_LOST:
+		log.Info0("Nodes of service \"" + notify.Service.Name() + "\": " + strings.Join(notify.Service.Nodes(), ",") + ".")
 
-	log.Info0("Node discovery stopping...")
+	case dig.EVENT_NODE_LOST:
+		log.Info0("Node \"" + notify.Name + "\" lost.")
+		g.LB.RemoveNode(notify.Name)
+
+	case dig.EVENT_NODE_METADATA_KEY_ADD:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "svc" && proto.IsRPCMetadata(notify.Name) {
+			g.addServiceNode(notify)
+		} else if ok && role == "svc" && notify.Name == proto.DIG_META_WEIGHT {
+			g.updateServiceWeight(notify)
+		}
+
+	case dig.EVENT_NODE_METADATA_KEY_CHANGED:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "svc" && proto.IsRPCMetadata(notify.Name) {
+			g.addServiceNode(notify)
+		} else if ok && role == "svc" && notify.Name == proto.DIG_META_WEIGHT {
+			g.updateServiceWeight(notify)
+		}
+
+	case dig.EVENT_NODE_METADATA_KEY_DEL:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "svc" && proto.IsRPCMetadata(notify.Name) {
+			log.Info0("RPC metadata \"" + notify.Name + "\" of node \"" + notify.Node.Name + "\" removed.")
+			g.addServiceNode(notify)
+		} else if ok && role == "svc" && notify.Name == proto.DIG_META_WEIGHT {
+			g.updateServiceWeight(notify)
+		}
+	}
 }
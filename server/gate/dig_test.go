@@ -0,0 +1,85 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/Sunmxt/linker-im/server/dig"
+	"github.com/Sunmxt/linker-im/server/dig/digtest"
+	"testing"
+)
+
+func testServiceNode(name, rpc string, id server.NodeID) *dig.Node {
+	return &dig.Node{
+		Name: name,
+		Metadata: map[string]string{
+			"linker-role":         "svc",
+			"linker-nodeid":       id.String(),
+			"linker-rpc":          rpc,
+			proto.DIG_META_WEIGHT: "3",
+		},
+	}
+}
+
+func TestGateWatchDig(t *testing.T) {
+	g := &Gate{LB: NewLB()}
+	id := server.NewNodeID()
+
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: testServiceNode("svc-1", "127.0.0.1:1", id)})
+	added := g.LB.Node("svc-1")
+	if added == nil {
+		t.Fatal("service node not added")
+	}
+	if weight := added.Weight(); weight != 3 {
+		t.Fatalf("expected weight 3, got %v", weight)
+	}
+	// Nodes of other roles are ignored.
+	gateNode := testServiceNode("gate-1", "127.0.0.1:2", server.NewNodeID())
+	gateNode.Metadata["linker-role"] = "gate"
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: gateNode})
+	if g.LB.Node("gate-1") != nil {
+		t.Fatal("gate node added to load balancer")
+	}
+
+	// Unchanged RPC metadata keeps node.
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_CHANGED, Name: "linker-role", Node: testServiceNode("svc-1", "127.0.0.1:1", id)})
+	if g.LB.Node("svc-1") != added {
+		t.Fatal("node reopened without RPC metadata changed")
+	}
+	// Changed endpoint reopens node.
+	changed := testServiceNode("svc-1", "127.0.0.1:3", id)
+	changed.Metadata[proto.DIG_META_WEIGHT] = "5"
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_CHANGED, Name: "linker-rpc", Node: changed})
+	reopened := g.LB.Node("svc-1")
+	if reopened == nil || reopened == added {
+		t.Fatal("node not reopened after endpoint changed")
+	}
+	if weight := reopened.Weight(); weight != 5 {
+		t.Fatalf("expected weight 5, got %v", weight)
+	}
+
+	// Weight.
+	changed.Metadata[proto.DIG_META_WEIGHT] = "7"
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_CHANGED, Name: proto.DIG_META_WEIGHT, Node: changed})
+	if weight := reopened.Weight(); weight != 7 {
+		t.Fatalf("expected weight 7, got %v", weight)
+	}
+
+	// Incomplete RPC metadata removes node.
+	delete(changed.Metadata, "linker-rpc")
+	digtest.Notify(g.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_DEL, Name: "linker-rpc", Node: changed})
+	if g.LB.Node("svc-1") != nil {
+		t.Fatal("node not removed after RPC endpoint removed")
+	}
+
+	digtest.Notify(g.watchDig,
+		&dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: testServiceNode("svc-2", "127.0.0.1:4", server.NewNodeID())},
+		&dig.Notification{Event: dig.EVENT_NODE_LOST, Name: "svc-2"},
+	)
+	if g.LB.Node("svc-2") != nil {
+		t.Fatal("node not removed after lost")
+	}
+}
+
+func TestGateWatchDigCanceled(t *testing.T) {
+	digtest.Canceled(t, (&Gate{LB: NewLB()}).watchDig)
+}
@@ -5,28 +5,38 @@ import (
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/server/dig"
+	"github.com/Sunmxt/linker-im/server/trace"
 	"github.com/gomodule/redigo/redis"
 	gmux "github.com/gorilla/mux"
 	"net/http"
+	"net/rpc"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 var Config *GatewayOptions
 
 type Gate struct {
-	config     *GatewayOptions
-	ID         server.NodeID
-	HTTP       *http.Server
-	Router     *gmux.Router
-	RPCRouter  *gmux.Router
-	RPC        *http.Server
-	LB         *ServiceLB
-	Dig        dig.Registry
-	Node       *dig.Node
-	Redis      *redis.Pool
-	Hub        *Hub
-	KeySession sync.Map
-	fatal      chan error
+	config       *GatewayOptions
+	ID           server.NodeID
+	HTTP         *http.Server
+	Router       *gmux.Router
+	Manage       *http.Server
+	ManageRouter *gmux.Router
+	RPCRouter    *gmux.Router
+	RPC          *http.Server
+	RPCServer    *rpc.Server
+	LB           *ServiceLB
+	Dig          dig.Registry
+	Node         *dig.Node
+	Redis        *redis.Pool
+	Hub          *Hub
+	KeySession   SessionKeyCache
+	fatal        chan error
+	mqttSessions sync.Map // MQTT client states kept across connections.
+	mqttClients  sync.Map // MQTT connections by key and client ID.
 }
 
 var gate *Gate
@@ -47,9 +57,21 @@ func (g *Gate) Run() {
 	log.Infof0("Log Level set to %v.", g.config.LogLevel.Value)
 	log.SetGlobalLogLevel(g.config.LogLevel.Value)
 
+	// Tracing
+	if path := g.config.TraceExport.Value; path != "" {
+		exporter, err := trace.OpenJSONExporter(path)
+		if err != nil {
+			log.Fatal("Cannot open trace exporter: " + err.Error())
+			return
+		}
+		trace.SetService("gate")
+		trace.SetExporter(exporter)
+		log.Info0("Export traces to \"" + path + "\".")
+	}
+
 	// Node ID
 	g.ID = server.NewNodeID()
-	log.Infof0("Gateway Node ID is " + g.ID.String() + ".")
+	log.Info0("Gateway Node ID is " + g.ID.String() + ".")
 
 	g.fatal = make(chan error)
 
@@ -59,6 +81,12 @@ func (g *Gate) Run() {
 		return
 	}
 
+	// Management API
+	if err = g.InitManage(); err != nil {
+		log.Fatal("Cannot initialize management API: " + err.Error())
+		return
+	}
+
 	// Core objects.
 	if err = g.InitService(); err != nil {
 		log.Fatal("Cannot initialize Services: " + err.Error())
@@ -72,12 +100,28 @@ func (g *Gate) Run() {
 	}
 
 	go g.ServeHTTP()
+	go g.ServeManage()
+	go g.ServeTCP()
+	go g.ServeMQTT()
 	go g.ServeRPC()
 	go g.Discover()
 	go g.Routing()
 	go g.Keepalive()
 
-	if err = <-g.fatal; err != nil {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-g.fatal:
+	case sig := <-stop:
+		log.Info0("Signal \"" + sig.String() + "\" received.")
+	}
+
+	// Deregister, so that services stop routing to this gate.
+	log.Info0("Deregister from discovery.")
+	if closeErr := g.Dig.Close(); closeErr != nil {
+		log.Error("Deregistering failure: " + closeErr.Error())
+	}
+	if err != nil {
 		log.Fatal(err.Error())
 	}
 
@@ -10,8 +10,22 @@ type Hashed uint32
 
 func (h Hashed) Hash() uint32 { return uint32(h) }
 
-func HashMessage(msg *proto.MessageBody) server.Hashable {
+// HashMessage shards group messages by group, and direct messages by conversation pair.
+// Sender is empty if unknown, in which case direct messages are sharded by recipient.
+func HashMessage(msg *proto.MessageBody, sender string) server.Hashable {
 	fnvHash := fnv.New32a()
-	fnvHash.Write([]byte(msg.Group))
+	if msg.To == "" {
+		fnvHash.Write([]byte(msg.Group))
+		return Hashed(fnvHash.Sum32())
+	}
+	a, b := sender, msg.To
+	if a > b {
+		a, b = b, a
+	}
+	// Group names are never empty for group messages. Mark direct messages with a leading zero byte.
+	fnvHash.Write([]byte{0})
+	fnvHash.Write([]byte(a))
+	fnvHash.Write([]byte{0})
+	fnvHash.Write([]byte(b))
 	return Hashed(fnvHash.Sum32())
 }
@@ -0,0 +1,85 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/proto"
+	"net/http"
+	"strconv"
+)
+
+// ParseHistoryQuery parses history range from request.
+// Range is [begin, end). Identifiers are in form "<timestamp>-<sequence>".
+func (ctx *APIRequestContext) ParseHistoryQuery() (string, *proto.HistoryQuery, error) {
+	enc, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return "", nil, err
+	}
+	query := &proto.HistoryQuery{
+		Namespace: ctx.Namespace,
+		Session:   session,
+		Trace:     ctx.TraceContext(),
+	}
+	if raw, ok := ctx.Req.Form["g"]; ok && len(raw) > 0 {
+		query.Group = raw[0]
+	}
+	for name, id := range map[string]*proto.MessageIdentifier{
+		"begin": &query.Begin,
+		"end":   &query.End,
+	} {
+		raw, ok := ctx.Req.Form[name]
+		if !ok || len(raw) < 1 || raw[0] == "" {
+			continue
+		}
+		if *id, err = proto.ParseMessageIdentifier(raw[0]); err != nil {
+			ctx.ResponseError(proto.INVALID_ARGUMENT, "Invalid "+name+" \""+raw[0]+"\".")
+			return "", nil, err
+		}
+	}
+	if raw, ok := ctx.Req.Form["limit"]; ok && len(raw) > 0 {
+		limit, err := strconv.ParseUint(raw[0], 10, 31)
+		if err != nil {
+			ctx.ResponseError(proto.INVALID_ARGUMENT, "Invalid limit \""+raw[0]+"\".")
+			return "", nil, err
+		}
+		query.Limit = int(limit)
+	}
+	return enc, query, nil
+}
+
+func History(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	enc, query, err := ctx.ParseHistoryQuery()
+	if err != nil {
+		return
+	}
+	reply, err := gate.history(ctx.Context(), query)
+	if err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	reply.Msgs = encodeMessages(enc, reply.Msgs)
+	ctx.Data = reply
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+func HistoryCheck(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	_, query, err := ctx.ParseHistoryQuery()
+	if err != nil {
+		return
+	}
+	if ctx.Data, err = gate.historyCheck(ctx.Context(), query); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	ctx.ResponseError(proto.SUCCEED, "")
+}
@@ -1,6 +1,7 @@
 package gate
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 	//"github.com/Sunmxt/buger/jsonparser"
 )
 
@@ -36,6 +38,9 @@ type APIRequestContext struct {
 	Group      string
 
 	Log *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewRequestContext(w http.ResponseWriter, req *http.Request, ireq interface{}) (*APIRequestContext, error) {
@@ -77,6 +82,25 @@ func NewEmptyAPIRequestContext(w http.ResponseWriter, req *http.Request) *APIReq
 	return ctx
 }
 
+// TraceContext returns context for tracing request. Request ID is used as trace ID.
+func (ctx *APIRequestContext) TraceContext() proto.TraceContext {
+	return proto.TraceContext{
+		TraceID: ctx.RequestID.String(),
+	}
+}
+
+// Context returns context of request. Deadline is set if timeout specified.
+func (ctx *APIRequestContext) Context() context.Context {
+	if ctx.ctx == nil {
+		if ctx.EnableTimeout && ctx.Timeout > 0 {
+			ctx.ctx, ctx.cancel = context.WithTimeout(ctx.Req.Context(), time.Duration(ctx.Timeout)*time.Millisecond)
+		} else {
+			ctx.ctx, ctx.cancel = context.WithCancel(ctx.Req.Context())
+		}
+	}
+	return ctx.ctx
+}
+
 func (ctx *APIRequestContext) initializeContext() error {
 	if err := ctx.Req.ParseForm(); err != nil {
 		return err
@@ -109,15 +133,16 @@ func (ctx *APIRequestContext) ParseTimeout() error {
 	return nil
 }
 
-func (ctx *APIRequestContext) BeginRPC() (*sc.ServiceClient, error) {
+// BeginRPC selects service by strategy of operation type.
+func (ctx *APIRequestContext) BeginRPC(op uint8) (*sc.ServiceClient, error) {
 	var err error
 	var rawRPC *server.RPCClient
-	ctx.node, err = gate.LB.RoundRobinSelect()
+	ctx.node, err = gate.LB.Select(op)
 	if err != nil {
 		return nil, err
 	}
 	if ctx.EnableTimeout {
-		rawRPC, err = ctx.node.Connect(ctx.Timeout)
+		rawRPC, err = ctx.node.ConnectContext(ctx.Context())
 	} else {
 		rawRPC, err = ctx.node.TryConnect()
 	}
@@ -126,17 +151,16 @@ func (ctx *APIRequestContext) BeginRPC() (*sc.ServiceClient, error) {
 }
 
 func (ctx *APIRequestContext) ParseAndGetMessagingClientTuple() (string, string, error) {
-	var enc string
+	enc := "txt"
 	raw, ok := ctx.Req.Form["enc"]
-	if !ok || len(raw) < 1 {
-		return "", "", nil
-	}
-	if raw[0] != "txt" && raw[0] != "b64" {
-		msg := "Invalid enc \"" + enc + "\""
-		ctx.ResponseError(proto.INVALID_ARGUMENT, msg)
-		return "", "", errors.New(msg)
+	if ok && len(raw) > 0 {
+		if raw[0] != "txt" && raw[0] != "b64" {
+			msg := "Invalid enc \"" + raw[0] + "\""
+			ctx.ResponseError(proto.INVALID_ARGUMENT, msg)
+			return "", "", errors.New(msg)
+		}
+		enc = raw[0]
 	}
-	enc = raw[0]
 	raw, ok = ctx.Req.Form["s"]
 	if !ok || len(raw) < 1 {
 		msg := "Session missing."
@@ -179,6 +203,12 @@ func (ctx *APIRequestContext) WriteJson(resp interface{}) error {
 	return nil
 }
 
+// ResponseRPCError responses error returned by service.
+func (ctx *APIRequestContext) ResponseRPCError(err error) {
+	code, msg := streamErrorCode(err)
+	ctx.ResponseError(code, msg)
+}
+
 func (ctx *APIRequestContext) ResponseError(code uint32, msg string) {
 	ctx.Code = code
 	ctx.CodeMessage = msg
@@ -228,4 +258,7 @@ func (ctx *APIRequestContext) Finalize() {
 	}
 
 	ctx.EndRPC(nil)
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
 }
@@ -2,21 +2,40 @@ package gate
 
 import (
 	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server/trace"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const HUB_RING_DEFAULT_BUFFER_SIZE = 1024
+const (
+	HUB_RING_DEFAULT_BUFFER_SIZE = 1024
+	HUB_DEFAULT_ACK_TIMEOUT      = 30 * time.Second
+	HUB_DEFAULT_IDLE_TIMEOUT     = 5 * time.Minute
+)
+
+// Connections of a user key, indexed by device.
+type keyConnections struct {
+	lock    sync.RWMutex
+	devices map[string]*Connection
+	removed bool
+}
 
 // Hub is message exchange.
 type Hub struct {
-	KeyConn   sync.Map
+	KeyConn   sync.Map // key -> *keyConnections
 	ConnCount int32
 
 	Meta    ConnectMetadata
 	BufSize uint
 
+	// Period to wait for acknowledgement before redelivering.
+	AckTimeout time.Duration
+
+	// Connections without client activity within the period are idle.
+	IdleTimeout time.Duration
+
 	sigRoute chan *Connection
 }
 
@@ -25,9 +44,11 @@ func NewHub(meta ConnectMetadata, bufSize uint) *Hub {
 		bufSize = HUB_RING_DEFAULT_BUFFER_SIZE
 	}
 	return &Hub{
-		Meta:     meta,
-		sigRoute: make(chan *Connection),
-		BufSize:  bufSize,
+		Meta:        meta,
+		sigRoute:    make(chan *Connection),
+		BufSize:     bufSize,
+		AckTimeout:  HUB_DEFAULT_ACK_TIMEOUT,
+		IdleTimeout: HUB_DEFAULT_IDLE_TIMEOUT,
 	}
 }
 
@@ -38,41 +59,86 @@ func (h *Hub) InitConnection(conn *Connection, meta *ConnectMetadata) {
 	}
 	conn.Meta = *meta
 	conn.State = CONN_CONNECTED
+	conn.touch()
+	conn.Activate()
 }
 
-// Clean timeout connections
-func (h *Hub) Clean(notAfter time.Time) {
-	h.Visit(func(key string, conn *Connection) bool {
-		if conn.Expire.After(notAfter) {
-			h.KeyConn.Delete(key)
+func (h *Hub) keyConnections(key string) *keyConnections {
+	raw, ok := h.KeyConn.Load(key)
+	if !ok {
+		return nil
+	}
+	kc, ok := raw.(*keyConnections)
+	if !ok {
+		h.KeyConn.Delete(key)
+		return nil
+	}
+	return kc
+}
+
+// Clean expired connections.
+// Returns removed connections.
+func (h *Hub) Clean(notAfter time.Time) []*Connection {
+	removed := make([]*Connection, 0)
+	h.KeyConn.Range(func(k, v interface{}) bool {
+		kc, ok := v.(*keyConnections)
+		if !ok {
+			h.KeyConn.Delete(k)
+			return true
+		}
+		kc.lock.Lock()
+		for device, conn := range kc.devices {
+			if conn.Expired(notAfter) {
+				conn.State = CONN_CLOSE
+				delete(kc.devices, device)
+				removed = append(removed, conn)
+				atomic.AddInt32(&h.ConnCount, -1)
+			}
+		}
+		if len(kc.devices) < 1 {
+			kc.removed = true
+			h.KeyConn.Delete(k)
 		}
+		kc.lock.Unlock()
 		return true
 	})
+	return removed
 }
 
 func (h *Hub) Visit(fn func(key string, conn *Connection) bool) {
 	var count int
+	conns := make([]*Connection, 0, 4)
 	h.KeyConn.Range(func(k, v interface{}) bool {
-		var conn *Connection
 		key, ok := k.(string)
 		if !ok {
 			h.KeyConn.Delete(k)
 			return true
 		}
-		conn, ok = v.(*Connection)
-		if !ok || conn == nil {
+		kc, ok := v.(*keyConnections)
+		if !ok || kc == nil {
 			h.KeyConn.Delete(k)
 			return true
 		}
-		count++
-		return fn(key, conn)
+		conns = conns[0:0]
+		kc.lock.RLock()
+		for _, conn := range kc.devices {
+			conns = append(conns, conn)
+		}
+		kc.lock.RUnlock()
+		for _, conn := range conns {
+			count++
+			if !fn(key, conn) {
+				return false
+			}
+		}
+		return true
 	})
-	h.ConnCount = int32(count)
+	atomic.StoreInt32(&h.ConnCount, int32(count))
 }
 
 // Count return connection count.
 func (h *Hub) Count() uint32 {
-	cnt := h.ConnCount
+	cnt := atomic.LoadInt32(&h.ConnCount)
 	if cnt < 0 {
 		return 0
 	}
@@ -86,85 +152,133 @@ func (h *Hub) Snapshot(buf []ActiveMetadata) []ActiveMetadata {
 		meta.Proto = conn.Meta.Proto
 		meta.Remote = conn.Meta.Remote
 		meta.Key = key
+		meta.Device = conn.device
 		buf = append(buf, meta)
 		return true
 	})
 	return buf
 }
 
-// Connect to hub by key
-func (h *Hub) Connect(key string, meta ConnectMetadata) (*Connection, error) {
+// Connect device to hub by key
+func (h *Hub) Connect(key, device string, meta ConnectMetadata) (*Connection, error) {
 	var conn *Connection
 
-	newConn := func() *Connection {
-		if conn == nil {
-			conn = &Connection{
-				key:   key,
-				State: CONN_OPEN,
-				Buf:   NewRing(uint64(h.BufSize)),
-				Meta:  meta,
+	for conn == nil {
+		kc := h.keyConnections(key)
+		if kc == nil {
+			raw, _ := h.KeyConn.LoadOrStore(key, &keyConnections{
+				devices: make(map[string]*Connection),
+			})
+			if kc, _ = raw.(*keyConnections); kc == nil {
+				h.KeyConn.Delete(key) // Wrong type. Force to replace.
+				continue
 			}
-			conn.signal = sync.NewCond(&conn.WriteLock)
 		}
-		return conn
-	}
-
-	for conn == nil {
-		raw, loaded := h.KeyConn.Load(key)
 
-		if !loaded { // non-exist
-			raw, loaded = h.KeyConn.LoadOrStore(key, newConn())
-			if !loaded {
+		kc.lock.Lock()
+		if kc.removed { // Removed by cleaning. Retry.
+			kc.lock.Unlock()
+			continue
+		}
+		if conn = kc.devices[device]; conn == nil || conn.Kicked() {
+			if conn == nil {
 				atomic.AddInt32(&h.ConnCount, 1)
-				break
 			}
+			conn = &Connection{
+				key:    key,
+				device: device,
+				State:  CONN_OPEN,
+				Buf:    NewRing(uint64(h.BufSize)),
+				Meta:   meta,
+			}
+			conn.signal = sync.NewCond(&conn.WriteLock)
+			kc.devices[device] = conn
 		}
-
-		conn, loaded = raw.(*Connection)
-		if !loaded { // Wrong type. Force to replace.
-			h.KeyConn.Store(key, newConn())
-		}
-		break
+		h.InitConnection(conn, &meta)
+		kc.lock.Unlock()
 	}
-	h.InitConnection(conn, &meta)
 
 	h.sigRoute <- conn
 
 	return conn, nil
 }
 
-// Get connection related to key
-func (h *Hub) Route(key string) *Connection {
-	var conn *Connection
+// Expire marks connection of device expired. It will be removed by next cleaning.
+func (h *Hub) Expire(key, device string) {
+	kc := h.keyConnections(key)
+	if kc == nil {
+		return
+	}
+	kc.lock.RLock()
+	conn := kc.devices[device]
+	kc.lock.RUnlock()
+	if conn != nil {
+		atomic.StoreInt64(&conn.expire, 0)
+	}
+}
 
-	raw, loaded := h.KeyConn.Load(key)
-	if !loaded {
-		return nil
+// Kick connection of device, or connections of all devices if device is empty.
+// Returns number of kicked connections.
+func (h *Hub) Kick(key, device string) int {
+	kc := h.keyConnections(key)
+	if kc == nil {
+		return 0
 	}
-	if conn, loaded = raw.(*Connection); !loaded {
-		return nil
+	kicked := 0
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	for d, conn := range kc.devices {
+		if device == "" || d == device {
+			conn.Kick()
+			kicked++
+		}
 	}
-	if conn.State != CONN_CONNECTED {
-		return nil
+	return kicked
+}
+
+// Route returns connections of all devices related to key.
+func (h *Hub) Route(key string, buf []*Connection) []*Connection {
+	buf = buf[0:0]
+	kc := h.keyConnections(key)
+	if kc == nil {
+		return buf
+	}
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	for _, conn := range kc.devices {
+		if conn.State == CONN_CONNECTED {
+			buf = append(buf, conn)
+		}
 	}
-	return conn
+	return buf
 }
 
-// Push messages by key.
+// Push messages to all devices by key.
 func (h *Hub) KeyPush(key string, msgs []*proto.Message) (uint, uint) {
-	var conn *Connection
-	if conn = h.Route(key); conn == nil {
-		return 0, 0
+	var pushed, overrided uint
+	conns := h.Route(key, nil)
+	for _, conn := range conns {
+		p, o := conn.Push(msgs)
+		pushed += p
+		overrided += o
 	}
-	return conn.Push(msgs)
+	metricPushFanout.Observe(float64(len(conns)))
+	metricPushMessages.Add(float64(pushed))
+	return pushed, overrided
 }
 
 // Push groups of messages.
 func (h *Hub) Push(groups []proto.MessageGroup) error {
 	for _, g := range groups {
+		span := trace.Continue(g.Trace, "gate.hub_push")
+		var pushed uint
 		for _, key := range g.Keys {
-			h.KeyPush(key, g.Msgs)
+			p, _ := h.KeyPush(key, g.Msgs)
+			pushed += p
 		}
+		span.Tag("keys", strconv.Itoa(len(g.Keys)))
+		span.Tag("pushed", strconv.FormatUint(uint64(pushed), 10))
+		span.Finish(nil)
 	}
 	return nil
 }
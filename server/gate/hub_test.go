@@ -0,0 +1,67 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/proto"
+	"strconv"
+	"testing"
+)
+
+func testMessages(count int) []*proto.Message {
+	msgs := make([]*proto.Message, count)
+	for idx := range msgs {
+		msgs[idx] = &proto.Message{
+			MessageIdentifier: proto.MessageIdentifier{Timestamp: 1, Sequence: uint32(idx)},
+			MessageBody:       &proto.MessageBody{Raw: strconv.Itoa(idx)},
+		}
+	}
+	return msgs
+}
+
+func testHubConnect(t *testing.T, h *Hub, key, device string) *Connection {
+	go func() { <-h.sigRoute }()
+	conn, err := h.Connect(key, device, ConnectMetadata{Timeout: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.State = CONN_CONNECTED
+	return conn
+}
+
+func TestConnectionPushCount(t *testing.T) {
+	h := NewHub(ConnectMetadata{}, 4)
+	conn := testHubConnect(t, h, "ns.user", "d1")
+	size := int(conn.Buf.Size())
+
+	pushed, overrided := conn.Push(testMessages(size))
+	if pushed != uint(size) || overrided != 0 {
+		t.Fatalf("expected %v pushed without overriding, got %v pushed and %v overrided", size, pushed, overrided)
+	}
+
+	// Full ring keeps the latest messages.
+	pushed, overrided = conn.Push(testMessages(3))
+	if pushed != 3 || overrided != 3 {
+		t.Fatalf("expected 3 pushed and 3 overrided, got %v and %v", pushed, overrided)
+	}
+	buf := conn.Receive(make([]proto.Message, 0, size), size, 1, 0)
+	if len(buf) != size {
+		t.Fatalf("expected %v messages in ring, got %v", size, len(buf))
+	}
+	if last := buf[len(buf)-1].MessageIdentifier.Sequence; last != 2 {
+		t.Fatalf("expected the latest message with sequence 2, got %v", last)
+	}
+}
+
+func TestHubPushCount(t *testing.T) {
+	h := NewHub(ConnectMetadata{}, 64)
+	testHubConnect(t, h, "ns.user", "d1")
+	testHubConnect(t, h, "ns.user", "d2")
+
+	// Messages are counted for each device.
+	pushed, overrided := h.KeyPush("ns.user", testMessages(5))
+	if pushed != 10 || overrided != 0 {
+		t.Fatalf("expected 10 pushed without overriding, got %v pushed and %v overrided", pushed, overrided)
+	}
+	if pushed, _ = h.KeyPush("ns.nobody", testMessages(5)); pushed != 0 {
+		t.Fatalf("expected nothing pushed to unknown key, got %v", pushed)
+	}
+}
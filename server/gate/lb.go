@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
@@ -11,6 +12,37 @@ import (
 var ErrNodeMissing = errors.New("load balancer: No avaliable RPC endpoint.")
 var ErrNodeType = errors.New("Wrong type of endpoint.")
 
+// Load balancing strategies.
+const (
+	LB_ROUND_ROBIN = "round-robin"
+	// Smooth weighted round-robin.
+	LB_WEIGHTED = "weighted"
+	// Fewest requests in flight per weight.
+	LB_LEAST_OUTSTANDING = "least-outstanding"
+	// Lowest EWMA latency multiplied by requests in flight, per weight.
+	LB_EWMA = "ewma"
+)
+
+var LBStrategies = []string{LB_ROUND_ROBIN, LB_WEIGHTED, LB_LEAST_OUTSTANDING, LB_EWMA}
+
+func IsLBStrategy(name string) bool {
+	for _, strategy := range LBStrategies {
+		if strategy == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Operation types whose strategies are configured separately.
+const (
+	LB_OP_DEFAULT = uint8(iota)
+	LB_OP_CONNECT
+	LB_OP_SUBSCRIBE
+	LB_OP_ENTITY
+	lbOpCount
+)
+
 type ServiceLB struct {
 	lock sync.RWMutex
 	ring *server.HashRing
@@ -18,6 +50,11 @@ type ServiceLB struct {
 	FromName map[string]*server.RPCNode
 	round    uint32
 
+	strategies [lbOpCount]string
+	// Current weights of smooth weighted round-robin.
+	wrrLock    sync.Mutex
+	wrrCurrent map[*server.RPCNode]int64
+
 	event        chan *server.RPCNodeEvent
 	running      sync.Map
 	runningCount uint32
@@ -25,11 +62,60 @@ type ServiceLB struct {
 }
 
 func NewLB() *ServiceLB {
-	return &ServiceLB{
-		ring:     server.NewEmptyHashRing(),
-		event:    make(chan *server.RPCNodeEvent),
-		stop:     make(chan struct{}, 1),
-		FromName: make(map[string]*server.RPCNode),
+	lb := &ServiceLB{
+		ring:       server.NewEmptyHashRing(),
+		event:      make(chan *server.RPCNodeEvent),
+		stop:       make(chan struct{}, 1),
+		FromName:   make(map[string]*server.RPCNode),
+		wrrCurrent: make(map[*server.RPCNode]int64),
+	}
+	for op := range lb.strategies {
+		lb.strategies[op] = LB_ROUND_ROBIN
+	}
+	return lb
+}
+
+// SetStrategy sets strategy of operation type.
+func (lb *ServiceLB) SetStrategy(op uint8, strategy string) error {
+	if op >= lbOpCount {
+		return errors.New("Unknown operation type.")
+	}
+	if !IsLBStrategy(strategy) {
+		return errors.New("Unknown load balancing strategy \"" + strategy + "\".")
+	}
+	lb.lock.Lock()
+	lb.strategies[op] = strategy
+	lb.lock.Unlock()
+	return nil
+}
+
+// SetHashing sets virtual points of each node on hash ring,
+// and bounds key share of node to (100 + loadBound)% of average. Load is not bounded if loadBound is 0.
+func (lb *ServiceLB) SetHashing(replicas, loadBound uint) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	lb.ring.SetReplicas(int(replicas))
+	if loadBound == 0 {
+		lb.ring.SetLoadBound(-1)
+	} else {
+		lb.ring.SetLoadBound(float64(loadBound) / 100)
+	}
+}
+
+// Shares returns share of key space owned by nodes, regardless of failover.
+func (lb *ServiceLB) Shares() map[string]float64 {
+	lb.lock.RLock()
+	defer lb.lock.RUnlock()
+	shares := make(map[string]float64)
+	for _, share := range lb.ring.Shares() {
+		shares[share.Bucket.(*server.RPCNode).Name] = share.Share
+	}
+	return shares
+}
+
+func (lb *ServiceLB) logShares() {
+	for name, share := range lb.Shares() {
+		log.Infof0("Node \"%v\" owns %.2f%% of key space.", name, share*100)
 	}
 }
 
@@ -39,6 +125,18 @@ func (lb *ServiceLB) Node(name string) *server.RPCNode {
 	return lb.FromName[name]
 }
 
+// Nodes returns all nodes sorted by name.
+func (lb *ServiceLB) Nodes() []*server.RPCNode {
+	lb.lock.RLock()
+	nodes := make([]*server.RPCNode, 0, len(lb.FromName))
+	for _, node := range lb.FromName {
+		nodes = append(nodes, node)
+	}
+	lb.lock.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
 func (lb *ServiceLB) AddNode(name string, node *server.RPCNode) error {
 	lb.lock.Lock()
 	defer lb.lock.Unlock()
@@ -46,9 +144,38 @@ func (lb *ServiceLB) AddNode(name string, node *server.RPCNode) error {
 		return errors.New("Node \"" + name + "\"already exists.")
 	}
 	lb.FromName[name] = node
+	if !lb.ring.Has(node) {
+		// Ring is built from discovered nodes only, so that all gates hash keys to the same nodes.
+		lb.ring.Append(node)
+		go lb.logShares()
+	}
 	return nil
 }
 
+// nodeHealthy reports whether node is avaliable and not ejected.
+func nodeHealthy(bucket server.Bucket) bool {
+	node, ok := bucket.(*server.RPCNode)
+	return ok && node.State == server.NODE_AVALIABLE && !node.Ejected()
+}
+
+// nodeAvaliable reports whether node is avaliable, ejected or not.
+func nodeAvaliable(bucket server.Bucket) bool {
+	node, ok := bucket.(*server.RPCNode)
+	return ok && node.State == server.NODE_AVALIABLE
+}
+
+// hashHit hits healthy node. Keys of unavaliable or ejected nodes fail over to the next healthy node
+// on ring, while keys of others stay. Ejected nodes are used if no node is healthy.
+func (lb *ServiceLB) hashHit(hash uint32) server.Bucket {
+	lb.lock.RLock()
+	defer lb.lock.RUnlock()
+	if _, bucket := lb.ring.HashHitAccepted(hash, nodeHealthy); bucket != nil {
+		return bucket
+	}
+	_, bucket := lb.ring.HashHitAccepted(hash, nodeAvaliable)
+	return bucket
+}
+
 func (lb *ServiceLB) RemoveNode(name string) {
 	lb.lock.Lock()
 	defer lb.lock.Unlock()
@@ -84,11 +211,8 @@ func (lb *ServiceLB) Keepalive() {
 				switch event.OldState {
 				case server.NODE_UNAVALIABLE:
 					log.Info0("Node \"" + event.Node.Name + "\" becomes avaliable.")
-					lb.ring.Append(event.Node)
-
 				case server.NODE_AVALIABLE:
 					log.Info0("Node \"" + event.Node.Name + "\" becomes unavaliable.")
-					lb.ring.RemoveHash(event.Node.Hash())
 				}
 			}
 			lb.running.Delete(event.Node)
@@ -118,33 +242,153 @@ func (lb *ServiceLB) selectNode(helper func() server.Bucket) (*server.RPCNode, e
 }
 
 func (lb *ServiceLB) HashSelect(h server.Hashable) (*server.RPCNode, error) {
-	return lb.selectNode(func() server.Bucket {
-		lb.lock.RLock()
-		defer lb.lock.RUnlock()
-		_, bucket := lb.ring.Hit(h)
-		return bucket
-	})
+	return lb.HashValueSelect(h.Hash())
 }
 
 func (lb *ServiceLB) HashValueSelect(hash uint32) (*server.RPCNode, error) {
 	return lb.selectNode(func() server.Bucket {
-		lb.lock.RLock()
-		defer lb.lock.RUnlock()
-		_, bucket := lb.ring.HashHit(hash)
-		return bucket
+		return lb.hashHit(hash)
 	})
 }
 
 func (lb *ServiceLB) RoundRobinSelect() (*server.RPCNode, error) {
-	return lb.selectNode(func() server.Bucket {
-		round := atomic.AddUint32(&lb.round, 1)
-		lb.lock.RLock()
-		defer lb.lock.RUnlock()
-		if r := lb.ring.Len(); r <= 0 {
-			round = 0
-		} else {
-			round = round % uint32(r)
+	nodes := lb.avaliableNodes()
+	if len(nodes) < 1 {
+		return nil, ErrNodeMissing
+	}
+	return nodes[atomic.AddUint32(&lb.round, 1)%uint32(len(nodes))], nil
+}
+
+// Select node by strategy of operation type.
+func (lb *ServiceLB) Select(op uint8) (*server.RPCNode, error) {
+	lb.lock.RLock()
+	strategy := LB_ROUND_ROBIN
+	if op < lbOpCount {
+		strategy = lb.strategies[op]
+	}
+	lb.lock.RUnlock()
+	switch strategy {
+	case LB_WEIGHTED:
+		return lb.WeightedSelect()
+	case LB_LEAST_OUTSTANDING:
+		return lb.LeastOutstandingSelect()
+	case LB_EWMA:
+		return lb.EWMASelect()
+	}
+	return lb.RoundRobinSelect()
+}
+
+// avaliableNodes returns healthy nodes, or avaliable nodes if none is healthy.
+func (lb *ServiceLB) avaliableNodes() []*server.RPCNode {
+	lb.lock.RLock()
+	defer lb.lock.RUnlock()
+	for _, accept := range []func(server.Bucket) bool{nodeHealthy, nodeAvaliable} {
+		nodes := make([]*server.RPCNode, 0, lb.ring.Len())
+		for idx := 0; idx < lb.ring.Len(); idx++ {
+			if bucket := lb.ring.At(idx); accept(bucket) {
+				nodes = append(nodes, bucket.(*server.RPCNode))
+			}
+		}
+		if len(nodes) > 0 {
+			return nodes
+		}
+	}
+	return nil
+}
+
+func (lb *ServiceLB) WeightedSelect() (*server.RPCNode, error) {
+	nodes := lb.avaliableNodes()
+	if len(nodes) < 1 {
+		return nil, ErrNodeMissing
+	}
+	lb.wrrLock.Lock()
+	defer lb.wrrLock.Unlock()
+	var (
+		best  *server.RPCNode
+		total int64
+	)
+	for _, node := range nodes {
+		weight := int64(node.Weight())
+		total += weight
+		lb.wrrCurrent[node] += weight
+		if best == nil || lb.wrrCurrent[node] > lb.wrrCurrent[best] {
+			best = node
+		}
+	}
+	lb.wrrCurrent[best] -= total
+	// Forget nodes gone.
+	if len(lb.wrrCurrent) > len(nodes) {
+		exists := make(map[*server.RPCNode]struct{}, len(nodes))
+		for _, node := range nodes {
+			exists[node] = struct{}{}
+		}
+		for node := range lb.wrrCurrent {
+			if _, ok := exists[node]; !ok {
+				delete(lb.wrrCurrent, node)
+			}
+		}
+	}
+	return best, nil
+}
+
+// scoreSelect selects node with the lowest score.
+// Scanning starts from rotating offset, so that ties are broken evenly.
+func (lb *ServiceLB) scoreSelect(score func(*server.RPCNode) float64) (*server.RPCNode, error) {
+	nodes := lb.avaliableNodes()
+	if len(nodes) < 1 {
+		return nil, ErrNodeMissing
+	}
+	offset := int(atomic.AddUint32(&lb.round, 1) % uint32(len(nodes)))
+	var (
+		best      *server.RPCNode
+		bestScore float64
+	)
+	for idx := range nodes {
+		node := nodes[(offset+idx)%len(nodes)]
+		if s := score(node); best == nil || s < bestScore {
+			best, bestScore = node, s
+		}
+	}
+	return best, nil
+}
+
+func (lb *ServiceLB) LeastOutstandingSelect() (*server.RPCNode, error) {
+	return lb.scoreSelect(func(node *server.RPCNode) float64 {
+		return float64(node.Outstanding()+1) / float64(node.Weight())
+	})
+}
+
+// Latency assumed for nodes never sampled if no node is sampled.
+const LB_EWMA_DEFAULT_LATENCY = 0.1
+
+// ewmaSeed returns median latency in seconds of sampled nodes, which is assumed for nodes never sampled.
+func ewmaSeed(nodes []*server.RPCNode) float64 {
+	sampled := make([]float64, 0, len(nodes))
+	for _, node := range nodes {
+		if latency := node.Latency(); latency > 0 {
+			sampled = append(sampled, latency.Seconds())
+		}
+	}
+	if len(sampled) < 1 {
+		return LB_EWMA_DEFAULT_LATENCY
+	}
+	sort.Float64s(sampled)
+	mid := len(sampled) / 2
+	if len(sampled)%2 == 0 {
+		return (sampled[mid-1] + sampled[mid]) / 2
+	}
+	return sampled[mid]
+}
+
+// EWMASelect assumes median latency for nodes never sampled,
+// so that new nodes are probed without being flooded by requests in flight.
+func (lb *ServiceLB) EWMASelect() (*server.RPCNode, error) {
+	seed := ewmaSeed(lb.avaliableNodes())
+	return lb.scoreSelect(func(node *server.RPCNode) float64 {
+		latency := node.Latency().Seconds()
+		if latency <= 0 {
+			latency = seed
 		}
-		return lb.ring.At(int(round))
+		return latency * float64(node.Outstanding()+1) / float64(node.Weight())
 	})
 }
@@ -0,0 +1,59 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/server"
+	"strconv"
+	"testing"
+)
+
+// Keys of unavaliable node fail over, while keys of other nodes stay.
+func TestLBHashFailover(t *testing.T) {
+	lb := NewLB()
+	for idx := 0; idx < 4; idx++ {
+		name := "svc-" + strconv.Itoa(idx)
+		node := OpenServiceNode(server.NewNodeID(), name, "127.0.0.1:1", "", "/", 1, 1)
+		defer node.Close()
+		node.State = server.NODE_AVALIABLE
+		if err := lb.AddNode(name, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hit := func(hash uint32) *server.RPCNode {
+		node, err := lb.HashValueSelect(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	before := make(map[uint32]*server.RPCNode)
+	for hash := uint32(0); hash < 1<<20; hash += 997 {
+		before[hash*4099] = hit(hash * 4099)
+	}
+
+	down := lb.Node("svc-2")
+	down.State = server.NODE_UNAVALIABLE
+	for hash, node := range before {
+		switch failover := hit(hash); {
+		case failover == down:
+			t.Fatalf("hash %v hits unavaliable node", hash)
+		case node != down && failover != node:
+			t.Fatalf("hash %v moved from %v to %v", hash, node.Name, failover.Name)
+		}
+	}
+	down.State = server.NODE_AVALIABLE
+	for hash, node := range before {
+		if hit(hash) != node {
+			t.Fatalf("hash %v not restored after node recovered", hash)
+		}
+	}
+
+	for _, node := range lb.Nodes() {
+		node.State = server.NODE_UNAVALIABLE
+	}
+	if _, err := lb.HashValueSelect(0); err != ErrNodeMissing {
+		t.Fatalf("expected no node, got %v", err)
+	}
+	if _, err := lb.RoundRobinSelect(); err != ErrNodeMissing {
+		t.Fatalf("expected no node, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package gate
+
+import (
+	"crypto/subtle"
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	gmux "github.com/gorilla/mux"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MANAGE_TOKEN_HEADER = "X-Admin-Token"
+)
+
+type NodeStatus struct {
+	Name      string `json:"name"`
+	Avaliable bool   `json:"avaliable"`
+	Hash      uint32 `json:"hash"`
+
+	// Share of key space. 0 if node is unavaliable.
+	Share float64 `json:"share"`
+
+	Weight      uint32  `json:"weight"`
+	Outstanding int     `json:"outstanding"`
+	Latency     float64 `json:"latency_ms"`
+	Breaker     string  `json:"breaker"`
+}
+
+type KickResult struct {
+	Kicked int `json:"kicked"`
+}
+
+type LogLevelStatus struct {
+	Level uint `json:"level"`
+}
+
+func manageToken(req *http.Request) string {
+	if token := req.Header.Get(MANAGE_TOKEN_HEADER); token != "" {
+		return token
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// manageAuth rejects requests without valid admin token.
+func manageAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := manageToken(req)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(gate.config.AdminToken.Value)) != 1 {
+			ctx := NewEmptyAPIRequestContext(w, req)
+			ctx.Log.Fields["entity"] = "manage"
+			ctx.Log.Warn("Management request from " + req.RemoteAddr + " rejected.")
+			ctx.StatusCode = 403
+			ctx.ResponseError(proto.ACCESS_DEINED, "Invalid admin token.")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func newManageContext(w http.ResponseWriter, req *http.Request) (*APIRequestContext, error) {
+	ctx := NewEmptyAPIRequestContext(w, req)
+	ctx.Log.Fields["entity"] = "manage"
+	ctx.Version = 1
+	if err := req.ParseForm(); err != nil {
+		ctx.ResponseError(proto.INVALID_ARGUMENT, err.Error())
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// ConnectionList lists live connections. Filtered by key if given.
+func ConnectionList(w http.ResponseWriter, req *http.Request) {
+	ctx, err := newManageContext(w, req)
+	if err != nil {
+		return
+	}
+	metas := gate.Hub.Snapshot(nil)
+	if key := req.Form.Get("key"); key != "" {
+		filtered := metas[:0]
+		for _, meta := range metas {
+			if meta.Key == key {
+				filtered = append(filtered, meta)
+			}
+		}
+		metas = filtered
+	}
+	ctx.Data = metas
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+// ConnectionKick closes connection of device, or all connections of user if device is omitted.
+// User is given either by key, or by namespace and user.
+// Kicked clients are free to connect again unless their sessions are revoked.
+func ConnectionKick(w http.ResponseWriter, req *http.Request) {
+	ctx, err := newManageContext(w, req)
+	if err != nil {
+		return
+	}
+	key := req.Form.Get("key")
+	if key == "" {
+		namespace, user := req.Form.Get("namespace"), req.Form.Get("user")
+		if namespace == "" || user == "" {
+			ctx.ResponseError(proto.INVALID_ARGUMENT, "Key or namespace with user required.")
+			return
+		}
+		key = namespace + "." + user
+	}
+	device := req.Form.Get("device")
+	kicked := gate.Hub.Kick(key, device)
+	ctx.Log.Infof0("Kick %v connection(s) of key \"%v\" (device = \"%v\").", kicked, key, device)
+	ctx.Data = &KickResult{Kicked: kicked}
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+// NodeList shows service nodes known by load balancer.
+func NodeList(w http.ResponseWriter, req *http.Request) {
+	ctx, err := newManageContext(w, req)
+	if err != nil {
+		return
+	}
+	nodes, shares := gate.LB.Nodes(), gate.LB.Shares()
+	status := make([]NodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		status = append(status, NodeStatus{
+			Name:      node.Name,
+			Avaliable: node.State == server.NODE_AVALIABLE,
+			Hash:      node.Hash(),
+			Share:     shares[node.Name],
+
+			Weight:      node.Weight(),
+			Outstanding: node.Outstanding(),
+			Latency:     float64(node.Latency()) / float64(time.Millisecond),
+			Breaker:     server.BreakerStateNames[node.BreakerState()],
+		})
+	}
+	ctx.Data = status
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+// NodeRemove removes node from load balancer.
+// Node still published in registry will be discovered again.
+func NodeRemove(w http.ResponseWriter, req *http.Request) {
+	ctx, err := newManageContext(w, req)
+	if err != nil {
+		return
+	}
+	name := gmux.Vars(req)["name"]
+	if gate.LB.Node(name) == nil {
+		ctx.ResponseError(proto.INVALID_ARGUMENT, "Node \""+name+"\" not found.")
+		return
+	}
+	gate.LB.RemoveNode(name)
+	ctx.Log.Info0("Node \"" + name + "\" removed by management API.")
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+func LogLevel(w http.ResponseWriter, req *http.Request) {
+	ctx, err := newManageContext(w, req)
+	if err != nil {
+		return
+	}
+	if req.Method == "PUT" {
+		level, err := strconv.ParseUint(req.Form.Get("level"), 10, 32)
+		if err != nil {
+			ctx.ResponseError(proto.INVALID_ARGUMENT, "Invalid log level.")
+			return
+		}
+		log.SetGlobalLogLevel(uint(level))
+		gate.config.LogLevel.Value = uint(level)
+		ctx.Log.Infof0("Log Level set to %v.", level)
+	}
+	ctx.Data = &LogLevelStatus{Level: log.GlobalLogLevel()}
+	ctx.ResponseError(proto.SUCCEED, "")
+}
+
+func (g *Gate) InitManage() error {
+	g.ManageRouter = gmux.NewRouter()
+
+	log.Info0("Register management endpoint \"/v1/connections\"")
+	g.ManageRouter.HandleFunc("/v1/connections", ConnectionList).Methods("GET")
+	g.ManageRouter.HandleFunc("/v1/connections", ConnectionKick).Methods("DELETE")
+
+	log.Info0("Register management endpoint \"/v1/nodes\"")
+	g.ManageRouter.HandleFunc("/v1/nodes", NodeList).Methods("GET")
+	g.ManageRouter.HandleFunc("/v1/nodes/{name}", NodeRemove).Methods("DELETE")
+
+	log.Info0("Register management endpoint \"/v1/loglevel\"")
+	g.ManageRouter.HandleFunc("/v1/loglevel", LogLevel).Methods("GET", "PUT")
+
+	log.Info0("Register management endpoint \"/debug/pprof\"")
+	g.ManageRouter.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	g.ManageRouter.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	g.ManageRouter.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	g.ManageRouter.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	g.ManageRouter.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	return nil
+}
+
+func (g *Gate) ServeManage() {
+	if g.config.AdminToken.Value == "" {
+		log.Warn("No admin token configured. Management API disabled.")
+		return
+	}
+	endpoint := g.config.ManageEndpoint.AuthorityString()
+	log.Info0("Create management API server. Endpoint is \"" + endpoint + "\"")
+	g.Manage = &http.Server{
+		Addr: endpoint,
+		Handler: log.TagLogHandler(manageAuth(g.ManageRouter), map[string]interface{}{
+			"entity": "manage",
+		}),
+	}
+
+	log.Info0("Serving management API...")
+	if err := g.Manage.ListenAndServe(); err != nil {
+		g.fatal <- err
+		log.Fatal("Management API server failure: " + err.Error())
+	}
+}
@@ -0,0 +1,19 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/utils/metrics"
+)
+
+var (
+	metricRingOverflows = metrics.NewCounter("linker_gate_ring_overflows_total", "Pushes finding connection ring buffer full.")
+	metricRingDrops     = metrics.NewCounter("linker_gate_ring_drops_total", "Messages dropped by connection ring buffer.")
+	metricPullSeconds   = metrics.NewHistogramVec("linker_gate_pull_seconds", "Latency of HTTP message pulling.", metrics.DefaultBuckets, "ack")
+	metricPushFanout    = metrics.NewHistogram("linker_gate_push_fanout", "Connections reached by each pushed key.", metrics.SizeBuckets)
+	metricPushMessages  = metrics.NewCounter("linker_gate_push_messages_total", "Messages written to connections.")
+)
+
+func (g *Gate) initMetrics() {
+	metrics.NewGaugeFunc("linker_gate_connections", "Active hub connections.", func() float64 {
+		return float64(g.Hub.Count())
+	})
+}
@@ -0,0 +1,553 @@
+package gate
+
+import (
+	"context"
+	"errors"
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/Sunmxt/linker-im/utils/mqtt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MQTT_MAX_PACKET_SIZE = 1 << 20
+	MQTT_MAX_INFLIGHT    = 1024
+	// Seconds to keep state of disconnected client without clean session.
+	MQTT_SESSION_EXPIRE = 3600
+)
+
+var ErrMQTTProtocolViolation = errors.New("MQTT protocol violation.")
+
+type mqttInflight struct {
+	Publish *mqtt.Publish
+	Sent    time.Time
+}
+
+// mqttSession is state of client without clean session, kept across connections.
+// Session is reused on reconnecting, so that messages queued for its hub connection are delivered.
+// Subscriptions are restored and inflight QoS 1 messages are redelivered.
+type mqttSession struct {
+	namespace string
+	session   string
+	qos       map[string]uint8
+	inflight  map[uint16]*mqttInflight
+	packetID  uint16
+	saved     time.Time
+}
+
+// mqttConnection maps a MQTT client to gate operations.
+// Topics are in form "<namespace>/<group>". Username of CONNECT is namespace.
+// Direct messages use topic "<namespace>/@<peer>". Subscribing such topic only sets QoS of delivery.
+type mqttConnection struct {
+	Conn      net.Conn
+	Namespace string
+	Window    time.Duration
+	Idle      time.Duration // Read deadline. 0 if client disables keepalive.
+	stream    *streamSession
+	client    string          // Key and client ID. Empty if client ID is empty.
+	persist   string          // Key of kept state. Empty for clean session.
+	ctx       context.Context // Done once connection closed.
+	done      chan struct{}   // Closed after connection closed and state saved.
+
+	lock      sync.Mutex // write lock.
+	stateLock sync.Mutex
+	qos       map[string]uint8
+	inflight  map[uint16]*mqttInflight
+	packetID  uint16
+
+	log *log.Logger
+}
+
+func (c *mqttConnection) write(typ, flags uint8, body []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Window))
+	return mqtt.WritePacket(c.Conn, typ, flags, body)
+}
+
+func (c *mqttConnection) group(topic string) (string, bool) {
+	parts := strings.SplitN(topic, "/", 2)
+	if len(parts) < 2 || parts[0] != c.Namespace || parts[1] == "" || strings.ContainsAny(parts[1], "+#") {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (c *mqttConnection) nextPacketID() uint16 {
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	return c.packetID
+}
+
+func (c *mqttConnection) publish(pub *mqtt.Publish) error {
+	flags, body := pub.Encode()
+	return c.write(mqtt.PUBLISH, flags, body)
+}
+
+func (c *mqttConnection) deliver(msgs []proto.Message) error {
+	self := c.stream.User()
+	for idx := range msgs {
+		group := directGroup(msgs[idx].MessageBody, self)
+		pub := &mqtt.Publish{
+			Topic:   c.Namespace + "/" + group,
+			Payload: []byte(msgs[idx].Raw),
+		}
+		c.stateLock.Lock()
+		if qos := c.qos[group]; qos > 0 {
+			if len(c.inflight) < MQTT_MAX_INFLIGHT {
+				pub.QoS, pub.PacketID = 1, c.nextPacketID()
+				c.inflight[pub.PacketID] = &mqttInflight{
+					Publish: pub,
+					Sent:    time.Now(),
+				}
+			} else {
+				c.log.Warn("Too many inflight messages. Deliver with QoS 0.")
+			}
+		}
+		c.stateLock.Unlock()
+		if err := c.publish(pub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redeliver QoS 1 messages not acknowledged within a window.
+func (c *mqttConnection) redeliver() error {
+	return c.redeliverBefore(time.Now().Add(-c.Window))
+}
+
+// resend redelivers all inflight QoS 1 messages.
+func (c *mqttConnection) resend() error {
+	return c.redeliverBefore(time.Now().Add(time.Second))
+}
+
+func (c *mqttConnection) redeliverBefore(notAfter time.Time) error {
+	resend := make([]*mqtt.Publish, 0)
+	c.stateLock.Lock()
+	for _, inflight := range c.inflight {
+		if inflight.Sent.Before(notAfter) {
+			inflight.Publish.Dup = true
+			inflight.Sent = time.Now()
+			resend = append(resend, inflight.Publish)
+		}
+	}
+	c.stateLock.Unlock()
+	for _, pub := range resend {
+		if err := c.publish(pub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeover closes the previous connection of the same client, and waits until its state saved.
+func (c *mqttConnection) takeover() {
+	raw, _ := gate.mqttClients.Load(c.client)
+	if prev, _ := raw.(*mqttConnection); prev != nil && prev != c {
+		c.log.Info1("MQTT client reconnects. Close the previous connection.")
+		prev.Conn.Close()
+		select {
+		case <-prev.done:
+		case <-time.After(c.Window):
+			c.log.Warn("MQTT previous connection not closed in time.")
+		}
+	}
+	gate.mqttClients.Store(c.client, c)
+}
+
+// loadState takes kept state of client. Returns nil if no state kept.
+func (c *mqttConnection) loadState() *mqttSession {
+	raw, ok := gate.mqttSessions.Load(c.client)
+	if !ok {
+		return nil
+	}
+	gate.mqttSessions.Delete(c.client)
+	state, _ := raw.(*mqttSession)
+	if state != nil && time.Since(state.saved) > MQTT_SESSION_EXPIRE*time.Second {
+		go revokeMQTTSession(state.namespace, state.session)
+		return nil
+	}
+	return state
+}
+
+// restore subscribes groups of kept state again, and takes its inflight messages.
+func (c *mqttConnection) restore(state *mqttSession) {
+	for group := range state.qos {
+		if !strings.HasPrefix(group, proto.DIRECT_GROUP_PREFIX) {
+			if _, code, msg := c.stream.Serve(proto.OP_SUB, group, nil); code != proto.SUCCEED {
+				c.log.Info1("MQTT restoring subscription of \"" + group + "\" failure: " + msg)
+				delete(state.qos, group)
+			}
+		}
+	}
+	c.stateLock.Lock()
+	c.qos, c.inflight, c.packetID = state.qos, state.inflight, state.packetID
+	c.stateLock.Unlock()
+}
+
+// revokeMQTTSession revokes session no longer used by client.
+func revokeMQTTSession(namespace, session string) {
+	ctx, cancel := context.WithTimeout(context.Background(), STREAM_DEFAULT_WINDOW*time.Millisecond)
+	defer cancel()
+	if err := gate.disconnect(ctx, namespace, session); err != nil {
+		log.Warn("MQTT session revoking failure: " + err.Error())
+	}
+}
+
+// close saves state of client without clean session, or revokes session of client with clean session.
+func (c *mqttConnection) close() {
+	if c.stream == nil {
+		return
+	}
+	c.stream.Close()
+	if c.persist != "" {
+		c.save()
+	} else {
+		revokeMQTTSession(c.Namespace, c.stream.Session)
+	}
+}
+
+// save keeps state of client without clean session. Expired states are dropped.
+func (c *mqttConnection) save() {
+	if c.persist == "" {
+		return
+	}
+	now := time.Now()
+	gate.mqttSessions.Range(func(k, v interface{}) bool {
+		state, _ := v.(*mqttSession)
+		if state == nil || now.Sub(state.saved) > MQTT_SESSION_EXPIRE*time.Second {
+			gate.mqttSessions.Delete(k)
+			if state != nil {
+				go revokeMQTTSession(state.namespace, state.session)
+			}
+		}
+		return true
+	})
+	// Copy. Delivery may not stop yet.
+	state := &mqttSession{
+		namespace: c.Namespace,
+		session:   c.stream.Session,
+		qos:       make(map[string]uint8),
+		inflight:  make(map[uint16]*mqttInflight),
+		saved:     now,
+	}
+	c.stateLock.Lock()
+	for group, qos := range c.qos {
+		state.qos[group] = qos
+	}
+	for id, inflight := range c.inflight {
+		state.inflight[id] = inflight
+	}
+	state.packetID = c.packetID
+	c.stateLock.Unlock()
+	gate.mqttSessions.Store(c.persist, state)
+}
+
+func (c *mqttConnection) connect(body []byte) error {
+	var result *proto.ConnectResultV1
+	conn, err := mqtt.DecodeConnect(body)
+	if err != nil {
+		return err
+	}
+	if conn.ProtocolName != "MQTT" || conn.Level != mqtt.PROTOCOL_LEVEL_311 {
+		c.write(mqtt.CONNACK, 0, mqtt.EncodeConnack(false, mqtt.CONNACK_UNACCEPTABLE_PROTOCOL))
+		return ErrMQTTProtocolViolation
+	}
+	c.Namespace = conn.Username
+	ctx, cancel := context.WithTimeout(c.ctx, c.Window)
+	result, err = gate.connect(ctx, &proto.ConnectV1{
+		Credential: conn.Password,
+		Namespace:  c.Namespace,
+		Type:       proto.CONN_BASIC,
+	})
+	cancel()
+	if err != nil {
+		if server.IsAuthError(err) {
+			c.write(mqtt.CONNACK, 0, mqtt.EncodeConnack(false, mqtt.CONNACK_NOT_AUTHORIZED))
+		} else {
+			c.log.Error("MQTT connect failure: " + err.Error())
+			c.write(mqtt.CONNACK, 0, mqtt.EncodeConnack(false, mqtt.CONNACK_SERVER_UNAVALIABLE))
+		}
+		return err
+	}
+	meta := ConnectMetadata{
+		Proto:   PROTO_MQTT,
+		Remote:  c.Conn.RemoteAddr().String(),
+		Timeout: -1,
+	}
+	clean := conn.Flags&mqtt.CONNECT_FLAG_CLEAN_SESSION != 0 || conn.ClientID == ""
+	var state *mqttSession
+	if conn.ClientID != "" {
+		c.client = result.Key + "/" + conn.ClientID
+		c.takeover()
+		if state = c.loadState(); state != nil && clean {
+			go revokeMQTTSession(state.namespace, state.session)
+			state = nil
+		}
+	}
+	if state != nil && state.namespace == c.Namespace {
+		// Reuse session of client, and revoke the new one.
+		if c.stream, err = openStreamSession(c.ctx, c.Namespace, state.session, "bin", meta); err == nil {
+			go revokeMQTTSession(c.Namespace, result.Session)
+		} else {
+			c.log.Info1("MQTT kept session not reusable: " + err.Error())
+		}
+	}
+	if c.stream == nil {
+		if c.stream, err = openStreamSession(c.ctx, c.Namespace, result.Session, "bin", meta); err != nil {
+			c.write(mqtt.CONNACK, 0, mqtt.EncodeConnack(false, mqtt.CONNACK_NOT_AUTHORIZED))
+			return err
+		}
+	}
+	if conn.KeepAlive > 0 {
+		// Allow one and a half keepalive period.
+		c.Window = time.Duration(conn.KeepAlive) * time.Second * 3 / 2
+		c.Idle = c.Window
+	} else {
+		c.Idle = 0
+	}
+	c.log.Fields["ns"] = c.Namespace
+	c.log.Fields["client"] = conn.ClientID
+	present := state != nil
+	if !clean {
+		c.persist = c.client
+	}
+	if present {
+		c.restore(state)
+	}
+	if err = c.write(mqtt.CONNACK, 0, mqtt.EncodeConnack(present, mqtt.CONNACK_ACCEPTED)); err != nil {
+		return err
+	}
+	if present {
+		if err = c.resend(); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		if err := c.stream.Deliver(c.deliver, c.redeliver); err != ErrStreamClosed {
+			c.log.Info1("MQTT delivery stopped: " + err.Error())
+		}
+		c.Conn.Close()
+	}()
+	return nil
+}
+
+func (c *mqttConnection) subscribe(sub *mqtt.Subscribe) error {
+	codes := make([]uint8, len(sub.Topics))
+	for idx, topic := range sub.Topics {
+		group, ok := c.group(topic)
+		if !ok {
+			codes[idx] = mqtt.SUBACK_FAILURE
+			continue
+		}
+		// Direct messages are always delivered.
+		if !strings.HasPrefix(group, proto.DIRECT_GROUP_PREFIX) {
+			if _, code, msg := c.stream.Serve(proto.OP_SUB, group, nil); code != proto.SUCCEED {
+				c.log.Info1("MQTT subscribe \"" + topic + "\" failure: " + msg)
+				codes[idx] = mqtt.SUBACK_FAILURE
+				continue
+			}
+		}
+		qos := sub.QoS[idx]
+		if qos > 1 { // QoS 2 is downgraded.
+			qos = 1
+		}
+		c.stateLock.Lock()
+		c.qos[group] = qos
+		c.stateLock.Unlock()
+		codes[idx] = qos
+	}
+	return c.write(mqtt.SUBACK, 0, mqtt.EncodeSuback(sub.PacketID, codes))
+}
+
+func (c *mqttConnection) unsubscribe(unsub *mqtt.Unsubscribe) error {
+	for _, topic := range unsub.Topics {
+		group, ok := c.group(topic)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(group, proto.DIRECT_GROUP_PREFIX) {
+			if _, code, msg := c.stream.Serve(proto.OP_UNSUB, group, nil); code != proto.SUCCEED {
+				c.log.Info1("MQTT unsubscribe \"" + topic + "\" failure: " + msg)
+			}
+		}
+		c.stateLock.Lock()
+		delete(c.qos, group)
+		c.stateLock.Unlock()
+	}
+	return c.write(mqtt.UNSUBACK, 0, mqtt.EncodePacketID(unsub.PacketID))
+}
+
+func (c *mqttConnection) push(pub *mqtt.Publish) error {
+	if pub.QoS > 1 {
+		c.log.Info1("MQTT QoS 2 not supported.")
+		return ErrMQTTProtocolViolation
+	}
+	group, ok := c.group(pub.Topic)
+	if !ok {
+		return errors.New("Invalid topic \"" + pub.Topic + "\".")
+	}
+	body := proto.MessageBody{Group: group, Raw: string(pub.Payload)}
+	directBody(&body)
+	data, code, msg := c.stream.Serve(proto.OP_PUSH, "", []proto.MessageBody{body})
+	if code == proto.SUCCEED {
+		if results, _ := data.([]*proto.PushResult); len(results) > 0 && results[0] != nil && results[0].Msg != "" {
+			code, msg = proto.SERVER_INTERNAL_ERROR, results[0].Msg
+		}
+	}
+	if code != proto.SUCCEED {
+		// MQTT 3.1.1 has no negative acknowledgement. Disconnect to let client retry.
+		return errors.New("Push failure: " + msg)
+	}
+	if pub.QoS > 0 {
+		return c.write(mqtt.PUBACK, 0, mqtt.EncodePacketID(pub.PacketID))
+	}
+	return nil
+}
+
+func (c *mqttConnection) serve(typ, flags uint8, body []byte) error {
+	switch typ {
+	case mqtt.PUBLISH:
+		pub, err := mqtt.DecodePublish(flags, body)
+		if err != nil {
+			return err
+		}
+		return c.push(pub)
+
+	case mqtt.PUBACK:
+		id, err := mqtt.DecodePacketID(body)
+		if err != nil {
+			return err
+		}
+		c.stateLock.Lock()
+		delete(c.inflight, id)
+		c.stateLock.Unlock()
+		return nil
+
+	case mqtt.SUBSCRIBE:
+		if flags != mqtt.REQUIRED_FLAGS {
+			return ErrMQTTProtocolViolation
+		}
+		sub, err := mqtt.DecodeSubscribe(body)
+		if err != nil {
+			return err
+		}
+		return c.subscribe(sub)
+
+	case mqtt.UNSUBSCRIBE:
+		if flags != mqtt.REQUIRED_FLAGS {
+			return ErrMQTTProtocolViolation
+		}
+		unsub, err := mqtt.DecodeUnsubscribe(body)
+		if err != nil {
+			return err
+		}
+		return c.unsubscribe(unsub)
+
+	case mqtt.PINGREQ:
+		if c.stream != nil {
+			if _, code, msg := c.stream.Serve(proto.OP_KEEPALIVE, "", nil); code != proto.SUCCEED {
+				return errors.New("Keepalive failure: " + msg)
+			}
+		}
+		return c.write(mqtt.PINGRESP, 0, nil)
+
+	case mqtt.DISCONNECT:
+		return ErrStreamClosed
+	}
+	return ErrMQTTProtocolViolation
+}
+
+func (g *Gate) serveMQTTConnection(conn net.Conn) {
+	c := &mqttConnection{
+		Conn:     conn,
+		Window:   STREAM_DEFAULT_WINDOW * time.Millisecond,
+		qos:      make(map[string]uint8),
+		inflight: make(map[uint16]*mqttInflight),
+		log:      log.NewLogger(),
+		done:     make(chan struct{}),
+	}
+	c.log.Fields["entity"] = "mqtt"
+	c.log.Fields["remote"] = conn.RemoteAddr().String()
+	var cancel context.CancelFunc
+	c.ctx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		conn.Close()
+		c.close()
+		if raw, _ := gate.mqttClients.Load(c.client); raw == c {
+			gate.mqttClients.Delete(c.client)
+		}
+		close(c.done)
+	}()
+
+	// First packet should be CONNECT.
+	conn.SetReadDeadline(time.Now().Add(c.Window))
+	typ, _, body, err := mqtt.ReadPacket(conn, MQTT_MAX_PACKET_SIZE)
+	if err != nil {
+		c.log.Info1("MQTT connection closed: " + err.Error())
+		return
+	}
+	if typ != mqtt.CONNECT {
+		c.log.Info1("MQTT connection closed: CONNECT expected.")
+		return
+	}
+	if err = c.connect(body); err != nil {
+		c.log.Info1("MQTT connection rejected: " + err.Error())
+		return
+	}
+
+	for {
+		var flags uint8
+		if c.Idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.Idle))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		if typ, flags, body, err = mqtt.ReadPacket(conn, MQTT_MAX_PACKET_SIZE); err == nil {
+			err = c.serve(typ, flags, body)
+		}
+		if err != nil {
+			if err != ErrStreamClosed {
+				c.log.Info1("MQTT connection closed: " + err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (g *Gate) ServeMQTT() {
+	if g.config.MQTTEndpoint.String() == "" {
+		log.Info0("MQTT endpoint not specified. MQTT disabled.")
+		return
+	}
+	listener, err := net.Listen(g.config.MQTTEndpoint.Scheme, g.config.MQTTEndpoint.AuthorityString())
+	if err != nil {
+		log.Error("MQTT listen failure: " + err.Error())
+		g.fatal <- err
+		return
+	}
+	log.Info0("Serving MQTT at \"" + g.config.MQTTEndpoint.String() + "\"...")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Warn("MQTT accept failure: " + err.Error())
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Error("MQTT Server failure: " + err.Error())
+			g.fatal <- err
+			return
+		}
+		go g.serveMQTTConnection(conn)
+	}
+}
@@ -1,6 +1,7 @@
 package gate
 
 import (
+	"context"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server"
 	sc "github.com/Sunmxt/linker-im/server/svc/client"
@@ -10,21 +11,28 @@ import (
 )
 
 type ServiceDripInterface struct {
+	ID      server.NodeID
 	Name    string
 	Addr    string
 	RPCPath string
+	// Gob over HTTP is used if empty.
+	Codec string
 }
 
-func OpenServiceNode(id server.NodeID, name, addr, rpcPath string, maxConcurrentRequest, maxConnection int) *server.RPCNode {
+func OpenServiceNode(id server.NodeID, name, addr, codec, rpcPath string, maxConcurrentRequest, maxConnection int) *server.RPCNode {
 	return server.OpenRPCNode(id, name, &ServiceDripInterface{
+		ID:      id,
 		Name:    name,
 		Addr:    addr,
 		RPCPath: rpcPath,
+		Codec:   codec,
 	}, maxConcurrentRequest, maxConnection)
 }
 
 func (i *ServiceDripInterface) Keepalive(client *server.RPCClient, event chan *server.RPCNodeEvent) error {
-	_, err := (*sc.ServiceClient)(client).Echo("ping")
+	ctx, cancel := context.WithTimeout(context.Background(), server.RPC_KEEPALIVE_TIMEOUT)
+	defer cancel()
+	_, err := (*sc.ServiceClient)(client).Echo(ctx, "ping")
 	return err
 }
 
@@ -35,7 +43,7 @@ func (i *ServiceDripInterface) Healthy(x interface{}, err error) bool {
 }
 
 func (i *ServiceDripInterface) New() (interface{}, error) {
-	client, err := rpc.DialHTTPPath("tcp", i.Addr, i.RPCPath)
+	client, err := server.DialRPC(i.Addr, i.Codec, i.RPCPath)
 	if err != nil {
 		log.Info0("Failed to connect service endpoint \"" + i.Addr + "\": " + err.Error())
 		return nil, err
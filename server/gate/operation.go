@@ -1,12 +1,16 @@
 package gate
 
 import (
+	"context"
 	"errors"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
 	sc "github.com/Sunmxt/linker-im/server/svc/client"
+	"github.com/Sunmxt/linker-im/server/trace"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type MessageBucket struct {
@@ -15,11 +19,16 @@ type MessageBucket struct {
 	result []proto.PushResult
 }
 
-func (g *Gate) push(namespace, session string, msgs []proto.MessageBody) ([]*proto.PushResult, error) {
+func (g *Gate) push(ctx context.Context, parent proto.TraceContext, namespace, session string, msgs []proto.MessageBody) (result []*proto.PushResult, err error) {
+	span := trace.Start(parent, "gate.push")
+	span.Tag("namespace", namespace)
+	span.Tag("messages", strconv.Itoa(len(msgs)))
+	defer func() { span.Finish(err) }()
+
 	// Dispatch
-	buckets := make(map[uint32]*MessageBucket)
+	buckets, sender := make(map[uint32]*MessageBucket), g.sessionUser(ctx, namespace, session)
 	for idx := range msgs {
-		hash := HashMessage(&msgs[idx])
+		hash := HashMessage(&msgs[idx], sender)
 		bucket, ok := buckets[hash.Hash()]
 		if !ok {
 			bucket = &MessageBucket{
@@ -37,14 +46,14 @@ func (g *Gate) push(namespace, session string, msgs []proto.MessageBody) ([]*pro
 			return nil, err
 		}
 		wg.Add(1)
-		go g.bucketPush(&wg, node, bucket, session, namespace, 0)
+		go g.bucketPush(ctx, &wg, node, bucket, span.Inherit(parent), session, namespace)
 	}
 	wg.Wait()
 
 	// Serialize
-	result := make([]*proto.PushResult, len(msgs))
+	result = make([]*proto.PushResult, len(msgs))
 	for idx := range msgs {
-		bucket := buckets[HashMessage(&msgs[idx]).Hash()]
+		bucket := buckets[HashMessage(&msgs[idx], sender).Hash()]
 		if bucket.result == nil {
 			log.Warn("Gate.push() nil push result.")
 			continue
@@ -63,9 +72,9 @@ func (g *Gate) randomPush(namespace, session string, msgs []proto.MessageBody) (
 	return nil, errors.New("Not implemented.")
 }
 
-func (g *Gate) bucketPush(wg *sync.WaitGroup, node *server.RPCNode, bucket *MessageBucket, session, namespace string, connTimeout int) error {
+func (g *Gate) bucketPush(ctx context.Context, wg *sync.WaitGroup, node *server.RPCNode, bucket *MessageBucket, parent proto.TraceContext, session, namespace string) error {
 	defer wg.Done()
-	client, err := node.Connect(0)
+	client, err := node.ConnectContext(ctx)
 	if err != nil {
 		bucket.result = make([]proto.PushResult, len(bucket.slot))
 		for idx := range bucket.result {
@@ -75,20 +84,21 @@ func (g *Gate) bucketPush(wg *sync.WaitGroup, node *server.RPCNode, bucket *Mess
 		return err
 	}
 
-	if bucket.result, err = (*sc.ServiceClient)(client).Push(namespace, session, bucket.slot); err != nil {
+	if bucket.result, err = (*sc.ServiceClient)(client).Push(ctx, parent, namespace, session, bucket.slot); err != nil {
 		log.Error("bucketPush RPC failure: " + err.Error())
 	}
 	node.Disconnect(client, err)
 	return err
 }
 
-func (g *Gate) roundRobinDo(do func(*sc.ServiceClient) error) error {
+// serviceDo calls service selected by strategy of operation type. Client passed to do should be called with ctx.
+func (g *Gate) serviceDo(ctx context.Context, op uint8, do func(*sc.ServiceClient) error) error {
 	var client *server.RPCClient
-	node, err := g.LB.RoundRobinSelect()
+	node, err := g.LB.Select(op)
 	if err != nil {
 		return err
 	}
-	if client, err = node.Connect(0); err != nil {
+	if client, err = node.ConnectContext(ctx); err != nil {
 		return err
 	}
 	err = do((*sc.ServiceClient)(client))
@@ -96,17 +106,40 @@ func (g *Gate) roundRobinDo(do func(*sc.ServiceClient) error) error {
 	return err
 }
 
-func (g *Gate) subscribe(sub proto.Subscription) error {
-	return g.roundRobinDo(func(client *sc.ServiceClient) error {
-		return client.Subscribe(&sub)
+func (g *Gate) subscribe(ctx context.Context, sub proto.Subscription) error {
+	return g.serviceDo(ctx, LB_OP_SUBSCRIBE, func(client *sc.ServiceClient) error {
+		return client.Subscribe(ctx, &sub)
+	})
+}
+
+func (g *Gate) history(ctx context.Context, query *proto.HistoryQuery) (reply *proto.HistoryReply, err error) {
+	err = g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) (err error) {
+		reply, err = client.History(ctx, query)
+		return err
+	})
+	return
+}
+
+func (g *Gate) historyCheck(ctx context.Context, query *proto.HistoryQuery) (check *proto.MessageCheck, err error) {
+	err = g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) (err error) {
+		check, err = client.HistoryCheck(ctx, query)
+		return err
+	})
+	return
+}
+
+func (g *Gate) presence(ctx context.Context, query *proto.PresenceQuery) (presences []proto.Presence, err error) {
+	err = g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) (err error) {
+		presences, err = client.Presence(ctx, query)
+		return err
 	})
+	return
 }
 
-func (g *Gate) connect(conn *proto.ConnectV1) (*proto.ConnectResultV1, error) {
+func (g *Gate) connect(ctx context.Context, conn *proto.ConnectV1) (*proto.ConnectResultV1, error) {
 	var reply *proto.ConnectResultV1
-	var err error
-	g.roundRobinDo(func(client *sc.ServiceClient) error {
-		reply, err = client.Connect(conn)
+	err := g.serviceDo(ctx, LB_OP_CONNECT, func(client *sc.ServiceClient) (err error) {
+		reply, err = client.Connect(ctx, conn)
 		return err
 	})
 	if err != nil {
@@ -115,14 +148,46 @@ func (g *Gate) connect(conn *proto.ConnectV1) (*proto.ConnectResultV1, error) {
 	if reply.Key == "" {
 		reply.Key = reply.Session
 	}
-	gate.KeySession.Store(conn.Namespace+"."+reply.Session, reply.Key)
+	gate.KeySession.Store(sessionCacheKey(conn.Namespace, reply.Session, 0), reply.Key)
 	return reply, nil
 }
 
-func (g *Gate) hubConnect(session string, meta ConnectMetadata) (*Connection, error) {
-	key := g.sessionKey(session)
-	if key == "" {
-		return nil, server.NewAuthError(errors.New("Connection rejected."))
+// disconnect revokes session and expires its hub connection.
+func (g *Gate) disconnect(ctx context.Context, namespace, session string) error {
+	// Resolve before revoking, since key of revoked session is no longer resolvable.
+	key, _ := g.sessionKey(ctx, namespace, session, 0)
+	err := g.serviceDo(ctx, LB_OP_CONNECT, func(client *sc.ServiceClient) error {
+		return client.Disconnect(ctx, namespace, session)
+	})
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		g.Hub.Expire(key, sessionDevice(namespace+"."+session))
+	}
+	g.KeySession.Delete(sessionCacheKey(namespace, session, 0))
+	g.KeySession.Delete(sessionCacheKey(namespace, session, proto.OP_PULL))
+	return nil
+}
+
+// refreshSession postpones expiration of session at most once per SESSION_REFRESH_INTERVAL for a connection.
+func (g *Gate) refreshSession(ctx context.Context, conn *Connection, namespace, session string) error {
+	if !conn.dueRefresh(time.Now(), SESSION_REFRESH_INTERVAL) {
+		return nil
+	}
+	return g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) error {
+		return client.Keepalive(ctx, namespace, session)
+	})
+}
+
+// hubConnect opens connection of session to pull messages.
+func (g *Gate) hubConnect(ctx context.Context, namespace, session string, meta ConnectMetadata) (*Connection, error) {
+	key, err := g.sessionKey(ctx, namespace, session, proto.OP_PULL)
+	if err != nil {
+		if server.IsAuthError(err) {
+			return nil, server.NewAuthError(ErrConnectionRejected)
+		}
+		return nil, err
 	}
-	return g.Hub.Connect(key, meta)
+	return g.Hub.Connect(key, sessionDevice(namespace+"."+session), meta)
 }
@@ -0,0 +1,50 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/proto"
+	"net/http"
+	"strings"
+)
+
+// Max users queried in one request.
+const PRESENCE_MAX_QUERY_USERS = 1000
+
+func Presence(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	_, session, err := ctx.ParseAndGetMessagingClientTuple()
+	if err != nil {
+		return
+	}
+	// Users are comma-separated. "users" may be repeated.
+	users := make([]string, 0)
+	for _, raw := range ctx.Req.Form["users"] {
+		for _, user := range strings.Split(raw, ",") {
+			if user != "" {
+				users = append(users, user)
+			}
+		}
+	}
+	if len(users) < 1 {
+		ctx.ResponseError(proto.INVALID_ARGUMENT, "Users missing.")
+		return
+	}
+	if len(users) > PRESENCE_MAX_QUERY_USERS {
+		ctx.ResponseError(proto.INVALID_ARGUMENT, "Too many users.")
+		return
+	}
+	if ctx.Data, err = gate.presence(ctx.Context(), &proto.PresenceQuery{
+		Namespace: ctx.Namespace,
+		Session:   session,
+		Users:     users,
+		Trace:     ctx.TraceContext(),
+	}); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	ctx.ResponseError(proto.SUCCEED, "")
+}
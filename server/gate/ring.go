@@ -46,6 +46,21 @@ func (r *Ring) Write(msg *proto.Message, override bool) (bool, error) {
 	return override, nil
 }
 
+// Unread puts messages read back before the earliest message in ring, in the same order.
+// Messages are put back from the last one until ring is full. Returns count of messages put back.
+func (r *Ring) Unread(msgs []proto.Message) int {
+	count := 0
+	for idx := len(msgs) - 1; idx >= 0; idx-- {
+		if r.readc == 0 || r.writec-r.readc > r.mask {
+			break
+		}
+		r.readc--
+		r.buf[r.readc&r.mask] = msgs[idx]
+		count++
+	}
+	return count
+}
+
 func (r *Ring) Read() *proto.Message {
 	if r.Count() == 0 {
 		return nil
@@ -55,6 +70,10 @@ func (r *Ring) Read() *proto.Message {
 	return msg
 }
 
+func (r *Ring) Size() uint64 {
+	return r.mask + 1
+}
+
 func (r *Ring) Count() uint64 {
 	wc, rc := r.writec, r.readc
 	if wc < rc {
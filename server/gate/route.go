@@ -1,25 +1,28 @@
 package gate
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	sc "github.com/Sunmxt/linker-im/server/svc/client"
 	"github.com/gomodule/redigo/redis"
 	"time"
 )
 
-func (g *Gate) sendRoute(rconn redis.Conn, conn *Connection) (int, error) {
+// Presence notification fails if service doesn't reply in time.
+const PRESENCE_NOTIFY_TIMEOUT = 10 * time.Second
+
+func (g *Gate) routeInfoKey(conn *Connection) string {
+	return g.config.RedisPrefix.Value + "{clientinfo-" + conn.key + "}"
+}
+
+// sendRoute publishes route of connection.
+// Keys whose presence may change are recorded in changed.
+func (g *Gate) sendRoute(rconn redis.Conn, conn *Connection, changed map[string]struct{}) (int, error) {
 	var err error
 	var timeout int
 
-	infoKey := g.config.RedisPrefix.Value + "{clientinfo-" + conn.key + "}"
-	if err = rconn.Send("HSET", infoKey, "proto", conn.Meta.Proto); err != nil {
-		return 0, err
-	}
-	if err = rconn.Send("HSET", infoKey, "remote", conn.Meta.Remote); err != nil {
-		return 1, err
-	}
-	if err = rconn.Send("HSET", infoKey, "gate", g.ID.String()); err != nil {
-		return 2, err
-	}
 	if conn.Meta.Timeout <= 0 {
 		if g.config.RouteTimeout.Value > 0 {
 			timeout = int(g.config.RouteTimeout.Value)
@@ -34,12 +37,71 @@ func (g *Gate) sendRoute(rconn redis.Conn, conn *Connection) (int, error) {
 		if timeout < 1 {
 			timeout = 1
 		}
+	}
+
+	now := time.Now()
+	route := proto.ClientRoute{
+		Proto:  conn.Meta.Proto,
+		Remote: conn.Meta.Remote,
+		Gate:   g.ID.String(),
+		Active: conn.LastActive().Unix(),
+		Idle:   conn.Idle(now, g.Hub.IdleTimeout),
+	}
+	if !conn.routed || route.Idle != conn.reportedIdle {
+		conn.routed, conn.reportedIdle = true, route.Idle
+		changed[conn.key] = struct{}{}
+	}
+	if timeout > 0 {
+		route.Expire = now.Unix() + int64(timeout)
+	}
+	raw, err := json.Marshal(&route)
+	if err != nil {
+		return 0, err
+	}
+	infoKey := g.routeInfoKey(conn)
+	if err = rconn.Send("HSET", infoKey, conn.device, raw); err != nil {
+		return 0, err
+	}
+	if timeout > 0 {
+		// Keep routes of all devices alive.
 		if err = rconn.Send("EXPIRE", infoKey, timeout); err != nil {
-			return 3, err
+			return 1, err
 		}
-		return 4, nil
+		return 2, nil
+	}
+	return 1, nil
+}
+
+func (g *Gate) removeRoute(rconn redis.Conn, conn *Connection, changed map[string]struct{}) (int, error) {
+	changed[conn.key] = struct{}{}
+	if err := rconn.Send("HDEL", g.routeInfoKey(conn), conn.device); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Period to refresh routes of all connections.
+func (g *Gate) routeRefreshPeriod() time.Duration {
+	period := time.Duration(g.Hub.Meta.Timeout) * time.Millisecond * 2 / 3
+	if period < time.Millisecond*500 {
+		period = time.Millisecond * 500
 	}
-	return 3, nil
+	return period
+}
+
+func flushRoute(rconn redis.Conn, count *int) error {
+	if *count < 1 {
+		return nil
+	}
+	if err := rconn.Flush(); err != nil {
+		return err
+	}
+	for ; *count > 0; *count-- {
+		if _, err := rconn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (g *Gate) Routing() {
@@ -49,49 +111,57 @@ func (g *Gate) Routing() {
 	)
 	log.Info0("Start client publishing.")
 
-	count, flushTick := 0, time.Tick(time.Millisecond*1000)
+	changed := make(map[string]struct{})
+	count, flushTick, refreshTick := 0, time.Tick(time.Millisecond*1000), time.Tick(g.routeRefreshPeriod())
 	for {
 		rconn = g.Redis.Get()
-		count = 0
-		g.Hub.Visit(func(key string, conn *Connection) bool {
-			cnt, ierr := g.sendRoute(rconn, conn)
-			count += cnt
-			if ierr != nil {
-				err = ierr
-				for len(flushTick) > 0 {
-					<-flushTick
-				}
-				<-flushTick
-				return false
-			}
-			return true
-		})
+		count, err = 0, nil
 
 	RoutePublish:
 		for err == nil {
-			if count > 0 {
-				if err = rconn.Flush(); err != nil {
-					break
+			// Refresh all routes and drop expired connections.
+			for _, conn := range g.Hub.Clean(time.Now()) {
+				cnt, ierr := g.removeRoute(rconn, conn, changed)
+				count += cnt
+				if ierr != nil {
+					err = ierr
+					break RoutePublish
 				}
-				for count > 0 {
-					if _, err = rconn.Receive(); err != nil {
-						break RoutePublish
-					}
-					count--
+			}
+			g.Hub.Visit(func(key string, conn *Connection) bool {
+				cnt, ierr := g.sendRoute(rconn, conn, changed)
+				count += cnt
+				if ierr != nil {
+					err = ierr
+					return false
 				}
+				return true
+			})
+			if err != nil {
+				break
 			}
 
+			if err = flushRoute(rconn, &count); err != nil {
+				break
+			}
+			g.notifyPresence(changed)
+
 		ConnectionReceive:
 			for {
 				select {
 				case conn := <-g.Hub.sigRoute:
-					cnt, ierr := g.sendRoute(rconn, conn)
+					cnt, ierr := g.sendRoute(rconn, conn, changed)
 					count += cnt
 					if ierr != nil {
 						err = ierr
-						break ConnectionReceive
+						break RoutePublish
 					}
 				case <-flushTick:
+					if err = flushRoute(rconn, &count); err != nil {
+						break RoutePublish
+					}
+					g.notifyPresence(changed)
+				case <-refreshTick:
 					break ConnectionReceive
 				}
 			}
@@ -99,6 +169,32 @@ func (g *Gate) Routing() {
 		rconn.Close()
 		if err != nil {
 			log.Error("Route sending failure: " + err.Error())
+			// Back off.
+			for len(flushTick) > 0 {
+				<-flushTick
+			}
+			<-flushTick
 		}
 	}
 }
+
+// notifyPresence asks service to evaluate presence of keys after routes published.
+func (g *Gate) notifyPresence(changed map[string]struct{}) {
+	if len(changed) < 1 {
+		return
+	}
+	keys := make([]string, 0, len(changed))
+	for key := range changed {
+		keys = append(keys, key)
+		delete(changed, key)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), PRESENCE_NOTIFY_TIMEOUT)
+		defer cancel()
+		if err := g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) error {
+			return client.PresenceNotify(ctx, keys)
+		}); err != nil {
+			log.Warn("Presence notification failure: " + err.Error())
+		}
+	}()
+}
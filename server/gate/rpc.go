@@ -4,9 +4,12 @@ import (
 	"errors"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/Sunmxt/linker-im/utils/metrics"
 	"io"
 	"net/http"
 	"net/rpc"
+	"strings"
 )
 
 type GateRPC struct{}
@@ -24,16 +27,22 @@ func (g *Gate) ServeRPC() {
 		g.fatal <- errors.New("Not supported network type: " + g.config.RPCEndpoint.Scheme)
 	}
 
-	log.Info0("RPC Serving...")
-	if err := g.RPC.ListenAndServe(); err != nil {
+	listener, err := server.ListenRPC(g.RPC.Addr, g.RPCServer)
+	if err != nil {
+		log.Error("RPC Server failure: " + err.Error())
+		g.fatal <- err
+		return
+	}
+	log.Info0("RPC Serving... Codecs: " + strings.Join(server.RPCCodecNames(), ", ") + ".")
+	if err := g.RPC.Serve(listener); err != nil {
 		log.Error("RPC Server failure: " + err.Error())
 		g.fatal <- err
 	}
 }
 
 func (g *Gate) InitRPC() error {
-	rpc := rpc.NewServer()
-	rpc.Register(GateRPC{})
+	g.RPCServer = rpc.NewServer()
+	g.RPCServer.Register(GateRPC{})
 
 	// Mux
 	mux := http.NewServeMux()
@@ -41,8 +50,11 @@ func (g *Gate) InitRPC() error {
 	log.Info0("Register RPC health-check endpoint at \"/healthz\"")
 	mux.HandleFunc("/healthz", Health)
 
+	log.Info0("Register metrics endpoint at \"/metrics\"")
+	mux.Handle("/metrics", metrics.Handler())
+
 	log.Info0("Register RPC endpoint at \"" + proto.RPC_PATH + "\"")
-	mux.Handle(proto.RPC_PATH, rpc)
+	mux.Handle(proto.RPC_PATH, g.RPCServer)
 
 	g.RPC = &http.Server{
 		Addr:    g.config.RPCEndpoint.AuthorityString(),
@@ -4,6 +4,7 @@ import (
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server/dig"
 	"github.com/gomodule/redigo/redis"
+	"time"
 )
 
 func (g *Gate) InitService() error {
@@ -11,6 +12,11 @@ func (g *Gate) InitService() error {
 
 	log.Info0("Create service load balancer.")
 	g.LB = NewLB()
+	g.LB.SetHashing(g.config.HashReplicas.Value, g.config.HashLoadBound.Value)
+	g.LB.SetStrategy(LB_OP_DEFAULT, g.config.LBStrategy.Value)
+	g.LB.SetStrategy(LB_OP_CONNECT, g.config.LBConnect.Value)
+	g.LB.SetStrategy(LB_OP_SUBSCRIBE, g.config.LBSubscribe.Value)
+	g.LB.SetStrategy(LB_OP_ENTITY, g.config.LBEntity.Value)
 
 	log.Info0("Redis connection pooling.")
 	g.Redis = &redis.Pool{
@@ -28,11 +34,22 @@ func (g *Gate) InitService() error {
 	if g.Dig, err = dig.Connect("redis", g.Redis, g.config.RedisPrefix.Value); err != nil {
 		return err
 	}
+	if g.config.DigNotify.Value {
+		log.Infof0("Listen for discovery notifications. Full synchronization every %v seconds.", g.config.DigResync.Value)
+		if err = g.Dig.Listen(time.Duration(g.config.DigResync.Value) * time.Second); err != nil {
+			return err
+		}
+	}
 
 	log.Info0("Initialize hub.")
 	g.Hub = NewHub(ConnectMetadata{
 		Timeout: int(g.config.ActiveTimeout.Value),
 	}, g.config.ConnectionBufferSize.Value)
+	if g.config.AckTimeout.Value > 0 {
+		g.Hub.AckTimeout = time.Duration(g.config.AckTimeout.Value) * time.Millisecond
+	}
+	g.Hub.IdleTimeout = time.Duration(g.config.PresenceIdle.Value) * time.Second
+	g.initMetrics()
 
 	return nil
 }
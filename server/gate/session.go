@@ -1,13 +1,125 @@
 package gate
 
-func (g *Gate) sessionKey(session string) string {
+import (
+	"context"
+	"errors"
+	"github.com/Sunmxt/linker-im/server"
+	sc "github.com/Sunmxt/linker-im/server/svc/client"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimal interval to refresh session of a connection.
+	SESSION_REFRESH_INTERVAL = 10 * time.Second
+
+	// Period to cache session keys resolved by service.
+	SESSION_KEY_CACHE_TTL = time.Minute
+	// Max cached session keys.
+	SESSION_KEY_CACHE_MAX_ENTRIES = 65536
+	// Entries evicted at once when cache is full of unexpired entries.
+	SESSION_KEY_CACHE_EVICT_BATCH = SESSION_KEY_CACHE_MAX_ENTRIES / 16
+)
+
+var ErrConnectionRejected = errors.New("Connection rejected.")
+
+type sessionKeyEntry struct {
+	key    string
+	expire time.Time
+}
+
+// SessionKeyCache caches keys of sessions for SESSION_KEY_CACHE_TTL.
+type SessionKeyCache struct {
+	lock    sync.RWMutex
+	entries map[string]*sessionKeyEntry
+}
+
+func (c *SessionKeyCache) Load(session string) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.entries[session]
+	if !ok || time.Now().After(entry.expire) {
+		return "", false
+	}
+	return entry.key, true
+}
+
+func (c *SessionKeyCache) Store(session, key string) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*sessionKeyEntry)
+	}
+	if len(c.entries) >= SESSION_KEY_CACHE_MAX_ENTRIES {
+		for s, entry := range c.entries {
+			if now.After(entry.expire) {
+				delete(c.entries, s)
+			}
+		}
+		// Evict arbitrary entries in batch. They are resolved again when used.
+		for s := range c.entries {
+			if len(c.entries) < SESSION_KEY_CACHE_MAX_ENTRIES-SESSION_KEY_CACHE_EVICT_BATCH {
+				break
+			}
+			delete(c.entries, s)
+		}
+	}
+	c.entries[session] = &sessionKeyEntry{key: key, expire: now.Add(SESSION_KEY_CACHE_TTL)}
+}
+
+func (c *SessionKeyCache) Delete(session string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, session)
+}
+
+// Keys resolved with operation authorized are cached apart from plain keys.
+func sessionCacheKey(namespace, session string, op uint16) string {
+	if op == 0 {
+		return namespace + "." + session
+	}
+	return namespace + "." + session + "/" + strconv.FormatUint(uint64(op), 10)
+}
+
+// sessionKey resolves key of session, authorizing op if not zero. Keys are resolved by service
+// and cached locally, so that sessions connected through any gate are served.
+func (g *Gate) sessionKey(ctx context.Context, namespace, session string, op uint16) (string, error) {
+	cacheKey := sessionCacheKey(namespace, session, op)
+	if key, ok := g.KeySession.Load(cacheKey); ok {
+		return key, nil
+	}
 	var key string
-	raw, ok := g.KeySession.Load(session)
-	if !ok {
-		return ""
+	err := g.serviceDo(ctx, LB_OP_DEFAULT, func(client *sc.ServiceClient) (err error) {
+		key, err = client.SessionKey(ctx, namespace, session, op)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", server.NewAuthError(ErrConnectionRejected)
 	}
-	if key, ok = raw.(string); !ok {
+	g.KeySession.Store(cacheKey, key)
+	return key, nil
+}
+
+// sessionUser returns identifier of session user, or empty string if session unknown.
+func (g *Gate) sessionUser(ctx context.Context, namespace, session string) string {
+	key, err := g.sessionKey(ctx, namespace, session, 0)
+	if err != nil {
 		return ""
 	}
-	return key
+	return strings.TrimPrefix(key, namespace+".")
+}
+
+// sessionDevice returns device identifier of session.
+// Each session is regarded as a device. Session itself is hashed to avoid exposing credential in routes.
+func sessionDevice(session string) string {
+	fnvHash := fnv.New64a()
+	fnvHash.Write([]byte(session))
+	return strconv.FormatUint(fnvHash.Sum64(), 16)
 }
@@ -0,0 +1,117 @@
+package gate
+
+import (
+	"encoding/json"
+	"github.com/Sunmxt/linker-im/proto"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type sseWriter struct {
+	Writer  http.ResponseWriter
+	Flusher http.Flusher
+	After   *proto.MessageIdentifier
+}
+
+func (w *sseWriter) send(msgs []proto.Message) error {
+	var (
+		raw []byte
+		err error
+	)
+	if w.After != nil {
+		// Identifiers are generated by service nodes independently, so they are not ordered across nodes.
+		// Only messages requeued after failed delivery are redelivered. They are requeued ahead of
+		// messages arrived meanwhile, so they lead the first batch. Skip them up to the one matching Last-Event-ID.
+		for idx := range msgs {
+			if msgs[idx].MessageIdentifier == *w.After {
+				msgs = msgs[idx+1:]
+				break
+			}
+		}
+		w.After = nil
+	}
+	for idx := range msgs {
+		if raw, err = json.Marshal(msgs[idx]); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w.Writer, "id: "+msgs[idx].MessageIdentifier.Text()+"\nevent: msg\ndata: "+string(raw)+"\n\n"); err != nil {
+			return err
+		}
+	}
+	w.Flusher.Flush()
+	return nil
+}
+
+func (w *sseWriter) keepalive() error {
+	if _, err := io.WriteString(w.Writer, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	w.Flusher.Flush()
+	return nil
+}
+
+func StreamMessage(w http.ResponseWriter, req *http.Request) {
+	var (
+		enc, session string
+		stream       *streamSession
+	)
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	if enc, session, err = ctx.ParseAndGetMessagingClientTuple(); err != nil {
+		return
+	}
+	writer := &sseWriter{Writer: w}
+	if flusher, ok := w.(http.Flusher); !ok {
+		ctx.ResponseError(proto.SERVER_INTERNAL_ERROR, "Streaming not supported by ResponseWriter.")
+		return
+	} else {
+		writer.Flusher = flusher
+	}
+	lastID := req.Header.Get("Last-Event-ID")
+	if raw, ok := ctx.Req.Form["last"]; lastID == "" && ok && len(raw) > 0 {
+		lastID = raw[0]
+	}
+	if lastID != "" {
+		after, err := proto.ParseMessageIdentifier(lastID)
+		if err != nil {
+			ctx.ResponseError(proto.INVALID_ARGUMENT, "Invalid Last-Event-ID \""+lastID+"\".")
+			return
+		}
+		writer.After = &after
+	}
+
+	if stream, err = openStreamSession(req.Context(), ctx.Namespace, session, enc, ConnectMetadata{
+		Proto:   PROTO_SSE,
+		Remote:  req.RemoteAddr,
+		Timeout: -1,
+	}); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	go func() {
+		<-req.Context().Done()
+		stream.Close()
+	}()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.WriteString(w, "retry: "+strconv.FormatInt(int64(stream.Window()), 10)+"\n\n"); err != nil {
+		stream.Close()
+		return
+	}
+	writer.Flusher.Flush()
+
+	if err = stream.Deliver(writer.send, writer.keepalive); err != ErrStreamClosed {
+		ctx.Log.Info1("SSE delivery stopped: " + err.Error())
+	}
+	stream.Close()
+}
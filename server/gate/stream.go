@@ -0,0 +1,213 @@
+package gate
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default period (in milliseconds) to wait for messages before idle.
+const STREAM_DEFAULT_WINDOW = 5000
+
+var ErrStreamClosed = errors.New("Stream closed.")
+
+// streamSession binds a persistent client transport to a hub connection.
+type streamSession struct {
+	Namespace string
+	Session   string
+	Encoding  string
+	Conn      *Connection
+
+	// Calls to service are canceled once ctx is done, and bounded by window.
+	ctx    context.Context
+	closed uint32
+}
+
+func openStreamSession(ctx context.Context, namespace, session, enc string, meta ConnectMetadata) (*streamSession, error) {
+	callCtx, cancel := context.WithTimeout(ctx, STREAM_DEFAULT_WINDOW*time.Millisecond)
+	defer cancel()
+	conn, err := gate.hubConnect(callCtx, namespace, session, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &streamSession{
+		Namespace: namespace,
+		Session:   session,
+		Encoding:  enc,
+		Conn:      conn,
+		ctx:       ctx,
+	}, nil
+}
+
+// User returns identifier of session user.
+func (s *streamSession) User() string {
+	return strings.TrimPrefix(s.Conn.Key(), s.Namespace+".")
+}
+
+// directBody converts group "@<user>" of binary transports to direct message.
+func directBody(body *proto.MessageBody) {
+	if strings.HasPrefix(body.Group, proto.DIRECT_GROUP_PREFIX) {
+		body.To, body.Group = body.Group[len(proto.DIRECT_GROUP_PREFIX):], ""
+	}
+}
+
+// directGroup returns group of message for binary transports.
+// Direct messages are in group "@<peer>" where peer is the other side of conversation.
+func directGroup(body *proto.MessageBody, self string) string {
+	if body.To == "" {
+		return body.Group
+	}
+	if body.To == self {
+		return proto.DIRECT_GROUP_PREFIX + body.User
+	}
+	return proto.DIRECT_GROUP_PREFIX + body.To
+}
+
+func streamErrorCode(err error) (uint32, string) {
+	if server.IsAuthError(err) {
+		return proto.ACCESS_DEINED, err.Error()
+	}
+	if server.IsRequestError(err) {
+		return proto.INVALID_ARGUMENT, err.Error()
+	}
+	if server.IsTimeoutError(err) {
+		return proto.TIMEOUT, "(rpc timeout) " + err.Error()
+	}
+	log.Error("RPC Error: " + err.Error())
+	return proto.SERVER_INTERNAL_ERROR, "(rpc failure) " + err.Error()
+}
+
+func (s *streamSession) Close() {
+	atomic.StoreUint32(&s.closed, 1)
+}
+
+func (s *streamSession) Closed() bool {
+	return atomic.LoadUint32(&s.closed) != 0 || s.Conn.Kicked()
+}
+
+// Window returns waiting period for messages.
+func (s *streamSession) Window() int {
+	if s.Conn.Meta.Timeout > 0 {
+		return s.Conn.Meta.Timeout
+	}
+	return STREAM_DEFAULT_WINDOW
+}
+
+// callContext returns context of a call to service, which expires in a window.
+func (s *streamSession) callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(s.ctx, time.Duration(s.Window())*time.Millisecond)
+}
+
+// Serve a client request.
+// Returns response data, result code and message.
+func (s *streamSession) Serve(op uint16, group string, msgs []proto.MessageBody) (interface{}, uint32, string) {
+	var err error
+	ctx, cancel := s.callContext()
+	defer cancel()
+	if op != proto.OP_KEEPALIVE { // Keepalive is not client activity.
+		s.Conn.Activate()
+	}
+	switch op {
+	case proto.OP_KEEPALIVE:
+		if err = s.refresh(); err != nil {
+			code, msg := streamErrorCode(err)
+			return nil, code, msg
+		}
+		return nil, proto.SUCCEED, ""
+
+	case proto.OP_PUSH:
+		var result []*proto.PushResult
+		if len(msgs) < 1 {
+			return make([]*proto.PushResult, 0), proto.SUCCEED, ""
+		}
+		if s.Encoding == "b64" {
+			for idx := range msgs {
+				bin, err := base64.StdEncoding.DecodeString(msgs[idx].Raw)
+				if err != nil {
+					return nil, proto.INVALID_ARGUMENT, fmt.Sprintf("Invalid base64 string at message %v.", idx)
+				}
+				msgs[idx].Raw = string(bin)
+			}
+		}
+		if result, err = gate.push(ctx, proto.TraceContext{}, s.Namespace, s.Session, msgs); err != nil {
+			code, msg := streamErrorCode(err)
+			return nil, code, msg
+		}
+		return result, proto.SUCCEED, ""
+
+	case proto.OP_SUB, proto.OP_UNSUB:
+		sub := proto.Subscription{
+			Namespace: s.Namespace,
+			Session:   s.Session,
+			Group:     group,
+			Op:        proto.OP_SUB_ADD,
+		}
+		if op == proto.OP_UNSUB {
+			sub.Op = proto.OP_SUB_CANCEL
+		}
+		if err = gate.subscribe(ctx, sub); err != nil {
+			code, msg := streamErrorCode(err)
+			return nil, code, msg
+		}
+		return nil, proto.SUCCEED, ""
+	}
+
+	return nil, proto.INVALID_ARGUMENT, fmt.Sprintf("Unsupported operation: %v", op)
+}
+
+// refresh postpones expiration of session. Stream is closed if session is no longer valid.
+func (s *streamSession) refresh() error {
+	ctx, cancel := s.callContext()
+	defer cancel()
+	err := gate.refreshSession(ctx, s.Conn, s.Namespace, s.Session)
+	if server.IsAuthError(err) {
+		s.Close()
+	}
+	return err
+}
+
+// Deliver forwards messages from hub connection to client until session closed.
+// idle is called when no message arrived within a window.
+func (s *streamSession) Deliver(send func([]proto.Message) error, idle func() error) error {
+	var err error
+	buf, window := make([]proto.Message, 0, 16), s.Window()
+	for !s.Closed() {
+		if buf = s.Conn.Receive(buf, -1, 1, window); len(buf) < 1 {
+			// Open stream keeps session alive.
+			if err = s.refresh(); err != nil {
+				if server.IsAuthError(err) {
+					return err
+				}
+				log.Warn("Session refreshing failure: " + err.Error())
+			}
+			if idle != nil {
+				if err = idle(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if s.Closed() {
+			s.putBack(buf)
+			return ErrStreamClosed
+		}
+		if err = send(encodeMessages(s.Encoding, buf)); err != nil {
+			// Messages may be partially written. Client skips duplicates by message identifier.
+			s.putBack(buf)
+			return err
+		}
+	}
+	return ErrStreamClosed
+}
+
+// putBack requeues messages not delivered ahead of others. Client reconnecting with the same session takes them first.
+func (s *streamSession) putBack(buf []proto.Message) {
+	s.Conn.PutBack(buf)
+}
@@ -0,0 +1,100 @@
+package gate
+
+import (
+	"context"
+	"errors"
+	"github.com/Sunmxt/linker-im/proto"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMessagesKeepsOrigin(t *testing.T) {
+	msgs := make([]proto.Message, 0, 2)
+	for _, msg := range testMessages(2) {
+		msgs = append(msgs, *msg)
+	}
+	encoded := encodeMessages("b64", msgs)
+	if encoded[0].Raw != "MA==" || encoded[1].Raw != "MQ==" {
+		t.Fatalf("unexpected encoded messages %q, %q", encoded[0].Raw, encoded[1].Raw)
+	}
+	if msgs[0].Raw != "0" || msgs[1].Raw != "1" {
+		t.Fatalf("origin messages modified: %q, %q", msgs[0].Raw, msgs[1].Raw)
+	}
+}
+
+// Messages not delivered are requeued unencoded, ahead of messages arrived later.
+func TestDeliverPutBack(t *testing.T) {
+	h := NewHub(ConnectMetadata{}, 64)
+	conn := testHubConnect(t, h, "ns.user", "d1")
+	s := &streamSession{Namespace: "ns", Encoding: "b64", Conn: conn, ctx: context.Background()}
+
+	msgs := testMessages(3)
+	conn.Push(msgs)
+	failure := errors.New("Broken pipe.")
+	if err := s.Deliver(func([]proto.Message) error { return failure }, nil); err != failure {
+		t.Fatalf("expected send failure, got %v", err)
+	}
+	later := testMessages(5)[3:]
+	conn.Push(later)
+
+	buf := conn.Receive(make([]proto.Message, 0, 8), -1, 1, 0)
+	expected := append(msgs, later...)
+	if len(buf) != len(expected) {
+		t.Fatalf("expected %v messages, got %v", len(expected), len(buf))
+	}
+	for idx := range buf {
+		if buf[idx].MessageIdentifier != expected[idx].MessageIdentifier || buf[idx].Raw != expected[idx].Raw {
+			t.Fatalf("expected %v (%q) at %v, got %v (%q)", expected[idx].MessageIdentifier, expected[idx].Raw, idx, buf[idx].MessageIdentifier, buf[idx].Raw)
+		}
+	}
+}
+
+// The earliest messages requeued are dropped if ring is full.
+func TestConnectionPutBackFull(t *testing.T) {
+	h := NewHub(ConnectMetadata{}, 4)
+	conn := testHubConnect(t, h, "ns.user", "d1")
+	size := int(conn.Buf.Size())
+
+	conn.Push(testMessages(2))
+	buf := conn.Receive(make([]proto.Message, 0, 2), -1, 1, 0)
+	conn.Push(testMessages(size))
+	if count := conn.PutBack(buf); count != 0 {
+		t.Fatalf("expected nothing requeued to full ring, got %v", count)
+	}
+	conn.Receive(make([]proto.Message, 0, size), -1, 1, 0)
+	conn.Push(testMessages(size - 1))
+	if count := conn.PutBack(buf); count != 1 {
+		t.Fatalf("expected 1 message requeued, got %v", count)
+	}
+	if buf = conn.Receive(make([]proto.Message, 0, size), -1, 1, 0); len(buf) != size || buf[0].Sequence != 1 {
+		t.Fatalf("expected the latest message requeued ahead, got %v messages led by sequence %v", len(buf), buf[0].Sequence)
+	}
+}
+
+func TestSSEResume(t *testing.T) {
+	msgs := make([]proto.Message, 0, 4)
+	for _, msg := range testMessages(4) {
+		msgs = append(msgs, *msg)
+	}
+	recorder := httptest.NewRecorder()
+	after := msgs[1].MessageIdentifier
+	w := &sseWriter{Writer: recorder, Flusher: recorder, After: &after}
+	if err := w.send(msgs); err != nil {
+		t.Fatal(err)
+	}
+	// Skipping applies to the first batch only.
+	if err := w.send(msgs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, line[4:])
+		}
+	}
+	expected := []string{msgs[2].MessageIdentifier.Text(), msgs[3].MessageIdentifier.Text(), msgs[0].MessageIdentifier.Text()}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, got %v", expected, ids)
+	}
+}
@@ -0,0 +1,263 @@
+package gate
+
+import (
+	"context"
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"net"
+	"sync"
+	"time"
+)
+
+const TCP_MAX_FRAME_SIZE = 1 << 20
+
+type tcpConnection struct {
+	Conn   net.Conn
+	Window time.Duration
+	stream *streamSession
+	lock   sync.Mutex
+	log    *log.Logger
+
+	// Done once connection closed.
+	ctx context.Context
+}
+
+func (c *tcpConnection) write(op uint16, id, code uint32, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Window))
+	return proto.WriteFrame(c.Conn, op, id, code, payload)
+}
+
+func (c *tcpConnection) writeError(op uint16, id, code uint32, msg string) error {
+	if msg == "" {
+		msg = proto.ErrorCodeText(code)
+	}
+	enc := proto.FrameEncoder{}
+	enc.PutString(msg)
+	return c.write(op, id, code, enc.Buf)
+}
+
+func (c *tcpConnection) keepalive() error {
+	return c.write(proto.OP_KEEPALIVE, 0, proto.SUCCEED, nil)
+}
+
+func (c *tcpConnection) deliver(msgs []proto.Message) error {
+	enc := proto.FrameEncoder{}
+	enc.PutUint32(uint32(len(msgs)))
+	self := c.stream.User()
+	for idx := range msgs {
+		enc.PutUint64(msgs[idx].Timestamp)
+		enc.PutUint32(msgs[idx].Sequence)
+		enc.PutString(msgs[idx].User)
+		enc.PutString(directGroup(msgs[idx].MessageBody, self))
+		enc.PutString(msgs[idx].Raw)
+	}
+	return c.write(proto.OP_PULL, 0, proto.SUCCEED, enc.Buf)
+}
+
+func (c *tcpConnection) connect(hdr *proto.FrameHeader, dec *proto.FrameDecoder) error {
+	var result *proto.ConnectResultV1
+	if c.stream != nil {
+		return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, "Already connected.")
+	}
+	typ, namespace, credential := dec.Uint8(), dec.String(), dec.String()
+	if err := dec.Err(); err != nil {
+		return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, err.Error())
+	}
+	session := credential
+	switch typ {
+	case proto.CONN_SESSION:
+	case proto.CONN_BASIC:
+		var err error
+		ctx, cancel := context.WithTimeout(c.ctx, c.Window)
+		result, err = gate.connect(ctx, &proto.ConnectV1{
+			Credential: credential,
+			Namespace:  namespace,
+			Type:       typ,
+		})
+		cancel()
+		if err != nil {
+			code, msg := streamErrorCode(err)
+			return c.writeError(hdr.Op, hdr.ID, code, msg)
+		}
+		session = result.Session
+	default:
+		return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, "Unknown connection type.")
+	}
+
+	stream, err := openStreamSession(c.ctx, namespace, session, "bin", ConnectMetadata{
+		Proto:   PROTO_TCP,
+		Remote:  c.Conn.RemoteAddr().String(),
+		Timeout: -1,
+	})
+	if err != nil {
+		code, msg := streamErrorCode(err)
+		return c.writeError(hdr.Op, hdr.ID, code, msg)
+	}
+	c.stream = stream
+	c.Window = time.Duration(stream.Window()) * time.Millisecond
+
+	enc := proto.FrameEncoder{}
+	enc.PutString(session)
+	if err = c.write(hdr.Op, hdr.ID, proto.SUCCEED, enc.Buf); err != nil {
+		return err
+	}
+	go func() {
+		if err := stream.Deliver(c.deliver, c.keepalive); err != ErrStreamClosed {
+			c.log.Info1("TCP delivery stopped: " + err.Error())
+		}
+		c.Conn.Close()
+	}()
+	return nil
+}
+
+// decodePush decodes messages in payload of OP_PUSH.
+func decodePush(payload []byte) ([]proto.MessageBody, error) {
+	dec := proto.NewFrameDecoder(payload)
+	count := dec.Uint32()
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	// Each message takes at least 8 bytes. Bound count before allocating.
+	if count > uint32(len(payload)/8) {
+		return nil, proto.ErrFrameTruncated
+	}
+	msgs := make([]proto.MessageBody, count)
+	for idx := range msgs {
+		msgs[idx].Group = dec.String()
+		msgs[idx].Raw = dec.String()
+		directBody(&msgs[idx])
+	}
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (c *tcpConnection) serve(hdr *proto.FrameHeader, payload []byte) error {
+	var (
+		group string
+		msgs  []proto.MessageBody
+	)
+	dec := proto.NewFrameDecoder(payload)
+
+	switch hdr.Op {
+	case proto.OP_CONNECT:
+		return c.connect(hdr, dec)
+
+	case proto.OP_INFO:
+		enc := proto.FrameEncoder{}
+		enc.PutString(gate.ID.String())
+		enc.PutUint32(uint32(c.Window / time.Millisecond))
+		return c.write(hdr.Op, hdr.ID, proto.SUCCEED, enc.Buf)
+
+	case proto.OP_KEEPALIVE:
+		if c.stream == nil {
+			return c.write(hdr.Op, hdr.ID, proto.SUCCEED, nil)
+		}
+
+	case proto.OP_SUB, proto.OP_UNSUB:
+		group = dec.String()
+
+	case proto.OP_PUSH:
+		var err error
+		if msgs, err = decodePush(payload); err != nil {
+			return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, err.Error())
+		}
+
+	default:
+		return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, "Unsupported operation.")
+	}
+	if err := dec.Err(); err != nil {
+		return c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, err.Error())
+	}
+	if c.stream == nil {
+		return c.writeError(hdr.Op, hdr.ID, proto.ACCESS_DEINED, "Not connected.")
+	}
+
+	data, code, msg := c.stream.Serve(hdr.Op, group, msgs)
+	if code != proto.SUCCEED {
+		return c.writeError(hdr.Op, hdr.ID, code, msg)
+	}
+	enc := proto.FrameEncoder{}
+	if results, ok := data.([]*proto.PushResult); ok {
+		enc.PutUint32(uint32(len(results)))
+		for _, result := range results {
+			if result == nil {
+				result = &proto.PushResult{}
+			}
+			enc.PutUint64(result.Timestamp)
+			enc.PutUint32(result.Sequence)
+			enc.PutString(result.Msg)
+		}
+	}
+	return c.write(hdr.Op, hdr.ID, proto.SUCCEED, enc.Buf)
+}
+
+func (g *Gate) serveTCPConnection(conn net.Conn) {
+	c := &tcpConnection{
+		Conn:   conn,
+		Window: time.Duration(g.Hub.Meta.Timeout) * time.Millisecond,
+		log:    log.NewLogger(),
+	}
+	if c.Window <= 0 {
+		c.Window = STREAM_DEFAULT_WINDOW * time.Millisecond
+	}
+	c.log.Fields["entity"] = "tcp"
+	c.log.Fields["remote"] = conn.RemoteAddr().String()
+	var cancel context.CancelFunc
+	c.ctx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		if c.stream != nil {
+			c.stream.Close()
+		}
+		conn.Close()
+	}()
+
+	for {
+		// Clients should send frames (at least OP_KEEPALIVE) within 3 windows.
+		conn.SetReadDeadline(time.Now().Add(c.Window * 3))
+		hdr, payload, err := proto.ReadFrame(conn, TCP_MAX_FRAME_SIZE)
+		if err != nil {
+			if err == proto.ErrFrameTooLarge {
+				c.writeError(hdr.Op, hdr.ID, proto.INVALID_ARGUMENT, err.Error())
+			}
+			c.log.Info1("TCP connection closed: " + err.Error())
+			return
+		}
+		if err = c.serve(hdr, payload); err != nil {
+			c.log.Info1("TCP write failure: " + err.Error())
+			return
+		}
+	}
+}
+
+func (g *Gate) ServeTCP() {
+	if g.config.TCPEndpoint.String() == "" {
+		log.Info0("TCP endpoint not specified. Binary protocol disabled.")
+		return
+	}
+	listener, err := net.Listen(g.config.TCPEndpoint.Scheme, g.config.TCPEndpoint.AuthorityString())
+	if err != nil {
+		log.Error("TCP listen failure: " + err.Error())
+		g.fatal <- err
+		return
+	}
+	log.Info0("Serving binary protocol at \"" + g.config.TCPEndpoint.String() + "\"...")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Warn("TCP accept failure: " + err.Error())
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Error("TCP Server failure: " + err.Error())
+			g.fatal <- err
+			return
+		}
+		go g.serveTCPConnection(conn)
+	}
+}
@@ -0,0 +1,76 @@
+package gate
+
+import (
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodePush(t *testing.T) {
+	enc := proto.FrameEncoder{}
+	enc.PutUint32(2)
+	enc.PutString("g1")
+	enc.PutString("hello")
+	enc.PutString(proto.DIRECT_GROUP_PREFIX + "bob")
+	enc.PutString("hi")
+	msgs, err := decodePush(enc.Buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %v", len(msgs))
+	}
+	if msgs[0].Group != "g1" || msgs[0].Raw != "hello" || msgs[0].To != "" {
+		t.Fatalf("unexpected group message %+v", msgs[0])
+	}
+	if msgs[1].Group != "" || msgs[1].To != "bob" || msgs[1].Raw != "hi" {
+		t.Fatalf("unexpected direct message %+v", msgs[1])
+	}
+
+	// Empty messages take 8 bytes each.
+	enc = proto.FrameEncoder{}
+	enc.PutUint32(1)
+	enc.PutString("")
+	enc.PutString("")
+	if msgs, err = decodePush(enc.Buf); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 empty message, got %v with %v", len(msgs), err)
+	}
+}
+
+func TestDecodePushMalformed(t *testing.T) {
+	for name, payload := range map[string][]byte{
+		"empty":     nil,
+		"short":     {0, 0},
+		"count":     {0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0},
+		"truncated": {0, 0, 0, 1, 0, 0, 0, 5, 'a', 0, 0, 0},
+	} {
+		if msgs, err := decodePush(payload); err != proto.ErrFrameTruncated || msgs != nil {
+			t.Errorf("%v: expected ErrFrameTruncated, got %v messages with %v", name, len(msgs), err)
+		}
+	}
+}
+
+// Malformed pushes are rejected before connected.
+func TestTCPServePushMalformed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &tcpConnection{Conn: server, Window: 5 * time.Second, log: log.NewLogger()}
+
+	enc := proto.FrameEncoder{}
+	enc.PutUint32(1 << 20)
+	go c.serve(&proto.FrameHeader{Op: proto.OP_PUSH, ID: 3}, append(enc.Buf, make([]byte, 64)...))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hdr, payload, err := proto.ReadFrame(client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Op != proto.OP_PUSH || hdr.ID != 3 || hdr.Code != proto.INVALID_ARGUMENT {
+		t.Fatalf("unexpected reply %+v", hdr)
+	}
+	if msg := proto.NewFrameDecoder(payload).String(); msg != proto.ErrFrameTruncated.Error() {
+		t.Fatalf("expected %q, got %q", proto.ErrFrameTruncated.Error(), msg)
+	}
+}
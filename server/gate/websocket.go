@@ -0,0 +1,123 @@
+package gate
+
+import (
+	"encoding/json"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const WEBSOCKET_MAX_FRAME_SIZE = 1 << 20
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Clients are authenticated by session instead of cookies.
+	CheckOrigin: func(req *http.Request) bool { return true },
+}
+
+type webSocketConnection struct {
+	WS     *websocket.Conn
+	Window time.Duration
+	lock   sync.Mutex
+}
+
+func (c *webSocketConnection) write(frame *proto.WebSocketResponseV1) error {
+	if frame.Msg == "" {
+		frame.Msg = proto.ErrorCodeText(frame.Code)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.WS.SetWriteDeadline(time.Now().Add(c.Window))
+	return c.WS.WriteJSON(frame)
+}
+
+func (c *webSocketConnection) ping() error {
+	return c.WS.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.Window))
+}
+
+func (c *webSocketConnection) extendDeadline() {
+	c.WS.SetReadDeadline(time.Now().Add(c.Window * 3))
+}
+
+func WebSocket(w http.ResponseWriter, req *http.Request) {
+	var (
+		enc, session string
+		stream       *streamSession
+		ws           *websocket.Conn
+	)
+	ctx, err := NewRequestContext(w, req, nil)
+	if err != nil {
+		return
+	}
+	ctx.Version = 1
+	if enc, session, err = ctx.ParseAndGetMessagingClientTuple(); err != nil {
+		return
+	}
+	if stream, err = openStreamSession(req.Context(), ctx.Namespace, session, enc, ConnectMetadata{
+		Proto:   PROTO_WEBSOCKET,
+		Remote:  req.RemoteAddr,
+		Timeout: -1,
+	}); err != nil {
+		code, msg := streamErrorCode(err)
+		ctx.ResponseError(code, msg)
+		return
+	}
+	if ws, err = upgrader.Upgrade(w, req, nil); err != nil {
+		// Upgrader has replied with HTTP error.
+		ctx.Log.Info0("WebSocket upgrade failure: " + err.Error())
+		stream.Close()
+		return
+	}
+	conn := &webSocketConnection{
+		WS:     ws,
+		Window: time.Duration(stream.Window()) * time.Millisecond,
+	}
+	defer ws.Close()
+	ws.SetReadLimit(WEBSOCKET_MAX_FRAME_SIZE)
+	conn.extendDeadline()
+	ws.SetPongHandler(func(string) error {
+		conn.extendDeadline()
+		return nil
+	})
+	ctx.Log.Info1("WebSocket connected from " + req.RemoteAddr + ".")
+
+	go func() {
+		err := stream.Deliver(func(msgs []proto.Message) error {
+			return conn.write(&proto.WebSocketResponseV1{
+				Op:   proto.OP_PULL,
+				Data: msgs,
+				Code: proto.SUCCEED,
+			})
+		}, conn.ping)
+		if err != ErrStreamClosed {
+			ctx.Log.Info1("WebSocket delivery stopped: " + err.Error())
+		}
+		ws.Close()
+	}()
+
+	for {
+		var raw []byte
+		frame := proto.WebSocketRequestV1{}
+		if _, raw, err = ws.ReadMessage(); err != nil {
+			break
+		}
+		conn.extendDeadline()
+		reply := &proto.WebSocketResponseV1{}
+		if err = json.Unmarshal(raw, &frame); err != nil {
+			reply.Code, reply.Msg = proto.INVALID_ARGUMENT, err.Error()
+		} else {
+			reply.Op, reply.ID = frame.Op, frame.ID
+			reply.Data, reply.Code, reply.Msg = stream.Serve(frame.Op, frame.Group, frame.Msgs)
+		}
+		if err = conn.write(reply); err != nil {
+			break
+		}
+	}
+	stream.Close()
+	if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		ctx.Log.Info1("WebSocket of " + req.RemoteAddr + " closed: " + err.Error())
+	}
+}
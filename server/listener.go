@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"github.com/Sunmxt/linker-im/log"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Plain RPC connections start with preamble followed by codec name and newline.
+	RPC_CODEC_PREAMBLE = "LINKER-RPC "
+
+	// Max time to wait for first bytes of connection.
+	RPC_SNIFF_TIMEOUT = 10 * time.Second
+
+	RPC_DIAL_TIMEOUT = 10 * time.Second
+)
+
+var ErrListenerClosed = errors.New("Listener closed.")
+
+// DialRPC connects RPC endpoint with codec.
+// Gob over HTTP CONNECT at httpPath is used if codec is empty.
+func DialRPC(addr, codec, httpPath string) (*rpc.Client, error) {
+	if codec == "" {
+		return rpc.DialHTTPPath("tcp", addr, httpPath)
+	}
+	c := GetRPCCodec(codec)
+	if c == nil {
+		return nil, errors.New("Unknown RPC codec \"" + codec + "\".")
+	}
+	conn, err := net.DialTimeout("tcp", addr, RPC_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte(RPC_CODEC_PREAMBLE + codec + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(c.NewClientCodec(conn)), nil
+}
+
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// RPCListener serves plain RPC connections of any registered codec,
+// and passes other connections to HTTP server through Accept().
+type RPCListener struct {
+	net.Listener
+	RPC *rpc.Server
+
+	conns     chan net.Conn
+	err       error // Set before closed. Read after closed.
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func ListenRPC(addr string, server *rpc.Server) (*RPCListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &RPCListener{
+		Listener: listener,
+		RPC:      server,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *RPCListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.close(err)
+			return
+		}
+		go l.sniff(conn)
+	}
+}
+
+func (l *RPCListener) sniff(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(RPC_SNIFF_TIMEOUT))
+	head, _ := r.Peek(len(RPC_CODEC_PREAMBLE))
+	if string(head) != RPC_CODEC_PREAMBLE {
+		conn.SetReadDeadline(time.Time{})
+		select {
+		case l.conns <- &sniffedConn{Conn: conn, r: r}:
+		case <-l.closed:
+			conn.Close()
+		}
+		return
+	}
+	line, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(line, RPC_CODEC_PREAMBLE))
+	codec := GetRPCCodec(name)
+	if codec == nil {
+		log.Warn("Reject RPC connection from " + conn.RemoteAddr().String() + " with unknown codec \"" + name + "\".")
+		conn.Close()
+		return
+	}
+	l.RPC.ServeCodec(codec.NewServerCodec(&sniffedConn{Conn: conn, r: r}))
+}
+
+// Accept returns connections other than plain RPC connections.
+func (l *RPCListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *RPCListener) Close() error {
+	return l.close(nil)
+}
+
+// close stops listener. Accept returns cause if not nil.
+func (l *RPCListener) close(cause error) error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.err = cause
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+const testRPCPath = "/__rpc_test"
+
+type TestEcho struct{}
+
+type TestEchoArgs struct {
+	Text  string
+	Count int
+}
+
+func (TestEcho) Echo(args *TestEchoArgs, reply *TestEchoArgs) error {
+	if args.Count < 0 {
+		return errors.New("Negative count.")
+	}
+	*reply = *args
+	return nil
+}
+
+// testListen serves RPC and HTTP on the same port.
+func testListen(t *testing.T) *RPCListener {
+	server := rpc.NewServer()
+	if err := server.Register(TestEcho{}); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := ListenRPC("127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(testRPCPath, server)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	go http.Serve(listener, mux)
+	return listener
+}
+
+func testEcho(t *testing.T, client *rpc.Client) {
+	args, reply := &TestEchoArgs{Text: "hello", Count: 3}, &TestEchoArgs{}
+	if err := client.Call("TestEcho.Echo", args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if *reply != *args {
+		t.Fatalf("expected %+v, got %+v", args, reply)
+	}
+	err := client.Call("TestEcho.Echo", &TestEchoArgs{Count: -1}, reply)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "Negative count." {
+		t.Fatalf("expected server error, got %v", err)
+	}
+}
+
+func TestListenerServesCodecsAndHTTP(t *testing.T) {
+	listener := testListen(t)
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// Gob over HTTP CONNECT.
+	client, err := DialRPC(addr, "", testRPCPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, client)
+	client.Close()
+
+	// Plain codecs.
+	for _, codec := range RPCCodecNames() {
+		if client, err = DialRPC(addr, codec, ""); err != nil {
+			t.Fatalf("codec %v: %v", codec, err)
+		}
+		testEcho(t, client)
+		client.Close()
+	}
+
+	// Plain HTTP.
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("expected \"ok\", got %q", body)
+	}
+}
+
+func TestListenerRejectsUnknownCodec(t *testing.T) {
+	listener := testListen(t)
+	defer listener.Close()
+
+	if _, err := DialRPC(listener.Addr().String(), "unknown", ""); err == nil {
+		t.Fatal("expected failure dialing with unknown codec")
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(RPC_CODEC_PREAMBLE + "unknown\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("expected connection closed, read %v bytes with %v", n, err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	listener := testListen(t)
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-accepted:
+		if err != ErrListenerClosed {
+			t.Fatalf("expected ErrListenerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept not returned after closed")
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatalf("closing twice: %v", err)
+	}
+}
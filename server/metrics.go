@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/Sunmxt/linker-im/utils/metrics"
+	"github.com/Sunmxt/linker-im/utils/pool"
+)
+
+var poolEventNames = map[uint]string{
+	pool.POOL_NEW:               "new",
+	pool.POOL_NEW_DRIP:          "new_drip",
+	pool.POOL_DESTROY_DRIP:      "destroy_drip",
+	pool.POOL_REMOVE_DRIP:       "remove_drip",
+	pool.POOL_NEW_DRIP_FAILURE:  "new_drip_failure",
+	pool.DRIP_USED_COUNTER_UP:   "used_up",
+	pool.DRIP_USED_COUNTER_DOWN: "used_down",
+}
+
+var (
+	metricPoolEvents      = metrics.NewCounterVec("linker_rpc_pool_events_total", "RPC connection pool events.", "node", "event")
+	metricPoolConnections = metrics.NewGaugeVec("linker_rpc_pool_connections", "Connections in RPC connection pool.", "node")
+	metricPoolInUse       = metrics.NewGaugeVec("linker_rpc_pool_in_use", "RPC requests holding pooled connections.", "node")
+	metricNodeAvaliable   = metrics.NewGaugeVec("linker_rpc_node_avaliable", "Whether RPC node is avaliable (1) or not (0).", "node")
+
+	metricBreakerState       = metrics.NewGaugeVec("linker_rpc_breaker_state", "Circuit breaker state of RPC node. 0 for closed, 1 for open, 2 for half-open.", "node")
+	metricBreakerTransitions = metrics.NewCounterVec("linker_rpc_breaker_transitions_total", "Circuit breaker state transitions of RPC node.", "node", "state")
+)
+
+func observePoolEvent(node string, ctx *pool.NotifyContext) {
+	name, ok := poolEventNames[ctx.Event]
+	if !ok {
+		name = "unknown"
+	}
+	metricPoolEvents.With(node, name).Inc()
+	metricPoolConnections.With(node).Set(float64(ctx.DripCount))
+	switch ctx.Event {
+	case pool.DRIP_USED_COUNTER_UP:
+		metricPoolInUse.With(node).Inc()
+	case pool.DRIP_USED_COUNTER_DOWN:
+		metricPoolInUse.With(node).Dec()
+	}
+}
+
+func observeNodeState(node string, state uint8) {
+	if state == NODE_AVALIABLE {
+		metricNodeAvaliable.With(node).Set(1)
+	} else {
+		metricNodeAvaliable.With(node).Set(0)
+	}
+}
+
+func observeBreakerState(node string, state uint8) {
+	metricBreakerState.With(node).Set(float64(state))
+	metricBreakerTransitions.With(node, BreakerStateNames[state]).Inc()
+}
+
+// forgetNode drops series of closed node.
+func forgetNode(node string) {
+	metricPoolConnections.Delete(node)
+	metricPoolInUse.Delete(node)
+	metricNodeAvaliable.Delete(node)
+	metricBreakerState.Delete(node)
+	for _, name := range BreakerStateNames {
+		metricBreakerTransitions.Delete(node, name)
+	}
+	for _, name := range poolEventNames {
+		metricPoolEvents.Delete(node, name)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,8 +9,12 @@ import (
 	"github.com/Sunmxt/linker-im/utils/pool"
 	guuid "github.com/satori/go.uuid"
 	"hash/fnv"
+	"math"
 	"net/rpc"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Errors
@@ -41,14 +46,54 @@ func (n *NodeID) FromString(raw string) error {
 }
 
 // RPC Node
+// Pooled clients are shared by callers. Each borrowing gets its own RPCClient handle.
 type RPCClient struct {
 	Extra interface{}
 	*rpc.Client
+
+	since time.Time // When borrowed.
+}
+
+// CallContext invokes method and returns ctx.Err() once ctx is done.
+// Reply should not be used if call is abandoned.
+func (c *RPCClient) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if ctx.Done() == nil {
+		return replyError(c.Client.Call(method, args, reply))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Request is written once Go returns.
+	call := c.Client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return replyError(call.Error)
+	case <-ctx.Done():
+	}
+	select {
+	case <-call.Done:
+		return replyError(call.Error)
+	default:
+	}
+	if err := ctx.Err(); err == context.DeadlineExceeded {
+		// Node didn't reply in time.
+		return ReplyTimeoutError{Origin: err}
+	}
+	return ctx.Err()
 }
 
 const (
 	NODE_AVALIABLE   = uint8(0)
 	NODE_UNAVALIABLE = uint8(1)
+
+	// Node not responding to keepalive in time is unavaliable.
+	RPC_KEEPALIVE_TIMEOUT = 5 * time.Second
+
+	// Time constant of latency EWMA. Older samples decay by e every period.
+	RPC_LATENCY_DECAY = 10 * time.Second
+
+	// Failed calls are regarded as latency at least this long, so that failing node is not preferred.
+	RPC_FAILURE_LATENCY = time.Second
 )
 
 type RPCNodeEvent struct {
@@ -69,16 +114,26 @@ type RPCNode struct {
 	id      NodeID
 	hash    uint32
 	ifce    RPCDripInterface
+	closed  uint32
+	weight  uint32
+
+	latencyLock sync.Mutex
+	latency     float64 // EWMA in seconds.
+	sampledAt   time.Time
+
+	breaker *Breaker
 }
 
 func OpenRPCNode(id NodeID, name string, ifce RPCDripInterface, maxConcurrentRequest, maxConnection int) *RPCNode {
 	n := &RPCNode{
-		Name:  name,
-		id:    id,
-		State: NODE_UNAVALIABLE,
-		ifce:  ifce,
+		Name:   name,
+		id:     id,
+		State:  NODE_UNAVALIABLE,
+		ifce:   ifce,
+		weight: 1,
 	}
 	n.ResetHash()
+	n.breaker = NewBreaker(n.breakerChanged)
 	n.clients = pool.NewPool(n, maxConnection, maxConcurrentRequest)
 	return n
 }
@@ -94,8 +149,11 @@ func connectRPCClient(helper func() (*pool.Drip, error)) (*RPCClient, error) {
 		log.Error(err.Error())
 		return nil, err
 	}
-	wrap.Extra = drip
-	return wrap, nil
+	return &RPCClient{
+		Extra:  drip,
+		Client: wrap.Client,
+		since:  time.Now(),
+	}, nil
 }
 
 func (n *RPCNode) Connect(timeout uint32) (*RPCClient, error) {
@@ -104,28 +162,117 @@ func (n *RPCNode) Connect(timeout uint32) (*RPCClient, error) {
 	})
 }
 
+// ConnectContext waits for client until ctx is done.
+func (n *RPCNode) ConnectContext(ctx context.Context) (*RPCClient, error) {
+	return connectRPCClient(func() (*pool.Drip, error) {
+		return n.clients.GetContext(ctx)
+	})
+}
+
 func (n *RPCNode) TryConnect() (*RPCClient, error) {
 	return connectRPCClient(func() (*pool.Drip, error) {
 		return n.clients.Get(false, 0)
 	})
 }
 
+// Disconnect releases client. err is result of calls, which drives latency and breaker.
 func (n *RPCNode) Disconnect(conn *RPCClient, err error) {
+	n.release(conn, err, true)
+}
+
+func (n *RPCNode) release(conn *RPCClient, err error, observe bool) {
 	drip, ok := conn.Extra.(*pool.Drip)
 	if !ok {
 		log.Panic("Broken extra field of RPCClient.")
 	}
+	if observe {
+		latency := time.Since(conn.since)
+		if IsBreakerFailure(err) && latency < RPC_FAILURE_LATENCY {
+			latency = RPC_FAILURE_LATENCY
+		}
+		n.observeLatency(latency)
+		n.breaker.Record(err)
+	}
 	drip.Release(err)
 }
 
+// Ejected reports whether node is ejected by breaker.
+func (n *RPCNode) Ejected() bool {
+	return n.breaker.State() == BREAKER_OPEN
+}
+
+func (n *RPCNode) BreakerState() uint8 {
+	return n.breaker.State()
+}
+
+func (n *RPCNode) breakerChanged(from, to uint8) {
+	switch to {
+	case BREAKER_OPEN:
+		log.Warnf("Node \"%v\" ejected for %v by circuit breaker.", n.Name, n.breaker.OpenPeriod())
+	case BREAKER_HALF_OPEN:
+		log.Infof0("Node \"%v\" readmitted by circuit breaker. (half-open)", n.Name)
+	case BREAKER_CLOSED:
+		log.Infof0("Circuit breaker of node \"%v\" closed.", n.Name)
+	}
+	if atomic.LoadUint32(&n.closed) == 0 {
+		observeBreakerState(n.Name, to)
+	}
+}
+
+func (n *RPCNode) observeLatency(latency time.Duration) {
+	n.latencyLock.Lock()
+	defer n.latencyLock.Unlock()
+	now := time.Now()
+	if n.sampledAt.IsZero() {
+		n.latency = latency.Seconds()
+	} else {
+		alpha := 1 - math.Exp(-float64(now.Sub(n.sampledAt))/float64(RPC_LATENCY_DECAY))
+		n.latency += alpha * (latency.Seconds() - n.latency)
+	}
+	n.sampledAt = now
+}
+
+// Latency returns EWMA of time clients are held by callers. 0 if never sampled.
+func (n *RPCNode) Latency() time.Duration {
+	n.latencyLock.Lock()
+	defer n.latencyLock.Unlock()
+	return time.Duration(n.latency * float64(time.Second))
+}
+
+// Outstanding returns number of requests in flight.
+func (n *RPCNode) Outstanding() int {
+	return n.clients.Used()
+}
+
+// Interface returns drip interface node opened with.
+func (n *RPCNode) Interface() RPCDripInterface {
+	return n.ifce
+}
+
+func (n *RPCNode) Weight() uint32 {
+	return atomic.LoadUint32(&n.weight)
+}
+
+// SetWeight sets load balancing weight. Weight less than 1 is regarded as 1.
+func (n *RPCNode) SetWeight(weight uint32) {
+	if weight < 1 {
+		weight = 1
+	}
+	atomic.StoreUint32(&n.weight, weight)
+}
+
 func (n *RPCNode) Close() {
+	atomic.StoreUint32(&n.closed, 1)
+	n.breaker.Stop()
 	n.clients.Close()
+	forgetNode(n.Name)
 }
 
 func (n *RPCNode) Keepalive(event chan *RPCNodeEvent) error {
 	old, state := n.State, NODE_UNAVALIABLE
-	conn, err := n.Connect(0)
+	conn, err := n.Connect(uint32(RPC_KEEPALIVE_TIMEOUT / time.Millisecond))
 	defer func() {
+		n.State = state
 		if event != nil {
 			event <- &RPCNodeEvent{
 				Node:     n,
@@ -133,8 +280,13 @@ func (n *RPCNode) Keepalive(event chan *RPCNodeEvent) error {
 				NewState: state,
 			}
 		}
-		n.State = state
-		n.Disconnect(conn, err)
+		if atomic.LoadUint32(&n.closed) == 0 {
+			observeNodeState(n.Name, state)
+		}
+		if conn != nil {
+			// Echo is not real traffic. Breaker is not driven by it.
+			n.release(conn, err, false)
+		}
 	}()
 	if err != nil {
 		return err
@@ -175,6 +327,9 @@ func (n *RPCNode) Destroy(x interface{}) {
 
 func (n *RPCNode) Notify(ctx *pool.NotifyContext) {
 	n.ifce.Notify(ctx)
+	if atomic.LoadUint32(&n.closed) == 0 {
+		observePoolEvent(n.Name, ctx)
+	}
 	log.DebugLazy(func() string { return fmt.Sprintf("pool:%v", n.clients) })
 }
 
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"github.com/Sunmxt/linker-im/utils/pool"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDrips dials an echo server over pipes.
+type testDrips struct {
+	server *rpc.Server
+}
+
+func (d *testDrips) New() (interface{}, error) {
+	client, server := net.Pipe()
+	go d.server.ServeConn(server)
+	return rpc.NewClient(client), nil
+}
+
+func (d *testDrips) Destroy(x interface{}) {
+	x.(*rpc.Client).Close()
+}
+
+func (d *testDrips) Healthy(x interface{}, err error) bool {
+	return err != rpc.ErrShutdown
+}
+
+func (d *testDrips) Notify(ctx *pool.NotifyContext) {}
+
+func (d *testDrips) Keepalive(client *RPCClient, event chan *RPCNodeEvent) error {
+	return client.Call("TestEcho.Echo", &TestEchoArgs{}, &TestEchoArgs{})
+}
+
+func TestNodeSharedClients(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(TestEcho{}); err != nil {
+		t.Fatal(err)
+	}
+	// Clients are shared by concurrent callers.
+	node := OpenRPCNode(NewNodeID(), "test-shared", &testDrips{server: server}, 8, 1)
+	defer node.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				client, err := node.ConnectContext(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				reply := &TestEchoArgs{}
+				err = client.Call("TestEcho.Echo", &TestEchoArgs{Text: "x"}, reply)
+				node.Disconnect(client, err)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if used := node.Outstanding(); used != 0 {
+		t.Fatalf("expected all clients released, %v outstanding", used)
+	}
+	if latency := node.Latency(); latency <= 0 || latency > time.Second {
+		t.Fatalf("unexpected latency %v", latency)
+	}
+}
+
+type testSlow struct{}
+
+// Sleep replies after args.Count milliseconds.
+func (testSlow) Sleep(args *TestEchoArgs, reply *TestEchoArgs) error {
+	time.Sleep(time.Duration(args.Count) * time.Millisecond)
+	*reply = *args
+	return nil
+}
+
+// Node answering keepalive but failing half of calls is ejected.
+func TestNodeBreakerCallFailures(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(TestEcho{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterName("TestSlow", testSlow{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fail := range map[string]func(*RPCClient) error{
+		"reply timeout": func(client *RPCClient) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+			err := client.CallContext(ctx, "TestSlow.Sleep", &TestEchoArgs{Count: 100}, &TestEchoArgs{})
+			if _, ok := err.(ReplyTimeoutError); !ok {
+				t.Errorf("expected reply timeout, got %v", err)
+			}
+			return err
+		},
+		"server error": func(client *RPCClient) error {
+			return client.Call("TestEcho.Echo", &TestEchoArgs{Count: -1}, &TestEchoArgs{})
+		},
+	} {
+		node := OpenRPCNode(NewNodeID(), "test-"+name, &testDrips{server: server}, 4, 1)
+		for idx := 0; idx < BREAKER_MIN_CALLS && !node.Ejected(); idx++ {
+			client, err := node.ConnectContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idx%2 == 0 {
+				err = client.Call("TestEcho.Echo", &TestEchoArgs{Text: "x"}, &TestEchoArgs{})
+			} else {
+				err = fail(client)
+			}
+			node.Disconnect(client, err)
+		}
+		if !node.Ejected() {
+			t.Errorf("%v: expected node ejected", name)
+		}
+		node.Close()
+	}
+}
@@ -5,3 +5,16 @@ type SessionPool interface {
 	Register(string, map[string]string) (string, error)
 	Remove(string, string) error
 }
+
+// Session field holding identifier resolved at connecting.
+const SESSION_IDENTIFIER = "$id"
+
+// SessionRefresher is implemented by session pools with idle timeout.
+type SessionRefresher interface {
+	Refresh(namespace, key string) error
+}
+
+// UserSessionRevoker is implemented by session pools able to revoke all sessions of a user.
+type UserSessionRevoker interface {
+	RemoveUser(namespace, user string) (int, error)
+}
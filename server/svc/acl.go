@@ -0,0 +1,319 @@
+package svc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Sunmxt/linker-im/config"
+	ilog "github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	yaml "gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	ACL_EFFECT_ALLOW = "allow"
+	ACL_EFFECT_DENY  = "deny"
+
+	// Period to check ACL file for changes.
+	ACL_RELOAD_PERIOD = 5 * time.Second
+)
+
+var ErrACLNoPolicy = errors.New("No ACL policy loaded.")
+
+// Operation names used in ACL rules.
+var ACLOpNames = map[string]uint16{
+	"sub":       proto.OP_SUB,
+	"unsub":     proto.OP_UNSUB,
+	"connect":   proto.OP_CONNECT,
+	"keepalive": proto.OP_KEEPALIVE,
+	"push":      proto.OP_PUSH,
+	"pull":      proto.OP_PULL,
+	"info":      proto.OP_INFO,
+	"history":   proto.OP_HISTORY,
+	"presence":  proto.OP_PRESENCE,
+	"entity":    proto.OP_ENTITY,
+}
+
+// Operations never authorized by service, so that rules on them take no effect.
+// Info is served by gates. Connect and keepalive carry no session to authorize.
+var aclUncheckedOps = map[string]struct{}{
+	"connect":   struct{}{},
+	"keepalive": struct{}{},
+	"info":      struct{}{},
+}
+
+type aclRule struct {
+	name       string
+	allow      bool
+	namespaces []string
+	ops        map[uint16]struct{}
+	groups     []string
+	session    map[string]string
+}
+
+// ACLPolicy is ordered rule list. The first matching rule decides.
+type ACLPolicy struct {
+	Config *config.ACLConfigure
+
+	defaultAllow bool
+	rules        []*aclRule
+}
+
+// ACLRuleTrace records how a rule is evaluated.
+type ACLRuleTrace struct {
+	Rule    int    `json:"rule"`
+	Name    string `json:"name,omitempty"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ACLDecision is result of ACL evaluation.
+// Rule is -1 if decided by default effect.
+type ACLDecision struct {
+	Allow bool           `json:"allow"`
+	Rule  int            `json:"rule"`
+	Name  string         `json:"name,omitempty"`
+	Trace []ACLRuleTrace `json:"trace,omitempty"`
+}
+
+func aclEffect(effect string) (bool, error) {
+	switch effect {
+	case ACL_EFFECT_ALLOW:
+		return true, nil
+	case ACL_EFFECT_DENY:
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid effect \"%v\".", effect)
+}
+
+func aclCheckPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern \"%v\".", pattern)
+		}
+	}
+	return nil
+}
+
+func NewACLPolicy(cfg *config.ACLConfigure) (*ACLPolicy, error) {
+	var err error
+	p := &ACLPolicy{
+		Config: cfg,
+		rules:  make([]*aclRule, 0, len(cfg.Rules)),
+	}
+	if cfg.Default == "" {
+		cfg.Default = ACL_EFFECT_DENY
+	}
+	if p.defaultAllow, err = aclEffect(cfg.Default); err != nil {
+		return nil, fmt.Errorf("Default: %v", err.Error())
+	}
+	for idx, ruleCfg := range cfg.Rules {
+		rule := &aclRule{
+			name:       ruleCfg.Name,
+			namespaces: ruleCfg.Namespaces,
+			groups:     ruleCfg.Groups,
+			session:    ruleCfg.Session,
+		}
+		if rule.allow, err = aclEffect(ruleCfg.Effect); err != nil {
+			return nil, fmt.Errorf("Rule %v: %v", idx, err.Error())
+		}
+		if len(ruleCfg.Ops) > 0 {
+			rule.ops = make(map[uint16]struct{}, len(ruleCfg.Ops))
+			for _, name := range ruleCfg.Ops {
+				op, ok := ACLOpNames[name]
+				if !ok {
+					return nil, fmt.Errorf("Rule %v: Unknown operation \"%v\".", idx, name)
+				}
+				if _, unchecked := aclUncheckedOps[name]; unchecked {
+					return nil, fmt.Errorf("Rule %v: Operation \"%v\" is not authorized by ACL.", idx, name)
+				}
+				rule.ops[op] = struct{}{}
+			}
+		}
+		for _, patterns := range [][]string{rule.namespaces, rule.groups} {
+			if err = aclCheckPatterns(patterns); err != nil {
+				return nil, fmt.Errorf("Rule %v: %v", idx, err.Error())
+			}
+		}
+		for _, pattern := range rule.session {
+			if err = aclCheckPatterns([]string{pattern}); err != nil {
+				return nil, fmt.Errorf("Rule %v: %v", idx, err.Error())
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+func ParseACLPolicy(raw []byte) (*ACLPolicy, error) {
+	cfg := &config.ACLConfigure{}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("Invalid ACL format: %v", err.Error())
+	}
+	return NewACLPolicy(cfg)
+}
+
+func aclMatchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns reason of mismatch, or empty string if rule matches.
+// Rules with group patterns never match operations without group.
+func (r *aclRule) match(namespace string, op uint16, group string, session map[string]string) string {
+	if len(r.namespaces) > 0 && !aclMatchAny(r.namespaces, namespace) {
+		return "namespace mismatch"
+	}
+	if r.ops != nil {
+		if _, ok := r.ops[op]; !ok {
+			return "operation mismatch"
+		}
+	}
+	if len(r.groups) > 0 && (group == "" || !aclMatchAny(r.groups, group)) {
+		return "group mismatch"
+	}
+	for name, pattern := range r.session {
+		value, ok := session[name]
+		if !ok {
+			return "session attribute \"" + name + "\" missing"
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return "session attribute \"" + name + "\" mismatch"
+		}
+	}
+	return ""
+}
+
+// Evaluate decides operation on group. Trace is recorded if explain is true.
+func (p *ACLPolicy) Evaluate(namespace string, op uint16, group string, session map[string]string, explain bool) *ACLDecision {
+	decision := &ACLDecision{Allow: p.defaultAllow, Rule: -1}
+	for idx, rule := range p.rules {
+		reason := rule.match(namespace, op, group, session)
+		if explain {
+			decision.Trace = append(decision.Trace, ACLRuleTrace{
+				Rule:    idx,
+				Name:    rule.name,
+				Matched: reason == "",
+				Reason:  reason,
+			})
+		}
+		if reason == "" {
+			decision.Allow, decision.Rule, decision.Name = rule.allow, idx, rule.name
+			break
+		}
+	}
+	return decision
+}
+
+// ACLAuthorizer authorizes operations by ACL policy loaded from YAML file.
+// Policy file is reloaded when changed. Connecting and identifier resolution are left
+// to other authorizers, so ACLAuthorizer is expected to be combined with AndAuthorizer.
+type ACLAuthorizer struct {
+	Path string
+	Log  *ilog.Logger
+
+	lock    sync.RWMutex
+	policy  *ACLPolicy
+	modTime time.Time
+	size    int64
+}
+
+func LoadACLAuthorizer(path string) (*ACLAuthorizer, error) {
+	a := &ACLAuthorizer{
+		Path: path,
+		Log:  ilog.NewLogger(),
+	}
+	a.Log.Fields["entity"] = "acl"
+	if _, err := a.Reload(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload loads policy file if it changes or force is true.
+// Current policy is kept when the new one is invalid.
+func (a *ACLAuthorizer) Reload(force bool) (bool, error) {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return false, err
+	}
+	a.lock.RLock()
+	changed := !info.ModTime().Equal(a.modTime) || info.Size() != a.size
+	a.lock.RUnlock()
+	if !changed && !force {
+		return false, nil
+	}
+	raw, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return false, err
+	}
+	policy, err := ParseACLPolicy(raw)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.modTime, a.size = info.ModTime(), info.Size()
+	if err != nil {
+		return false, err
+	}
+	a.policy = policy
+	return true, nil
+}
+
+// Watch reloads policy file periodically.
+func (a *ACLAuthorizer) Watch(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := a.Reload(false)
+		if err != nil {
+			a.Log.Warn("ACL reloading failure: " + err.Error())
+		} else if reloaded {
+			a.Log.Info0("ACL reloaded from \"" + a.Path + "\".")
+		}
+	}
+}
+
+func (a *ACLAuthorizer) Policy() *ACLPolicy {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.policy
+}
+
+func (a *ACLAuthorizer) Connect(namespace, credential string, session map[string]string) error {
+	return nil
+}
+
+func (a *ACLAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
+	return a.AuthResource(namespace, op, "", session)
+}
+
+func (a *ACLAuthorizer) AuthResource(namespace string, op uint16, group string, session map[string]string) error {
+	policy := a.Policy()
+	if policy == nil {
+		return server.NewAuthError(ErrACLNoPolicy)
+	}
+	decision := policy.Evaluate(namespace, op, group, session, false)
+	if decision.Allow {
+		return nil
+	}
+	if decision.Rule < 0 {
+		return server.NewAuthError(errors.New("Denied by ACL default."))
+	}
+	if decision.Name != "" {
+		return server.NewAuthError(fmt.Errorf("Denied by ACL rule \"%v\".", decision.Name))
+	}
+	return server.NewAuthError(fmt.Errorf("Denied by ACL rule %v.", decision.Rule))
+}
+
+func (a *ACLAuthorizer) Identifier(namespace string, session map[string]string) (string, error) {
+	ident, _ := session["u"]
+	return ident, nil
+}
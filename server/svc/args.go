@@ -4,7 +4,19 @@ import (
 	"flag"
 	"fmt"
 	ilog "github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/utils/cmdline"
+	"strings"
+)
+
+const (
+	AUTHORIZER_DEFAULT = "default"
+	AUTHORIZER_JWT     = "jwt"
+	AUTHORIZER_WEBHOOK = "webhook"
+
+	SESSION_POOL_REDIS = "redis"
+	// Stateless pool taking JWT as session. Works with JWT authorizer only.
+	SESSION_POOL_TOKEN = "token"
 )
 
 type ServiceOptions struct {
@@ -21,15 +33,53 @@ type ServiceOptions struct {
 	// RPC Publish.
 	RPCPublish *cmdline.NetEndpointValue
 
+	// Codec of RPC served by service. Advertised to gates.
+	RPCCodec *cmdline.StringValue
+
+	// Load balancing weight advertised to gates.
+	Weight *cmdline.UintValue
+
 	// Redis prefix.
 	// All the name of redis key will be add prefix.
 	// Redis prefix of all Linker Service nodes should be same.
 	RedisPrefix *cmdline.StringValue
 
-	// Cache timeout.
+	// Discover node changes by redis notifications instead of polling.
+	DigNotify *cmdline.BoolValue
+
+	// Seconds between full synchronization of discovery when notified.
+	DigResync *cmdline.UintValue
+
+	// Session idle timeout in milliseconds.
 	// 0 means infinite timeout.
 	CacheTimeout *cmdline.UintValue
 
+	// Session pool. "redis" or "token".
+	SessionPool *cmdline.StringValue
+
+	// Max messages kept in history of each user and group.
+	// 0 disables message history.
+	HistorySize *cmdline.UintValue
+
+	// Authorizer to use. "default", "jwt" or "webhook".
+	Authorizer *cmdline.StringValue
+
+	// YAML configure of JWT authorizer.
+	JWTConfig *cmdline.StringValue
+
+	// YAML configure of webhook authorizer.
+	WebhookConfig *cmdline.StringValue
+
+	// YAML ACL policy applied after authorizer.
+	ACLConfig *cmdline.StringValue
+
+	// Token required by management endpoints.
+	AdminToken *cmdline.StringValue
+
+	// File to export trace spans to, or "stdout".
+	// Tracing is disabled when empty.
+	TraceExport *cmdline.StringValue
+
 	// Persistent storage endpoint to persist sessions and messages.
 	//PersistStorageEndpoint *cmdline.NetEndpointValue
 
@@ -69,7 +119,35 @@ func (opt *ServiceOptions) SetDefault() error {
 	//	ilog.Warnf("No persistent storage endpoint. Session may be lost in %v milliseconds.", opt.CacheTimeout.Value)
 	//}
 	if opt.CacheTimeout.Value < 0 {
-		ilog.Warnf("Cache timeout should not be nagtive. Set to 0.", opt.CacheTimeout.Value)
+		ilog.Warnf("Cache timeout should not be nagtive (%v). Set to 0.", opt.CacheTimeout.Value)
+	}
+	switch opt.Authorizer.Value {
+	case AUTHORIZER_DEFAULT:
+	case AUTHORIZER_JWT:
+		if opt.JWTConfig.Value == "" {
+			return fmt.Errorf("JWT configure not specified.")
+		}
+	case AUTHORIZER_WEBHOOK:
+		if opt.WebhookConfig.Value == "" {
+			return fmt.Errorf("Webhook configure not specified.")
+		}
+	default:
+		return fmt.Errorf("Unknown authorizer \"%v\".", opt.Authorizer.Value)
+	}
+	switch opt.SessionPool.Value {
+	case SESSION_POOL_REDIS:
+	case SESSION_POOL_TOKEN:
+		if opt.Authorizer.Value != AUTHORIZER_JWT {
+			return fmt.Errorf("Session pool \"token\" requires JWT authorizer.")
+		}
+	default:
+		return fmt.Errorf("Unknown session pool \"%v\".", opt.SessionPool.Value)
+	}
+	if server.GetRPCCodec(opt.RPCCodec.Value) == nil {
+		return fmt.Errorf("Unknown RPC codec \"%v\". Supported codecs: %v.", opt.RPCCodec.Value, strings.Join(server.RPCCodecNames(), ", "))
+	}
+	if opt.Weight.Value == 0 {
+		return fmt.Errorf("Weight should not be 0.")
 	}
 	if opt.RPCPublish.Port == 0 || opt.RPCPublish.Port > 0xFFFF {
 		opt.RPCPublish.Port = opt.Endpoint.Port
@@ -105,10 +183,18 @@ func configureParse() (*ServiceOptions, error) {
 
 	options := &ServiceOptions{
 		LogLevel:      cmdline.NewUintValueDefault(0),
-		CacheTimeout:  cmdline.NewUintValueDefault(0),
+		CacheTimeout:  cmdline.NewUintValueDefault(1800000),
+		SessionPool:   cmdline.NewStringValueDefault(SESSION_POOL_REDIS),
 		Endpoint:      RPCEndpoint,
 		RedisEndpoint: redisEndpoint,
 		RedisPrefix:   cmdline.NewStringValueDefault("linker"),
+		HistorySize:   cmdline.NewUintValueDefault(1000),
+		Authorizer:    cmdline.NewStringValueDefault(AUTHORIZER_DEFAULT),
+		JWTConfig:     cmdline.NewStringValue(),
+		WebhookConfig: cmdline.NewStringValue(),
+		ACLConfig:     cmdline.NewStringValue(),
+		AdminToken:    cmdline.NewStringValue(),
+		TraceExport:   cmdline.NewStringValue(),
 		//PersistStorageEndpoint: persistEndpoint,
 		//DisableSessionPersist:  cmdline.NewBoolValueDefault(false),
 		//DisableMessagePersist:  cmdline.NewBoolValueDefault(false),
@@ -116,13 +202,27 @@ func configureParse() (*ServiceOptions, error) {
 		//AsyncSessionPersist:    cmdline.NewBoolValueDefault(false),
 		//AsyncMessagePersist:    cmdline.NewBoolValueDefault(true),
 		RPCPublish: publish,
+		RPCCodec:   cmdline.NewStringValueDefault(server.RPC_CODEC_GOB),
+		Weight:     cmdline.NewUintValueDefault(1),
+		DigNotify:  cmdline.NewBoolValueDefault(false),
+		DigResync:  cmdline.NewUintValueDefault(30),
 	}
 
 	flag.Var(options.LogLevel, "log-level", "Log level.")
 	flag.Var(options.Endpoint, "endpoint", "RPC bing endpoint.")
 	flag.Var(options.RedisEndpoint, "redis-endpoint", "Redis endpoint used for session caching.")
-	flag.Var(options.CacheTimeout, "cache-timeout", "Session cache timeout.")
+	flag.Var(options.CacheTimeout, "cache-timeout", "Session idle timeout in milliseconds. 0 means no timeout.")
+	flag.Var(options.SessionPool, "session-pool", "Session pool. \"redis\" or \"token\".")
 	flag.Var(options.RedisPrefix, "redis-prefix", "Redis key prefix.")
+	flag.Var(options.DigNotify, "dig-notify", "Discover node changes by redis pub/sub notifications instead of polling only.")
+	flag.Var(options.DigResync, "dig-resync", "Seconds between full discovery synchronization when \"-dig-notify\" is enabled.")
+	flag.Var(options.HistorySize, "history-size", "Max messages kept in history of each user and group. 0 disables history.")
+	flag.Var(options.Authorizer, "authorizer", "Authorizer. \"default\", \"jwt\" or \"webhook\".")
+	flag.Var(options.JWTConfig, "jwt-config", "YAML configure of JWT authorizer.")
+	flag.Var(options.WebhookConfig, "webhook-config", "YAML configure of webhook authorizer.")
+	flag.Var(options.ACLConfig, "acl-config", "YAML ACL policy applied after authorizer. Reloaded when changed.")
+	flag.Var(options.AdminToken, "admin-token", "Token required by management endpoints. Management endpoints are disabled if empty.")
+	flag.Var(options.TraceExport, "trace-export", "File to export trace spans to as JSON lines, or \"stdout\". Tracing is disabled if empty.")
 	//flag.Var(options.PersistStorageEndpoint, "persist-endpoint", "Storage endpoint to persist session")
 	//flag.Var(options.DisableMessagePersist, "disable-message-persist", "Do not persist messages.")
 	//flag.Var(options.DisableSessionPersist, "disable-session-persist", "Do not persist sessions.")
@@ -130,6 +230,8 @@ func configureParse() (*ServiceOptions, error) {
 	//flag.Var(options.AsyncMessagePersist, "async-message-persist", "Persist messages asynchronously.")
 	//flag.Var(options.AsyncSessionPersist, "async-session-persist", "Persist session asynchronously.")
 	flag.Var(options.RPCPublish, "rpc-publish", "Published RPC endpoint.")
+	flag.Var(options.RPCCodec, "rpc-codec", "Codec of RPC served over plain TCP. \"gob\" or \"json\".")
+	flag.Var(options.Weight, "weight", "Load balancing weight advertised to gates.")
 
 	flag.Parse()
 
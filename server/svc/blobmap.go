@@ -200,7 +200,7 @@ func (b *BlobMap) gets(conn redis.Conn, keys []string, allowDirty bool) ([][]byt
 	for _, key := range keys {
 		args = append(args, key)
 	}
-	result, err := ScriptBlobMapGets.Do(conn, args...)
+	result, err := doBlobMapScript("gets", ScriptBlobMapGets, conn, args...)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -228,7 +228,7 @@ func (b *BlobMap) keys(conn redis.Conn, allowDirty bool) ([]string, int64, error
 	var raw []interface{}
 	var version int64
 
-	result, err := ScriptBlobMapKeys.Do(conn, b.prefix+"{"+b.tag+"}", b.Timeout, allowDirty)
+	result, err := doBlobMapScript("keys", ScriptBlobMapKeys, conn, b.prefix+"{"+b.tag+"}", b.Timeout, allowDirty)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -255,7 +255,7 @@ func (b *BlobMap) replace(conn redis.Conn, kv map[string][]byte, version int64,
 	for k, v := range kv {
 		args = append(args, k, v)
 	}
-	result, err := ScriptBlobMapReplace.Do(conn, args...)
+	result, err := doBlobMapScript("replace", ScriptBlobMapReplace, conn, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -292,7 +292,7 @@ func (b *BlobMap) update(conn redis.Conn, raw interface{}, version int64, op int
 	} else {
 		return ErrInvalidWriteOperation
 	}
-	_, err := ScriptBlobMapUpdate.Do(conn, args...)
+	_, err := doBlobMapScript("update", ScriptBlobMapUpdate, conn, args...)
 	if err != nil {
 		return err
 	}
@@ -330,7 +330,7 @@ func (b *BlobMap) newVersion(conn redis.Conn, allowDirty bool) (int64, error) {
 	var version int64
 
 	for {
-		result, err := ScriptBlobMapNewVersion.Do(conn, b.prefix+"{"+b.tag+"}", allowDirty)
+		result, err := doBlobMapScript("new_version", ScriptBlobMapNewVersion, conn, b.prefix+"{"+b.tag+"}", allowDirty)
 		if version, err = redis.Int64(result, nil); err != nil {
 			return 0, err
 		}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
@@ -8,20 +9,26 @@ import (
 
 type ServiceClient server.RPCClient
 
-func (c *ServiceClient) Echo(echo string) (string, error) {
+// call returns ctx.Err() if ctx is done before reply arrives.
+func (c *ServiceClient) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return (*server.RPCClient)(c).CallContext(ctx, method, args, reply)
+}
+
+func (c *ServiceClient) Echo(ctx context.Context, echo string) (string, error) {
 	var reply string
-	if err := c.Client.Call("ServiceRPC.Echo", &echo, &reply); err != nil {
+	if err := c.call(ctx, "ServiceRPC.Echo", &echo, &reply); err != nil {
 		return "", err
 	}
 	return reply, nil
 }
 
-func (c *ServiceClient) Push(namespace, session string, msgs []*proto.MessageBody) ([]proto.PushResult, error) {
+func (c *ServiceClient) Push(ctx context.Context, parent proto.TraceContext, namespace, session string, msgs []*proto.MessageBody) ([]proto.PushResult, error) {
 	reply := proto.MessagePushResult{}
-	if err := c.Client.Call("ServiceRPC.Push", &proto.RawMessagePushArguments{
+	if err := c.call(ctx, "ServiceRPC.Push", &proto.RawMessagePushArguments{
 		Msgs:      msgs,
 		Session:   session,
 		Namespace: namespace,
+		Trace:     parent,
 	}, &reply); err != nil {
 		return nil, err
 	}
@@ -31,14 +38,18 @@ func (c *ServiceClient) Push(namespace, session string, msgs []*proto.MessageBod
 	return reply.Replies, nil
 }
 
-func (c *ServiceClient) listEntity(namespace string, entityType uint8) ([]string, error) {
+func (c *ServiceClient) listEntity(ctx context.Context, namespace, session string, entityType uint8) ([]string, error) {
 	reply := proto.EntityListReply{}
-	if err := c.Client.Call("ServiceRPC.EntityList", proto.EntityListArguments{
+	if err := c.call(ctx, "ServiceRPC.EntityList", proto.EntityListArguments{
 		Type:      entityType,
 		Namespace: namespace,
+		Session:   session,
 	}, &reply); err != nil {
 		return nil, err
 	}
+	if reply.IsAuthError {
+		return nil, server.NewAuthError(errors.New(reply.Msg))
+	}
 	if reply.Msg != "" {
 		return nil, errors.New(reply.Msg)
 	}
@@ -48,22 +59,24 @@ func (c *ServiceClient) listEntity(namespace string, entityType uint8) ([]string
 	return reply.Entities, nil
 }
 
-func (c *ServiceClient) ListNamespace() ([]string, error) {
-	return c.listEntity("", proto.ENTITY_NAMESPACE)
+// ListNamespace lists all namespaces with session of namespace.
+func (c *ServiceClient) ListNamespace(ctx context.Context, namespace, session string) ([]string, error) {
+	return c.listEntity(ctx, namespace, session, proto.ENTITY_NAMESPACE)
 }
 
-func (c *ServiceClient) ListGroup(namespace string) ([]string, error) {
-	return c.listEntity(namespace, proto.ENTITY_GROUP)
+func (c *ServiceClient) ListGroup(ctx context.Context, namespace, session string) ([]string, error) {
+	return c.listEntity(ctx, namespace, session, proto.ENTITY_GROUP)
 }
 
-func (c *ServiceClient) ListUser(namespace string) ([]string, error) {
-	return c.listEntity(namespace, proto.ENTITY_USER)
+func (c *ServiceClient) ListUser(ctx context.Context, namespace, session string) ([]string, error) {
+	return c.listEntity(ctx, namespace, session, proto.ENTITY_USER)
 }
 
-func (c *ServiceClient) alterEntity(op, entityType uint8, namespace string, entities []string) error {
+func (c *ServiceClient) alterEntity(ctx context.Context, op, entityType uint8, namespace, session string, entities []string) error {
 	var msg string
-	if err := c.Client.Call("ServiceRPC.EntityAlter", &proto.EntityAlterArguments{
+	if err := c.call(ctx, "ServiceRPC.EntityAlter", &proto.EntityAlterArguments{
 		Namespace: namespace,
+		Session:   session,
 		Operation: op,
 		Type:      entityType,
 		Entities:  entities,
@@ -76,33 +89,41 @@ func (c *ServiceClient) alterEntity(op, entityType uint8, namespace string, enti
 	return nil
 }
 
-func (c *ServiceClient) DeleteNamespace(namespaces []string) error {
-	return c.alterEntity(proto.ENTITY_DEL, proto.ENTITY_NAMESPACE, "", namespaces)
+// DeleteNamespace alters namespaces with session of namespace.
+func (c *ServiceClient) DeleteNamespace(ctx context.Context, namespace, session string, namespaces []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_DEL, proto.ENTITY_NAMESPACE, namespace, session, namespaces)
 }
 
-func (c *ServiceClient) DeleteGroup(namespace string, groups []string) error {
-	return c.alterEntity(proto.ENTITY_DEL, proto.ENTITY_GROUP, namespace, groups)
+func (c *ServiceClient) DeleteGroup(ctx context.Context, namespace, session string, groups []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_DEL, proto.ENTITY_GROUP, namespace, session, groups)
 }
 
-func (c *ServiceClient) DeleteUser(namespace string, users []string) error {
-	return c.alterEntity(proto.ENTITY_DEL, proto.ENTITY_USER, namespace, users)
+func (c *ServiceClient) DeleteUser(ctx context.Context, namespace, session string, users []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_DEL, proto.ENTITY_USER, namespace, session, users)
 }
 
-func (c *ServiceClient) AddNamespace(namespaces []string) error {
-	return c.alterEntity(proto.ENTITY_ADD, proto.ENTITY_NAMESPACE, "", namespaces)
+// AddNamespace alters namespaces with session of namespace.
+func (c *ServiceClient) AddNamespace(ctx context.Context, namespace, session string, namespaces []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_ADD, proto.ENTITY_NAMESPACE, namespace, session, namespaces)
 }
 
-func (c *ServiceClient) AddGroup(namespace string, groups []string) error {
-	return c.alterEntity(proto.ENTITY_ADD, proto.ENTITY_GROUP, namespace, groups)
+func (c *ServiceClient) AddGroup(ctx context.Context, namespace, session string, groups []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_ADD, proto.ENTITY_GROUP, namespace, session, groups)
 }
 
-func (c *ServiceClient) AddUser(namespace string, users []string) error {
-	return c.alterEntity(proto.ENTITY_ADD, proto.ENTITY_USER, namespace, users)
+func (c *ServiceClient) AddUser(ctx context.Context, namespace, session string, users []string) error {
+	return c.alterEntity(ctx, proto.ENTITY_ADD, proto.ENTITY_USER, namespace, session, users)
 }
 
-func (c *ServiceClient) Subscribe(sub *proto.Subscription) error {
+func (c *ServiceClient) Subscribe(ctx context.Context, sub *proto.Subscription) error {
 	var msg string
-	if err := c.Client.Call("ServiceRPC.Subscribe", sub, &msg); err != nil {
+	if err := c.call(ctx, "ServiceRPC.Subscribe", &proto.SubscribeArguments{
+		Namespace: sub.Namespace,
+		Session:   sub.Session,
+		Group:     sub.Group,
+		Op:        sub.Op,
+		Trace:     sub.Trace,
+	}, &msg); err != nil {
 		return err
 	}
 	if msg != "" {
@@ -111,13 +132,122 @@ func (c *ServiceClient) Subscribe(sub *proto.Subscription) error {
 	return nil
 }
 
-func (c *ServiceClient) Connect(args *proto.ConnectV1) (*proto.ConnectResultV1, error) {
-	reply := proto.ConnectResultV1{}
-	if err := c.Client.Call("ServiceRPC.Connect", args, &reply); err != nil {
+func (c *ServiceClient) Connect(ctx context.Context, args *proto.ConnectV1) (*proto.ConnectResultV1, error) {
+	reply := proto.ConnectReply{}
+	if err := c.call(ctx, "ServiceRPC.Connect", &proto.ConnectArguments{
+		Credential: args.Credential,
+		Namespace:  args.Namespace,
+		Type:       args.Type,
+		Trace:      args.Trace,
+	}, &reply); err != nil {
 		return nil, err
 	}
 	if reply.AuthError != "" {
 		return nil, server.NewAuthError(errors.New(reply.AuthError))
 	}
-	return &reply, nil
+	return &proto.ConnectResultV1{
+		Session: reply.Session,
+		Key:     reply.Key,
+	}, nil
+}
+
+func (c *ServiceClient) History(ctx context.Context, query *proto.HistoryQuery) (*proto.HistoryReply, error) {
+	reply := proto.HistoryRangeReply{}
+	if err := c.call(ctx, "ServiceRPC.History", query, &reply); err != nil {
+		return nil, err
+	}
+	if reply.IsAuthError {
+		return nil, server.NewAuthError(errors.New(reply.Msg))
+	}
+	if reply.Msg != "" {
+		return nil, errors.New(reply.Msg)
+	}
+	if reply.Msgs == nil {
+		reply.Msgs = make([]proto.Message, 0)
+	}
+	return &proto.HistoryReply{
+		Msgs: reply.Msgs,
+		Next: reply.Next,
+	}, nil
+}
+
+func (c *ServiceClient) HistoryCheck(ctx context.Context, query *proto.HistoryQuery) (*proto.MessageCheck, error) {
+	reply := proto.HistoryCheckReply{}
+	if err := c.call(ctx, "ServiceRPC.HistoryCheck", query, &reply); err != nil {
+		return nil, err
+	}
+	if reply.IsAuthError {
+		return nil, server.NewAuthError(errors.New(reply.Msg))
+	}
+	if reply.Msg != "" {
+		return nil, errors.New(reply.Msg)
+	}
+	return &reply.Check, nil
+}
+
+func (c *ServiceClient) Presence(ctx context.Context, query *proto.PresenceQuery) ([]proto.Presence, error) {
+	reply := proto.PresenceReply{}
+	if err := c.call(ctx, "ServiceRPC.Presence", query, &reply); err != nil {
+		return nil, err
+	}
+	if reply.IsAuthError {
+		return nil, server.NewAuthError(errors.New(reply.Msg))
+	}
+	if reply.Presences == nil {
+		reply.Presences = make([]proto.Presence, 0)
+	}
+	return reply.Presences, nil
+}
+
+func (c *ServiceClient) PresenceNotify(ctx context.Context, keys []string) error {
+	var msg string
+	return c.call(ctx, "ServiceRPC.PresenceNotify", &proto.PresenceNotifyArguments{
+		Keys: keys,
+	}, &msg)
+}
+
+func (c *ServiceClient) sessionCall(ctx context.Context, method, namespace, session string) error {
+	reply := proto.SessionReply{}
+	if err := c.call(ctx, method, &proto.SessionArguments{
+		Namespace: namespace,
+		Session:   session,
+	}, &reply); err != nil {
+		return err
+	}
+	if reply.IsAuthError {
+		return server.NewAuthError(errors.New(reply.Msg))
+	}
+	if reply.Msg != "" {
+		return errors.New(reply.Msg)
+	}
+	return nil
+}
+
+// Keepalive postpones expiration of session.
+func (c *ServiceClient) Keepalive(ctx context.Context, namespace, session string) error {
+	return c.sessionCall(ctx, "ServiceRPC.Keepalive", namespace, session)
+}
+
+// Disconnect revokes session.
+func (c *ServiceClient) Disconnect(ctx context.Context, namespace, session string) error {
+	return c.sessionCall(ctx, "ServiceRPC.Disconnect", namespace, session)
+}
+
+// SessionKey resolves key of session. Operation op is authorized if not zero.
+func (c *ServiceClient) SessionKey(ctx context.Context, namespace, session string, op uint16) (string, error) {
+	reply := proto.SessionKeyReply{}
+	if err := c.call(ctx, "ServiceRPC.SessionKey", &proto.SessionArguments{
+		Namespace: namespace,
+		Session:   session,
+		Op:        op,
+	}, &reply); err != nil {
+		return "", err
+	}
+	if reply.IsAuthError {
+		return "", server.NewAuthError(errors.New(reply.Msg))
+	}
+	if reply.Msg != "" {
+		return "", errors.New(reply.Msg)
+	}
+	return reply.Key, nil
 }
@@ -1,11 +1,13 @@
 package svc
 
 import (
+	"context"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/server/dig"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,7 +32,7 @@ func (s *Service) openDigService(name string) dig.Service {
 	return svc
 }
 
-func (svc *Service) gateOp(notify *dig.Notification, oper func(rawID, rpc string, id server.NodeID)) {
+func (svc *Service) gateOp(notify *dig.Notification, oper func(rawID, rpc, codec string, id server.NodeID)) {
 	var (
 		ID  server.NodeID
 		rpc string
@@ -49,39 +51,44 @@ func (svc *Service) gateOp(notify *dig.Notification, oper func(rawID, rpc string
 		log.Warn("[Dig] Invalid ID of node \"" + notify.Node.Name + "\". skip.")
 		return
 	}
-	oper(rawID, rpc, ID)
+	oper(rawID, rpc, notify.Node.Metadata[proto.DIG_META_RPC_CODEC], ID)
 }
 
 func (svc *Service) addGate(notify *dig.Notification) {
-	svc.gateOp(notify, func(rawID, rpc string, id server.NodeID) {
+	svc.gateOp(notify, func(rawID, rpc, codec string, id server.NodeID) {
 		_, loaded := svc.gateNode.Load(rawID)
 		if !loaded {
-			_, loaded = svc.gateNode.LoadOrStore(rawID, OpenGateNode(id, notify.Node.Name, rpc, proto.RPC_PATH, runtime.NumCPU(), runtime.NumCPU()))
+			_, loaded = svc.gateNode.LoadOrStore(rawID, OpenGateNode(id, notify.Node.Name, rpc, codec, proto.RPC_PATH, runtime.NumCPU(), runtime.NumCPU()))
 			if !loaded {
-				log.Info0("[Dig] Add node \"" + notify.Node.Name + "\" with ID \"" + rawID + "\" to load balancer. Endpoint is \"" + rpc + "\".")
+				log.Info0("[Dig] Add node \"" + notify.Node.Name + "\" with ID \"" + rawID + "\" to load balancer. Endpoint is \"" + rpc + "\". Codec is \"" + codec + "\".")
 			}
 		}
 	})
 }
 
-func (svc *Service) removeGate(notify *dig.Notification) {
-	svc.gateOp(notify, func(rawID, rpc string, id server.NodeID) {
-		log.Info0("[Dig] Remove node \"" + notify.Node.Name + "\" with ID \"" + rawID + "\" to load balancer. Endpoint is \"" + rpc + "\".")
-		svc.gateNode.Delete(rawID)
+// removeGate removes and closes gate node. Node is found by name, since its ID may be changed or missing.
+func (svc *Service) removeGate(name string) {
+	svc.gateNode.Range(func(k, v interface{}) bool {
+		node, ok := v.(*server.RPCNode)
+		if !ok || node.Name != name {
+			return true
+		}
+		rawID, _ := k.(string)
+		svc.gateNode.Delete(k)
+		log.Info0("[Dig] Remove node \"" + name + "\" with ID \"" + rawID + "\" from load balancer.")
+		go node.Close() // Requests in flight are waited.
+		return true
 	})
 }
 
 func (svc *Service) Discover() {
-	var (
-		gateSvc, svcSvc dig.Service
-	)
-
 	log.Info0("[Dig] start.")
 
-	gateSvc = svc.openDigService(proto.DIG_GATE_SERVICE_NAME)
+	// Focus on gate nodes.
+	svc.openDigService(proto.DIG_GATE_SERVICE_NAME)
 	log.Info0("[Dig] Service \"" + proto.DIG_GATE_SERVICE_NAME + "\" opened.")
 
-	svcSvc = svc.openDigService(proto.DIG_SERVICE_NAME)
+	svcSvc := svc.openDigService(proto.DIG_SERVICE_NAME)
 	log.Info0("[Dig] Service \"" + proto.DIG_SERVICE_NAME + "\" opened.")
 
 	svc.Node = &dig.Node{
@@ -90,52 +97,71 @@ func (svc *Service) Discover() {
 			"linker-rpc":    svc.Config.RPCPublish.String(),
 			"linker-nodeid": svc.ID.String(),
 			"linker-role":   "svc",
+
+			proto.DIG_META_RPC_CODEC: svc.Config.RPCCodec.Value,
+			proto.DIG_META_WEIGHT:    strconv.FormatUint(uint64(svc.Config.Weight.Value), 10),
 		},
 		Timeout: 3,
 	}
-	svcSvc.Publish(svc.Node)
+	if err := svcSvc.Publish(svc.Node); err != nil {
+		log.Warn("[Dig] Cannot publish node \"" + svc.Node.Name + "\": " + err.Error() + ". Retry later.")
+	}
 	log.Info0("[Dig] Publish node \"" + svc.Node.Name + "\" of service \"" + proto.DIG_SERVICE_NAME + "\".")
+
+	ctx := context.Background()
+	events := svc.Reg.Watch(ctx, dig.WatchFilter{})
+	go dig.Sync(ctx, svc.Reg, time.Second)
+	svc.watchDig(ctx, events)
+}
+
+// watchDig handles dig notifications until ctx is done or events is closed.
+func (svc *Service) watchDig(ctx context.Context, events <-chan *dig.Notification) {
 	for {
-		changed, err := svc.Reg.Poll(func(notify *dig.Notification) {
-			switch notify.Event {
-			case dig.EVENT_NODE_FOCUS:
-				log.Info2("[Dig] Focus on node \"" + notify.Name + "\"")
-
-			case dig.EVENT_SVC_NODE_FOUND:
-				log.Info0("[Dig] Node \"" + notify.Name + "\" of service \"" + notify.Service.Name() + "\" discovered.")
-
-			case dig.EVENT_NODE_LOST:
-				log.Info0("[Dig] Node \"" + notify.Name + "\" lost.")
-
-			case dig.EVENT_NODE_METADATA_KEY_ADD:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "gate" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					svc.addGate(notify)
-				}
-
-			case dig.EVENT_NODE_METADATA_KEY_CHANGED:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "gate" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					svc.removeGate(notify)
-					svc.addGate(notify)
-				}
-
-			case dig.EVENT_NODE_METADATA_KEY_DEL:
-				role, ok := notify.Node.Metadata["linker-role"]
-				if ok && role == "gate" && (notify.Name == "linker-nodeid" || notify.Name == "linker-rpc" || notify.Name == "linker-role") {
-					svc.removeGate(notify)
-				}
+		select {
+		case <-ctx.Done():
+			return
+		case notify, ok := <-events:
+			if !ok {
+				return
 			}
-		})
-		if err != nil {
-			log.Error("[Dig] polling failure: " + err.Error())
+			svc.digNotified(notify)
+		}
+	}
+}
+
+func (svc *Service) digNotified(notify *dig.Notification) {
+	switch notify.Event {
+	case dig.EVENT_NODE_FOCUS:
+		log.Info2("[Dig] Focus on node \"" + notify.Name + "\"")
+
+	case dig.EVENT_SVC_NODE_FOUND:
+		log.Info0("[Dig] Node \"" + notify.Name + "\" of service \"" + notify.Service.Name() + "\" discovered.")
+		log.Info0("[Dig] Node of service \"" + notify.Service.Name() + "\": " + strings.Join(notify.Service.Nodes(), " ,") + ".")
+
+	case dig.EVENT_SVC_NODE_LOST:
+		log.Info0("[Dig] Node of service \"" + notify.Service.Name() + "\": " + strings.Join(notify.Service.Nodes(), " ,") + ".")
+
+	case dig.EVENT_NODE_LOST:
+		log.Info0("[Dig] Node \"" + notify.Name + "\" lost.")
+		svc.removeGate(notify.Name)
+
+	case dig.EVENT_NODE_METADATA_KEY_ADD:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "gate" && proto.IsRPCMetadata(notify.Name) {
+			svc.addGate(notify)
 		}
-		if changed {
-			log.Info2("[Dig] state changed.")
-			log.Info0("[Dig] Node of service \"" + proto.DIG_SERVICE_NAME + "\": " + strings.Join(svcSvc.Nodes(), " ,") + ".")
-			log.Info0("[Dig] Node of service \"" + proto.DIG_GATE_SERVICE_NAME + "\": " + strings.Join(gateSvc.Nodes(), " ,") + ".")
+
+	case dig.EVENT_NODE_METADATA_KEY_CHANGED:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "gate" && proto.IsRPCMetadata(notify.Name) {
+			svc.removeGate(notify.Node.Name)
+			svc.addGate(notify)
+		}
+
+	case dig.EVENT_NODE_METADATA_KEY_DEL:
+		role, ok := notify.Node.Metadata["linker-role"]
+		if ok && role == "gate" && proto.IsRPCMetadata(notify.Name) {
+			svc.removeGate(notify.Node.Name)
 		}
-		time.Sleep(time.Second)
 	}
-	log.Info0("[Dig] stopping...")
 }
@@ -0,0 +1,72 @@
+package svc
+
+import (
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/Sunmxt/linker-im/server/dig"
+	"github.com/Sunmxt/linker-im/server/dig/digtest"
+	"testing"
+)
+
+func testGateNode(svc *Service, id server.NodeID) *server.RPCNode {
+	raw, _ := svc.gateNode.Load(id.String())
+	node, _ := raw.(*server.RPCNode)
+	return node
+}
+
+func TestServiceWatchDig(t *testing.T) {
+	svc := &Service{}
+	id := server.NewNodeID()
+	gateNode := &dig.Node{
+		Name: "gateway-1",
+		Metadata: map[string]string{
+			"linker-role":   "gate",
+			"linker-nodeid": id.String(),
+			"linker-rpc":    "127.0.0.1:1",
+		},
+	}
+
+	digtest.Notify(svc.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: gateNode})
+	added := testGateNode(svc, id)
+	if added == nil {
+		t.Fatal("gate node not added")
+	}
+	// Nodes of other roles are ignored.
+	other := server.NewNodeID()
+	digtest.Notify(svc.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: &dig.Node{
+		Name: "svc-1",
+		Metadata: map[string]string{
+			"linker-role":   "svc",
+			"linker-nodeid": other.String(),
+			"linker-rpc":    "127.0.0.1:2",
+		},
+	}})
+	if testGateNode(svc, other) != nil {
+		t.Fatal("service node added as gate")
+	}
+
+	gateNode.Metadata["linker-rpc"] = "127.0.0.1:3"
+	digtest.Notify(svc.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_CHANGED, Name: "linker-rpc", Node: gateNode})
+	if reopened := testGateNode(svc, id); reopened == nil || reopened == added {
+		t.Fatal("gate node not reopened after endpoint changed")
+	}
+
+	// Endpoint removed.
+	delete(gateNode.Metadata, "linker-rpc")
+	digtest.Notify(svc.watchDig, &dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_DEL, Name: "linker-rpc", Node: gateNode})
+	if testGateNode(svc, id) != nil {
+		t.Fatal("gate node not removed after RPC endpoint removed")
+	}
+
+	gateNode.Metadata["linker-rpc"] = "127.0.0.1:4"
+	digtest.Notify(svc.watchDig,
+		&dig.Notification{Event: dig.EVENT_NODE_METADATA_KEY_ADD, Name: "linker-rpc", Node: gateNode},
+		&dig.Notification{Event: dig.EVENT_NODE_LOST, Name: "gateway-1"},
+	)
+	if testGateNode(svc, id) != nil {
+		t.Fatal("gate node not removed after lost")
+	}
+}
+
+func TestServiceWatchDigCanceled(t *testing.T) {
+	digtest.Canceled(t, (&Service{}).watchDig)
+}
@@ -1,6 +1,7 @@
 package svc
 
 import (
+	"context"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server"
 	sc "github.com/Sunmxt/linker-im/server/gate/client"
@@ -13,18 +14,23 @@ type GateDripInterface struct {
 	Name    string
 	Addr    string
 	RPCPath string
+	// Gob over HTTP is used if empty.
+	Codec string
 }
 
-func OpenGateNode(id server.NodeID, name, addr, rpcPath string, maxConcurrentRequest, maxConnection int) *server.RPCNode {
+func OpenGateNode(id server.NodeID, name, addr, codec, rpcPath string, maxConcurrentRequest, maxConnection int) *server.RPCNode {
 	return server.OpenRPCNode(id, name, &GateDripInterface{
 		Name:    name,
 		Addr:    addr,
 		RPCPath: rpcPath,
+		Codec:   codec,
 	}, maxConcurrentRequest, maxConnection)
 }
 
 func (i *GateDripInterface) Keepalive(client *server.RPCClient, event chan *server.RPCNodeEvent) error {
-	_, err := (*sc.GateClient)(client).Echo("ping")
+	ctx, cancel := context.WithTimeout(context.Background(), server.RPC_KEEPALIVE_TIMEOUT)
+	defer cancel()
+	_, err := (*sc.GateClient)(client).Echo(ctx, "ping")
 	return err
 }
 
@@ -35,7 +41,7 @@ func (i *GateDripInterface) Healthy(x interface{}, err error) bool {
 }
 
 func (i *GateDripInterface) New() (interface{}, error) {
-	client, err := rpc.DialHTTPPath("tcp", i.Addr, i.RPCPath)
+	client, err := server.DialRPC(i.Addr, i.Codec, i.RPCPath)
 	if err != nil {
 		log.Info0("Failed to connect gate endpoint \"" + i.Addr + "\": " + err.Error())
 		return nil, err
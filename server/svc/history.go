@@ -0,0 +1,230 @@
+package svc
+
+import (
+	"encoding/json"
+	"errors"
+	ilog "github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+)
+
+const (
+	HISTORY_DEFAULT_PAGE_SIZE = 100
+	HISTORY_MAX_PAGE_SIZE     = 1000
+
+	// Sorted set score is timestamp << HISTORY_SEQUENCE_BITS | sequence.
+	// Scores keep exact within 53 bits. Larger sequences are clamped and ordered by identifier after loading.
+	HISTORY_SEQUENCE_BITS = 20
+)
+
+var ErrHistoryDisabled = errors.New("Message history disabled.")
+
+// MessageLog persists messages of groups and users in redis sorted sets.
+// Group messages are logged once in log of group. Logs of users keep direct messages.
+type MessageLog struct {
+	Pool   *redis.Pool
+	Prefix string
+	Size   int
+	Log    *ilog.Logger
+}
+
+func NewMessageLog(pool *redis.Pool, prefix string, size int) *MessageLog {
+	l := &MessageLog{
+		Pool:   pool,
+		Prefix: prefix,
+		Size:   size,
+		Log:    ilog.NewLogger(),
+	}
+	l.Log.Fields["entity"] = "history"
+	return l
+}
+
+func (l *MessageLog) groupKey(namespace, group string) string {
+	return l.Prefix + "{msglog-" + namespace + ".g." + group + "}"
+}
+
+func (l *MessageLog) userKey(namespace, user string) string {
+	return l.Prefix + "{msglog-" + namespace + ".u." + user + "}"
+}
+
+func historyScore(id proto.MessageIdentifier) string {
+	seq := uint64(id.Sequence)
+	if seq >= 1<<HISTORY_SEQUENCE_BITS {
+		seq = 1<<HISTORY_SEQUENCE_BITS - 1
+	}
+	return strconv.FormatUint(id.Timestamp<<HISTORY_SEQUENCE_BITS|seq, 10)
+}
+
+func historyStamp(score uint64) uint64 {
+	return score >> HISTORY_SEQUENCE_BITS
+}
+
+// Append messages to log of group, or logs of users for direct messages with empty group.
+func (l *MessageLog) Append(namespace, group string, users []string, msgs []*proto.Message) error {
+	if l.Size < 1 || len(msgs) < 1 {
+		return nil
+	}
+	args := make(redis.Args, 0, len(msgs)*2+1)
+	args = append(args, "")
+	for _, msg := range msgs {
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		args = append(args, historyScore(msg.MessageIdentifier), raw)
+	}
+	conn := l.Pool.Get()
+	defer conn.Close()
+
+	keys, count := make([]string, 0, len(users)), 0
+	if group != "" {
+		keys = append(keys, l.groupKey(namespace, group))
+	} else {
+		for _, user := range users {
+			keys = append(keys, l.userKey(namespace, user))
+		}
+	}
+	for _, key := range keys {
+		args[0] = key
+		if err := conn.Send("ZADD", args...); err != nil {
+			return err
+		}
+		// Keep the latest messages only.
+		if err := conn.Send("ZREMRANGEBYRANK", key, 0, -l.Size-1); err != nil {
+			return err
+		}
+		count += 2
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for ; count > 0; count-- {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *MessageLog) scoreRange(begin, end proto.MessageIdentifier) (string, string) {
+	max := "+inf"
+	if end.Timestamp > 0 || end.Sequence > 0 {
+		max = "(" + historyScore(end)
+	}
+	return historyScore(begin), max
+}
+
+func inHistoryRange(id, begin, end proto.MessageIdentifier) bool {
+	if id.Less(begin) {
+		return false
+	}
+	if end.Timestamp > 0 || end.Sequence > 0 {
+		return id.Less(end)
+	}
+	return true
+}
+
+// Range loads messages in [begin, end).
+// Returns identifier to begin next page with, or empty string if no more message.
+func (l *MessageLog) Range(key string, begin, end proto.MessageIdentifier, limit int) ([]proto.Message, string, error) {
+	if l.Size < 1 {
+		return nil, "", ErrHistoryDisabled
+	}
+	if limit < 1 {
+		limit = HISTORY_DEFAULT_PAGE_SIZE
+	} else if limit > HISTORY_MAX_PAGE_SIZE {
+		limit = HISTORY_MAX_PAGE_SIZE
+	}
+	conn := l.Pool.Get()
+	defer conn.Close()
+
+	min, max := l.scoreRange(begin, end)
+	msgs, next, offset := make([]proto.Message, 0, limit+1), "", 0
+	// Messages broken or out of range are dropped after loading. Load until page is full.
+	for len(msgs) <= limit {
+		batch := limit + 1 - len(msgs)
+		raws, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", key, min, max, "LIMIT", offset, batch))
+		if err != nil {
+			return nil, "", err
+		}
+		offset += len(raws)
+		for _, raw := range raws {
+			msg := proto.Message{MessageBody: &proto.MessageBody{}}
+			if err = json.Unmarshal(raw, &msg); err != nil {
+				l.Log.Warn("Drop broken message in \"" + key + "\": " + err.Error())
+				continue
+			}
+			if !inHistoryRange(msg.MessageIdentifier, begin, end) {
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(raws) < batch {
+			break
+		}
+	}
+	// Messages with clamped sequences share a score, and are ordered by raw data in redis.
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].MessageIdentifier.Less(msgs[j].MessageIdentifier)
+	})
+	if len(msgs) > limit {
+		next = msgs[limit].MessageIdentifier.Text()
+		msgs = msgs[:limit]
+	}
+	return msgs, next, nil
+}
+
+// Check counts messages in [begin, end).
+func (l *MessageLog) Check(key string, begin, end proto.MessageIdentifier) (*proto.MessageCheck, error) {
+	if l.Size < 1 {
+		return nil, ErrHistoryDisabled
+	}
+	conn := l.Pool.Get()
+	defer conn.Close()
+
+	min, max := l.scoreRange(begin, end)
+	if err := conn.Send("ZCOUNT", key, min, max); err != nil {
+		return nil, err
+	}
+	if err := conn.Send("ZRANGEBYSCORE", key, min, max, "WITHSCORES", "LIMIT", 0, 1); err != nil {
+		return nil, err
+	}
+	if err := conn.Send("ZREVRANGEBYSCORE", key, max, min, "WITHSCORES", "LIMIT", 0, 1); err != nil {
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	check := &proto.MessageCheck{}
+	count, err := redis.Uint64(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	check.Count = count
+	for _, stamp := range []*uint64{&check.StampBegin, &check.StampEnd} {
+		// [member, score]
+		values, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 2 {
+			continue
+		}
+		score, err := strconv.ParseFloat(values[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		*stamp = historyStamp(uint64(score))
+	}
+	return check, nil
+}
+
+// Key of log to query. Log of user is queried for direct messages if group is empty.
+func (l *MessageLog) QueryKey(query *proto.HistoryQuery, user string) string {
+	if query.Group == "" {
+		return l.userKey(query.Namespace, user)
+	}
+	return l.groupKey(query.Namespace, query.Group)
+}
@@ -1,10 +1,161 @@
 package svc
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	ilog "github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/server"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+)
+
+const (
+	// Max bytes of management request body.
+	MANAGE_MAX_BODY = 1 << 20
+
+	MANAGE_TOKEN_HEADER = "X-Admin-Token"
 )
 
 func Healthz(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "ok")
 }
+
+func manageToken(req *http.Request) string {
+	if token := req.Header.Get(MANAGE_TOKEN_HEADER); token != "" {
+		return token
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// manageAuth rejects requests without valid admin token.
+func manageAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(manageToken(req)), []byte(service.Config.AdminToken.Value)) != 1 {
+			ilog.Warn("Management request from " + req.RemoteAddr + " rejected.")
+			http.Error(w, "Invalid admin token.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ACLExplainRequest asks for decision of an operation.
+// Session attributes are loaded from session pool if SessionID is given.
+// Policy is YAML policy to dry-run instead of the loaded one.
+type ACLExplainRequest struct {
+	Namespace string            `json:"namespace"`
+	Op        string            `json:"op"`
+	Group     string            `json:"group,omitempty"`
+	Session   map[string]string `json:"session,omitempty"`
+	SessionID string            `json:"sid,omitempty"`
+	Policy    string            `json:"policy,omitempty"`
+}
+
+// ACLPolicyShow responses loaded ACL policy.
+func ACLPolicyShow(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	policy := service.ACL.Policy()
+	if policy == nil {
+		http.Error(w, ErrACLNoPolicy.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, policy.Config)
+}
+
+// ACLReload reloads ACL policy file immediately.
+func ACLReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := service.ACL.Reload(true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service.ACL.Log.Info0("ACL reloaded from \"" + service.ACL.Path + "\" by request.")
+	writeJSON(w, service.ACL.Policy().Config)
+}
+
+// ACLExplain evaluates an operation and responses matching trace of rules.
+func ACLExplain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, MANAGE_MAX_BODY))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	explain := &ACLExplainRequest{}
+	if err = json.Unmarshal(raw, explain); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ok := ACLOpNames[explain.Op]
+	if !ok {
+		http.Error(w, "Unknown operation \""+explain.Op+"\".", http.StatusBadRequest)
+		return
+	}
+	session := explain.Session
+	if explain.SessionID != "" {
+		if session, err = service.Session.Get(explain.Namespace, explain.SessionID); err != nil {
+			http.Error(w, "Session failure: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	policy := service.ACL.Policy()
+	if explain.Policy != "" {
+		if policy, err = ParseACLPolicy([]byte(explain.Policy)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if policy == nil {
+		http.Error(w, ErrACLNoPolicy.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, policy.Evaluate(explain.Namespace, op, explain.Group, session, true))
+}
+
+// SessionRevoke revokes all sessions of a user.
+// Form parameters: "namespace", "user".
+func SessionRevoke(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	namespace, user := req.FormValue("namespace"), req.FormValue("user")
+	if namespace == "" || user == "" {
+		http.Error(w, "Namespace and user required.", http.StatusBadRequest)
+		return
+	}
+	revoker, ok := service.Session.(server.UserSessionRevoker)
+	if !ok {
+		http.Error(w, "Session revoking not supported.", http.StatusNotImplemented)
+		return
+	}
+	revoked, err := revoker.RemoveUser(namespace, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ilog.Infof0("%v session(s) of \"%v.%v\" revoked.", revoked, namespace, user)
+	writeJSON(w, map[string]int{"revoked": revoked})
+}
@@ -0,0 +1,446 @@
+package svc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Sunmxt/linker-im/config"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/gomodule/redigo/redis"
+	yaml "gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JWT_ALG_HS256 = "HS256"
+	JWT_ALG_RS256 = "RS256"
+
+	JWT_DEFAULT_SCOPE_CLAIM = "scope"
+	// Scope claim set to this disables scope checking.
+	JWT_SCOPE_DISABLED = "-"
+	// Scope granting all operations.
+	JWT_SCOPE_ALL = "*"
+
+	// Session key of raw token. Only kept when token is the session itself.
+	JWT_SESSION_TOKEN = "jwt"
+)
+
+// Registered claims copied to session.
+var JWTSessionClaims = []string{"sub", "exp", "iss", "jti"}
+
+var (
+	ErrJWTMalformed      = errors.New("Malformed token.")
+	ErrJWTAlgorithm      = errors.New("Unexpected token algorithm.")
+	ErrJWTSignature      = errors.New("Invalid token signature.")
+	ErrJWTExpired        = errors.New("Token expired.")
+	ErrJWTNotBefore      = errors.New("Token not valid yet.")
+	ErrJWTIssuer         = errors.New("Unexpected token issuer.")
+	ErrJWTAudience       = errors.New("Unexpected token audience.")
+	ErrJWTNoSubject      = errors.New("No subject in token.")
+	ErrJWTNoNamespace    = errors.New("No token key configured for namespace.")
+	ErrJWTOutOfScope     = errors.New("Operation out of token scope.")
+	ErrJWTNoSessionToken = errors.New("No token in session.")
+	ErrJWTRevoked        = errors.New("Token revoked.")
+)
+
+// Scope required by each operation.
+var JWTOpScopes = map[uint16]string{
+	proto.OP_SUB:       "sub",
+	proto.OP_UNSUB:     "sub",
+	proto.OP_CONNECT:   "connect",
+	proto.OP_KEEPALIVE: "connect",
+	proto.OP_PUSH:      "push",
+	proto.OP_PULL:      "pull",
+	proto.OP_INFO:      "info",
+	proto.OP_HISTORY:   "history",
+	proto.OP_PRESENCE:  "presence",
+	proto.OP_ENTITY:    "entity",
+}
+
+type jwtKey struct {
+	alg      string
+	secret   []byte
+	public   *rsa.PublicKey
+	issuer   string
+	audience string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// JWTAuthorizer authorizes clients with JSON Web Tokens signed by HS256 or RS256.
+// Registered claims, scopes and configured claims are copied to session. Identifier is the "sub" claim.
+type JWTAuthorizer struct {
+	ScopeClaim string
+	Claims     []string
+	Leeway     int64
+	// Keep raw token in session for JWTSessionPool.
+	KeepToken bool
+
+	keys map[string]*jwtKey
+}
+
+func NewJWTAuthorizer(cfg *config.JWTConfigure) (*JWTAuthorizer, error) {
+	a := &JWTAuthorizer{
+		ScopeClaim: cfg.ScopeClaim,
+		Claims:     append(append([]string{}, JWTSessionClaims...), cfg.Claims...),
+		Leeway:     int64(cfg.Leeway),
+		keys:       make(map[string]*jwtKey, len(cfg.Namespaces)),
+	}
+	if a.ScopeClaim == "" {
+		a.ScopeClaim = JWT_DEFAULT_SCOPE_CLAIM
+	}
+	if a.ScopeClaim != JWT_SCOPE_DISABLED {
+		a.Claims = append(a.Claims, a.ScopeClaim)
+	}
+	for namespace, keyCfg := range cfg.Namespaces {
+		key := &jwtKey{
+			alg:      strings.ToUpper(keyCfg.Algorithm),
+			issuer:   keyCfg.Issuer,
+			audience: keyCfg.Audience,
+		}
+		switch key.alg {
+		case JWT_ALG_HS256:
+			if keyCfg.Secret == "" {
+				return nil, fmt.Errorf("No HS256 secret for namespace \"%v\".", namespace)
+			}
+			key.secret = []byte(keyCfg.Secret)
+		case JWT_ALG_RS256:
+			public, err := loadRSAPublicKey(keyCfg.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot load RS256 public key for namespace \"%v\": %v", namespace, err.Error())
+			}
+			key.public = public
+		default:
+			return nil, fmt.Errorf("Unsupported algorithm \"%v\" for namespace \"%v\".", keyCfg.Algorithm, namespace)
+		}
+		a.keys[namespace] = key
+	}
+	return a, nil
+}
+
+// LoadJWTAuthorizer creates JWTAuthorizer from YAML configure file.
+func LoadJWTAuthorizer(path string) (*JWTAuthorizer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load JWT configure: %v", err.Error())
+	}
+	cfg := &config.JWTConfigure{}
+	if err = yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("Invalid JWT configure format: %v", err.Error())
+	}
+	return NewJWTAuthorizer(cfg)
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM block found.")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if public, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return public, nil
+		}
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if public, ok := key.(*rsa.PublicKey); ok {
+			return public, nil
+		}
+	}
+	return nil, errors.New("Not a RSA public key.")
+}
+
+func jwtDecodeSegment(segment string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	return raw, nil
+}
+
+func jwtNumericClaim(claims map[string]interface{}, name string) (int64, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return 0, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false, ErrJWTMalformed
+	}
+	stamp, err := number.Float64()
+	if err != nil {
+		return 0, false, ErrJWTMalformed
+	}
+	return int64(stamp), true, nil
+}
+
+func jwtHasAudience(value interface{}, audience string) bool {
+	switch aud := value.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, item := range aud {
+			if s, ok := item.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verify checks signature and registered claims of token.
+// Returns claims of valid token.
+func (a *JWTAuthorizer) Verify(namespace, token string) (map[string]interface{}, error) {
+	key, ok := a.keys[namespace]
+	if !ok {
+		return nil, ErrJWTNoNamespace
+	}
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	raw, err := jwtDecodeSegment(segments[0])
+	if err != nil {
+		return nil, err
+	}
+	header := jwtHeader{}
+	if err = json.Unmarshal(raw, &header); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	// Algorithm is pinned by configure to avoid algorithm confusion.
+	if header.Alg != key.alg {
+		return nil, ErrJWTAlgorithm
+	}
+	signature, err := jwtDecodeSegment(segments[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(token[:len(segments[0])+len(segments[1])+1])
+	switch key.alg {
+	case JWT_ALG_HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, ErrJWTSignature
+		}
+	case JWT_ALG_RS256:
+		digest := sha256.Sum256(signed)
+		if err = rsa.VerifyPKCS1v15(key.public, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, ErrJWTSignature
+		}
+	}
+
+	if raw, err = jwtDecodeSegment(segments[1]); err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	now := time.Now().Unix()
+	if exp, ok, err := jwtNumericClaim(claims, "exp"); err != nil {
+		return nil, err
+	} else if ok && now > exp+a.Leeway {
+		return nil, ErrJWTExpired
+	}
+	if nbf, ok, err := jwtNumericClaim(claims, "nbf"); err != nil {
+		return nil, err
+	} else if ok && now+a.Leeway < nbf {
+		return nil, ErrJWTNotBefore
+	}
+	if key.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != key.issuer {
+			return nil, ErrJWTIssuer
+		}
+	}
+	if key.audience != "" && !jwtHasAudience(claims["aud"], key.audience) {
+		return nil, ErrJWTAudience
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, ErrJWTNoSubject
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthorizer) Connect(namespace, credential string, session map[string]string) error {
+	claims, err := a.Verify(namespace, credential)
+	if err != nil {
+		return server.NewAuthError(err)
+	}
+	for _, name := range a.Claims {
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			session[name] = v
+		case json.Number:
+			session[name] = v.String()
+		default:
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return server.NewAuthError(ErrJWTMalformed)
+			}
+			session[name] = string(raw)
+		}
+	}
+	session["ns"] = namespace
+	if a.KeepToken {
+		session[JWT_SESSION_TOKEN] = credential
+	}
+	return nil
+}
+
+// Scopes are either space-delimited string or array of strings.
+func jwtScopes(raw string) []string {
+	if strings.HasPrefix(raw, "[") {
+		scopes := []string{}
+		if err := json.Unmarshal([]byte(raw), &scopes); err == nil {
+			return scopes
+		}
+	}
+	return strings.Fields(raw)
+}
+
+func (a *JWTAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
+	// Session may outlive token.
+	if raw, ok := session["exp"]; ok {
+		exp, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return server.NewAuthError(ErrJWTMalformed)
+		}
+		if time.Now().Unix() > int64(exp)+a.Leeway {
+			return server.NewAuthError(ErrJWTExpired)
+		}
+	}
+	if a.ScopeClaim == JWT_SCOPE_DISABLED {
+		return nil
+	}
+	need, ok := JWTOpScopes[op]
+	if !ok {
+		return server.NewAuthError(ErrJWTOutOfScope)
+	}
+	raw, _ := session[a.ScopeClaim]
+	for _, scope := range jwtScopes(raw) {
+		if scope == need || scope == JWT_SCOPE_ALL {
+			return nil
+		}
+	}
+	return server.NewAuthError(ErrJWTOutOfScope)
+}
+
+func (a *JWTAuthorizer) Identifier(namespace string, session map[string]string) (string, error) {
+	sub, _ := session["sub"]
+	if sub == "" {
+		return "", ErrJWTNoSubject
+	}
+	return sub, nil
+}
+
+// JWTSessionPool is session pool using token as session.
+// Token is verified on every access, so session expires along with token.
+// Removed tokens are denied until they expire.
+type JWTSessionPool struct {
+	Auther *JWTAuthorizer
+	Pool   *redis.Pool
+	Prefix string
+}
+
+func NewJWTSessionPool(auther *JWTAuthorizer, pool *redis.Pool, prefix string) *JWTSessionPool {
+	auther.KeepToken = true
+	return &JWTSessionPool{
+		Auther: auther,
+		Pool:   pool,
+		Prefix: prefix,
+	}
+}
+
+// Denylist key of token. Tokens without "jti" are identified by digest.
+func (p *JWTSessionPool) revokedKey(namespace, token string, session map[string]string) string {
+	id, _ := session["jti"]
+	if id == "" {
+		digest := sha256.Sum256([]byte(token))
+		id = base64.RawURLEncoding.EncodeToString(digest[:])
+	}
+	return p.Prefix + "{jwtrevoked-" + namespace + "." + id + "}"
+}
+
+func (p *JWTSessionPool) Get(namespace, key string) (map[string]string, error) {
+	session := make(map[string]string)
+	if err := p.Auther.Connect(namespace, key, session); err != nil {
+		return nil, err
+	}
+	conn := p.Pool.Get()
+	defer conn.Close()
+	revoked, err := redis.Bool(conn.Do("EXISTS", p.revokedKey(namespace, key, session)))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, server.NewAuthError(ErrJWTRevoked)
+	}
+	return session, nil
+}
+
+func (p *JWTSessionPool) Register(namespace string, session map[string]string) (string, error) {
+	token, _ := session[JWT_SESSION_TOKEN]
+	if token == "" {
+		return "", ErrJWTNoSessionToken
+	}
+	return token, nil
+}
+
+// Remove denies token until it expires.
+func (p *JWTSessionPool) Remove(namespace, key string) error {
+	session := make(map[string]string)
+	if err := p.Auther.Connect(namespace, key, session); err != nil {
+		return err
+	}
+	args := redis.Args{}.Add(p.revokedKey(namespace, key, session), "1")
+	if raw, ok := session["exp"]; ok {
+		exp, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return server.NewAuthError(ErrJWTMalformed)
+		}
+		ttl := int64(exp) + p.Auther.Leeway - time.Now().Unix()
+		if ttl < 1 {
+			ttl = 1
+		}
+		args = args.Add("EX", ttl)
+	}
+	conn := p.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", args...)
+	return err
+}
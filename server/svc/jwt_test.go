@@ -0,0 +1,189 @@
+package svc
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/Sunmxt/linker-im/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "test-secret"
+
+// testJWT signs claims with HS256 secret, or RS256 key if given.
+func testJWT(t *testing.T, alg string, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch {
+	case alg == JWT_ALG_RS256 && key != nil:
+		digest := sha256.Sum256([]byte(signed))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case alg == "none":
+	default:
+		mac := hmac.New(sha256.New, []byte(testJWTSecret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWTAuthorizer creates authorizer with HS256 namespace "hs" and RS256 namespace "rs".
+func testJWTAuthorizer(t *testing.T) (*JWTAuthorizer, *rsa.PrivateKey, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "linker-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "public.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auther, err := NewJWTAuthorizer(&config.JWTConfigure{
+		Claims: []string{"role"},
+		Namespaces: map[string]config.JWTKeyConfigure{
+			"hs": {Algorithm: JWT_ALG_HS256, Secret: testJWTSecret, Issuer: "linker", Audience: "im"},
+			"rs": {Algorithm: JWT_ALG_RS256, PublicKey: path},
+		},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return auther, key, func() { os.RemoveAll(dir) }
+}
+
+func TestJWTVerify(t *testing.T) {
+	auther, key, cleanup := testJWTAuthorizer(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "u1", "iss": "linker", "aud": "im", "exp": now + 60}
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	hs := func(claims map[string]interface{}) string { return testJWT(t, JWT_ALG_HS256, claims, nil) }
+	// Flip bits of signature, or replace payload keeping signature.
+	tamperSignature := func(token string) string {
+		segments := strings.Split(token, ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(segments[2])
+		signature[0] ^= 0xff
+		return segments[0] + "." + segments[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	tamperPayload := func(token string) string {
+		segments := strings.Split(token, ".")
+		forged, _ := json.Marshal(with("sub", "admin"))
+		return segments[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + segments[2]
+	}
+
+	// HS256 token signed with RS256 public key as secret.
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	confusion := func() string {
+		header, _ := json.Marshal(map[string]string{"alg": JWT_ALG_HS256, "typ": "JWT"})
+		payload, _ := json.Marshal(map[string]interface{}{"sub": "u1"})
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		mac := hmac.New(sha256.New, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}()
+
+	cases := []struct {
+		name      string
+		namespace string
+		token     string
+		err       error
+	}{
+		{"valid HS256", "hs", hs(valid()), nil},
+		{"valid RS256", "rs", testJWT(t, JWT_ALG_RS256, map[string]interface{}{"sub": "u1"}, key), nil},
+		{"alg none", "hs", testJWT(t, "none", valid(), nil), ErrJWTAlgorithm},
+		{"alg none on RS256", "rs", testJWT(t, "none", valid(), nil), ErrJWTAlgorithm},
+		{"HS256 on RS256", "rs", confusion, ErrJWTAlgorithm},
+		{"RS256 on HS256", "hs", testJWT(t, JWT_ALG_RS256, valid(), key), ErrJWTAlgorithm},
+		{"expired", "hs", hs(with("exp", now-60)), ErrJWTExpired},
+		{"not before", "hs", hs(with("nbf", now+60)), ErrJWTNotBefore},
+		{"wrong issuer", "hs", hs(with("iss", "other")), ErrJWTIssuer},
+		{"no issuer", "hs", hs(with("iss", nil)), ErrJWTIssuer},
+		{"wrong audience", "hs", hs(with("aud", []string{"other"})), ErrJWTAudience},
+		{"audience in list", "hs", hs(with("aud", []string{"other", "im"})), nil},
+		{"tampered signature", "hs", tamperSignature(hs(valid())), ErrJWTSignature},
+		{"tampered payload", "hs", tamperPayload(hs(valid())), ErrJWTSignature},
+		{"tampered RS256 signature", "rs", tamperSignature(testJWT(t, JWT_ALG_RS256, valid(), key)), ErrJWTSignature},
+		{"tampered RS256 payload", "rs", tamperPayload(testJWT(t, JWT_ALG_RS256, valid(), key)), ErrJWTSignature},
+		{"no subject", "hs", hs(with("sub", nil)), ErrJWTNoSubject},
+		{"malformed", "hs", "a.b", ErrJWTMalformed},
+		{"unknown namespace", "other", hs(valid()), ErrJWTNoNamespace},
+	}
+	for _, c := range cases {
+		if _, err := auther.Verify(c.namespace, c.token); err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestJWTConnectClaims(t *testing.T) {
+	auther, _, cleanup := testJWTAuthorizer(t)
+	defer cleanup()
+
+	exp := time.Now().Unix() + 60
+	token := testJWT(t, JWT_ALG_HS256, map[string]interface{}{
+		"sub": "u1", "iss": "linker", "aud": "im", "exp": exp,
+		"scope": "push sub", "role": "admin", "email": "u1@example.com",
+	}, nil)
+	session := make(map[string]string)
+	if err := auther.Connect("hs", token, session); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"ns": "hs", "sub": "u1", "iss": "linker", "exp": strconv.FormatInt(exp, 10),
+		"scope": "push sub", "role": "admin",
+	}
+	if len(session) != len(expected) {
+		t.Fatalf("unexpected session %v", session)
+	}
+	for name, value := range expected {
+		if session[name] != value {
+			t.Fatalf("expected %v of session to be \"%v\", got \"%v\"", name, value, session[name])
+		}
+	}
+	// Raw token is kept only for token session pool.
+	auther.KeepToken = true
+	if err := auther.Connect("hs", token, session); err != nil {
+		t.Fatal(err)
+	}
+	if session[JWT_SESSION_TOKEN] != token {
+		t.Fatal("token not kept in session")
+	}
+}
@@ -0,0 +1,53 @@
+package svc
+
+import (
+	"github.com/Sunmxt/linker-im/utils/metrics"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+const (
+	AUTH_FAILURE_SESSION    = "session"
+	AUTH_FAILURE_DENIED     = "denied"
+	AUTH_FAILURE_IDENTIFIER = "identifier"
+
+	FLUSH_FAILURE_UNKNOWN_GATE = "unknown_gate"
+	FLUSH_FAILURE_CONNECT      = "connect"
+	FLUSH_FAILURE_PUSH         = "push"
+)
+
+var (
+	metricFlushBatch           = metrics.NewHistogram("linker_svc_gate_flush_batch_size", "Message groups flushed to gate at once.", metrics.SizeBuckets)
+	metricFlushFailures        = metrics.NewCounterVec("linker_svc_gate_flush_failures_total", "Failures of flushing messages to gate.", "reason")
+	metricBlobMapScriptSeconds = metrics.NewHistogramVec("linker_svc_blobmap_script_seconds", "Latency of BlobMap Redis scripts.", metrics.DefaultBuckets, "script")
+	metricBlobMapScriptErrors  = metrics.NewCounterVec("linker_svc_blobmap_script_errors_total", "Failures of BlobMap Redis scripts.", "script")
+	metricAuthFailures         = metrics.NewCounterVec("linker_svc_auth_failures_total", "Rejected connections and operations.", "op", "reason")
+)
+
+var metricOpNames = make(map[uint16]string, len(ACLOpNames))
+
+func init() {
+	for name, op := range ACLOpNames {
+		metricOpNames[op] = name
+	}
+}
+
+func observeAuthFailure(op uint16, reason string) {
+	name, ok := metricOpNames[op]
+	if !ok {
+		name = strconv.FormatUint(uint64(op), 10)
+	}
+	metricAuthFailures.With(name, reason).Inc()
+}
+
+// doBlobMapScript runs BlobMap script and records its latency.
+func doBlobMapScript(name string, script *redis.Script, conn redis.Conn, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	result, err := script.Do(conn, args...)
+	metricBlobMapScriptSeconds.With(name).ObserveSince(start)
+	if err != nil {
+		metricBlobMapScriptErrors.With(name).Inc()
+	}
+	return result, err
+}
@@ -71,6 +71,14 @@ func (m *Model) GetSubscription(namespace, group string) ([]string, error) {
 	return m.listMetadata("group." + namespace + "." + group)
 }
 
+func (m *Model) IsSubscribed(namespace, group, user string) (bool, error) {
+	bins, err := m.getMetadata("group."+namespace+"."+group, []string{user})
+	if err != nil {
+		return false, err
+	}
+	return len(bins) > 0 && bins[0] != nil, nil
+}
+
 func (m *Model) Unsubscribe(namespace, group string, users []string) error {
 	return m.delMetadata("group."+namespace+"."+group, users)
 }
@@ -243,7 +251,7 @@ func (m *Model) GetBlobMap(key string, timeout int, primitive BlobMapPersistPrim
 			ref = &ModelBlobMapReference{
 				Map: NewBlobMap(m.Pool, m.Prefix, key, timeout, primitive),
 			}
-			m.Log.Infof1("Add new blobmap \"" + key + "\" to pool.")
+			m.Log.Info1("Add new blobmap \"" + key + "\" to pool.")
 		}
 		return ref
 	}
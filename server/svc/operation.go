@@ -1,64 +1,153 @@
 package svc
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
 	sc "github.com/Sunmxt/linker-im/server/gate/client"
+	"github.com/Sunmxt/linker-im/server/trace"
 	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Flushing fails if gate doesn't reply in time.
+const GATE_FLUSH_TIMEOUT = 10 * time.Second
+
 type GateMessageBuffer struct {
 	msgs []*proto.MessageBody
 }
 
-func (s *Service) pushBulk(namespace string, msgs []proto.Message, result []proto.PushResult) {
-	kBuf := make(map[string][]*proto.Message)
+func (s *Service) pushBulk(parent proto.TraceContext, namespace string, msgs []proto.Message, result []proto.PushResult) {
+	kBuf, dBuf := make(map[string][]*proto.Message), make(map[string][]*proto.Message)
 	for idx := range msgs {
-		keyBufPut(kBuf, msgs[idx].MessageBody.Group, &msgs[idx], 1)
+		if to := msgs[idx].MessageBody.To; to != "" {
+			keyBufPut(dBuf, to, &msgs[idx], 1)
+		} else {
+			keyBufPut(kBuf, msgs[idx].MessageBody.Group, &msgs[idx], 1)
+		}
 	}
-	kErr := make(map[string]error, len(kBuf))
+	kErr, dErr := make(map[string]error, len(kBuf)), make(map[string]error, len(dBuf))
 	for group, buf := range kBuf {
-		kErr[group] = s.pushGroup(namespace, group, buf)
+		if strings.HasPrefix(group, proto.PRESENCE_GROUP_PREFIX) {
+			kErr[group] = ErrReservedGroup
+			continue
+		}
+		kErr[group] = s.pushGroup(parent, namespace, group, buf)
+	}
+	for to, buf := range dBuf {
+		dErr[to] = s.pushDirect(parent, namespace, to, buf)
 	}
 	for idx := range msgs {
-		if err := kErr[msgs[idx].MessageBody.Group]; err != nil {
+		err := kErr[msgs[idx].MessageBody.Group]
+		if to := msgs[idx].MessageBody.To; to != "" {
+			err = dErr[to]
+		}
+		if err != nil {
 			result[idx].Msg = err.Error()
 		}
 	}
 }
 
-func (s *Service) pushGroup(namespace, group string, msgs []*proto.Message) error {
+func (s *Service) pushGroup(parent proto.TraceContext, namespace, group string, msgs []*proto.Message) error {
+	span := trace.Start(parent, "svc.subscription")
+	span.Tag("group", group)
 	keys, err := s.Model.GetSubscription(namespace, group)
+	span.Tag("subscribers", strconv.Itoa(len(keys)))
+	span.Finish(err)
 	if err != nil {
 		return err
 	}
-	conn := s.Redis.Get()
-	defer conn.Close()
-	for idx := range keys {
-		keys[idx] = namespace + "." + keys[idx]
-		if err = conn.Send("HGET", s.Config.RedisPrefix.Value+"{clientinfo-"+keys[idx]+"}", "gate"); err != nil {
-			return err
+	if err = s.History.Append(namespace, group, nil, msgs); err != nil {
+		log.Error("Message history failure: " + err.Error())
+	}
+	return s.deliver(parent, namespace, keys, msgs)
+}
+
+// pushDirect pushes messages to recipient and devices of senders, bypassing subscriptions.
+func (s *Service) pushDirect(parent proto.TraceContext, namespace, to string, msgs []*proto.Message) error {
+	users := []string{to}
+	for _, msg := range msgs {
+		if user := msg.MessageBody.User; user != to && (len(users) < 2 || users[len(users)-1] != user) {
+			users = append(users, user)
 		}
 	}
-	if err = conn.Flush(); err != nil {
-		return err
+	if err := s.History.Append(namespace, "", users, msgs); err != nil {
+		log.Error("Message history failure: " + err.Error())
+	}
+	return s.deliver(parent, namespace, users, msgs)
+}
+
+// clientRoutes loads alive routes of devices for each key.
+func (s *Service) clientRoutes(conn redis.Conn, keys []string) ([][]proto.ClientRoute, error) {
+	for _, key := range keys {
+		if err := conn.Send("HGETALL", s.Config.RedisPrefix.Value+"{clientinfo-"+key+"}"); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
 	}
-	for range keys {
-		gate, err := redis.String(conn.Receive())
+	routes, now := make([][]proto.ClientRoute, len(keys)), time.Now().Unix()
+	for idx, key := range keys {
+		raws, err := redis.StringMap(conn.Receive())
 		if err != nil {
 			if err != redis.ErrNil {
-				return err
+				return nil, err
 			}
 			continue
 		}
-		go s.pushGate(namespace, gate, keys, msgs)
+		for device, raw := range raws {
+			route := proto.ClientRoute{}
+			if err = json.Unmarshal([]byte(raw), &route); err != nil {
+				log.Warn("Drop invalid route of device \"" + device + "\" for \"" + key + "\": " + err.Error())
+				continue
+			}
+			if route.Expire > 0 && route.Expire < now {
+				continue
+			}
+			routes[idx] = append(routes[idx], route)
+		}
+	}
+	return routes, nil
+}
+
+// deliver pushes messages to all devices of users.
+func (s *Service) deliver(parent proto.TraceContext, namespace string, users []string, msgs []*proto.Message) error {
+	conn := s.Redis.Get()
+	defer conn.Close()
+	keys := make([]string, len(users))
+	for idx := range users {
+		keys[idx] = namespace + "." + users[idx]
+	}
+	span := trace.Start(parent, "svc.route")
+	routes, err := s.clientRoutes(conn, keys)
+	span.Tag("keys", strconv.Itoa(len(keys)))
+	span.Finish(err)
+	if err != nil {
+		return err
+	}
+	// Devices of a key may connect to many gates.
+	gateKeys := make(map[string][]string)
+	for idx, key := range keys {
+		for _, route := range routes[idx] {
+			gkeys := gateKeys[route.Gate]
+			if len(gkeys) > 0 && gkeys[len(gkeys)-1] == key {
+				continue
+			}
+			gateKeys[route.Gate] = append(gkeys, key)
+		}
+	}
+	for gate, gkeys := range gateKeys {
+		go s.pushGate(parent, namespace, gate, gkeys, msgs)
 	}
 	return nil
 }
 
-func (s *Service) pushGate(namespace, gate string, keys []string, msgs []*proto.Message) {
+func (s *Service) pushGate(parent proto.TraceContext, namespace, gate string, keys []string, msgs []*proto.Message) {
 	raw, loaded := s.gateBuf.Load(gate)
 	if !loaded {
 		raw, _ = s.gateBuf.LoadOrStore(gate, NewConcurrencyMessageGroupBuffer(uint(len(msgs))))
@@ -67,8 +156,9 @@ func (s *Service) pushGate(namespace, gate string, keys []string, msgs []*proto.
 	buf.Lock()
 	defer buf.Unlock()
 	buf.Buf = append(buf.Buf, proto.MessageGroup{
-		Keys: keys,
-		Msgs: msgs,
+		Keys:  keys,
+		Msgs:  msgs,
+		Trace: parent,
 	})
 	if buf.Flusher > 0 {
 		return
@@ -83,17 +173,42 @@ func (s *Service) flushGateBuf(gate string, buf *ConcurrencyMessageGroupBuffer,
 	if !ok {
 		s.gateBuf.Delete(gate)
 		log.Warn("flushGateBuf(): Unknown gate \"" + gate + "\"")
+		metricFlushFailures.With(FLUSH_FAILURE_UNKNOWN_GATE).Inc()
 		return
 	}
-	clientRaw, err := raw.(*server.RPCNode).Connect(0)
+	ctx, cancel := context.WithTimeout(context.Background(), GATE_FLUSH_TIMEOUT)
+	defer cancel()
+	node := raw.(*server.RPCNode)
+	clientRaw, err := node.ConnectContext(ctx)
 	if err != nil {
 		log.Error("flushGateBuf(): " + err.Error())
+		metricFlushFailures.With(FLUSH_FAILURE_CONNECT).Inc()
+		// Messages are kept. Next push schedules flushing again.
+		buf.Lock()
+		buf.Flusher = 0
+		buf.Unlock()
 		return
 	}
 	buf.Lock()
 	defer buf.Unlock()
-	if err = (*sc.GateClient)(clientRaw).Push(buf.Buf); err != nil {
+	metricFlushBatch.Observe(float64(len(buf.Buf)))
+	// Flushing is shared by groups, so it is recorded in each traced group.
+	spans := make([]*trace.Span, 0)
+	for idx := range buf.Buf {
+		if span := trace.Continue(buf.Buf[idx].Trace, "svc.gate_flush"); span != nil {
+			span.Tag("gate", gate)
+			span.Tag("batch", strconv.Itoa(len(buf.Buf)))
+			buf.Buf[idx].Trace = span.Context()
+			spans = append(spans, span)
+		}
+	}
+	if err = (*sc.GateClient)(clientRaw).Push(ctx, buf.Buf); err != nil {
 		log.Warn("flushGateBuf() push error: " + err.Error())
+		metricFlushFailures.With(FLUSH_FAILURE_PUSH).Inc()
+	}
+	node.Disconnect(clientRaw, err)
+	for _, span := range spans {
+		span.Finish(err)
 	}
 	buf.Buf = buf.Buf[0:0]
 	buf.Flusher = 0
@@ -0,0 +1,174 @@
+package svc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/proto"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+const (
+	// Seconds to keep last published presence state.
+	PRESENCE_STATE_TIMEOUT = 86400
+	// Period to look for presences whose routes expired.
+	PRESENCE_SWEEP_PERIOD = 10 * time.Second
+)
+
+var ErrReservedGroup = errors.New("Group reserved.")
+
+// presence evaluates presence of keys from client routes across all gates.
+func (s *Service) presence(conn redis.Conn, keys []string) ([]proto.Presence, error) {
+	routes, err := s.clientRoutes(conn, keys)
+	if err != nil {
+		return nil, err
+	}
+	presences := make([]proto.Presence, len(keys))
+	for idx, key := range keys {
+		p, idle := &presences[idx], true
+		if parts := strings.SplitN(key, ".", 2); len(parts) > 1 {
+			p.User = parts[1]
+		}
+		for _, route := range routes[idx] {
+			if !route.Idle {
+				idle = false
+			}
+			if route.Active > p.Active {
+				p.Active = route.Active
+			}
+		}
+		switch {
+		case len(routes[idx]) < 1:
+			p.State = proto.PRESENCE_OFFLINE
+		case idle:
+			p.State = proto.PRESENCE_IDLE
+		default:
+			p.State = proto.PRESENCE_ONLINE
+		}
+	}
+	return presences, nil
+}
+
+// notifyPresence publishes presence changes of keys to their presence groups.
+func (s *Service) notifyPresence(keys []string) error {
+	conn := s.Redis.Get()
+	defer conn.Close()
+
+	presences, err := s.presence(conn, keys)
+	if err != nil {
+		return err
+	}
+	for idx, key := range keys {
+		stateKey := s.Config.RedisPrefix.Value + "{presence-" + key + "}"
+		if err = conn.Send("GETSET", stateKey, presences[idx].State); err != nil {
+			return err
+		}
+		if err = conn.Send("EXPIRE", stateKey, PRESENCE_STATE_TIMEOUT); err != nil {
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+	changed := make([]int, 0, len(keys))
+	for idx := range keys {
+		last, err := redis.String(conn.Receive())
+		if err != nil {
+			if err != redis.ErrNil {
+				return err
+			}
+			last = proto.PRESENCE_OFFLINE
+		}
+		if _, err = conn.Receive(); err != nil {
+			return err
+		}
+		if last != presences[idx].State {
+			changed = append(changed, idx)
+		}
+	}
+
+	for _, idx := range changed {
+		namespace := strings.SplitN(keys[idx], ".", 2)[0]
+		if err = s.publishPresence(namespace, &presences[idx]); err != nil {
+			log.Warn("Presence publishing failure for \"" + keys[idx] + "\": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *Service) publishPresence(namespace string, presence *proto.Presence) error {
+	group := proto.PRESENCE_GROUP_PREFIX + presence.User
+	users, err := s.Model.GetSubscription(namespace, group)
+	if err != nil {
+		return err
+	}
+	if len(users) < 1 {
+		return nil
+	}
+	raw, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+	body, result := &proto.MessageBody{Group: group, Raw: string(raw)}, make([]proto.PushResult, 1)
+	if err = s.serial.SerializeMessage(presence.User, []*proto.MessageBody{body}, result); err != nil {
+		return err
+	}
+	return s.deliver(proto.TraceContext{}, namespace, users, []*proto.Message{{
+		MessageIdentifier: result[0].MessageIdentifier,
+		MessageBody:       body,
+	}})
+}
+
+// sweepPresence re-evaluates keys whose last published presence isn't offline.
+// Routes left by a crashed gate expire without being removed, so gates never
+// notify their keys. Their offline presence is published here instead.
+func (s *Service) sweepPresence() error {
+	conn := s.Redis.Get()
+	defer conn.Close()
+
+	prefix, cursor := s.Config.RedisPrefix.Value+"{presence-", "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var stateKeys []string
+		if _, err = redis.Scan(reply, &cursor, &stateKeys); err != nil {
+			return err
+		}
+		if len(stateKeys) > 0 {
+			states, err := redis.Strings(conn.Do("MGET", redis.Args{}.AddFlat(stateKeys)...))
+			if err != nil {
+				return err
+			}
+			keys := make([]string, 0, len(stateKeys))
+			for idx, stateKey := range stateKeys {
+				if states[idx] == "" || states[idx] == proto.PRESENCE_OFFLINE {
+					continue
+				}
+				keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(stateKey, prefix), "}"))
+			}
+			if len(keys) > 0 {
+				if err = s.notifyPresence(keys); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// SweepPresence publishes presences of expired routes periodically.
+func (s *Service) SweepPresence(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.sweepPresence(); err != nil {
+			log.Warn("Presence sweeping failure: " + err.Error())
+		}
+	}
+}
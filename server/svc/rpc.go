@@ -6,8 +6,12 @@ import (
 	ilog "github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/proto"
 	"github.com/Sunmxt/linker-im/server"
+	"github.com/Sunmxt/linker-im/server/trace"
+	"github.com/Sunmxt/linker-im/utils/metrics"
 	"net/http"
 	"net/rpc"
+	"strconv"
+	"strings"
 )
 
 // Errors
@@ -22,31 +26,79 @@ func (svc ServiceRPC) Echo(args *string, reply *string) error {
 	return nil
 }
 
-func rpcAuth(op uint16, namespace, session string) (string, error) {
-	var ident string
+// rpcAuth authorizes operation on session, and on each group if given.
+func rpcAuth(parent proto.TraceContext, op uint16, namespace, session string, groups ...string) (ident string, err error) {
+	span := trace.Start(parent, "svc.auth")
+	span.Tag("op", strconv.FormatUint(uint64(op), 10))
+	defer func() { span.Finish(err) }()
+
 	sessionMap, err := service.Session.Get(namespace, session)
 	if err != nil {
+		observeAuthFailure(op, AUTH_FAILURE_SESSION)
 		return "", errors.New("Session failure: " + err.Error())
 	}
-	if err = service.Auther.Auth(namespace, op, sessionMap); err != nil {
+	if len(groups) < 1 {
+		err = service.Auther.Auth(namespace, op, sessionMap)
+	}
+	for _, group := range groups {
+		if err = server.AuthResource(service.Auther, namespace, op, group, sessionMap); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		observeAuthFailure(op, AUTH_FAILURE_DENIED)
 		return "", errors.New("Operation failure: " + err.Error())
 	}
 	if ident, err = service.Auther.Identifier(namespace, sessionMap); err != nil {
+		observeAuthFailure(op, AUTH_FAILURE_IDENTIFIER)
 		return "", errors.New("Identifier resolution failure: " + err.Error())
 	}
 	return ident, nil
 }
 
+// rpcError marks errors caused by request, so that they are not regarded as failures of node.
+func rpcError(err error) error {
+	switch err {
+	case ErrNamespaceMissing, ErrInvalidNamespaceName:
+		return server.ReplyRequestError(err)
+	}
+	return err
+}
+
+// Groups messages pushed to. Direct messages are addressed by DIRECT_GROUP_PREFIX + receiver.
+func pushGroups(msgs []*proto.MessageBody) []string {
+	groups, set := make([]string, 0, 1), make(map[string]struct{})
+	for _, msg := range msgs {
+		group := msg.Group
+		if msg.To != "" {
+			group = proto.DIRECT_GROUP_PREFIX + msg.To
+		}
+		if _, ok := set[group]; !ok {
+			set[group] = struct{}{}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
 // Push message sequences.
 func (svc ServiceRPC) Push(args *proto.RawMessagePushArguments, reply *proto.MessagePushResult) error {
-	ident, err := rpcAuth(proto.OP_PUSH, args.Namespace, args.Session)
+	span := trace.Start(args.Trace, "svc.push")
+	span.Tag("namespace", args.Namespace)
+	span.Tag("messages", strconv.Itoa(len(args.Msgs)))
+	defer span.Finish(nil)
+
+	ident, err := rpcAuth(span.Inherit(args.Trace), proto.OP_PUSH, args.Namespace, args.Session, pushGroups(args.Msgs)...)
 	result := make([]proto.PushResult, len(args.Msgs))
 	if err != nil {
 		reply.IsAuthError = true
 		reply.Msg = err.Error()
 		return nil
 	}
-	if err = service.serial.SerializeMessage(ident, args.Msgs, result); err != nil {
+	serialSpan := trace.Start(span.Inherit(args.Trace), "svc.serialize")
+	err = service.serial.SerializeMessage(ident, args.Msgs, result)
+	serialSpan.Finish(err)
+	if err != nil {
 		return err
 	}
 	msgs := make([]proto.Message, len(args.Msgs))
@@ -54,50 +106,203 @@ func (svc ServiceRPC) Push(args *proto.RawMessagePushArguments, reply *proto.Mes
 		msgs[idx].MessageBody = args.Msgs[idx]
 		msgs[idx].MessageIdentifier = result[idx].MessageIdentifier
 	}
-	service.pushBulk(args.Namespace, msgs, result)
+	service.pushBulk(span.Inherit(args.Trace), args.Namespace, msgs, result)
 	reply.Replies = result
 	return err
 }
 
-func (svc ServiceRPC) Subscribe(args *proto.Subscription, reply *string) error {
-	ident, err := rpcAuth(proto.OP_SUB, args.Namespace, args.Session)
+func (svc ServiceRPC) Subscribe(args *proto.SubscribeArguments, reply *string) error {
+	op := proto.OP_SUB
+	if args.Op == proto.OP_SUB_CANCEL {
+		op = proto.OP_UNSUB
+	}
+	ident, err := rpcAuth(args.Trace, op, args.Namespace, args.Session, args.Group)
+	if err == nil && args.Op == proto.OP_SUB_ADD && strings.HasPrefix(args.Group, proto.PRESENCE_GROUP_PREFIX) {
+		// Subscribing presence group watches presence of the user.
+		_, err = rpcAuth(args.Trace, proto.OP_PRESENCE, args.Namespace, args.Session, args.Group)
+	}
 	if err != nil {
 		*reply = err.Error()
 		return nil
 	}
 	switch args.Op {
 	case proto.OP_SUB_ADD:
-		return service.Model.Subscribe(args.Namespace, args.Group, []string{ident})
+		return rpcError(service.Model.Subscribe(args.Namespace, args.Group, []string{ident}))
 	case proto.OP_SUB_CANCEL:
-		return service.Model.Unsubscribe(args.Namespace, args.Group, []string{ident})
+		return rpcError(service.Model.Unsubscribe(args.Namespace, args.Group, []string{ident}))
 	default:
-		return errors.New("Invalid operation for subscription.")
+		return server.ReplyRequestError(errors.New("Invalid operation for subscription."))
+	}
+}
+
+// Authorize history query. Returns key of message log.
+func historyAuth(args *proto.HistoryQuery) (string, string, error) {
+	groups := []string{}
+	if args.Group != "" {
+		groups = append(groups, args.Group)
+	}
+	ident, err := rpcAuth(args.Trace, proto.OP_HISTORY, args.Namespace, args.Session, groups...)
+	if err != nil {
+		return "", err.Error(), nil
+	}
+	if args.Group != "" {
+		subscribed, err := service.Model.IsSubscribed(args.Namespace, args.Group, ident)
+		if err != nil {
+			return "", "", err
+		}
+		if !subscribed {
+			return "", "Not subscribed to group \"" + args.Group + "\".", nil
+		}
+	}
+	return service.History.QueryKey(args, ident), "", nil
+}
+
+func (svc ServiceRPC) History(args *proto.HistoryQuery, reply *proto.HistoryRangeReply) error {
+	key, msg, err := historyAuth(args)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		reply.IsAuthError, reply.Msg = true, msg
+		return nil
+	}
+	if reply.Msgs, reply.Next, err = service.History.Range(key, args.Begin, args.End, args.Limit); err == ErrHistoryDisabled {
+		reply.Msg = err.Error()
+		return nil
+	}
+	return err
+}
+
+func (svc ServiceRPC) HistoryCheck(args *proto.HistoryQuery, reply *proto.HistoryCheckReply) error {
+	key, msg, err := historyAuth(args)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		reply.IsAuthError, reply.Msg = true, msg
+		return nil
+	}
+	check, err := service.History.Check(key, args.Begin, args.End)
+	if err != nil {
+		if err == ErrHistoryDisabled {
+			reply.Msg = err.Error()
+			return nil
+		}
+		return err
+	}
+	reply.Check = *check
+	return nil
+}
+
+func (svc ServiceRPC) Presence(args *proto.PresenceQuery, reply *proto.PresenceReply) error {
+	// Querying presence of user is authorized as watching presence group of the user.
+	keys, groups := make([]string, len(args.Users)), make([]string, len(args.Users))
+	for idx, user := range args.Users {
+		keys[idx], groups[idx] = args.Namespace+"."+user, proto.PRESENCE_GROUP_PREFIX+user
+	}
+	if len(groups) < 1 {
+		return nil
+	}
+	if _, err := rpcAuth(args.Trace, proto.OP_PRESENCE, args.Namespace, args.Session, groups...); err != nil {
+		reply.IsAuthError, reply.Msg = true, err.Error()
+		return nil
 	}
+	conn := service.Redis.Get()
+	defer conn.Close()
+	presences, err := service.presence(conn, keys)
+	if err != nil {
+		return err
+	}
+	reply.Presences = presences
+	return nil
 }
 
-func (svc ServiceRPC) Connect(conn *proto.ConnectV1, reply *proto.ConnectResultV1) error {
+// PresenceNotify is called by gates when client routes change.
+func (svc ServiceRPC) PresenceNotify(args *proto.PresenceNotifyArguments, reply *string) error {
+	return service.notifyPresence(args.Keys)
+}
+
+func (svc ServiceRPC) Connect(conn *proto.ConnectArguments, reply *proto.ConnectReply) error {
 	session, ident := make(map[string]string), ""
+	span := trace.Start(conn.Trace, "svc.connect")
+	span.Tag("namespace", conn.Namespace)
 	err := service.Auther.Connect(conn.Namespace, conn.Credential, session)
+	span.Finish(err)
 	if err != nil {
 		if server.IsAuthError(err) {
+			observeAuthFailure(proto.OP_CONNECT, AUTH_FAILURE_DENIED)
 			reply.AuthError = err.Error()
 			return nil
 		}
 		return err
 	}
-	if reply.Session, err = service.Session.Register(conn.Namespace, session); err != nil {
-		return err
-	}
 	if ident, err = service.Auther.Identifier(conn.Namespace, session); err != nil {
+		observeAuthFailure(proto.OP_CONNECT, AUTH_FAILURE_IDENTIFIER)
 		reply.AuthError = "Identifier resolution failure: " + err.Error()
 		return nil
 	}
+	session[server.SESSION_IDENTIFIER] = ident
+	if reply.Session, err = service.Session.Register(conn.Namespace, session); err != nil {
+		return err
+	}
 	reply.Key = conn.Namespace + "." + ident
 	return nil
 }
 
-func (svc ServiceRPC) EntityList(args *proto.EntityListArguments, reply *proto.EntityListReply) error {
+// sessionError converts invalid session to reply.
+func sessionError(err error, reply *proto.SessionReply) error {
+	if err == ErrSessionNotFound || server.IsAuthError(err) {
+		reply.IsAuthError, reply.Msg = true, err.Error()
+		return nil
+	}
+	return err
+}
 
+// Keepalive postpones expiration of session.
+func (svc ServiceRPC) Keepalive(args *proto.SessionArguments, reply *proto.SessionReply) error {
+	var err error
+	if refresher, ok := service.Session.(server.SessionRefresher); ok {
+		err = refresher.Refresh(args.Namespace, args.Session)
+	} else {
+		_, err = service.Session.Get(args.Namespace, args.Session)
+	}
+	return sessionError(err, reply)
+}
+
+// SessionKey resolves key of session for gates, authorizing args.Op if given.
+func (svc ServiceRPC) SessionKey(args *proto.SessionArguments, reply *proto.SessionKeyReply) error {
+	if args.Op != 0 {
+		ident, err := rpcAuth(args.Trace, args.Op, args.Namespace, args.Session)
+		if err != nil {
+			reply.IsAuthError, reply.Msg = true, err.Error()
+			return nil
+		}
+		reply.Key = args.Namespace + "." + ident
+		return nil
+	}
+	session, err := service.Session.Get(args.Namespace, args.Session)
+	if err != nil {
+		return sessionError(err, &reply.SessionReply)
+	}
+	ident, err := service.Auther.Identifier(args.Namespace, session)
+	if err != nil {
+		reply.IsAuthError, reply.Msg = true, "Identifier resolution failure: "+err.Error()
+		return nil
+	}
+	reply.Key = args.Namespace + "." + ident
+	return nil
+}
+
+// Disconnect revokes session.
+func (svc ServiceRPC) Disconnect(args *proto.SessionArguments, reply *proto.SessionReply) error {
+	return sessionError(service.Session.Remove(args.Namespace, args.Session), reply)
+}
+
+func (svc ServiceRPC) EntityList(args *proto.EntityListArguments, reply *proto.EntityListReply) error {
+	if _, err := rpcAuth(args.Trace, proto.OP_ENTITY, args.Namespace, args.Session); err != nil {
+		reply.IsAuthError, reply.Msg = true, err.Error()
+		return nil
+	}
 	var err error
 	switch args.Type {
 	case proto.ENTITY_NAMESPACE:
@@ -109,10 +314,7 @@ func (svc ServiceRPC) EntityList(args *proto.EntityListArguments, reply *proto.E
 	default:
 		reply.Msg = fmt.Sprintf("Unknown entity: %v", args.Type)
 	}
-	if err != nil {
-		return err
-	}
-	return nil
+	return rpcError(err)
 }
 
 func (svc ServiceRPC) EntityAlter(args *proto.EntityAlterArguments, reply *string) error {
@@ -121,6 +323,10 @@ func (svc ServiceRPC) EntityAlter(args *proto.EntityAlterArguments, reply *strin
 		*reply = fmt.Sprintf("Unknown operation: %v", args.Operation)
 		return nil
 	}
+	if _, err = rpcAuth(args.Trace, proto.OP_ENTITY, args.Namespace, args.Session); err != nil {
+		*reply = err.Error()
+		return nil
+	}
 
 	if args.Entities == nil || len(args.Entities) < 1 {
 		return nil
@@ -170,11 +376,12 @@ func (svc ServiceRPC) EntityAlter(args *proto.EntityAlterArguments, reply *strin
 	default:
 		*reply = fmt.Sprintf("Unknown entity: %v", args.Type)
 	}
-	return err
+	return rpcError(err)
 }
 
 func (svc *Service) InitRPC() error {
-	rpcServer := rpc.NewServer()
+	svc.RPCServer = rpc.NewServer()
+	rpcServer := svc.RPCServer
 	rpcRuntime := ServiceRPC{
 		NodeID: svc.ID,
 		log:    ilog.NewLogger(),
@@ -194,6 +401,37 @@ func (svc *Service) InitRPC() error {
 		"entity": "health-check",
 	}))
 
+	// ACL management
+	if svc.ACL != nil && svc.Config.AdminToken.Value == "" {
+		ilog.Warn("No admin token configured. ACL management endpoints disabled.")
+	} else if svc.ACL != nil {
+		aclHandlers := map[string]http.HandlerFunc{
+			"/acl":         ACLPolicyShow,
+			"/acl/reload":  ACLReload,
+			"/acl/explain": ACLExplain,
+		}
+		for path, handler := range aclHandlers {
+			ilog.Info0("Register ACL management endpoint \"" + path + "\"")
+			svc.RPCRouter.Handle(path, ilog.TagLogHandler(manageAuth(handler), map[string]interface{}{
+				"entity": "acl",
+			}))
+		}
+	}
+
+	// Session management
+	if _, ok := svc.Session.(server.UserSessionRevoker); ok && svc.Config.AdminToken.Value == "" {
+		ilog.Warn("No admin token configured. Session management endpoint disabled.")
+	} else if ok {
+		ilog.Info0("Register session management endpoint \"/session/revoke\"")
+		svc.RPCRouter.Handle("/session/revoke", ilog.TagLogHandler(manageAuth(http.HandlerFunc(SessionRevoke)), map[string]interface{}{
+			"entity": "session",
+		}))
+	}
+
+	// Metrics
+	ilog.Info0("Register metrics endpoint \"/metrics\"")
+	svc.RPCRouter.Handle("/metrics", metrics.Handler())
+
 	// RPC
 	ilog.Info0("Register RPC endpoint \"" + proto.RPC_PATH + "\"")
 	svc.RPCRouter.Handle(proto.RPC_PATH, rpcServer)
@@ -212,8 +450,14 @@ func (svc *Service) InitRPC() error {
 }
 
 func (svc *Service) ServeRPC() {
-	ilog.Info0("RPC Serving...")
-	if err := svc.RPC.ListenAndServe(); err != nil {
+	listener, err := server.ListenRPC(svc.RPC.Addr, svc.RPCServer)
+	if err != nil {
+		ilog.Error("RPC Server failure: " + err.Error())
+		svc.fatal <- err
+		return
+	}
+	ilog.Info0("RPC Serving... Codecs: " + strings.Join(server.RPCCodecNames(), ", ") + ".")
+	if err := svc.RPC.Serve(listener); err != nil {
 		ilog.Error("RPC Server failure: " + err.Error())
 		svc.fatal <- err
 	}
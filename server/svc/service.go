@@ -2,9 +2,11 @@ package svc
 
 import (
 	"github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/server/dig"
 	"github.com/gomodule/redigo/redis"
 	"runtime"
+	"time"
 )
 
 func (svc *Service) InitService() error {
@@ -25,16 +27,52 @@ func (svc *Service) InitService() error {
 	log.Info0("Initialize model.")
 	svc.Model = NewModel(svc.Redis, svc.Config.RedisPrefix.Value)
 
+	log.Info0("Initialize message history.")
+	svc.History = NewMessageLog(svc.Redis, svc.Config.RedisPrefix.Value, int(svc.Config.HistorySize.Value))
+
 	log.Info0("Initialize node discovery.")
 	if svc.Reg, err = dig.Connect("redis", svc.Redis, svc.Config.RedisPrefix.Value); err != nil {
 		return err
 	}
-
-	log.Info0("Initialize session pool.")
-	svc.Session = &DefaultSessionPool{}
+	if svc.Config.DigNotify.Value {
+		log.Infof0("Listen for discovery notifications. Full synchronization every %v seconds.", svc.Config.DigResync.Value)
+		if err = svc.Reg.Listen(time.Duration(svc.Config.DigResync.Value) * time.Second); err != nil {
+			return err
+		}
+	}
 
 	log.Info0("Initialize authorizer.")
-	svc.Auther = &DefaultAuthorizer{}
+	switch svc.Config.Authorizer.Value {
+	case AUTHORIZER_JWT:
+		auther, err := LoadJWTAuthorizer(svc.Config.JWTConfig.Value)
+		if err != nil {
+			return err
+		}
+		svc.Auther = auther
+		if svc.Config.SessionPool.Value == SESSION_POOL_TOKEN {
+			// Token is session itself.
+			svc.Session = NewJWTSessionPool(auther, svc.Redis, svc.Config.RedisPrefix.Value)
+		}
+	case AUTHORIZER_WEBHOOK:
+		if svc.Auther, err = LoadWebhookAuthorizer(svc.Config.WebhookConfig.Value); err != nil {
+			return err
+		}
+	default:
+		svc.Auther = &DefaultAuthorizer{}
+	}
+	if svc.Session == nil {
+		log.Info0("Initialize session pool.")
+		svc.Session = NewRedisSessionPool(svc.Redis, svc.Config.RedisPrefix.Value, time.Duration(svc.Config.CacheTimeout.Value)*time.Millisecond)
+	}
+	if svc.Config.ACLConfig.Value != "" {
+		log.Info0("Load ACL policy from \"" + svc.Config.ACLConfig.Value + "\".")
+		if svc.ACL, err = LoadACLAuthorizer(svc.Config.ACLConfig.Value); err != nil {
+			return err
+		}
+		svc.Auther = server.AuthAnd(svc.Auther, svc.ACL)
+		go svc.ACL.Watch(ACL_RELOAD_PERIOD)
+	}
+	go svc.SweepPresence(PRESENCE_SWEEP_PERIOD)
 
 	return nil
 }
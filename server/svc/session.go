@@ -1,14 +1,241 @@
 package svc
 
-type DefaultSessionPool struct{}
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/Sunmxt/linker-im/server"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
 
-func (s *DefaultSessionPool) Get(namespace, key string) (map[string]string, error) {
-	return map[string]string{"u": key, "ns": namespace}, nil
+const (
+	SESSION_TOKEN_BYTES = 24
+	// Dead tokens are pruned from user index when it grows over this size.
+	SESSION_INDEX_PRUNE_SIZE = 64
+)
+
+var ErrSessionNotFound = errors.New("Session not found.")
+
+// RedisSessionPool stores sessions in redis hashes keyed by random tokens.
+// Sessions expire after being idle for Timeout. Zero Timeout means no expiration.
+type RedisSessionPool struct {
+	Pool    *redis.Pool
+	Prefix  string
+	Timeout time.Duration
+}
+
+func NewRedisSessionPool(pool *redis.Pool, prefix string, timeout time.Duration) *RedisSessionPool {
+	return &RedisSessionPool{
+		Pool:    pool,
+		Prefix:  prefix,
+		Timeout: timeout,
+	}
+}
+
+func (p *RedisSessionPool) sessionKey(namespace, token string) string {
+	return p.Prefix + "{session-" + namespace + "." + token + "}"
+}
+
+// Tokens of user.
+func (p *RedisSessionPool) userKey(namespace, user string) string {
+	return p.Prefix + "{usersession-" + namespace + "." + user + "}"
+}
+
+func newSessionToken() (string, error) {
+	raw := make([]byte, SESSION_TOKEN_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (p *RedisSessionPool) timeoutMillisecond() int64 {
+	return int64(p.Timeout / time.Millisecond)
+}
+
+func (p *RedisSessionPool) Register(namespace string, session map[string]string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	key, user := p.sessionKey(namespace, token), session[server.SESSION_IDENTIFIER]
+	if err = conn.Send("HMSET", redis.Args{}.Add(key).AddFlat(session)...); err != nil {
+		return "", err
+	}
+	count := 1
+	if p.Timeout > 0 {
+		if err = conn.Send("PEXPIRE", key, p.timeoutMillisecond()); err != nil {
+			return "", err
+		}
+		count++
+	}
+	if user != "" {
+		if err = conn.Send("SADD", p.userKey(namespace, user), token); err != nil {
+			return "", err
+		}
+		if err = conn.Send("SCARD", p.userKey(namespace, user)); err != nil {
+			return "", err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return "", err
+	}
+	for ; count > 0; count-- {
+		if _, err = conn.Receive(); err != nil {
+			return "", err
+		}
+	}
+	if user != "" {
+		if _, err = conn.Receive(); err != nil {
+			return "", err
+		}
+		size, err := redis.Int(conn.Receive())
+		if err != nil {
+			return "", err
+		}
+		if size > SESSION_INDEX_PRUNE_SIZE {
+			if err = p.prune(conn, namespace, user); err != nil {
+				return "", err
+			}
+		}
+	}
+	return token, nil
 }
 
-func (s *DefaultSessionPool) Register(namespace string, session map[string]string) (string, error) {
-	key, _ := session["u"]
-	return key, nil
+// prune removes tokens of expired sessions from user index.
+func (p *RedisSessionPool) prune(conn redis.Conn, namespace, user string) error {
+	userKey := p.userKey(namespace, user)
+	tokens, err := redis.Strings(conn.Do("SMEMBERS", userKey))
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err = conn.Send("EXISTS", p.sessionKey(namespace, token)); err != nil {
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+	dead := redis.Args{}.Add(userKey)
+	for _, token := range tokens {
+		exists, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			dead = dead.Add(token)
+		}
+	}
+	if len(dead) > 1 {
+		_, err = conn.Do("SREM", dead...)
+	}
+	return err
 }
 
-func (s *DefaultSessionPool) Remove(namespace, key string) error { return nil }
+// Get loads session and postpones its expiration.
+func (p *RedisSessionPool) Get(namespace, token string) (map[string]string, error) {
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	key := p.sessionKey(namespace, token)
+	if err := conn.Send("HGETALL", key); err != nil {
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		if err := conn.Send("PEXPIRE", key, p.timeoutMillisecond()); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	session, err := redis.StringMap(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		if _, err = conn.Receive(); err != nil {
+			return nil, err
+		}
+	}
+	if len(session) < 1 {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// Refresh postpones expiration of session.
+func (p *RedisSessionPool) Refresh(namespace, token string) error {
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	var exists bool
+	var err error
+	key := p.sessionKey(namespace, token)
+	if p.Timeout > 0 {
+		exists, err = redis.Bool(conn.Do("PEXPIRE", key, p.timeoutMillisecond()))
+	} else {
+		exists, err = redis.Bool(conn.Do("EXISTS", key))
+	}
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Remove revokes session.
+func (p *RedisSessionPool) Remove(namespace, token string) error {
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	key := p.sessionKey(namespace, token)
+	user, err := redis.String(conn.Do("HGET", key, server.SESSION_IDENTIFIER))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if err = conn.Send("DEL", key); err != nil {
+		return err
+	}
+	if user != "" {
+		if err = conn.Send("SREM", p.userKey(namespace, user), token); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("")
+	return err
+}
+
+// RemoveUser revokes all sessions of user.
+// Returns number of revoked sessions.
+func (p *RedisSessionPool) RemoveUser(namespace, user string) (int, error) {
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	userKey := p.userKey(namespace, user)
+	tokens, err := redis.Strings(conn.Do("SMEMBERS", userKey))
+	if err != nil {
+		return 0, err
+	}
+	keys := redis.Args{}
+	for _, token := range tokens {
+		keys = keys.Add(p.sessionKey(namespace, token))
+	}
+	revoked := 0
+	if len(keys) > 0 {
+		if revoked, err = redis.Int(conn.Do("DEL", keys...)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = conn.Do("DEL", userKey); err != nil {
+		return revoked, err
+	}
+	return revoked, nil
+}
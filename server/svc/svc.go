@@ -5,9 +5,14 @@ import (
 	ilog "github.com/Sunmxt/linker-im/log"
 	"github.com/Sunmxt/linker-im/server"
 	"github.com/Sunmxt/linker-im/server/dig"
+	"github.com/Sunmxt/linker-im/server/trace"
 	"github.com/gomodule/redigo/redis"
 	"net/http"
+	"net/rpc"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 var service *Service
@@ -15,14 +20,17 @@ var service *Service
 type Service struct {
 	Config    *ServiceOptions
 	Model     *Model
+	History   *MessageLog
 	Redis     *redis.Pool
 	RPCRouter *http.ServeMux
 	RPC       *http.Server
+	RPCServer *rpc.Server
 	Node      *dig.Node
 	Reg       dig.Registry
 	ID        server.NodeID
 	Session   server.SessionPool
 	Auther    server.Authorizer
+	ACL       *ACLAuthorizer
 
 	fatal    chan error
 	serial   TimeSerializer
@@ -44,6 +52,17 @@ func (svc *Service) Run() {
 	ilog.Infof0("Log level: %v", svc.Config.LogLevel.Value)
 	ilog.SetGlobalLogLevel(svc.Config.LogLevel.Value)
 
+	if path := svc.Config.TraceExport.Value; path != "" {
+		exporter, err := trace.OpenJSONExporter(path)
+		if err != nil {
+			ilog.Fatal("Cannot open trace exporter: " + err.Error())
+			return
+		}
+		trace.SetService("svc")
+		trace.SetExporter(exporter)
+		ilog.Info0("Export traces to \"" + path + "\".")
+	}
+
 	svc.ID = server.NewNodeID()
 	ilog.Info0("Node ID is " + svc.ID.String())
 	svc.fatal = make(chan error)
@@ -61,7 +80,20 @@ func (svc *Service) Run() {
 	go svc.ServeRPC()
 	go svc.Discover()
 
-	if err = <-svc.fatal; err != nil {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-svc.fatal:
+	case sig := <-stop:
+		ilog.Info0("Signal \"" + sig.String() + "\" received.")
+	}
+
+	// Deregister, so that gates stop routing to this node.
+	ilog.Info0("[Dig] Deregister.")
+	if closeErr := svc.Reg.Close(); closeErr != nil {
+		ilog.Error("[Dig] Deregistering failure: " + closeErr.Error())
+	}
+	if err != nil {
 		ilog.Fatal(err.Error())
 	}
 	ilog.Info0("Exiting...")
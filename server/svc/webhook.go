@@ -0,0 +1,262 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sunmxt/linker-im/config"
+	ilog "github.com/Sunmxt/linker-im/log"
+	"github.com/Sunmxt/linker-im/server"
+	yaml "gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_TYPE_CONNECT = "connect"
+	WEBHOOK_TYPE_AUTH    = "auth"
+
+	WEBHOOK_DEFAULT_TIMEOUT   = 3000
+	WEBHOOK_DEFAULT_CACHE_TTL = 60
+	// Max cached decisions.
+	WEBHOOK_CACHE_MAX_ENTRIES = 65536
+	// Max bytes of webhook response.
+	WEBHOOK_MAX_RESPONSE = 1 << 20
+)
+
+var (
+	ErrWebhookNoURL  = errors.New("No webhook configured for namespace.")
+	ErrWebhookDenied = errors.New("Denied by webhook.")
+	ErrWebhookNoUser = errors.New("No identifier returned by webhook.")
+)
+
+// WebhookRequest is posted to webhook.
+type WebhookRequest struct {
+	Type       string            `json:"type"`
+	Namespace  string            `json:"namespace"`
+	Credential string            `json:"credential,omitempty"`
+	Op         uint16            `json:"op,omitempty"`
+	Session    map[string]string `json:"session,omitempty"`
+}
+
+// WebhookResponse is replied by webhook.
+// Identifier and Session are used by connecting only.
+type WebhookResponse struct {
+	Allow      bool              `json:"allow"`
+	Identifier string            `json:"identifier,omitempty"`
+	Session    map[string]string `json:"session,omitempty"`
+	Msg        string            `json:"msg,omitempty"`
+}
+
+type webhookDecision struct {
+	allow  bool
+	msg    string
+	expire time.Time
+}
+
+// WebhookAuthorizer delegates authorization to external HTTP endpoints.
+// Decisions of operations are cached for CacheTTL.
+// Extra session fields returned by webhook survive only in session pools storing sessions.
+type WebhookAuthorizer struct {
+	URLs       map[string]string
+	DefaultURL string
+	CacheTTL   time.Duration
+	Client     *http.Client
+	Log        *ilog.Logger
+
+	lock  sync.RWMutex
+	cache map[[sha256.Size]byte]*webhookDecision
+}
+
+func NewWebhookAuthorizer(cfg *config.WebhookConfigure) *WebhookAuthorizer {
+	timeout := cfg.Timeout
+	if timeout < 1 {
+		timeout = WEBHOOK_DEFAULT_TIMEOUT
+	}
+	a := &WebhookAuthorizer{
+		URLs:       make(map[string]string, len(cfg.Namespaces)),
+		DefaultURL: cfg.Default,
+		CacheTTL:   time.Duration(cfg.CacheTTL) * time.Second,
+		Client:     &http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		Log:        ilog.NewLogger(),
+		cache:      make(map[[sha256.Size]byte]*webhookDecision),
+	}
+	for namespace, url := range cfg.Namespaces {
+		a.URLs[namespace] = url
+	}
+	a.Log.Fields["entity"] = "webhook"
+	return a
+}
+
+// LoadWebhookAuthorizer creates WebhookAuthorizer from YAML configure file.
+func LoadWebhookAuthorizer(path string) (*WebhookAuthorizer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load webhook configure: %v", err.Error())
+	}
+	cfg := &config.WebhookConfigure{
+		CacheTTL: WEBHOOK_DEFAULT_CACHE_TTL,
+	}
+	if err = yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("Invalid webhook configure format: %v", err.Error())
+	}
+	if cfg.Default == "" && len(cfg.Namespaces) < 1 {
+		return nil, errors.New("No webhook URL configured.")
+	}
+	return NewWebhookAuthorizer(cfg), nil
+}
+
+func (a *WebhookAuthorizer) call(req *WebhookRequest) (*WebhookResponse, error) {
+	url, ok := a.URLs[req.Namespace]
+	if !ok {
+		if url = a.DefaultURL; url == "" {
+			return nil, ErrWebhookNoURL
+		}
+	}
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.Client.Post(url, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Webhook responses status %v.", resp.StatusCode)
+	}
+	if raw, err = ioutil.ReadAll(io.LimitReader(resp.Body, WEBHOOK_MAX_RESPONSE)); err != nil {
+		return nil, err
+	}
+	reply := &WebhookResponse{}
+	if err = json.Unmarshal(raw, reply); err != nil {
+		return nil, fmt.Errorf("Invalid webhook response: %v", err.Error())
+	}
+	return reply, nil
+}
+
+func webhookDenied(msg string) error {
+	if msg == "" {
+		return server.NewAuthError(ErrWebhookDenied)
+	}
+	return server.NewAuthError(errors.New(msg))
+}
+
+func (a *WebhookAuthorizer) Connect(namespace, credential string, session map[string]string) error {
+	reply, err := a.call(&WebhookRequest{
+		Type:       WEBHOOK_TYPE_CONNECT,
+		Namespace:  namespace,
+		Credential: credential,
+	})
+	if err != nil {
+		a.Log.Warn("Webhook failure: " + err.Error())
+		return err
+	}
+	if !reply.Allow {
+		return webhookDenied(reply.Msg)
+	}
+	if reply.Identifier == "" {
+		return server.NewAuthError(ErrWebhookNoUser)
+	}
+	for name, value := range reply.Session {
+		session[name] = value
+	}
+	session["u"] = reply.Identifier
+	session["ns"] = namespace
+	return nil
+}
+
+// Decision key of operation on session.
+func webhookCacheKey(namespace string, op uint16, session map[string]string) [sha256.Size]byte {
+	names := make([]string, 0, len(session))
+	for name := range session {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := bytes.NewBufferString(namespace)
+	buf.WriteByte(0)
+	buf.WriteString(strconv.FormatUint(uint64(op), 10))
+	for _, name := range names {
+		buf.WriteByte(0)
+		buf.WriteString(strconv.Quote(name))
+		buf.WriteByte('=')
+		buf.WriteString(strconv.Quote(session[name]))
+	}
+	return sha256.Sum256(buf.Bytes())
+}
+
+func (a *WebhookAuthorizer) cached(key [sha256.Size]byte, now time.Time) *webhookDecision {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	decision, ok := a.cache[key]
+	if !ok || now.After(decision.expire) {
+		return nil
+	}
+	return decision
+}
+
+func (a *WebhookAuthorizer) remember(key [sha256.Size]byte, decision *webhookDecision, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.cache) >= WEBHOOK_CACHE_MAX_ENTRIES {
+		for k, d := range a.cache {
+			if now.After(d.expire) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= WEBHOOK_CACHE_MAX_ENTRIES {
+			a.cache = make(map[[sha256.Size]byte]*webhookDecision)
+		}
+	}
+	a.cache[key] = decision
+}
+
+func (a *WebhookAuthorizer) Auth(namespace string, op uint16, session map[string]string) error {
+	var key [sha256.Size]byte
+	now := time.Now()
+	if a.CacheTTL > 0 {
+		key = webhookCacheKey(namespace, op, session)
+		if decision := a.cached(key, now); decision != nil {
+			if !decision.allow {
+				return webhookDenied(decision.msg)
+			}
+			return nil
+		}
+	}
+	reply, err := a.call(&WebhookRequest{
+		Type:      WEBHOOK_TYPE_AUTH,
+		Namespace: namespace,
+		Op:        op,
+		Session:   session,
+	})
+	if err != nil {
+		a.Log.Warn("Webhook failure: " + err.Error())
+		return err
+	}
+	if a.CacheTTL > 0 {
+		a.remember(key, &webhookDecision{
+			allow:  reply.Allow,
+			msg:    reply.Msg,
+			expire: now.Add(a.CacheTTL),
+		}, now)
+	}
+	if !reply.Allow {
+		return webhookDenied(reply.Msg)
+	}
+	return nil
+}
+
+func (a *WebhookAuthorizer) Identifier(namespace string, session map[string]string) (string, error) {
+	ident, _ := session["u"]
+	if ident == "" {
+		return "", ErrWebhookNoUser
+	}
+	return ident, nil
+}
@@ -0,0 +1,58 @@
+package trace
+
+import (
+	"encoding/json"
+	"github.com/Sunmxt/linker-im/log"
+	"io"
+	"os"
+)
+
+const (
+	// Spans exported to stdout.
+	EXPORT_STDOUT = "stdout"
+
+	// Spans buffered before being dropped.
+	JSON_EXPORT_BUFFER = 4096
+)
+
+// JSONExporter writes spans as JSON lines.
+// Spans are written asynchronously and dropped when writer falls behind.
+type JSONExporter struct {
+	spans chan *Span
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	e := &JSONExporter{
+		spans: make(chan *Span, JSON_EXPORT_BUFFER),
+	}
+	go e.write(json.NewEncoder(w))
+	return e
+}
+
+// OpenJSONExporter appends spans to file at path, or stdout if path is EXPORT_STDOUT.
+func OpenJSONExporter(path string) (*JSONExporter, error) {
+	if path == EXPORT_STDOUT {
+		return NewJSONExporter(os.Stdout), nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONExporter(file), nil
+}
+
+func (e *JSONExporter) write(encoder *json.Encoder) {
+	for span := range e.spans {
+		if err := encoder.Encode(span); err != nil {
+			log.Warn("Span exporting failure: " + err.Error())
+		}
+	}
+}
+
+func (e *JSONExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		log.Warn("Span dropped for full exporting buffer.")
+	}
+}
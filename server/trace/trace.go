@@ -0,0 +1,137 @@
+// Package trace records spans of requests across gates and services.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/Sunmxt/linker-im/proto"
+	"sync"
+	"time"
+)
+
+// Span is a timed stage of traced request.
+type Span struct {
+	TraceID  string            `json:"trace"`
+	SpanID   string            `json:"span"`
+	ParentID string            `json:"parent,omitempty"`
+	Name     string            `json:"name"`
+	Service  string            `json:"service"`
+	Start    time.Time         `json:"start"`
+	Duration int64             `json:"duration_us"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Exporter receives finished spans.
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	lock     sync.RWMutex
+	exporter Exporter
+	service  string
+)
+
+// SetExporter enables tracing. Tracing is disabled if exporter is nil.
+func SetExporter(e Exporter) {
+	lock.Lock()
+	exporter = e
+	lock.Unlock()
+}
+
+// SetService sets name of local service recorded in spans.
+func SetService(name string) {
+	lock.Lock()
+	service = name
+	lock.Unlock()
+}
+
+func currentExporter() (Exporter, string) {
+	lock.RLock()
+	defer lock.RUnlock()
+	return exporter, service
+}
+
+func Enabled() bool {
+	e, _ := currentExporter()
+	return e != nil
+}
+
+func NewID(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Start begins span under parent. New trace is started if parent is empty.
+// Returns nil if tracing is disabled. Methods of nil span are no-op.
+func Start(parent proto.TraceContext, name string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	if parent.TraceID == "" {
+		parent.TraceID, parent.SpanID = NewID(16), ""
+	}
+	_, svc := currentExporter()
+	return &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   NewID(8),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Service:  svc,
+		Start:    time.Now(),
+	}
+}
+
+// Continue begins span only if parent is traced.
+func Continue(parent proto.TraceContext, name string) *Span {
+	if parent.TraceID == "" {
+		return nil
+	}
+	return Start(parent, name)
+}
+
+// Context returns trace context to be passed to children.
+func (s *Span) Context() proto.TraceContext {
+	if s == nil {
+		return proto.TraceContext{}
+	}
+	return proto.TraceContext{
+		TraceID: s.TraceID,
+		SpanID:  s.SpanID,
+	}
+}
+
+// Inherit returns context of span, or parent if tracing is disabled locally,
+// so that downstream services may still trace the request.
+func (s *Span) Inherit(parent proto.TraceContext) proto.TraceContext {
+	if s == nil {
+		return parent
+	}
+	return s.Context()
+}
+
+func (s *Span) Tag(name, value string) {
+	if s == nil {
+		return
+	}
+	if s.Tags == nil {
+		s.Tags = make(map[string]string)
+	}
+	s.Tags[name] = value
+}
+
+// Finish ends span and exports it. Error is recorded if err is not nil.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.Duration = int64(time.Since(s.Start) / time.Microsecond)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if e, _ := currentExporter(); e != nil {
+		e.Export(s)
+	}
+}
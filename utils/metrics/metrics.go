@@ -0,0 +1,326 @@
+// Package metrics implements minimal Prometheus metrics in text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Default buckets of latency histograms in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default buckets of size histograms.
+var SizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+type series struct {
+	values []string
+
+	bits    uint64 // float64 value of counter or gauge. Sum of histogram.
+	count   uint64
+	buckets []uint64
+}
+
+func (s *series) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		if atomic.CompareAndSwapUint64(&s.bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (s *series) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	lock   sync.RWMutex
+	series map[string]*series
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + ": expect " + strconv.Itoa(len(f.labels)) + " label values.")
+	}
+	key := strings.Join(values, "\xff")
+	f.lock.RLock()
+	s, ok := f.series[key]
+	f.lock.RUnlock()
+	if ok {
+		return s
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if s, ok = f.series[key]; !ok {
+		s = &series{
+			values: append(make([]string, 0, len(values)), values...),
+		}
+		if f.typ == TYPE_HISTOGRAM {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(values []string) {
+	f.lock.Lock()
+	delete(f.series, strings.Join(values, "\xff"))
+	f.lock.Unlock()
+}
+
+// Registry holds metric families.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// DefaultRegistry is used by package level constructors and Handler.
+var DefaultRegistry = NewRegistry()
+
+// register returns existing family of the same name.
+func (r *Registry) register(f *family) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if exist, ok := r.families[f.name]; ok {
+		if exist.typ != f.typ || len(exist.labels) != len(f.labels) {
+			panic("metrics: " + f.name + " registered with different type or labels.")
+		}
+		return exist
+	}
+	f.series = make(map[string]*series)
+	r.families[f.name] = f
+	return f
+}
+
+// Counter
+type Counter struct{ s *series }
+
+func (c *Counter) Inc()          { c.s.add(1) }
+func (c *Counter) Add(v float64) { c.s.add(v) }
+
+type CounterVec struct{ f *family }
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(&family{name: name, help: help, typ: TYPE_COUNTER, labels: labels})}
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (v *CounterVec) With(values ...string) *Counter { return &Counter{s: v.f.with(values)} }
+func (v *CounterVec) Delete(values ...string)        { v.f.delete(values) }
+
+// Gauge
+type Gauge struct{ s *series }
+
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.s.bits, math.Float64bits(v)) }
+func (g *Gauge) Add(v float64) { g.s.add(v) }
+func (g *Gauge) Inc()          { g.s.add(1) }
+func (g *Gauge) Dec()          { g.s.add(-1) }
+
+type GaugeVec struct{ f *family }
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(&family{name: name, help: help, typ: TYPE_GAUGE, labels: labels})}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewGaugeFunc registers gauge whose value is computed by fn on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, typ: TYPE_GAUGE, fn: fn})
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge { return &Gauge{s: v.f.with(values)} }
+func (v *GaugeVec) Delete(values ...string)      { v.f.delete(values) }
+
+// Histogram
+type Histogram struct {
+	s      *series
+	bounds []float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	if idx := sort.SearchFloat64s(h.bounds, v); idx < len(h.bounds) {
+		atomic.AddUint64(&h.s.buckets[idx], 1)
+	}
+	atomic.AddUint64(&h.s.count, 1)
+	h.s.add(v)
+}
+
+// ObserveSince observes seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+type HistogramVec struct{ f *family }
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append(make([]float64, 0, len(buckets)), buckets...)
+	sort.Float64s(bounds)
+	return &HistogramVec{f: r.register(&family{name: name, help: help, typ: TYPE_HISTOGRAM, labels: labels, buckets: bounds})}
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{s: v.f.with(values), bounds: v.f.buckets}
+}
+func (v *HistogramVec) Delete(values ...string) { v.f.delete(values) }
+
+// Package level constructors register to DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+func NewCounter(name, help string) *Counter { return DefaultRegistry.NewCounter(name, help) }
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+func NewGauge(name, help string) *Gauge { return DefaultRegistry.NewGauge(name, help) }
+func NewGaugeFunc(name, help string, fn func() float64) {
+	DefaultRegistry.NewGaugeFunc(name, help, fn)
+}
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets)
+}
+
+// Exposition
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+var helpEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for idx, label := range labels {
+			if idx > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + "=\"" + labelEscaper.Replace(values[idx]) + "\"")
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + "=\"" + extraValue + "\"")
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func (f *family) write(w *bufio.Writer) {
+	w.WriteString("# HELP " + f.name + " " + helpEscaper.Replace(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	if f.fn != nil {
+		writeSample(w, f.name, nil, nil, "", "", formatFloat(f.fn()))
+		return
+	}
+
+	f.lock.RLock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, f.series[key])
+	}
+	f.lock.RUnlock()
+
+	for _, s := range series {
+		if f.typ != TYPE_HISTOGRAM {
+			writeSample(w, f.name, f.labels, s.values, "", "", formatFloat(s.value()))
+			continue
+		}
+		var cumulative uint64
+		for idx, bound := range f.buckets {
+			cumulative += atomic.LoadUint64(&s.buckets[idx])
+			writeSample(w, f.name+"_bucket", f.labels, s.values, "le", formatFloat(bound), strconv.FormatUint(cumulative, 10))
+		}
+		count := strconv.FormatUint(atomic.LoadUint64(&s.count), 10)
+		writeSample(w, f.name+"_bucket", f.labels, s.values, "le", "+Inf", count)
+		writeSample(w, f.name+"_sum", f.labels, s.values, "", "", formatFloat(s.value()))
+		writeSample(w, f.name+"_count", f.labels, s.values, "", "", count)
+	}
+}
+
+// WriteText writes all metrics in Prometheus text format.
+func (r *Registry) WriteText(writer io.Writer) error {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	w := bufio.NewWriter(writer)
+	for _, f := range families {
+		f.write(w)
+	}
+	return w.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	r.WriteText(w)
+}
+
+// Handler serves metrics of DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{5, 1, 2}, "op")
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		latency.With("push").Observe(v)
+	}
+	latency.With("pull").Observe(1)
+	latency.Delete("pull")
+
+	requests := r.NewCounterVec("test_requests_total", "Requests with \\ and\nnewline.", "path", "code")
+	requests.With("/a\"b\\c\nd", "200").Add(2)
+	requests.With("/", "500").Inc()
+	requests.With("/gone", "200").Inc()
+	requests.Delete("/gone", "200")
+
+	r.NewGauge("test_connections", "Connections.").Set(3)
+	r.NewGaugeFunc("test_up", "Up.", func() float64 { return 1 })
+
+	expected := `# HELP test_connections Connections.
+# TYPE test_connections gauge
+test_connections 3
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="push",le="1"} 2
+test_latency_seconds_bucket{op="push",le="2"} 2
+test_latency_seconds_bucket{op="push",le="5"} 3
+test_latency_seconds_bucket{op="push",le="+Inf"} 4
+test_latency_seconds_sum{op="push"} 14.5
+test_latency_seconds_count{op="push"} 4
+# HELP test_requests_total Requests with \\ and\nnewline.
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b\\c\nd",code="200"} 2
+test_requests_total{path="/",code="500"} 1
+# HELP test_up Up.
+# TYPE test_up gauge
+test_up 1
+`
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("unexpected exposition:\n%v\nexpected:\n%v", buf.String(), expected)
+	}
+}
@@ -0,0 +1,374 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	CONNECT     = uint8(1)
+	CONNACK     = uint8(2)
+	PUBLISH     = uint8(3)
+	PUBACK      = uint8(4)
+	PUBREC      = uint8(5)
+	PUBREL      = uint8(6)
+	PUBCOMP     = uint8(7)
+	SUBSCRIBE   = uint8(8)
+	SUBACK      = uint8(9)
+	UNSUBSCRIBE = uint8(10)
+	UNSUBACK    = uint8(11)
+	PINGREQ     = uint8(12)
+	PINGRESP    = uint8(13)
+	DISCONNECT  = uint8(14)
+)
+
+const PROTOCOL_LEVEL_311 = uint8(4)
+
+// CONNACK return codes.
+const (
+	CONNACK_ACCEPTED              = uint8(0)
+	CONNACK_UNACCEPTABLE_PROTOCOL = uint8(1)
+	CONNACK_IDENTIFIER_REJECTED   = uint8(2)
+	CONNACK_SERVER_UNAVALIABLE    = uint8(3)
+	CONNACK_BAD_USERNAME_PASSWORD = uint8(4)
+	CONNACK_NOT_AUTHORIZED        = uint8(5)
+)
+
+const SUBACK_FAILURE = uint8(0x80)
+
+// Flags.
+const (
+	CONNECT_FLAG_USERNAME      = uint8(0x80)
+	CONNECT_FLAG_PASSWORD      = uint8(0x40)
+	CONNECT_FLAG_WILL          = uint8(0x04)
+	CONNECT_FLAG_CLEAN_SESSION = uint8(0x02)
+
+	PUBLISH_FLAG_DUP    = uint8(0x08)
+	PUBLISH_FLAG_RETAIN = uint8(0x01)
+	PUBLISH_QOS_SHIFT   = 1
+	PUBLISH_QOS_MASK    = uint8(0x06)
+
+	// Fixed header flags required by SUBSCRIBE, UNSUBSCRIBE and PUBREL.
+	REQUIRED_FLAGS = uint8(0x02)
+)
+
+// Fixed header.
+const (
+	FIXED_HEADER_FLAGS_MASK        = uint8(0x0F)
+	FIXED_HEADER_TYPE_SHIFT        = 4
+	REMAINING_LENGTH_MAX_BYTES     = 4
+	REMAINING_LENGTH_CONTINUE_FLAG = 0x80
+	MAX_REMAINING_LENGTH           = 268435455
+)
+
+var ErrMalformedPacket = errors.New("Malformed MQTT packet.")
+var ErrPacketTooLarge = errors.New("MQTT packet too large.")
+
+// ReadPacket reads a control packet.
+// Returns packet type, fixed header flags and remaining bytes.
+func ReadPacket(r io.Reader, maxLength int) (uint8, uint8, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	typ, flags := b[0]>>FIXED_HEADER_TYPE_SHIFT, b[0]&FIXED_HEADER_FLAGS_MASK
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i >= REMAINING_LENGTH_MAX_BYTES {
+			return typ, flags, nil, ErrMalformedPacket
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return typ, flags, nil, err
+		}
+		length += int(b[0]&^REMAINING_LENGTH_CONTINUE_FLAG) * multiplier
+		if b[0]&REMAINING_LENGTH_CONTINUE_FLAG == 0 {
+			break
+		}
+		multiplier <<= 7
+	}
+	if maxLength > 0 && length > maxLength {
+		return typ, flags, nil, ErrPacketTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return typ, flags, nil, err
+	}
+	return typ, flags, body, nil
+}
+
+// WritePacket writes a control packet.
+func WritePacket(w io.Writer, typ, flags uint8, body []byte) error {
+	length := len(body)
+	if length > MAX_REMAINING_LENGTH {
+		return ErrPacketTooLarge
+	}
+	raw := make([]byte, 0, len(body)+1+REMAINING_LENGTH_MAX_BYTES)
+	raw = append(raw, typ<<FIXED_HEADER_TYPE_SHIFT|flags&FIXED_HEADER_FLAGS_MASK)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= REMAINING_LENGTH_CONTINUE_FLAG
+		}
+		raw = append(raw, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(raw, body...))
+	return err
+}
+
+// Decoder reads fields of packet.
+// The first failure is kept and returned by Err().
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+func NewDecoder(body []byte) *Decoder {
+	return &Decoder{buf: body}
+}
+
+func (d *Decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrMalformedPacket
+		return nil
+	}
+	raw := d.buf[:n]
+	d.buf = d.buf[n:]
+	return raw
+}
+
+func (d *Decoder) Byte() uint8 {
+	if raw := d.take(1); raw != nil {
+		return raw[0]
+	}
+	return 0
+}
+
+func (d *Decoder) Uint16() uint16 {
+	if raw := d.take(2); raw != nil {
+		return binary.BigEndian.Uint16(raw)
+	}
+	return 0
+}
+
+func (d *Decoder) Bytes() []byte {
+	length := d.Uint16()
+	return d.take(int(length))
+}
+
+func (d *Decoder) String() string {
+	return string(d.Bytes())
+}
+
+// Rest returns all unread bytes.
+func (d *Decoder) Rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	raw := d.buf
+	d.buf = nil
+	return raw
+}
+
+func (d *Decoder) Len() int {
+	return len(d.buf)
+}
+
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Encoder builds packet body.
+type Encoder struct {
+	Buf []byte
+}
+
+func (e *Encoder) PutByte(v uint8) {
+	e.Buf = append(e.Buf, v)
+}
+
+func (e *Encoder) PutUint16(v uint16) {
+	var raw [2]byte
+	binary.BigEndian.PutUint16(raw[:], v)
+	e.Buf = append(e.Buf, raw[:]...)
+}
+
+func (e *Encoder) PutBytes(v []byte) {
+	e.PutUint16(uint16(len(v)))
+	e.Buf = append(e.Buf, v...)
+}
+
+func (e *Encoder) PutString(v string) {
+	e.PutUint16(uint16(len(v)))
+	e.Buf = append(e.Buf, v...)
+}
+
+// Connect is CONNECT packet.
+type Connect struct {
+	ProtocolName string
+	Level        uint8
+	Flags        uint8
+	KeepAlive    uint16
+	ClientID     string
+	WillTopic    string
+	WillMessage  []byte
+	Username     string
+	Password     string
+}
+
+func DecodeConnect(body []byte) (*Connect, error) {
+	dec, conn := NewDecoder(body), &Connect{}
+	conn.ProtocolName = dec.String()
+	conn.Level = dec.Byte()
+	conn.Flags = dec.Byte()
+	conn.KeepAlive = dec.Uint16()
+	conn.ClientID = dec.String()
+	if conn.Flags&CONNECT_FLAG_WILL != 0 {
+		conn.WillTopic = dec.String()
+		conn.WillMessage = dec.Bytes()
+	}
+	if conn.Flags&CONNECT_FLAG_USERNAME != 0 {
+		conn.Username = dec.String()
+	}
+	if conn.Flags&CONNECT_FLAG_PASSWORD != 0 {
+		conn.Password = dec.String()
+	}
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func EncodeConnack(sessionPresent bool, code uint8) []byte {
+	var flags uint8
+	if sessionPresent {
+		flags = 1
+	}
+	return []byte{flags, code}
+}
+
+// Publish is PUBLISH packet.
+type Publish struct {
+	Topic    string
+	PacketID uint16
+	QoS      uint8
+	Dup      bool
+	Retain   bool
+	Payload  []byte
+}
+
+func DecodePublish(flags uint8, body []byte) (*Publish, error) {
+	dec := NewDecoder(body)
+	pub := &Publish{
+		QoS:    (flags & PUBLISH_QOS_MASK) >> PUBLISH_QOS_SHIFT,
+		Dup:    flags&PUBLISH_FLAG_DUP != 0,
+		Retain: flags&PUBLISH_FLAG_RETAIN != 0,
+	}
+	if pub.QoS > 2 {
+		return nil, ErrMalformedPacket
+	}
+	pub.Topic = dec.String()
+	if pub.QoS > 0 {
+		pub.PacketID = dec.Uint16()
+	}
+	pub.Payload = dec.Rest()
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// Encode returns fixed header flags and body.
+func (p *Publish) Encode() (uint8, []byte) {
+	flags := (p.QoS << PUBLISH_QOS_SHIFT) & PUBLISH_QOS_MASK
+	if p.Dup {
+		flags |= PUBLISH_FLAG_DUP
+	}
+	if p.Retain {
+		flags |= PUBLISH_FLAG_RETAIN
+	}
+	enc := Encoder{Buf: make([]byte, 0, len(p.Topic)+len(p.Payload)+4)}
+	enc.PutString(p.Topic)
+	if p.QoS > 0 {
+		enc.PutUint16(p.PacketID)
+	}
+	enc.Buf = append(enc.Buf, p.Payload...)
+	return flags, enc.Buf
+}
+
+// Subscribe is SUBSCRIBE packet.
+type Subscribe struct {
+	PacketID uint16
+	Topics   []string
+	QoS      []uint8
+}
+
+func DecodeSubscribe(body []byte) (*Subscribe, error) {
+	dec := NewDecoder(body)
+	sub := &Subscribe{
+		PacketID: dec.Uint16(),
+	}
+	for dec.Err() == nil && dec.Len() > 0 {
+		sub.Topics = append(sub.Topics, dec.String())
+		sub.QoS = append(sub.QoS, dec.Byte())
+	}
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	if len(sub.Topics) < 1 {
+		return nil, ErrMalformedPacket
+	}
+	return sub, nil
+}
+
+func EncodeSuback(packetID uint16, codes []uint8) []byte {
+	enc := Encoder{}
+	enc.PutUint16(packetID)
+	enc.Buf = append(enc.Buf, codes...)
+	return enc.Buf
+}
+
+// Unsubscribe is UNSUBSCRIBE packet.
+type Unsubscribe struct {
+	PacketID uint16
+	Topics   []string
+}
+
+func DecodeUnsubscribe(body []byte) (*Unsubscribe, error) {
+	dec := NewDecoder(body)
+	unsub := &Unsubscribe{
+		PacketID: dec.Uint16(),
+	}
+	for dec.Err() == nil && dec.Len() > 0 {
+		unsub.Topics = append(unsub.Topics, dec.String())
+	}
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	if len(unsub.Topics) < 1 {
+		return nil, ErrMalformedPacket
+	}
+	return unsub, nil
+}
+
+// EncodePacketID builds body of PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK.
+func EncodePacketID(packetID uint16) []byte {
+	enc := Encoder{}
+	enc.PutUint16(packetID)
+	return enc.Buf
+}
+
+func DecodePacketID(body []byte) (uint16, error) {
+	dec := NewDecoder(body)
+	id := dec.Uint16()
+	return id, dec.Err()
+}
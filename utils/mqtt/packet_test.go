@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	// Remaining length boundaries of 1, 2 and 3 bytes.
+	for _, length := range []int{0, 1, 127, 128, 16383, 16384, 100000} {
+		body := bytes.Repeat([]byte{0xA5}, length)
+		buf := &bytes.Buffer{}
+		if err := WritePacket(buf, PUBLISH, PUBLISH_FLAG_DUP|PUBLISH_FLAG_RETAIN, body); err != nil {
+			t.Fatalf("write packet of length %v: %v", length, err)
+		}
+		typ, flags, read, err := ReadPacket(buf, 0)
+		if err != nil {
+			t.Fatalf("read packet of length %v: %v", length, err)
+		}
+		if typ != PUBLISH || flags != PUBLISH_FLAG_DUP|PUBLISH_FLAG_RETAIN {
+			t.Fatalf("packet of length %v: got type %v flags %v", length, typ, flags)
+		}
+		if !bytes.Equal(read, body) {
+			t.Fatalf("packet of length %v: body mismatched", length)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("packet of length %v: %v bytes left", length, buf.Len())
+		}
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	for _, pub := range []*Publish{
+		{Topic: "ns/group", Payload: []byte("hello")},
+		{Topic: "ns/@user", PacketID: 7, QoS: 1, Dup: true, Payload: []byte{}},
+		{Topic: "ns/group", PacketID: 65535, QoS: 1, Retain: true, Payload: []byte("x")},
+	} {
+		flags, body := pub.Encode()
+		decoded, err := DecodePublish(flags, body)
+		if err != nil {
+			t.Fatalf("decode publish %+v: %v", pub, err)
+		}
+		if !reflect.DeepEqual(decoded, pub) {
+			t.Fatalf("publish mismatched. expected %+v, got %+v", pub, decoded)
+		}
+	}
+}
+
+func TestConnectDecode(t *testing.T) {
+	enc := Encoder{}
+	enc.PutString("MQTT")
+	enc.PutByte(PROTOCOL_LEVEL_311)
+	enc.PutByte(CONNECT_FLAG_USERNAME | CONNECT_FLAG_PASSWORD | CONNECT_FLAG_WILL | CONNECT_FLAG_CLEAN_SESSION)
+	enc.PutUint16(60)
+	enc.PutString("client")
+	enc.PutString("will")
+	enc.PutBytes([]byte("bye"))
+	enc.PutString("ns")
+	enc.PutString("secret")
+
+	conn, err := DecodeConnect(enc.Buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Connect{
+		ProtocolName: "MQTT",
+		Level:        PROTOCOL_LEVEL_311,
+		Flags:        CONNECT_FLAG_USERNAME | CONNECT_FLAG_PASSWORD | CONNECT_FLAG_WILL | CONNECT_FLAG_CLEAN_SESSION,
+		KeepAlive:    60,
+		ClientID:     "client",
+		WillTopic:    "will",
+		WillMessage:  []byte("bye"),
+		Username:     "ns",
+		Password:     "secret",
+	}
+	if !reflect.DeepEqual(conn, expected) {
+		t.Fatalf("connect mismatched. expected %+v, got %+v", expected, conn)
+	}
+
+	// Truncated at every byte.
+	for n := 0; n < len(enc.Buf); n++ {
+		if _, err = DecodeConnect(enc.Buf[:n]); err != ErrMalformedPacket {
+			t.Fatalf("truncated connect of %v bytes: expected ErrMalformedPacket, got %v", n, err)
+		}
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	enc := Encoder{}
+	enc.PutUint16(3)
+	enc.PutString("ns/a")
+	enc.PutByte(1)
+	enc.PutString("ns/b")
+	enc.PutByte(0)
+	sub, err := DecodeSubscribe(enc.Buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.PacketID != 3 || !reflect.DeepEqual(sub.Topics, []string{"ns/a", "ns/b"}) || !reflect.DeepEqual(sub.QoS, []uint8{1, 0}) {
+		t.Fatalf("subscribe mismatched: %+v", sub)
+	}
+
+	// Topic without QoS.
+	if _, err = DecodeSubscribe(enc.Buf[:len(enc.Buf)-1]); err != ErrMalformedPacket {
+		t.Fatalf("expected ErrMalformedPacket, got %v", err)
+	}
+	// No topic.
+	if _, err = DecodeSubscribe(enc.Buf[:2]); err != ErrMalformedPacket {
+		t.Fatalf("expected ErrMalformedPacket, got %v", err)
+	}
+	if _, err = DecodeUnsubscribe(enc.Buf[:2]); err != ErrMalformedPacket {
+		t.Fatalf("expected ErrMalformedPacket, got %v", err)
+	}
+}
+
+func TestMalformedLength(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		raw  []byte
+		max  int
+		err  error
+	}{
+		{"five length bytes", []byte{PUBLISH << FIXED_HEADER_TYPE_SHIFT, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, 0, ErrMalformedPacket},
+		{"truncated length", []byte{PUBLISH << FIXED_HEADER_TYPE_SHIFT, 0xFF}, 0, io.ErrUnexpectedEOF},
+		{"missing length", []byte{PUBLISH << FIXED_HEADER_TYPE_SHIFT}, 0, io.ErrUnexpectedEOF},
+		{"truncated body", []byte{PUBLISH << FIXED_HEADER_TYPE_SHIFT, 0x03, 0x00, 0x01}, 0, io.ErrUnexpectedEOF},
+		{"too large", []byte{PUBLISH << FIXED_HEADER_TYPE_SHIFT, 0x80, 0x01}, 127, ErrPacketTooLarge},
+	} {
+		_, _, _, err := ReadPacket(bytes.NewReader(c.raw), c.max)
+		if c.err == io.ErrUnexpectedEOF && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != c.err {
+			t.Fatalf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if err := WritePacket(&bytes.Buffer{}, PUBLISH, 0, make([]byte, MAX_REMAINING_LENGTH+1)); err != ErrPacketTooLarge {
+		t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+	}
+	if _, err := DecodePublish(PUBLISH_QOS_MASK, []byte{0, 1, 'a'}); err != ErrMalformedPacket {
+		t.Fatalf("QoS 3: expected ErrMalformedPacket, got %v", err)
+	}
+	// String length exceeds body.
+	if _, err := DecodePublish(0, []byte{0, 5, 'a'}); err != ErrMalformedPacket {
+		t.Fatalf("expected ErrMalformedPacket, got %v", err)
+	}
+	if _, err := DecodePacketID([]byte{1}); err != ErrMalformedPacket {
+		t.Fatalf("expected ErrMalformedPacket, got %v", err)
+	}
+}
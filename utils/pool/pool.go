@@ -2,6 +2,7 @@ package pool
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -241,13 +242,11 @@ func (p *Pool) balanceSelect() (int, error) {
 	return 0, nil
 }
 
-// Wait for free drip.
-func (p *Pool) wait(timeout uint32) error {
-	var err error
-
+// Wait for free drip until done is closed. Waits forever if done is nil.
+func (p *Pool) wait(done <-chan struct{}) bool {
 	// Register myself
 	waitToken, wg := p.waitc, &sync.WaitGroup{}
-	waitChan := make(chan struct{})
+	waitChan := make(chan struct{}, 1)
 
 	p.waitc++
 	p.waiter[waitToken] = wg
@@ -261,23 +260,15 @@ func (p *Pool) wait(timeout uint32) error {
 	}()
 
 	// Then wait
-	if timeout > 0 {
-		chanTimeout := time.After(time.Duration(timeout) * time.Millisecond)
-		select {
-		case <-waitChan:
-		case <-chanTimeout:
-			p.lock.Lock()
-			p.wakeTarget(waitToken)
-			p.lock.Unlock()
-			err = ErrWaitTimeout
-		}
-	} else {
-		<-waitChan
+	select {
+	case <-waitChan:
+		return true
+	case <-done:
+		p.lock.Lock()
+		p.wakeTarget(waitToken)
+		p.lock.Unlock()
 	}
-
-	close(waitChan)
-
-	return err
+	return false
 }
 
 func (p *Pool) wakeMany(sleeper uint32) uint32 {
@@ -297,7 +288,7 @@ func (p *Pool) wakeTarget(waitc uint32) bool {
 	}
 
 	wg.Done()
-	delete(p.waiter, p.wake)
+	delete(p.waiter, waitc)
 
 	return true
 }
@@ -325,10 +316,44 @@ func (p *Pool) newDrip() (interface{}, error) {
 	return raw, err
 }
 
+// Get a drip. Waits for free drip within timeout (in milliseconds) if toWait is true.
+// Waits until a drip is released if timeout is 0.
 func (p *Pool) Get(toWait bool, timeout uint32) (*Drip, error) {
+	if !toWait {
+		return p.get(false, nil)
+	}
+	if timeout == 0 {
+		return p.GetContext(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	drip, err := p.GetContext(ctx)
+	if err == context.DeadlineExceeded {
+		err = ErrWaitTimeout
+	}
+	return drip, err
+}
+
+// GetContext waits for free drip until ctx is done. ctx.Err() is returned if so.
+func (p *Pool) GetContext(ctx context.Context) (*Drip, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	drip, err := p.get(true, ctx.Done())
+	if err == errWaitCanceled {
+		err = ctx.Err()
+	}
+	return drip, err
+}
+
+var errWaitCanceled = errors.New("Waiting canceled.")
+
+// get waits for free drip until done is closed if toWait is true. Waits forever if done is nil.
+// Never waits if no drip can be created, since no drip will be released.
+func (p *Pool) get(toWait bool, done <-chan struct{}) (*Drip, error) {
 	var drip *Drip
 	var idx int
-	var err error
+	var err, newErr error
 
 	for {
 		p.lock.Lock()
@@ -339,18 +364,17 @@ func (p *Pool) Get(toWait bool, timeout uint32) (*Drip, error) {
 			break
 		}
 
-		p.newDrip()
+		_, newErr = p.newDrip()
 
 		// select a drip
 		idx, err = p.balanceSelect()
 		if idx < 0 {
-			if toWait {
+			if len(p.drip) < 1 && newErr != nil {
+				err = newErr
+			} else if toWait {
 				// No free drip. wait.
-
-				err = p.wait(timeout)
-				if err != nil {
-					// Timeout
-					return nil, err
+				if !p.wait(done) {
+					return nil, errWaitCanceled
 				}
 				continue
 			}
@@ -374,6 +398,17 @@ func (p *Pool) Get(toWait bool, timeout uint32) (*Drip, error) {
 	return drip, err
 }
 
+// Used returns sum of used counters of drips in pool.
+func (p *Pool) Used() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	used := 0
+	for _, drip := range p.drip {
+		used += drip.used
+	}
+	return used
+}
+
 // Close pool and wait until all drips are closed.
 func (p *Pool) Close() {
 	p.lock.Lock()
@@ -404,7 +439,7 @@ closeDrip:
 		}
 
 		// wait until new drip released.
-		p.wait(0)
+		p.wait(nil)
 		p.lock.Lock()
 	}
 	p.lock.Unlock()
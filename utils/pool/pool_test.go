@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDrips struct {
+	lock    sync.Mutex
+	created int
+	err     error
+}
+
+func (d *testDrips) New() (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.created++
+	return d.created, nil
+}
+
+func (d *testDrips) Destroy(interface{})                   {}
+func (d *testDrips) Healthy(x interface{}, err error) bool { return err == nil }
+func (d *testDrips) Notify(ctx *NotifyContext)             {}
+
+func TestGetWithoutWaiting(t *testing.T) {
+	p := NewPool(&testDrips{}, 1, 1)
+	drip, err := p.Get(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Get(false, 0); err != ErrFull {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	drip.Release(nil)
+	if drip, err = p.Get(false, 0); err != nil {
+		t.Fatalf("expected drip after released, got %v", err)
+	}
+	drip.Release(nil)
+}
+
+func TestGetWaitsUntilReleased(t *testing.T) {
+	p := NewPool(&testDrips{}, 1, 1)
+	drip, err := p.Get(true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, get := range map[string]func() (*Drip, error){
+		"Get":        func() (*Drip, error) { return p.Get(true, 0) },
+		"GetContext": func() (*Drip, error) { return p.GetContext(context.Background()) },
+	} {
+		got := make(chan error, 1)
+		go func() {
+			waited, err := get()
+			if err == nil {
+				waited.Release(nil)
+			}
+			got <- err
+		}()
+		select {
+		case err = <-got:
+			t.Fatalf("%v: expected waiting, got %v", name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		drip.Release(nil)
+		select {
+		case err = <-got:
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: not woken after released", name)
+		}
+		if drip, err = p.Get(false, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drip.Release(nil)
+}
+
+func TestGetTimeout(t *testing.T) {
+	p := NewPool(&testDrips{}, 1, 1)
+	drip, err := p.Get(true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drip.Release(nil)
+
+	if _, err = p.Get(true, 20); err != ErrWaitTimeout {
+		t.Fatalf("expected ErrWaitTimeout, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = p.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// No drip will be released if none created. Getting fails with creation error instead of waiting.
+func TestGetCreationFailure(t *testing.T) {
+	failure := errors.New("Dial failure.")
+	p := NewPool(&testDrips{err: failure}, 1, 1)
+	got := make(chan error, 1)
+	go func() {
+		_, err := p.Get(true, 0)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != failure {
+			t.Fatalf("expected creation failure, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting without drip")
+	}
+}